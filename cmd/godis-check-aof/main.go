@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/godis/conf"
+	"github.com/godis/errs"
+	"github.com/godis/persistence"
+	"github.com/rs/zerolog"
+)
+
+/*
+godis-check-aof [--fix] [--truncate-to-timestamp <ms>] <file.aof | file.manifest>
+校验AOF文件，输出第一个错误的位置，--fix将最后一个文件截断到最后一条完整命令
+--truncate-to-timestamp将最后一个文件截断到晚于该时间戳的第一条时间戳注释
+*/
+func main() {
+	var fix bool
+	var rdbChecksum bool
+	var truncateTo int64
+	flag.BoolVar(&fix, "fix", false, "truncate the last aof file to the last valid command")
+	flag.BoolVar(&rdbChecksum, "rdbchecksum", true, "verify the checksum of rdb preamble")
+	flag.Int64Var(&truncateTo, "truncate-to-timestamp", 0, "truncate the last aof file to the given unix timestamp in milliseconds")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: godis-check-aof [--fix] [--rdbchecksum=false] [--truncate-to-timestamp <ms>] <file.aof|file.manifest>")
+		os.Exit(1)
+	}
+
+	filename := flag.Arg(0)
+	files := []string{filename}
+	if strings.HasSuffix(filename, persistence.AOF_MANIFEST_SUFFIX) {
+		var err error
+		if files, err = persistence.ReadManifest(filename); err != nil {
+			fmt.Printf("Invalid manifest %s: %v\n", filename, err)
+			os.Exit(1)
+		}
+	}
+
+	logger := zerolog.Nop()
+	rdb := persistence.InitRDB(&conf.Config{RDBCheckSum: rdbChecksum}, &logger)
+	for i, file := range files {
+		last := i == len(files)-1
+		offset, err := persistence.CheckAOFFile(file, rdb, truncateTo)
+		if err == nil {
+			fmt.Printf("AOF %s is valid\n", file)
+			continue
+		}
+
+		if err == errs.AOFRestorePointError {
+			// 截断之前的文件会导致之后的文件内容失效，只允许截断最后一个文件
+			if !last {
+				fmt.Printf("Timestamp %d found in %s, which is not the last aof file, can not truncate\n", truncateTo, file)
+				os.Exit(1)
+			}
+			truncate(file, offset)
+			continue
+		}
+
+		fmt.Printf("AOF %s is not valid: %v\n", file, err)
+		fmt.Printf("Last valid command ends at offset %d\n", offset)
+		if err != errs.AOFTruncatedError && err != errs.AOFFormatError {
+			os.Exit(1)
+		}
+		// 只有最后一个文件可能因宕机写入不完整，其余文件出错需要人工处理
+		if !fix || !last {
+			os.Exit(1)
+		}
+		truncate(file, offset)
+	}
+}
+
+func truncate(file string, offset int64) {
+	if err := os.Truncate(file, offset); err != nil {
+		fmt.Printf("Failed to truncate AOF %s: %v\n", file, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Successfully truncated AOF %s to offset %d\n", file, offset)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/godis/conf"
+	"github.com/godis/data"
+	"github.com/godis/errs"
+	"github.com/godis/persistence"
+	"github.com/rs/zerolog"
+)
+
+/*
+godis-check-rdb [--rdbchecksum=false] [--dump <file.jsonl|->] [--stats] <dump.rdb>
+离线校验RDB文件(godis格式或Redis格式)的文件头、每条记录与校验和，输出第一条损坏记录的位置
+--dump将所有键值以JSON Lines格式导出，--stats按类型输出键数量与大小统计
+*/
+func main() {
+	var rdbChecksum bool
+	var dump string
+	var stats bool
+	flag.BoolVar(&rdbChecksum, "rdbchecksum", true, "verify the checksum of rdb file")
+	flag.StringVar(&dump, "dump", "", "dump all keys to the given file in JSON Lines format, - for stdout")
+	flag.BoolVar(&stats, "stats", false, "print per-type key counts and size statistics")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: godis-check-rdb [--rdbchecksum=false] [--dump <file.jsonl|->] [--stats] <dump.rdb>")
+		os.Exit(1)
+	}
+
+	filename := flag.Arg(0)
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open RDB %s: %v\n", filename, err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	// 导出到标准输出时，校验结果输出到标准错误，避免混入导出内容
+	var out io.Writer = os.Stdout
+	var encoder *json.Encoder
+	var dumpWriter *bufio.Writer
+	if dump != "" {
+		var dumpFile *os.File = os.Stdout
+		if dump != "-" {
+			if dumpFile, err = os.Create(dump); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to create dump file %s: %v\n", dump, err)
+				os.Exit(1)
+			}
+			defer dumpFile.Close()
+		} else {
+			out = os.Stderr
+		}
+		dumpWriter = bufio.NewWriter(dumpFile)
+		defer dumpWriter.Flush()
+		encoder = json.NewEncoder(dumpWriter)
+	}
+
+	logger := zerolog.Nop()
+	rdb := persistence.InitRDB(&conf.Config{RDBCheckSum: rdbChecksum, DBFilename: filename}, &logger)
+	summary := newRDBStats()
+	var lastKey string
+	n, err := rdb.DecodeEach(bufio.NewReaderSize(file, conf.RDB_BUF_BLOCK_SIZE), func(record *persistence.RDBRecord) error {
+		summary.add(record)
+		lastKey = record.Key.StrVal()
+		if encoder != nil {
+			return encoder.Encode(toJSONRecord(record))
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(out, "RDB %s is not valid: %v\n", filename, err)
+		var corruption *persistence.RDBCorruptionError
+		if errors.Is(err, errs.RDBCheckSumError) {
+			// 所有记录都能解析，但内容与校验和不符，无法确定损坏的具体位置
+			fmt.Fprintf(out, "All records parsed, the data before offset %d does not match the checksum\n", n)
+		} else if errors.As(err, &corruption) {
+			fmt.Fprintf(out, "First corrupted record at offset %d, corruption detected at offset %d\n", corruption.Record, corruption.Offset)
+		} else {
+			fmt.Fprintf(out, "Stopped at the record at offset %d\n", n)
+		}
+		if summary.total.keys > 0 {
+			fmt.Fprintf(out, "Last valid key: %s\n", lastKey)
+		}
+		// 损坏位置之前的记录仍然导出
+		if dumpWriter != nil {
+			dumpWriter.Flush()
+		}
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(out, "RDB %s is valid, %d keys, %d bytes\n", filename, summary.total.keys, n)
+	if info, err := file.Stat(); err == nil && info.Size() > n {
+		fmt.Fprintf(out, "Warning: %d trailing bytes after the end of RDB\n", info.Size()-n)
+		if !rdbChecksum && info.Size()-n == 8 {
+			fmt.Fprintln(out, "The trailing bytes may be the checksum, which is not verified with --rdbchecksum=false")
+		}
+	}
+	if stats {
+		summary.print(out)
+	}
+}
+
+type jsonRecord struct {
+	Key      string `json:"key"`
+	Type     string `json:"type"`
+	ExpireAt int64  `json:"expire_at,omitempty"` //毫秒级过期时间
+	Value    any    `json:"value"`
+}
+
+var typeNames = map[conf.Gtype]string{
+	conf.GSTR:  "string",
+	conf.GLIST: "list",
+	conf.GSET:  "set",
+	conf.GZSET: "zset",
+	conf.GDICT: "hash",
+	conf.GBIT:  "bitmap",
+}
+
+// 位图以[]byte导出，JSON中为base64编码；有序集合的分数保留原始字符串，以便表示inf
+func toJSONRecord(record *persistence.RDBRecord) *jsonRecord {
+	r := &jsonRecord{Key: record.Key.StrVal(), Type: typeNames[record.Val.Type_]}
+	if record.Expire != -1 {
+		r.ExpireAt = record.Expire
+	}
+	switch val := record.Val.Val_.(type) {
+	case string:
+		r.Value = val
+	case *data.Bitmap:
+		r.Value = val.Bytes[:val.Len]
+	case *data.List:
+		items := make([]string, 0, val.Length())
+		for node := val.First(); node != nil; node = node.Next() {
+			items = append(items, node.Val.StrVal())
+		}
+		r.Value = items
+	case *data.Set:
+		members := val.Dict.IterateDict()
+		items := make([]string, 0, len(members))
+		for _, member := range members {
+			items = append(items, member[0].StrVal())
+		}
+		r.Value = items
+	case *data.ZSet:
+		scores := make(map[string]string)
+		for _, obj := range val.Dict.IterateDict() {
+			scores[obj[0].StrVal()] = obj[1].StrVal()
+		}
+		r.Value = scores
+	case *data.Dict:
+		fields := make(map[string]string)
+		for _, obj := range val.IterateDict() {
+			fields[obj[0].StrVal()] = obj[1].StrVal()
+		}
+		r.Value = fields
+	}
+	return r
+}
+
+type typeStats struct {
+	keys        int
+	expires     int
+	elements    int
+	bytes       int64
+	largestKey  string
+	largestSize int64
+}
+
+type rdbStats struct {
+	types map[conf.Gtype]*typeStats
+	total typeStats
+}
+
+func newRDBStats() *rdbStats {
+	return &rdbStats{types: make(map[conf.Gtype]*typeStats)}
+}
+
+func (s *rdbStats) add(record *persistence.RDBRecord) {
+	stats, ok := s.types[record.Val.Type_]
+	if !ok {
+		stats = &typeStats{}
+		s.types[record.Val.Type_] = stats
+	}
+	elements := countElements(record.Val)
+	for _, t := range []*typeStats{stats, &s.total} {
+		t.keys++
+		if record.Expire != -1 {
+			t.expires++
+		}
+		t.elements += elements
+		t.bytes += record.Size
+		if record.Size > t.largestSize {
+			t.largestSize = record.Size
+			t.largestKey = record.Key.StrVal()
+		}
+	}
+}
+
+// 字符串与位图的元素个数为1
+func countElements(val *data.Gobj) int {
+	switch v := val.Val_.(type) {
+	case *data.List:
+		return v.Length()
+	case *data.Set:
+		return v.Length()
+	case *data.ZSet:
+		return int(v.Zcard())
+	case *data.Dict:
+		return len(v.IterateDict())
+	}
+	return 1
+}
+
+func (s *rdbStats) print(out io.Writer) {
+	fmt.Fprintf(out, "%-8s %10s %10s %12s %14s  %s\n", "type", "keys", "expires", "elements", "bytes", "largest key (bytes)")
+	for _, typ := range []conf.Gtype{conf.GSTR, conf.GLIST, conf.GSET, conf.GZSET, conf.GDICT, conf.GBIT} {
+		if stats, ok := s.types[typ]; ok {
+			stats.print(out, typeNames[typ])
+		}
+	}
+	s.total.print(out, "total")
+}
+
+func (t *typeStats) print(out io.Writer, name string) {
+	largest := ""
+	if t.keys > 0 {
+		largest = fmt.Sprintf("%s (%d)", t.largestKey, t.largestSize)
+	}
+	fmt.Fprintf(out, "%-8s %10d %10d %12d %14d  %s\n", name, t.keys, t.expires, t.elements, t.bytes, largest)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/godis/conf"
+	"github.com/godis/proxy"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+)
+
+/*
+godis-proxy [--config ./conf/proxy-conf.json] [--port <port>] [--loglevel info]
+代理模式，按key的哈希槽将普通客户端的命令转发到配置的后端节点，
+DEL、EXISTS、MSET的key分布在多个后端时拆分执行并合并回复
+*/
+func main() {
+	var config string
+	var port int
+	var logLevel string
+	flag.StringVar(&config, "config", "./conf/proxy-conf.json", "proxy config file")
+	flag.IntVar(&port, "port", 0, "port to listen on, overrides the config file")
+	flag.StringVar(&logLevel, "loglevel", "info", "log level")
+	flag.Parse()
+
+	log := zerolog.
+		New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.DateTime}).
+		With().Caller().
+		Timestamp().
+		Logger()
+
+	if logLevel == "trace" {
+		log = log.Level(zerolog.TraceLevel)
+	} else if logLevel == "debug" {
+		log = log.Level(zerolog.DebugLevel)
+	} else if logLevel == "info" {
+		log = log.Level(zerolog.InfoLevel)
+	}
+
+	var proxyConfig conf.ProxyConfig
+	viper.SetConfigFile(config)
+	viper.SetDefault("port", conf.PROXY_DEFAULT_PORT)
+	if err := viper.ReadInConfig(); err != nil {
+		log.Error().Err(err).Msg("[msg:load proxy config failed]")
+		os.Exit(1)
+	}
+	if err := viper.Unmarshal(&proxyConfig); err != nil {
+		log.Error().Err(err).Msg("[msg:unmarshal proxy config failed]")
+		os.Exit(1)
+	}
+	if port != 0 {
+		proxyConfig.Port = port
+	}
+	log.Info().Interface("config", proxyConfig).Msg("[msg:start godis proxy with config]")
+
+	p, err := proxy.New(&proxyConfig, &log)
+	if err != nil {
+		log.Error().Err(err).Msg("[msg:init proxy failed]")
+		os.Exit(1)
+	}
+	p.Run()
+}
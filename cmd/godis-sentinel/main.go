@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/godis/conf"
+	"github.com/godis/sentinel"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+)
+
+/*
+godis-sentinel [--config ./conf/sentinel-conf.json] [--port <port>] [--loglevel info]
+哨兵模式，监控配置中的主节点及其从节点，多数哨兵认为主节点下线后选出领头哨兵完成故障转移，
+客户端通过SENTINEL get-master-addr-by-name <name>查询当前的主节点
+*/
+func main() {
+	var config string
+	var port int
+	var logLevel string
+	flag.StringVar(&config, "config", "./conf/sentinel-conf.json", "sentinel config file")
+	flag.IntVar(&port, "port", 0, "port to listen on, overrides the config file")
+	flag.StringVar(&logLevel, "loglevel", "info", "log level")
+	flag.Parse()
+
+	log := zerolog.
+		New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.DateTime}).
+		With().Caller().
+		Timestamp().
+		Logger()
+
+	if logLevel == "trace" {
+		log = log.Level(zerolog.TraceLevel)
+	} else if logLevel == "debug" {
+		log = log.Level(zerolog.DebugLevel)
+	} else if logLevel == "info" {
+		log = log.Level(zerolog.InfoLevel)
+	}
+
+	var sentinelConfig conf.SentinelConfig
+	viper.SetConfigFile(config)
+	viper.SetDefault("port", conf.SENTINEL_DEFAULT_PORT)
+	if err := viper.ReadInConfig(); err != nil {
+		log.Error().Err(err).Msg("[msg:load sentinel config failed]")
+		os.Exit(1)
+	}
+	if err := viper.Unmarshal(&sentinelConfig); err != nil {
+		log.Error().Err(err).Msg("[msg:unmarshal sentinel config failed]")
+		os.Exit(1)
+	}
+	if port != 0 {
+		sentinelConfig.Port = port
+	}
+	log.Info().Interface("config", sentinelConfig).Msg("[msg:start godis sentinel with config]")
+
+	s, err := sentinel.New(&sentinelConfig, &log)
+	if err != nil {
+		log.Error().Err(err).Msg("[msg:init sentinel failed]")
+		os.Exit(1)
+	}
+	if err := s.Run(); err != nil {
+		log.Error().Err(err).Msg("[msg:sentinel exited]")
+		os.Exit(1)
+	}
+}
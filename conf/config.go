@@ -4,35 +4,134 @@ type RDBLenType byte
 
 const (
 	RDB_APPNAME     string = "GODIS"
-	RDB_VERSION     string = "0001"
+	RDB_VERSION     string = "0003" //0002:修正长度编码，支持LZF压缩字符串 0003:毫秒级过期时间
+	RDB_VERSION_V1  string = "0001" //长度编码与之后的版本不同，解析时按旧规则处理
 	RDB_APPNAME_LEN        = 5
 	RDB_VERSION_LEN        = 4
 
-	RDB_OPCODE_EXPIRETIME = 0xfd
-	RDB_OPCODE_EOF        = 0xff
+	RDB_OPCODE_EXPIRETIME_MS = 0xfc //毫秒级过期时间
+	RDB_OPCODE_EXPIRETIME    = 0xfd //秒级过期时间，0003之前的版本使用
+	RDB_OPCODE_EOF           = 0xff
+
+	RDB_ENCVAL           = 3  //长度字节最高两位为11时，表示特殊编码的字符串
+	RDB_ENC_INT8         = 0  //8位整数
+	RDB_ENC_INT16        = 1  //16位小端整数
+	RDB_ENC_INT32        = 2  //32位小端整数
+	RDB_ENC_LZF          = 3  //LZF压缩的字符串
+	RDB_COMPRESS_MIN_LEN = 20 //超过该长度的字符串才尝试压缩
 )
 
+// RDB文件格式，godis为自有格式，redis为Redis兼容格式
 const (
-	RDB_BUF_BLOCK_SIZE    = 20 * 1024 * 1024
+	RDB_FORMAT_GODIS = "godis"
+	RDB_FORMAT_REDIS = "redis"
+)
+
+// Redis RDB格式
+const (
+	REDIS_RDB_MAGIC       string = "REDIS"
+	REDIS_RDB_VERSION     string = "0011" //导出时使用的版本，对应Redis 7.2
+	REDIS_RDB_MIN_VERSION        = 1
+	REDIS_RDB_MAX_VERSION        = 12
+	REDIS_RDB_COMPAT_VER  string = "7.2.0" //导出时写入redis-ver辅助字段的值
+
+	REDIS_RDB_OPCODE_SLOT_INFO     = 0xf4
+	REDIS_RDB_OPCODE_FUNCTION2     = 0xf5
+	REDIS_RDB_OPCODE_FUNCTION      = 0xf6
+	REDIS_RDB_OPCODE_MODULE_AUX    = 0xf7
+	REDIS_RDB_OPCODE_IDLE          = 0xf8
+	REDIS_RDB_OPCODE_FREQ          = 0xf9
+	REDIS_RDB_OPCODE_AUX           = 0xfa
+	REDIS_RDB_OPCODE_RESIZEDB      = 0xfb
+	REDIS_RDB_OPCODE_EXPIRETIME_MS = 0xfc
+	REDIS_RDB_OPCODE_EXPIRETIME    = 0xfd
+	REDIS_RDB_OPCODE_SELECTDB      = 0xfe
+	REDIS_RDB_OPCODE_EOF           = 0xff
+
+	REDIS_RDB_TYPE_STRING           = 0
+	REDIS_RDB_TYPE_LIST             = 1
+	REDIS_RDB_TYPE_SET              = 2
+	REDIS_RDB_TYPE_ZSET             = 3
+	REDIS_RDB_TYPE_HASH             = 4
+	REDIS_RDB_TYPE_ZSET_2           = 5
+	REDIS_RDB_TYPE_HASH_ZIPMAP      = 9
+	REDIS_RDB_TYPE_LIST_ZIPLIST     = 10
+	REDIS_RDB_TYPE_SET_INTSET       = 11
+	REDIS_RDB_TYPE_ZSET_ZIPLIST     = 12
+	REDIS_RDB_TYPE_HASH_ZIPLIST     = 13
+	REDIS_RDB_TYPE_LIST_QUICKLIST   = 14
+	REDIS_RDB_TYPE_HASH_LISTPACK    = 16
+	REDIS_RDB_TYPE_ZSET_LISTPACK    = 17
+	REDIS_RDB_TYPE_LIST_QUICKLIST_2 = 18
+	REDIS_RDB_TYPE_SET_LISTPACK     = 20
+
+	REDIS_QUICKLIST_NODE_PLAIN  = 1 //quicklist节点为单个元素
+	REDIS_QUICKLIST_NODE_PACKED = 2 //quicklist节点为listpack
+)
+
+const (
+	RDB_BUF_BLOCK_SIZE    = 64 * 1024 //RDB流式读写的缓冲区大小
 	AOF_RW_BUF_BLOCK_SIZE = 10 * 1024 * 1024
 	AOF_BUF_BLOCK_SIZE    = 10 * 1024 * 1024
 
-	EXPIRE_CHECK_COUNT int = 100
+	AOF_REWRITE_ITEMS_PER_CMD int = 64 //重写时单条命令最多携带的元素个数
+
+	SERVER_CRON_PERIOD int64 = 100 //ServerCron的执行周期，毫秒
+
+	ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP    int   = 20   //定期删除每轮抽样的key个数
+	ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE int   = 25   //抽样中过期key的占比超过该百分比时继续下一轮抽样
+	ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC   int64 = 25   //慢速定期删除最多占用ServerCron周期的百分比
+	ACTIVE_EXPIRE_CYCLE_FAST_DURATION    int64 = 1000 //快速定期删除的时间上限，微秒
+)
+
+const (
+	REPL_PING_REPLICA_PERIOD int64 = 10        //主节点向从节点发送PING的间隔，秒
+	REPL_RETRY_PERIOD        int64 = 1000      //从节点连接主节点失败后的重试间隔，毫秒
+	REPL_BULK_CHUNK_SIZE     int   = 16 * 1024 //主节点发送RDB时每次写入的字节数
+	REPL_DEFAULT_TIMEOUT     int64 = 60        //未配置repl-timeout时的超时时间，秒
+	REPL_DEFAULT_BACKLOG     int64 = 1 << 20   //未配置repl-backlog-size时的积压缓冲区大小
+	REPL_ID_LEN              int   = 40        //复制ID的长度
+	REPL_ACK_PERIOD          int64 = 1000      //从节点向主节点上报复制偏移量的间隔，毫秒
+	REPL_DISKLESS_SYNC_DELAY int64 = 5         //未配置repl-diskless-sync-delay时等待更多从节点的时间，秒
+	REPL_EOF_MARK_LEN        int   = 40        //无盘复制时RDB结束标记的长度
+)
+
+// 从节点加载RDB的方式，disabled为先写入磁盘再加载，swapdb为直接从连接加载到新的数据集，加载完成后替换
+const (
+	REPL_DISKLESS_LOAD_DISABLED = "disabled"
+	REPL_DISKLESS_LOAD_SWAPDB   = "swapdb"
+)
+
+// 集群
+const (
+	CLUSTER_SLOTS                     int   = 16384 //哈希槽的数量
+	CLUSTER_PORT_INCR                 int   = 10000 //集群总线端口相对客户端端口的偏移
+	CLUSTER_NAMELEN                   int   = 40    //节点ID的长度
+	CLUSTER_DEFAULT_NODE_TIMEOUT      int64 = 15000 //节点超过该毫秒数没有回复PING时被标记为PFAIL
+	CLUSTER_FAIL_REPORT_VALIDITY_MULT int64 = 2     //失效报告的有效期为节点超时时间的倍数
+	CLUSTER_FAIL_UNDO_TIME_MULT       int64 = 2     //负责哈希槽的主节点恢复后，FAIL状态保留的时间为节点超时时间的倍数
+	CLUSTER_BLACKLIST_TTL             int64 = 60    //FORGET的节点在该秒数内不会通过gossip重新加入
+	CLUSTER_MAX_MSG_LEN               int   = 1024 * 1024
 )
 
 type CmdType = byte
 
 const (
-	COMMAND_UNKNOWN CmdType = 0x00
-	COMMAND_INLINE  CmdType = 0x01
-	COMMAND_BULK    CmdType = 0x02
+	COMMAND_UNKNOWN    CmdType = 0x00
+	COMMAND_INLINE     CmdType = 0x01
+	COMMAND_BULK       CmdType = 0x02
+	COMMAND_ANNOTATION CmdType = 0x03 //AOF中以#开头的注释行
 )
 
+const AOF_ANNOTATION_TIMESTAMP = "#TS:"
+
 const (
 	GODIS_IO_BUF     int = 1024 * 16
-	GODIS_MAX_BULK   int = 1024 * 4
+	GODIS_MAX_BULK   int = 1024 * 4 //读缓冲区每次扩容的大小
 	GODIS_MAX_INLINE int = 1024 * 4
 	GODIS_REPLY_BUF  int = 128
+
+	GODIS_PROTO_MAX_BULK_LEN int = 512 * 1024 * 1024 //单个bulk参数的长度上限，MIGRATE传输的序列化value可能较大
 )
 
 type Gtype uint8
@@ -65,14 +164,84 @@ type Config struct {
 	RDBCompression bool   `json:"rdbcompression"`
 	RDBCheckSum    bool   `json:"rdbchecksum"`
 	DBFilename     string `json:"dbfilename"`
+	RDBFormat      string `json:"rdb-format" mapstructure:"rdb-format"` //写入RDB时使用的格式，godis|redis，加载时自动识别
+	Save           string `json:"save"`                                 //自动保存条件，格式为"秒数 修改次数"的若干组，例如"900 1 300 10"，为空表示关闭
 
 	AppendOnly     bool   `json:"appendonly"`     //是否启用AOF
 	Dir            string `json:"dir"`            //AOF文件保存路径
 	AppendFilename string `json:"appendfilename"` //AOF文件名
+	AppendDirname  string `json:"appenddirname"`  //multi part AOF文件目录
 	Appendfsync    string `json:"appendfsync"`    //AOF持久化策略，AOF_FSYNC_EVERYSEC|AOF_FSYNC_ALWAYS|AOF_FSYNC_NO
 
+	AOFUseRDBPreamble        bool  `json:"aof-use-rdb-preamble" mapstructure:"aof-use-rdb-preamble"`               //AOF重写时是否以RDB格式写入数据集快照
+	AOFLoadTruncated         bool  `json:"aof-load-truncated" mapstructure:"aof-load-truncated"`                   //加载时若AOF末尾命令不完整，是否截断后继续启动
+	AutoAOFRewritePercentage int   `json:"auto-aof-rewrite-percentage" mapstructure:"auto-aof-rewrite-percentage"` //AOF文件相对上次重写后的增长比例，超过则自动重写，0表示关闭
+	AutoAOFRewriteMinSize    int64 `json:"auto-aof-rewrite-min-size" mapstructure:"auto-aof-rewrite-min-size"`     //自动重写的最小文件大小，单位MB
+	AOFTimestampEnabled      bool  `json:"aof-timestamp-enabled" mapstructure:"aof-timestamp-enabled"`             //是否在AOF中写入#TS:<毫秒时间戳>注释
+	AOFRestoreUntil          int64 `json:"-" mapstructure:"-"`                                                     //启动参数--restore-until，只加载该毫秒时间戳之前的命令
+
 	SlowLogSlowerThan int64 `json:"slowlogslowerthan"` //慢查询阈值
 	SlowLogMaxLen     int   `json:"slowlogmaxlen"`     //慢查询日志最大长度
 
 	MaxClients int `json:"maxclients"`
+
+	ReplicaOf       string `json:"replicaof"`                                          //"主节点地址 端口"，启动后作为该主节点的从节点，为空表示主节点
+	ReplicaReadOnly bool   `json:"replica-read-only" mapstructure:"replica-read-only"` //从节点是否拒绝普通客户端的写命令
+	ReplTimeout     int64  `json:"repl-timeout" mapstructure:"repl-timeout"`           //复制连接的超时时间，单位秒
+	ReplBacklogSize int64  `json:"repl-backlog-size" mapstructure:"repl-backlog-size"` //复制积压缓冲区大小，单位字节
+
+	ReplDisklessSync      bool   `json:"repl-diskless-sync" mapstructure:"repl-diskless-sync"`             //全量同步时直接将RDB写入从节点连接，不生成RDB文件
+	ReplDisklessSyncDelay int64  `json:"repl-diskless-sync-delay" mapstructure:"repl-diskless-sync-delay"` //无盘复制开始前等待更多从节点的时间，单位秒
+	ReplDisklessLoad      string `json:"repl-diskless-load" mapstructure:"repl-diskless-load"`             //从节点加载RDB的方式，disabled|swapdb
+
+	ClusterEnabled     bool   `json:"cluster-enabled" mapstructure:"cluster-enabled"`           //是否以集群模式启动
+	ClusterConfigFile  string `json:"cluster-config-file" mapstructure:"cluster-config-file"`   //节点自动维护的集群配置文件，记录已知节点、哈希槽与纪元，不需要手动编辑
+	ClusterNodeTimeout int64  `json:"cluster-node-timeout" mapstructure:"cluster-node-timeout"` //节点超时时间，毫秒
+}
+
+// 哨兵
+const (
+	SENTINEL_DEFAULT_PORT             int   = 26379
+	SENTINEL_TICK_PERIOD              int64 = 100    //哨兵定时任务的执行周期，毫秒
+	SENTINEL_PING_PERIOD              int64 = 1000   //向主从节点和其他哨兵发送PING的间隔，毫秒
+	SENTINEL_INFO_PERIOD              int64 = 10000  //向主从节点发送INFO的间隔，主节点下线或故障转移期间为SENTINEL_PING_PERIOD，毫秒
+	SENTINEL_HELLO_PERIOD             int64 = 2000   //向其他哨兵发送自身与主节点配置的间隔，毫秒
+	SENTINEL_ASK_PERIOD               int64 = 1000   //主节点主观下线后询问其他哨兵的间隔，毫秒
+	SENTINEL_REQUEST_TIMEOUT          int64 = 2000   //哨兵发出的单个请求的超时时间，毫秒
+	SENTINEL_ELECTION_TIMEOUT         int64 = 10000  //选举领头哨兵的超时时间，毫秒
+	SENTINEL_MAX_DESYNC               int64 = 1000   //投票给其他哨兵后推迟自身故障转移的随机时间上限，毫秒
+	SENTINEL_REPLICA_RECONF_TIMEOUT   int64 = 10000  //从节点切换主节点的超时时间，毫秒
+	SENTINEL_DEFAULT_DOWN_AFTER       int64 = 30000  //未配置down-after-milliseconds时判定主观下线的时间，毫秒
+	SENTINEL_DEFAULT_FAILOVER_TIMEOUT int64 = 180000 //未配置failover-timeout时故障转移的超时时间，毫秒
+	SENTINEL_DEFAULT_PARALLEL_SYNCS   int   = 1      //未配置parallel-syncs时同时切换主节点的从节点数
+)
+
+type SentinelConfig struct {
+	Port       int             `json:"port"`
+	AnnounceIP string          `json:"announce-ip" mapstructure:"announce-ip"` //告知其他哨兵的地址，为空时使用连接主节点的本地地址
+	Sentinels  []string        `json:"sentinels"`                              //初始已知的其他哨兵"ip:port"，其余哨兵通过hello消息互相发现
+	Monitors   []MonitorConfig `json:"monitors"`                               //监控的主节点
+}
+
+type MonitorConfig struct {
+	Name            string `json:"name"`
+	Host            string `json:"host"`
+	Port            int    `json:"port"`
+	Quorum          int    `json:"quorum"`                                                         //判定客观下线所需的哨兵数
+	DownAfter       int64  `json:"down-after-milliseconds" mapstructure:"down-after-milliseconds"` //超过该时间没有有效回复则判定主观下线，毫秒
+	FailoverTimeout int64  `json:"failover-timeout" mapstructure:"failover-timeout"`               //故障转移各阶段的超时时间，毫秒
+	ParallelSyncs   int    `json:"parallel-syncs" mapstructure:"parallel-syncs"`                   //故障转移时同时切换到新主节点的从节点数
+}
+
+// 代理
+const (
+	PROXY_DEFAULT_PORT     int   = 6380
+	PROXY_CRON_PERIOD      int64 = 100  //代理定时任务的执行周期，毫秒
+	PROXY_CONNECT_TIMEOUT  int64 = 1000 //连接后端的超时时间，毫秒
+	PROXY_RECONNECT_PERIOD int64 = 1000 //后端断开后重连的间隔，毫秒
+)
+
+type ProxyConfig struct {
+	Port     int      `json:"port"`
+	Backends []string `json:"backends"` //后端节点"ip:port"，哈希槽按顺序平均分配给各后端，增删后端会改变key的归属
 }
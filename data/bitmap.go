@@ -24,6 +24,15 @@ func BitmapCreate() *Bitmap {
 	}
 }
 
+func (bit *Bitmap) Dup() *Bitmap {
+	bytes := make([]byte, len(bit.Bytes))
+	copy(bytes, bit.Bytes)
+	return &Bitmap{
+		Bytes: bytes,
+		Len:   bit.Len,
+	}
+}
+
 func (bit *Bitmap) SetBit(offsetStr string, val string) (byte, error) {
 	b, err := bit.getByteValue(val)
 	if err != nil {
@@ -31,10 +31,10 @@ type htable struct {
 }
 
 type Dict struct {
-	hts       [2]*htable
-	rehashidx int64
-	h         hash.Hash64
-	// iterators
+	hts         [2]*htable
+	rehashidx   int64
+	h           hash.Hash64
+	pauseRehash int //大于0时查找不再推进rehash，只读访问不会修改字典
 }
 
 type dictIterator struct {
@@ -52,6 +52,14 @@ func DictCreate() *Dict {
 	return &dict
 }
 
+func (dict *Dict) Dup() *Dict {
+	dup := DictCreate()
+	for _, obj := range dict.IterateDict() {
+		dup.Set(obj[0], obj[1].Dup())
+	}
+	return dup
+}
+
 func (dict *Dict) GStrHash(key *Gobj) int64 {
 	if key.Type_ != conf.GSTR {
 		return 0
@@ -96,10 +104,21 @@ func (dict *Dict) isRehashing() bool {
 }
 
 func (dict *Dict) rehashStep() {
-	// TODO: check iterators
+	if dict.pauseRehash > 0 {
+		return
+	}
 	dict.rehash(DEFAULT_STEP)
 }
 
+// 暂停渐进式rehash，字典被后台goroutine读取期间，主线程的只读访问不能修改字典
+func (dict *Dict) PauseRehash() {
+	dict.pauseRehash++
+}
+
+func (dict *Dict) ResumeRehash() {
+	dict.pauseRehash--
+}
+
 func (dict *Dict) rehash(step int) {
 	for step > 0 {
 		if dict.hts[0].used == 0 {
@@ -319,6 +338,17 @@ func (dict *Dict) Get(key *Gobj) *Gobj {
 	return entry.Val
 }
 
+// 字典中的元素个数，包括rehash过程中两个哈希表的元素
+func (dict *Dict) Length() int {
+	length := 0
+	for _, ht := range dict.hts {
+		if ht != nil {
+			length += int(ht.used)
+		}
+	}
+	return length
+}
+
 func (dict *Dict) RandomGet() *Entry {
 	if dict.hts[0] == nil {
 		return nil
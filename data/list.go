@@ -14,6 +14,10 @@ type Node struct {
 	prev *Node
 }
 
+func (n *Node) Next() *Node {
+	return n.next
+}
+
 type ListType struct {
 	EqualFunc func(a, b *Gobj) bool
 }
@@ -31,6 +35,14 @@ func ListCreate(listType ListType) *List {
 	return &list
 }
 
+func (list *List) Dup() *List {
+	dup := ListCreate(list.ListType)
+	for node := list.Head; node != nil; node = node.next {
+		dup.Append(node.Val.Dup())
+	}
+	return dup
+}
+
 func (list *List) Length() int {
 	return list.length
 }
@@ -29,6 +29,50 @@ func CreateObjectFromInt(val int64) *Gobj {
 	}
 }
 
+// 深拷贝对象，用于生成数据集的时间点副本
+func (o *Gobj) Dup() *Gobj {
+	switch o.Type_ {
+	case conf.GLIST:
+		return CreateObject(o.Type_, o.Val_.(*List).Dup())
+	case conf.GSET:
+		return CreateObject(o.Type_, o.Val_.(*Set).Dup())
+	case conf.GZSET:
+		return CreateObject(o.Type_, o.Val_.(*ZSet).Dup())
+	case conf.GDICT:
+		return CreateObject(o.Type_, o.Val_.(*Dict).Dup())
+	case conf.GBIT:
+		return CreateObject(o.Type_, o.Val_.(*Bitmap).Dup())
+	default:
+		return CreateObject(o.Type_, o.Val_)
+	}
+}
+
+// value中的字典，没有字典的类型返回nil
+func (o *Gobj) dict() *Dict {
+	switch o.Type_ {
+	case conf.GSET:
+		return o.Val_.(*Set).Dict
+	case conf.GZSET:
+		return o.Val_.(*ZSet).Dict
+	case conf.GDICT:
+		return o.Val_.(*Dict)
+	}
+	return nil
+}
+
+// 暂停value中字典的rehash，value与后台任务共享期间只读访问不会修改value
+func (o *Gobj) PauseRehash() {
+	if dict := o.dict(); dict != nil {
+		dict.PauseRehash()
+	}
+}
+
+func (o *Gobj) ResumeRehash() {
+	if dict := o.dict(); dict != nil {
+		dict.ResumeRehash()
+	}
+}
+
 func (o *Gobj) IntVal() (int, error) {
 	if o.Type_ != conf.GSTR {
 		return 0, nil
@@ -12,6 +12,13 @@ func SetCreate() *Set {
 	}
 }
 
+func (set *Set) Dup() *Set {
+	return &Set{
+		Dict:   set.Dict.Dup(),
+		length: set.length,
+	}
+}
+
 func (set *Set) Length() int {
 	return set.length
 }
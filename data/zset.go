@@ -17,6 +17,15 @@ func NewZset() *ZSet {
 	}
 }
 
+func (zs *ZSet) Dup() *ZSet {
+	dup := NewZset()
+	for _, obj := range zs.Dict.IterateDict() {
+		member, score := obj[0], obj[1]
+		dup.Zadd([]*Gobj{score.Dup(), member})
+	}
+	return dup
+}
+
 func (zs *ZSet) Zlen() int {
 	return int(zs.skiplist.length)
 }
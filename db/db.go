@@ -1,8 +1,73 @@
 package db
 
-import "github.com/godis/data"
+import (
+	"github.com/godis/data"
+	"github.com/godis/errs"
+)
 
 type GodisDB struct {
 	Data   *data.Dict //存储Godis中的有效数据
 	Expire *data.Dict //存储Godis中的过期数据
+
+	shared map[*data.Gobj]struct{} //快照期间仍与快照共享的value，为nil表示没有进行中的快照
+}
+
+/*
+生成数据集的时间点快照，供后台RDB持久化与AOF重写使用
+只复制key空间，value与当前数据集共享，快照期间主线程通过LookupKeyWrite修改value前先复制(copy on write)，
+共享的value暂停字典的rehash，通过LookupKeyRead只读访问时不需要复制，
+因此后台goroutine读取的value不会再被主线程修改，同一时间只允许存在一个快照，其他后台任务等待快照释放后执行
+*/
+func (db *GodisDB) Snapshot() (*GodisDB, error) {
+	if db.shared != nil {
+		return nil, errs.SnapshotInProgressError
+	}
+	snapshot := &GodisDB{
+		Data:   data.DictCreate(),
+		Expire: data.DictCreate(),
+	}
+	objs := db.Data.IterateDict()
+	db.shared = make(map[*data.Gobj]struct{}, len(objs))
+	for _, obj := range objs {
+		snapshot.Data.Set(obj[0], obj[1])
+		db.shared[obj[1]] = struct{}{}
+		obj[1].PauseRehash()
+	}
+	// 过期时间不会原地修改，直接共享
+	for _, obj := range db.Expire.IterateDict() {
+		snapshot.Expire.Set(obj[0], obj[1])
+	}
+	return snapshot, nil
+}
+
+// 后台任务结束后释放快照，之后访问value不再需要复制
+func (db *GodisDB) ReleaseSnapshot() {
+	for obj := range db.shared {
+		obj.ResumeRehash()
+	}
+	db.shared = nil
+}
+
+// 查找key对应的value用于只读访问，与快照共享的value不需要复制
+func (db *GodisDB) LookupKeyRead(key *data.Gobj) *data.Gobj {
+	entry := db.Data.Find(key)
+	if entry == nil {
+		return nil
+	}
+	return entry.Val
+}
+
+// 查找key对应的value用于修改，若value仍与快照共享，先复制一份替换当前数据集中的value再返回
+func (db *GodisDB) LookupKeyWrite(key *data.Gobj) *data.Gobj {
+	entry := db.Data.Find(key)
+	if entry == nil {
+		return nil
+	}
+	if db.shared != nil {
+		if _, ok := db.shared[entry.Val]; ok {
+			delete(db.shared, entry.Val)
+			entry.Val = entry.Val.Dup()
+		}
+	}
+	return entry.Val
 }
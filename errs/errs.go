@@ -13,27 +13,50 @@ var CustomError = &GodisError{1, "custom error"}
 
 // 基础errors
 var (
-	TypeConvertError     = &GodisError{100, "type convert error"}
-	TypeCheckError       = &GodisError{101, "type check error"}
-	ParamsCheckError     = &GodisError{102, "params check error"}
-	OutOfRangeError      = &GodisError{103, "out of range error"}
-	AOFBufferWriteError  = &GodisError{104, "aof buffer write error"}
-	AOFFileSaveError     = &GodisError{105, "aof file save error"}
-	UnknownError         = &GodisError{106, "unknown error"}
-	RDBIsSavingError     = &GodisError{107, "rdb is saving error"}
-	ForkError            = &GodisError{108, "fork error"}
-	RDBFileNotExistError = &GodisError{109, "rdb file not exist"}
-	RDBAppNameError      = &GodisError{110, "rdb appname error"}
-	RDBVersionError      = &GodisError{111, "rdb version error"}
-	RDBLoadFailedError   = &GodisError{112, "rdb load failed error"}
-	RDBFileDamagedError  = &GodisError{113, "rdb file damaged error"}
-	ExpandError          = &GodisError{114, "expand error"}
-	KeyExistsError       = &GodisError{115, "key exists error"}
-	KeyNotExistError     = &GodisError{116, "key not exists error"}
-	OutOfLimitError      = &GodisError{117, "cmd length out of limit error"}
-	WrongCmdError        = &GodisError{118, "wrong cmd error"}
-	DelKeyError          = &GodisError{119, "del key error"}
-	RDBLoadNumberError   = &GodisError{120, "rdb load number error"}
+	TypeConvertError        = &GodisError{100, "type convert error"}
+	TypeCheckError          = &GodisError{101, "type check error"}
+	ParamsCheckError        = &GodisError{102, "params check error"}
+	OutOfRangeError         = &GodisError{103, "out of range error"}
+	AOFBufferWriteError     = &GodisError{104, "aof buffer write error"}
+	AOFFileSaveError        = &GodisError{105, "aof file save error"}
+	UnknownError            = &GodisError{106, "unknown error"}
+	RDBIsSavingError        = &GodisError{107, "rdb is saving error"}
+	ForkError               = &GodisError{108, "fork error"}
+	RDBFileNotExistError    = &GodisError{109, "rdb file not exist"}
+	RDBAppNameError         = &GodisError{110, "rdb appname error"}
+	RDBVersionError         = &GodisError{111, "rdb version error"}
+	RDBLoadFailedError      = &GodisError{112, "rdb load failed error"}
+	RDBFileDamagedError     = &GodisError{113, "rdb file damaged error"}
+	ExpandError             = &GodisError{114, "expand error"}
+	KeyExistsError          = &GodisError{115, "key exists error"}
+	KeyNotExistError        = &GodisError{116, "key not exists error"}
+	OutOfLimitError         = &GodisError{117, "cmd length out of limit error"}
+	WrongCmdError           = &GodisError{118, "wrong cmd error"}
+	DelKeyError             = &GodisError{119, "del key error"}
+	RDBLoadNumberError      = &GodisError{120, "rdb load number error"}
+	AOFIsRewritingError     = &GodisError{121, "aof is rewriting error"}
+	AOFRewriteError         = &GodisError{122, "aof rewrite error"}
+	AOFDisabledError        = &GodisError{123, "aof disabled error"}
+	AOFManifestError        = &GodisError{124, "aof manifest error"}
+	AOFTruncatedError       = &GodisError{125, "aof file truncated error"}
+	AOFFormatError          = &GodisError{126, "aof file bad format error"}
+	AOFRestorePointError    = &GodisError{127, "aof restore point reached"}
+	SnapshotInProgressError = &GodisError{128, "snapshot in progress error"}
+	LzfDecompressError      = &GodisError{129, "lzf decompress error"}
+	RDBUnsupportedTypeError = &GodisError{130, "rdb unsupported type error"}
+	RDBCheckSumError        = &GodisError{131, "rdb checksum mismatch error"}
+	ReplHandshakeError      = &GodisError{132, "replication handshake error"}
+	ReadOnlyReplicaError    = &GodisError{133, "write against a read only replica error"}
+	MasterLinkDownError     = &GodisError{134, "master link down error"}
+	ReplTransferError       = &GodisError{135, "no replica left for rdb transfer error"}
+	ReplEOFMarkError        = &GodisError{136, "rdb transfer eof mark mismatch error"}
+	SentinelConfigError     = &GodisError{137, "sentinel config error"}
+	ClusterConfigError      = &GodisError{138, "cluster config error"}
+	ClusterDisabledError    = &GodisError{139, "cluster support disabled error"}
+	DumpPayloadError        = &GodisError{140, "dump payload version or checksum are wrong"}
+	BusyKeyError            = &GodisError{141, "target key name already exists"}
+	MigrateError            = &GodisError{142, "migrate keys to target instance error"}
+	ProxyConfigError        = &GodisError{143, "proxy config error"}
 )
 
 // 数据类型errors
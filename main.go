@@ -16,8 +16,12 @@ import (
 func main() {
 	var pfile string
 	var logLevel string
+	var restoreUntil int64
+	var rdbFormat string
 	flag.StringVar(&pfile, "pfile", "./cpu.pprof", "pprof filename")
 	flag.StringVar(&logLevel, "loglevel", "info", "log level")
+	flag.Int64Var(&restoreUntil, "restore-until", 0, "only load aof commands before this unix timestamp in milliseconds")
+	flag.StringVar(&rdbFormat, "rdb-format", "", "rdb file format to write, godis or redis, overrides the config file")
 	flag.Parse()
 
 	log := zerolog.
@@ -43,12 +47,21 @@ func main() {
 	var config conf.Config
 	viper.AddConfigPath("./conf/")
 	viper.SetConfigName("godis-conf")
+	viper.SetDefault("replica-read-only", true)
+	viper.SetDefault("repl-timeout", conf.REPL_DEFAULT_TIMEOUT)
+	viper.SetDefault("repl-backlog-size", conf.REPL_DEFAULT_BACKLOG)
+	viper.SetDefault("repl-diskless-sync-delay", conf.REPL_DISKLESS_SYNC_DELAY)
+	viper.SetDefault("repl-diskless-load", conf.REPL_DISKLESS_LOAD_DISABLED)
 	if err := viper.ReadInConfig(); err != nil {
 		log.Error().Err(err).Msg("[msg:load godis config failed]")
 	}
 	if err := viper.Unmarshal(&config); err != nil {
 		log.Error().Err(err).Msg("[msg:unmarshal godis config failed]")
 	}
+	config.AOFRestoreUntil = restoreUntil
+	if rdbFormat != "" {
+		config.RDBFormat = rdbFormat
+	}
 	log.Info().Interface("config", config).Msg("[msg:start godis with config]")
 
 	server, err := server.InitGodisServerInstance(&config, &log)
@@ -1,6 +1,9 @@
 package net
 
 import (
+	gonet "net"
+	"time"
+
 	"github.com/rs/zerolog"
 	"golang.org/x/sys/unix"
 )
@@ -52,3 +55,48 @@ func TcpServer(port int, logger *zerolog.Logger) (int, error) {
 	}
 	return s, nil
 }
+
+// 连接addr，握手阶段使用标准库的连接以便设置超时，之后通过DetachFd交给事件循环
+func Connect(addr string, timeout time.Duration) (gonet.Conn, error) {
+	return gonet.DialTimeout("tcp", addr, timeout)
+}
+
+// 取出连接的文件描述符并设为阻塞模式，与事件循环中accept得到的连接一致，conn随之关闭
+func DetachFd(conn gonet.Conn) (int, error) {
+	defer conn.Close()
+	file, err := conn.(*gonet.TCPConn).File()
+	if err != nil {
+		return -1, err
+	}
+	defer file.Close()
+	fd, err := unix.Dup(int(file.Fd()))
+	if err != nil {
+		return -1, err
+	}
+	if err = unix.SetNonblock(fd, false); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// 设置阻塞写的超时时间，0表示不超时
+func SetWriteTimeout(fd int, timeout time.Duration) error {
+	tv := unix.NsecToTimeval(timeout.Nanoseconds())
+	return unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_SNDTIMEO, &tv)
+}
+
+// 对端的IP与端口
+func PeerAddr(fd int) (string, int) {
+	sa, err := unix.Getpeername(fd)
+	if err != nil {
+		return "", 0
+	}
+	switch addr := sa.(type) {
+	case *unix.SockaddrInet4:
+		return gonet.IP(addr.Addr[:]).String(), addr.Port
+	case *unix.SockaddrInet6:
+		return gonet.IP(addr.Addr[:]).String(), addr.Port
+	}
+	return "", 0
+}
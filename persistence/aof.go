@@ -3,53 +3,350 @@ package persistence
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
-	"strconv"
+	"strings"
 
 	"github.com/godis/conf"
 	"github.com/godis/data"
+	"github.com/godis/db"
 	"github.com/godis/errs"
 	"github.com/godis/util"
 	"github.com/rs/zerolog"
 )
 
+const (
+	AOF_FSYNC_ALWAYS   = 0
+	AOF_FSYNC_EVERYSEC = 1
+	AOF_FSYNC_NO       = 2
+
+	AOF_FLUSH_POSTPONE_MAX = 2000 //后台fsync未完成时，写入最多推迟的毫秒数
+)
+
 type AOF struct {
-	Buffer      *bufio.ReadWriter //有缓冲持久化
-	AppendOnly  bool              //是否启用AOF
-	File        *os.File          //AOF文件句柄
-	Appendfsync int               //0:always|1:everysec|2:no
-	Command     string            //待持久化的完整命令
-	when        int64             //上次刷盘时间
+	buf         []byte   //AOF缓冲区，事件循环休眠前统一写入文件
+	AppendOnly  bool     //是否启用AOF
+	File        *os.File //当前写入的incr文件句柄
+	Filename    string   //旧版本单文件AOF路径，用于升级
+	Dirname     string   //multi part AOF文件所在目录
+	Basename    string   //AOF文件名前缀
+	Appendfsync int      //0:always|1:everysec|2:no
+	Command     string   //待持久化的完整命令
 	logEntry    zerolog.Logger
+
+	bio                 *bioWorker
+	lastFsync           int64 //上次fsync的毫秒时间
+	syncedAt            int64 //上次在事件循环中完成fsync或打开新文件的毫秒时间，后台fsync的完成时间由bio记录
+	unsynced            bool  //上次fsync之后是否有新写入的数据
+	flushPostponedStart int64 //因后台fsync未完成而推迟写入的开始时间
+	DelayedFsync        int64 //等待后台fsync超时而直接写入的次数
+	LastWriteErr        error //最近一次写入文件的错误
+
+	Offset        int64 //缓冲区中的命令对应的复制偏移量，由调用方在Flush前更新
+	writtenOffset int64 //已写入文件的复制偏移量
+	fsyncedOffset int64 //always与no策略下已落盘的复制偏移量，everysec由后台fsync更新
+
+	manifest *aofManifest
+
+	CurrentSize       int64       //base与incr文件的总大小
+	BaseSize          int64       //上次重写后base文件的大小
+	RewritePercentage int         //自动重写的增长比例阈值
+	RewriteMinSize    int64       //自动重写的最小文件大小
+	rewriting         bool        //是否正在后台重写
+	rewriteDone       chan error  //后台重写结果
+	rewriteTemp       string      //重写临时文件名
+	rewriteIncrSeq    int64       //重写开始时新建的incr文件序号，重写完成后之前的incr文件均可删除
+	rewriteSource     *db.GodisDB //重写的数据集，重写结束后释放其快照
+	historyDir        string      //不为空时重写完成后历史文件移动到该目录，而不是删除
+	LastRewriteErr    error       //最近一次后台重写的错误
+
+	UseRDBPreamble bool //重写时是否使用RDB格式作为base文件
+	LoadTruncated  bool //加载时是否容忍末尾不完整的命令
+	rdb            *RDB
+
+	TimestampEnabled bool  //是否写入时间戳注释
+	lastTimestamp    int64 //上次写入时间戳注释的毫秒时间
+	RestoreUntil     int64 //只加载该毫秒时间戳之前的命令，0表示全部加载
 }
 
-func InitAOF(config *conf.Config, logger *zerolog.Logger) *AOF {
-	var err error
+func InitAOF(config *conf.Config, rdb *RDB, logger *zerolog.Logger) *AOF {
 	aof := &AOF{
-		AppendOnly: config.AppendOnly,
-		when:       0,
-		Command:    "",
-		logEntry:   logger.With().Logger(),
-	}
-
-	// 若有AOF文件则直接打开，不存在则创建
-	aof.File, err = os.OpenFile(config.Dir+config.AppendFilename, os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_SYNC, 0666)
-	if err != nil {
-		logger.Error().Msg("open aof file failed")
+		AppendOnly:        config.AppendOnly,
+		Filename:          config.Dir + config.AppendFilename,
+		Dirname:           config.Dir + config.AppendDirname + "/",
+		Basename:          config.AppendFilename,
+		Command:           "",
+		logEntry:          logger.With().Logger(),
+		RewritePercentage: config.AutoAOFRewritePercentage,
+		RewriteMinSize:    config.AutoAOFRewriteMinSize * 1024 * 1024,
+		UseRDBPreamble:    config.AOFUseRDBPreamble,
+		LoadTruncated:     config.AOFLoadTruncated,
+		rdb:               rdb,
+		TimestampEnabled:  config.AOFTimestampEnabled,
+		RestoreUntil:      config.AOFRestoreUntil,
 	}
-	aof.Buffer = bufio.NewReadWriter(bufio.NewReader(aof.File), bufio.NewWriterSize(aof.File, conf.AOF_BUF_BLOCK_SIZE))
 
 	switch config.Appendfsync {
 	case "always":
-		aof.Appendfsync = 0
+		aof.Appendfsync = AOF_FSYNC_ALWAYS
 	case "everysec":
-		aof.Appendfsync = 1
+		aof.Appendfsync = AOF_FSYNC_EVERYSEC
 	case "no":
-		aof.Appendfsync = 2
+		aof.Appendfsync = AOF_FSYNC_NO
+	}
+
+	if aof.AppendOnly {
+		aof.bio = newBioWorker(aof.logEntry)
+		if err := aof.initFiles(); err != nil {
+			logger.Error().Err(err).Msg("init aof files failed")
+		}
 	}
 	return aof
 }
 
+// 读取清单文件并打开最后一个incr文件用于追加，不存在清单时兼容旧版本的单文件AOF
+func (aof *AOF) initFiles() error {
+	if err := os.MkdirAll(aof.Dirname, 0755); err != nil {
+		return err
+	}
+	m, err := loadManifest(aof.manifestPath())
+	if os.IsNotExist(err) {
+		m = &aofManifest{}
+		if err := aof.upgradeLegacyFile(m); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	aof.manifest = m
+	aof.removeTempFiles()
+
+	if len(m.incrList) == 0 {
+		if err := aof.rotateIncrFile(); err != nil {
+			return err
+		}
+	} else if err := aof.openIncrFile(m.incrList[len(m.incrList)-1].name); err != nil {
+		return err
+	}
+
+	aof.BaseSize = 0
+	if m.base != nil {
+		aof.BaseSize = aof.fileSize(m.base.name)
+	}
+	aof.CurrentSize = aof.BaseSize
+	for _, info := range m.incrList {
+		aof.CurrentSize += aof.fileSize(info.name)
+	}
+	return nil
+}
+
+// 旧版本的单文件AOF直接作为base文件移入目录
+func (aof *AOF) upgradeLegacyFile(m *aofManifest) error {
+	if _, err := os.Stat(aof.Filename); err != nil {
+		return nil
+	}
+	m.baseSeq++
+	m.base = &aofInfo{name: aof.baseName(m.baseSeq), seq: m.baseSeq, typ: AOF_FILE_TYPE_BASE}
+	if err := os.Rename(aof.Filename, aof.Dirname+m.base.name); err != nil {
+		return err
+	}
+	if err := aof.persistManifest(m); err != nil {
+		return err
+	}
+	aof.logEntry.Info().Str("file", m.base.name).Msg("upgrade legacy aof file to multi part aof")
+	return nil
+}
+
+// 清理异常退出时遗留的重写临时文件
+func (aof *AOF) removeTempFiles() {
+	entries, err := os.ReadDir(aof.Dirname)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), AOF_TEMP_PREFIX) {
+			os.Remove(aof.Dirname + entry.Name())
+		}
+	}
+}
+
+func (aof *AOF) fileSize(name string) int64 {
+	info, err := os.Stat(aof.Dirname + name)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func (aof *AOF) openIncrFile(name string) error {
+	file, err := os.OpenFile(aof.Dirname+name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	aof.File = file
+	aof.syncedAt = util.GetMsTime()
+	return nil
+}
+
+// 新建incr文件并写入清单，之后的命令都追加到新文件中
+func (aof *AOF) rotateIncrFile() error {
+	m := aof.manifest.dup()
+	m.incrSeq++
+	info := &aofInfo{name: aof.incrName(m.incrSeq), seq: m.incrSeq, typ: AOF_FILE_TYPE_INCR}
+	m.incrList = append(m.incrList, info)
+
+	file, err := os.OpenFile(aof.Dirname+info.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	file.Close()
+	if err = aof.persistManifest(m); err != nil {
+		return err
+	}
+	aof.manifest = m
+
+	// 缓冲区的命令属于旧文件，写入后交给后台fsync并关闭
+	if aof.File != nil {
+		aof.Flush(true)
+		aof.bio.submit(BIO_AOF_FSYNC, aof.File, aof.writtenOffset)
+		aof.bio.submit(BIO_CLOSE_FILE, aof.File, 0)
+		aof.File = nil
+		aof.unsynced = false
+	}
+	// 新文件以时间戳注释开头
+	aof.lastTimestamp = 0
+	return aof.openIncrFile(info.name)
+}
+
+// 退出前写入缓冲区并同步fsync
+func (aof *AOF) Close() {
+	if aof.File == nil {
+		return
+	}
+	aof.Flush(true)
+	aof.bio.stop()
+	if err := aof.File.Sync(); err != nil {
+		aof.logEntry.Error().Err(err).Msg("fsync aof file failed")
+	}
+	aof.File.Close()
+	aof.File = nil
+}
+
+/*
+按清单顺序加载base与incr文件
+以RDB魔数开头的文件先用RDB解码快照部分，并跳过对应字节，剩余部分交给replay按命令重放
+replay返回最后一条完整命令的结束位置，用于定位损坏或被截断的位置
+*/
+func (aof *AOF) Load(db *db.GodisDB, replay func(reader io.Reader) (int64, error)) error {
+	if aof.manifest == nil {
+		return errs.AOFManifestError
+	}
+	files := aof.manifest.files()
+	for i, info := range files {
+		err := aof.loadFile(info, db, replay, i == len(files)-1)
+		if err == errs.AOFRestorePointError {
+			return aof.restore(db, files[i:])
+		}
+		if err != nil {
+			aof.logEntry.Error().Err(err).Str("file", info.name).Msg("load aof file failed")
+			return err
+		}
+	}
+	if aof.RestoreUntil > 0 {
+		aof.logEntry.Warn().Int64("restore-until", aof.RestoreUntil).Msg("restore point not reached, the whole append only file loaded")
+	}
+	return nil
+}
+
+/*
+加载到恢复时间点后，立即重写生成新的base文件，之后的启动只加载恢复后的数据集
+恢复前的清单与所有文件(包括恢复时间点之后的命令)移动到备份目录而不是删除，
+恢复的时间点有误时，可以停止服务后将备份目录中的文件移回原目录，重新按其他时间点恢复
+*/
+func (aof *AOF) restore(db *db.GodisDB, discarded []*aofInfo) error {
+	for _, info := range discarded {
+		aof.logEntry.Warn().Str("file", info.name).Msg("commands after the restore point will be discarded")
+	}
+	backupDir := fmt.Sprintf("%s%s.restore-%d/", aof.Dirname, aof.Basename, util.GetMsTime())
+	if err := aof.backupManifest(backupDir); err != nil {
+		aof.logEntry.Error().Err(err).Str("dir", backupDir).Msg("backup append only file manifest before restore failed")
+		return err
+	}
+	aof.historyDir = backupDir
+	defer func() { aof.historyDir = "" }()
+	if err := aof.Rewrite(db); err != nil {
+		aof.logEntry.Error().Err(err).Msg("rewrite append only file after restore failed")
+		return err
+	}
+	aof.logEntry.Info().Int64("restore-until", aof.RestoreUntil).Str("backup", backupDir).
+		Msg("dataset restored to the restore point, the original append only files are kept in the backup dir")
+	return nil
+}
+
+// 创建备份目录并复制当前的清单文件
+func (aof *AOF) backupManifest(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	content, err := os.ReadFile(aof.manifestPath())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dir+aof.Basename+AOF_MANIFEST_SUFFIX, content, 0644)
+}
+
+func (aof *AOF) loadFile(info *aofInfo, db *db.GodisDB, replay func(reader io.Reader) (int64, error), last bool) error {
+	filename := aof.Dirname + info.name
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	preamble, err := aof.loadPreamble(filename, reader, db)
+	if err != nil {
+		return err
+	}
+	offset, err := replay(reader)
+	offset += preamble
+	if err == errs.AOFRestorePointError {
+		aof.logEntry.Info().Str("file", info.name).Int64("offset", offset).Msg("restore point reached, stop loading the append only file")
+		return err
+	}
+	// 只有最后一个文件允许末尾存在不完整的命令，截断到最后一条完整命令
+	if err == errs.AOFTruncatedError && aof.LoadTruncated && last {
+		size := aof.fileSize(info.name)
+		aof.logEntry.Warn().Str("file", info.name).Int64("offset", offset).Int64("size", size).
+			Msg("short read while loading the append only file, aof loaded anyway because aof-load-truncated is enabled")
+		if err := os.Truncate(filename, offset); err != nil {
+			aof.logEntry.Error().Err(err).Msg("truncate append only file failed")
+			return err
+		}
+		aof.CurrentSize -= size - offset
+		return nil
+	}
+	if err != nil {
+		aof.logEntry.Error().Err(err).Str("file", info.name).Int64("offset", offset).
+			Msg("unrecoverable error loading the append only file, use godis-check-aof --fix to repair it")
+		return err
+	}
+	return nil
+}
+
+// 若文件以RDB魔数开头，则解码快照部分并返回其占用的字节数
+func (aof *AOF) loadPreamble(filename string, reader *bufio.Reader, db *db.GodisDB) (int64, error) {
+	if !isRDBPreamble(reader) {
+		return 0, nil
+	}
+	n, err := aof.rdb.Decode(reader, db)
+	if err != nil {
+		return 0, err
+	}
+	aof.logEntry.Info().Str("file", filename).Int64("size", n).Msg("rdb preamble of aof file loaded")
+	return n, nil
+}
+
 func (aof *AOF) FreeCommand() {
 	aof.Command = ""
 }
@@ -65,6 +362,14 @@ $2
 v1
 */
 func (aof *AOF) PersistCommand(args []*data.Gobj) error {
+	// 每秒最多写入一条时间戳注释，用于按时间点恢复
+	if aof.TimestampEnabled {
+		now := util.GetMsTime()
+		if now/1000 != aof.lastTimestamp/1000 {
+			aof.Command += fmt.Sprintf("%s%d\r\n", conf.AOF_ANNOTATION_TIMESTAMP, now)
+			aof.lastTimestamp = now
+		}
+	}
 	aof.Command += fmt.Sprintf("*%d\r\n", len(args))
 	for _, v := range args {
 		param := fmt.Sprintf("%v", v.Val_)
@@ -76,65 +381,136 @@ func (aof *AOF) PersistCommand(args []*data.Gobj) error {
 	return err
 }
 
-// 额外计算过期绝对时间
-func (aof *AOF) PersistExpireCommand(args []*data.Gobj) error {
-	aof.Command += fmt.Sprintf("*%d\r\n", len(args))
-	cmdStr := args[0].StrVal()
-	aof.Command += fmt.Sprintf("$%d\r\n%s\r\n", len(cmdStr), cmdStr)
-	seconds, err := args[2].Int64Val()
-	if err != nil {
-		return err
+func (aof *AOF) Persist() error {
+	aof.buf = append(aof.buf, aof.Command...)
+	return nil
+}
+
+/*
+将缓冲区写入文件，在事件循环休眠前与ServerCron中调用
+always: 写入后立即fsync，保证回复客户端前数据已落盘
+everysec: 距上次fsync超过1秒时交给后台fsync，若后台fsync仍未完成则推迟写入，最多推迟2秒
+no: 只写入，由操作系统决定何时落盘
+force为true时不推迟写入
+*/
+func (aof *AOF) Flush(force bool) {
+	if aof.File == nil {
+		return
+	}
+	now := util.GetMsTime()
+	if len(aof.buf) == 0 {
+		// 缓冲区为空时复制偏移量的增长与AOF无关，已写入的数据全部落盘后即可视为落盘到Offset
+		aof.writtenOffset = aof.Offset
+		if aof.Appendfsync == AOF_FSYNC_NO || (!aof.unsynced && aof.bio.pendingJobs(BIO_AOF_FSYNC) == 0) {
+			aof.fsyncedOffset = aof.Offset
+		}
+		// 没有新命令时也要保证已写入的数据每秒fsync一次
+		if aof.Appendfsync == AOF_FSYNC_EVERYSEC && aof.unsynced && now-aof.lastFsync >= 1000 &&
+			aof.bio.pendingJobs(BIO_AOF_FSYNC) == 0 {
+			aof.backgroundFsync(now)
+		}
+		return
 	}
-	expireTime := util.GetTime() + seconds
-	aof.Command += fmt.Sprintf("$%d\r\n%d\r\n", len(strconv.FormatInt(expireTime, 10)), expireTime)
-	err = aof.Persist()
-	aof.FreeCommand()
 
-	return err
-}
+	if aof.Appendfsync == AOF_FSYNC_EVERYSEC && !force && aof.bio.pendingJobs(BIO_AOF_FSYNC) > 0 {
+		if aof.flushPostponedStart == 0 {
+			aof.flushPostponedStart = now
+			return
+		} else if now-aof.flushPostponedStart < AOF_FLUSH_POSTPONE_MAX {
+			return
+		}
+		aof.DelayedFsync++
+		aof.logEntry.Warn().Msg("asynchronous AOF fsync is taking too long (disk is busy?), writing the AOF buffer without waiting for fsync to complete")
+	}
+	aof.flushPostponedStart = 0
+
+	n, err := aof.File.Write(aof.buf)
+	aof.CurrentSize += int64(n)
+	if n > 0 {
+		aof.unsynced = true
+	}
+	if err != nil {
+		// 已写入的部分从缓冲区移除，剩余部分下次继续追加
+		aof.buf = aof.buf[:copy(aof.buf, aof.buf[n:])]
+		aof.LastWriteErr = err
+		aof.logEntry.Error().Err(err).Int("written", n).Msg("write aof buffer failed")
+		return
+	}
+	aof.buf = aof.buf[:0]
+	aof.LastWriteErr = nil
+	aof.writtenOffset = aof.Offset
 
-func (aof *AOF) Persist() error {
-	var err error
-	// 根据刷盘方式写入
 	switch aof.Appendfsync {
-	case 0:
-		aof.Save()
-	case 1:
-		if util.GetTime()-aof.when > 1 {
-			err = aof.Save()
-			if err != nil {
-				return err
-			}
-			aof.when = util.GetTime()
-		} else {
-			aof.Write()
+	case AOF_FSYNC_ALWAYS:
+		if err = aof.File.Sync(); err != nil {
+			aof.logEntry.Error().Err(err).Msg("fsync aof file failed")
+			return
+		}
+		aof.lastFsync = now
+		aof.syncedAt = now
+		aof.unsynced = false
+		aof.fsyncedOffset = aof.writtenOffset
+	case AOF_FSYNC_NO:
+		// 由操作系统决定何时落盘，写入文件即视为已持久化
+		aof.fsyncedOffset = aof.writtenOffset
+	case AOF_FSYNC_EVERYSEC:
+		if now-aof.lastFsync >= 1000 && aof.bio.pendingJobs(BIO_AOF_FSYNC) == 0 {
+			aof.backgroundFsync(now)
 		}
-	case 2:
-		aof.Write()
 	}
-	if err != nil {
-		return err
+}
+
+func (aof *AOF) backgroundFsync(now int64) {
+	aof.bio.submit(BIO_AOF_FSYNC, aof.File, aof.writtenOffset)
+	aof.lastFsync = now
+	aof.unsynced = false
+}
+
+// 已落盘的命令对应的复制偏移量，用于WAITAOF
+func (aof *AOF) FsyncedOffset() int64 {
+	offset := aof.fsyncedOffset
+	if aof.bio != nil && aof.bio.fsynced.Load() > offset {
+		offset = aof.bio.fsynced.Load()
 	}
-	return nil
+	return offset
 }
 
-func (aof *AOF) Write() error {
-	n, err := aof.Buffer.WriteString(aof.Command)
-	if n != len(aof.Command) || err != nil {
-		return errs.AOFBufferWriteError
+// 复制偏移量不连续时(如从节点全量同步)重置各偏移量
+func (aof *AOF) ResetOffset(offset int64) {
+	aof.Offset = offset
+	aof.writtenOffset = offset
+	aof.fsyncedOffset = offset
+	if aof.bio != nil {
+		aof.bio.fsynced.Store(offset)
 	}
-	return nil
 }
 
-func (aof *AOF) Save() error {
-	n, err := aof.Buffer.WriteString(aof.Command)
-	if n != len(aof.Command) || err != nil {
-		return errs.AOFBufferWriteError
+// 缓冲区中尚未写入文件的字节数
+func (aof *AOF) BufferLength() int {
+	return len(aof.buf)
+}
+
+// 正在等待后台执行的fsync任务数
+func (aof *AOF) PendingFsync() int64 {
+	if aof.bio == nil {
+		return 0
 	}
-	err = aof.Buffer.Flush()
-	if err != nil {
-		aof.logEntry.Error().Msg("flush aof buffer error")
+	return aof.bio.pendingJobs(BIO_AOF_FSYNC)
+}
+
+// 距上次完成fsync的毫秒数，已写入文件的数据都已落盘时为0
+func (aof *AOF) FsyncLag() int64 {
+	if aof.File == nil || (!aof.unsynced && aof.PendingFsync() == 0) {
+		return 0
+	}
+	last := aof.syncedAt
+	if aof.bio != nil && aof.bio.syncedAt.Load() > last {
+		last = aof.bio.syncedAt.Load()
 	}
+	return util.GetMsTime() - last
+}
 
-	return nil
+// 最近一次后台fsync是否成功
+func (aof *AOF) FsyncOK() bool {
+	return aof.bio == nil || !aof.bio.fsyncErr.Load()
 }
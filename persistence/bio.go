@@ -0,0 +1,84 @@
+package persistence
+
+import (
+	"os"
+	"sync/atomic"
+
+	"github.com/godis/util"
+	"github.com/rs/zerolog"
+)
+
+const (
+	BIO_AOF_FSYNC  = iota //fsync AOF文件
+	BIO_CLOSE_FILE        //关闭旧的AOF文件
+	BIO_NUM_OPS
+)
+
+const BIO_JOB_QUEUE_SIZE = 1024
+
+type bioJob struct {
+	typ    int
+	file   *os.File
+	offset int64 //fsync完成后已落盘的复制偏移量
+}
+
+/*
+后台任务goroutine，负责耗时的fsync与close，避免阻塞事件循环
+任务按提交顺序执行，因此关闭文件前提交的fsync一定先完成
+*/
+type bioWorker struct {
+	jobs     chan *bioJob
+	pending  [BIO_NUM_OPS]atomic.Int64 //各类型已提交但未完成的任务数
+	fsyncErr atomic.Bool               //最近一次fsync是否失败
+	fsynced  atomic.Int64              //最近一次成功fsync对应的复制偏移量
+	syncedAt atomic.Int64              //最近一次成功fsync完成的毫秒时间
+	done     chan struct{}
+	logEntry zerolog.Logger
+}
+
+func newBioWorker(logger zerolog.Logger) *bioWorker {
+	bio := &bioWorker{
+		jobs:     make(chan *bioJob, BIO_JOB_QUEUE_SIZE),
+		done:     make(chan struct{}),
+		logEntry: logger,
+	}
+	go bio.run()
+	return bio
+}
+
+func (bio *bioWorker) run() {
+	for job := range bio.jobs {
+		switch job.typ {
+		case BIO_AOF_FSYNC:
+			if err := job.file.Sync(); err != nil {
+				bio.logEntry.Error().Err(err).Msg("background aof fsync failed")
+				bio.fsyncErr.Store(true)
+			} else {
+				bio.fsyncErr.Store(false)
+				bio.fsynced.Store(job.offset)
+				bio.syncedAt.Store(util.GetMsTime())
+			}
+		case BIO_CLOSE_FILE:
+			if err := job.file.Close(); err != nil {
+				bio.logEntry.Error().Err(err).Msg("background close file failed")
+			}
+		}
+		bio.pending[job.typ].Add(-1)
+	}
+	close(bio.done)
+}
+
+func (bio *bioWorker) submit(typ int, file *os.File, offset int64) {
+	bio.pending[typ].Add(1)
+	bio.jobs <- &bioJob{typ: typ, file: file, offset: offset}
+}
+
+func (bio *bioWorker) pendingJobs(typ int) int64 {
+	return bio.pending[typ].Load()
+}
+
+// 等待已提交的任务全部完成后退出
+func (bio *bioWorker) stop() {
+	close(bio.jobs)
+	<-bio.done
+}
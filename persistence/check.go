@@ -0,0 +1,144 @@
+package persistence
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/godis/conf"
+	"github.com/godis/errs"
+)
+
+// 读取清单文件，按加载顺序返回各文件的完整路径
+func ReadManifest(filename string) ([]string, error) {
+	m, err := loadManifest(filename)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(filename)
+	files := make([]string, 0, len(m.incrList)+1)
+	for _, info := range m.files() {
+		files = append(files, filepath.Join(dir, info.name))
+	}
+	return files, nil
+}
+
+/*
+校验单个AOF文件，返回最后一条完整命令的结束位置
+RDB前导部分损坏返回RDB的错误，命令格式错误返回AOFFormatError，末尾命令不完整返回AOFTruncatedError
+until大于0时，遇到晚于该毫秒时间戳的注释返回AOFRestorePointError，位置为该注释的起始位置
+*/
+func CheckAOFFile(filename string, rdb *RDB, until int64) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var preamble int64
+	if isRDBPreamble(reader) {
+		// 逐条校验记录，不保留解析出的数据
+		preamble, err = rdb.DecodeEach(reader, func(record *RDBRecord) error { return nil })
+		if err != nil {
+			return 0, err
+		}
+	}
+	offset, err := CheckAOFCommands(reader, until)
+	return preamble + offset, err
+}
+
+// 校验RESP格式的命令流，返回最后一条完整命令的结束位置
+func CheckAOFCommands(reader *bufio.Reader, until int64) (int64, error) {
+	var offset int64
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && len(line) == 0 {
+			return offset, nil
+		}
+		if err == io.EOF {
+			return offset, errs.AOFTruncatedError
+		}
+		if err != nil {
+			return offset, err
+		}
+		pos := int64(len(line))
+		if line[0] == '#' {
+			if err = checkAnnotation(line, until); err != nil {
+				return offset, err
+			}
+			offset += pos
+			continue
+		}
+		if line[0] != '*' {
+			return offset, errs.AOFFormatError
+		}
+		argc, err := parseRESPNumber(line)
+		if err != nil || argc < 1 {
+			return offset, errs.AOFFormatError
+		}
+
+		for i := 0; i < argc; i++ {
+			line, err = reader.ReadString('\n')
+			if err == io.EOF {
+				return offset, errs.AOFTruncatedError
+			}
+			if err != nil {
+				return offset, err
+			}
+			if line[0] != '$' {
+				return offset, errs.AOFFormatError
+			}
+			length, err := parseRESPNumber(line)
+			if err != nil || length < 0 || length > conf.GODIS_PROTO_MAX_BULK_LEN {
+				return offset, errs.AOFFormatError
+			}
+			// 只校验格式，参数内容直接跳过，不按文件中的长度分配内存
+			if _, err = reader.Discard(length); err == io.EOF {
+				return offset, errs.AOFTruncatedError
+			} else if err != nil {
+				return offset, err
+			}
+			var crlf [2]byte
+			if _, err = io.ReadFull(reader, crlf[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+				return offset, errs.AOFTruncatedError
+			} else if err != nil {
+				return offset, err
+			}
+			if crlf[0] != '\r' || crlf[1] != '\n' {
+				return offset, errs.AOFFormatError
+			}
+			pos += int64(len(line) + length + 2)
+		}
+		offset += pos
+	}
+}
+
+func checkAnnotation(line string, until int64) error {
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return errs.AOFFormatError
+	}
+	ts, ok := strings.CutPrefix(line[:len(line)-2], conf.AOF_ANNOTATION_TIMESTAMP)
+	if !ok {
+		return nil
+	}
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errs.AOFFormatError
+	}
+	if until > 0 && timestamp > until {
+		return errs.AOFRestorePointError
+	}
+	return nil
+}
+
+// 解析形如 *3\r\n 或 $5\r\n 的数字
+func parseRESPNumber(line string) (int, error) {
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return 0, errs.AOFFormatError
+	}
+	return strconv.Atoi(line[1 : len(line)-2])
+}
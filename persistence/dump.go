@@ -0,0 +1,55 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+
+	"github.com/godis/conf"
+	"github.com/godis/data"
+	"github.com/godis/errs"
+	"github.com/godis/util"
+)
+
+/*
+DUMP的序列化格式，用于MIGRATE在节点间迁移key：
+<类型 1字节> <value，与RDB文件中的编码相同> <RDB版本 4字节> <校验和 8字节>
+校验和覆盖之前的所有字节，RESTORE时校验版本与校验和
+*/
+func (rdb *RDB) DumpValue(val *data.Gobj) ([]byte, error) {
+	typ, err := rdbValueType(val)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	writer := NewRDBWriter(&buf)
+	writer.WriteByte(typ)
+	if err := rdb.writeValue(writer, val); err != nil {
+		return nil, err
+	}
+	writer.WriteString(conf.RDB_VERSION)
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	payload := buf.Bytes()
+	return binary.BigEndian.AppendUint64(payload, util.CheckSumCreate(payload)), nil
+}
+
+func (rdb *RDB) RestoreValue(payload []byte) (*data.Gobj, error) {
+	footer := conf.RDB_VERSION_LEN + 8
+	if len(payload) < 1+footer {
+		return nil, errs.DumpPayloadError
+	}
+	body := payload[:len(payload)-8]
+	if util.CheckSumCreate(body) != binary.BigEndian.Uint64(payload[len(payload)-8:]) ||
+		string(body[len(body)-conf.RDB_VERSION_LEN:]) != conf.RDB_VERSION {
+		return nil, errs.DumpPayloadError
+	}
+	body = body[:len(body)-conf.RDB_VERSION_LEN]
+	reader := NewRDBReader(bufio.NewReader(bytes.NewReader(body[1:])))
+	val, err := rdb.loadValue(reader, body[0])
+	if err != nil || reader.Offset() != int64(len(body)-1) {
+		return nil, errs.DumpPayloadError
+	}
+	return val, nil
+}
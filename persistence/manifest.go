@@ -0,0 +1,177 @@
+package persistence
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/godis/errs"
+)
+
+const (
+	AOF_FILE_TYPE_BASE byte = 'b' //重写生成的基础文件
+	AOF_FILE_TYPE_INCR byte = 'i' //增量命令文件
+
+	AOF_MANIFEST_SUFFIX = ".manifest"
+	AOF_BASE_SUFFIX     = ".base"
+	AOF_INCR_SUFFIX     = ".incr"
+	AOF_FORMAT_SUFFIX   = ".aof"
+	RDB_FORMAT_SUFFIX   = ".rdb"
+	AOF_TEMP_PREFIX     = "temp-"
+)
+
+type aofInfo struct {
+	name string
+	seq  int64
+	typ  byte
+}
+
+/*
+multi part AOF的清单文件，每行描述一个文件，按加载顺序排列:
+file appendonly.aof.1.base.rdb seq 1 type b
+file appendonly.aof.1.incr.aof seq 1 type i
+*/
+type aofManifest struct {
+	base     *aofInfo
+	incrList []*aofInfo
+	baseSeq  int64 //最近一次使用的base序号
+	incrSeq  int64 //最近一次使用的incr序号
+}
+
+func (info *aofInfo) String() string {
+	return fmt.Sprintf("file %s seq %d type %c\n", info.name, info.seq, info.typ)
+}
+
+// 按加载顺序返回所有文件
+func (m *aofManifest) files() []*aofInfo {
+	files := make([]*aofInfo, 0, len(m.incrList)+1)
+	if m.base != nil {
+		files = append(files, m.base)
+	}
+	return append(files, m.incrList...)
+}
+
+func (m *aofManifest) String() string {
+	var builder strings.Builder
+	for _, info := range m.files() {
+		builder.WriteString(info.String())
+	}
+	return builder.String()
+}
+
+func (m *aofManifest) dup() *aofManifest {
+	dup := &aofManifest{
+		base:     m.base,
+		incrList: make([]*aofInfo, len(m.incrList)),
+		baseSeq:  m.baseSeq,
+		incrSeq:  m.incrSeq,
+	}
+	copy(dup.incrList, m.incrList)
+	return dup
+}
+
+func loadManifest(filename string) (*aofManifest, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	m := &aofManifest{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		info, err := parseAOFInfo(line)
+		if err != nil {
+			return nil, err
+		}
+		switch info.typ {
+		case AOF_FILE_TYPE_BASE:
+			if m.base != nil {
+				return nil, errs.AOFManifestError
+			}
+			m.base = info
+			m.baseSeq = info.seq
+		case AOF_FILE_TYPE_INCR:
+			m.incrList = append(m.incrList, info)
+			if info.seq > m.incrSeq {
+				m.incrSeq = info.seq
+			}
+		default:
+			return nil, errs.AOFManifestError
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseAOFInfo(line string) (*aofInfo, error) {
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return nil, errs.AOFManifestError
+	}
+	info := &aofInfo{}
+	for i := 0; i < len(fields); i += 2 {
+		switch fields[i] {
+		case "file":
+			info.name = fields[i+1]
+		case "seq":
+			seq, err := strconv.ParseInt(fields[i+1], 10, 64)
+			if err != nil {
+				return nil, errs.AOFManifestError
+			}
+			info.seq = seq
+		case "type":
+			if len(fields[i+1]) != 1 {
+				return nil, errs.AOFManifestError
+			}
+			info.typ = fields[i+1][0]
+		}
+	}
+	if info.name == "" || info.typ == 0 {
+		return nil, errs.AOFManifestError
+	}
+	return info, nil
+}
+
+func (aof *AOF) manifestPath() string {
+	return aof.Dirname + aof.Basename + AOF_MANIFEST_SUFFIX
+}
+
+func (aof *AOF) baseName(seq int64) string {
+	suffix := AOF_FORMAT_SUFFIX
+	if aof.UseRDBPreamble {
+		suffix = RDB_FORMAT_SUFFIX
+	}
+	return fmt.Sprintf("%s.%d%s%s", aof.Basename, seq, AOF_BASE_SUFFIX, suffix)
+}
+
+func (aof *AOF) incrName(seq int64) string {
+	return fmt.Sprintf("%s.%d%s%s", aof.Basename, seq, AOF_INCR_SUFFIX, AOF_FORMAT_SUFFIX)
+}
+
+// 先写临时文件再rename，保证清单文件的原子替换
+func (aof *AOF) persistManifest(m *aofManifest) error {
+	tempName := aof.Dirname + AOF_TEMP_PREFIX + aof.Basename + AOF_MANIFEST_SUFFIX
+	file, err := os.Create(tempName)
+	if err != nil {
+		return err
+	}
+	if _, err = file.WriteString(m.String()); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	return os.Rename(tempName, aof.manifestPath())
+}
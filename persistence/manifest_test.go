@@ -0,0 +1,104 @@
+package persistence
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/godis/errs"
+)
+
+func writeManifest(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "appendonly.aof"+AOF_MANIFEST_SUFFIX)
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	aof := &AOF{Dirname: t.TempDir() + "/", Basename: "appendonly.aof", UseRDBPreamble: true}
+	m := &aofManifest{
+		base: &aofInfo{name: aof.baseName(3), seq: 3, typ: AOF_FILE_TYPE_BASE},
+		incrList: []*aofInfo{
+			{name: aof.incrName(5), seq: 5, typ: AOF_FILE_TYPE_INCR},
+			{name: aof.incrName(6), seq: 6, typ: AOF_FILE_TYPE_INCR},
+		},
+		baseSeq: 3,
+		incrSeq: 6,
+	}
+	if err := aof.persistManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	want := "file appendonly.aof.3.base.rdb seq 3 type b\n" +
+		"file appendonly.aof.5.incr.aof seq 5 type i\n" +
+		"file appendonly.aof.6.incr.aof seq 6 type i\n"
+	if content, err := os.ReadFile(aof.manifestPath()); err != nil || string(content) != want {
+		t.Fatalf("manifest content %q, %v, want %q", content, err, want)
+	}
+	loaded, err := loadManifest(aof.manifestPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, m) {
+		t.Fatalf("loaded %q, want %q", loaded, m)
+	}
+
+	// 修改副本不影响原清单
+	dup := m.dup()
+	dup.incrList = append(dup.incrList[:1], &aofInfo{name: aof.incrName(7), seq: 7, typ: AOF_FILE_TYPE_INCR})
+	if m.incrList[1].seq != 6 {
+		t.Fatal("dup shares the incr list with the original manifest")
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string //重新写出的清单
+		err     error
+	}{
+		{"empty", "", "", nil},
+		{"comments and blank lines", "# comment\n\nfile a.base.rdb seq 1 type b\n  \nfile a.incr.aof seq 2 type i\n",
+			"file a.base.rdb seq 1 type b\nfile a.incr.aof seq 2 type i\n", nil},
+		{"field order and unknown fields", "type i startoffset 100 seq 2 file a.incr.aof\n",
+			"file a.incr.aof seq 2 type i\n", nil},
+		{"no trailing newline", "file a.incr.aof seq 2 type i", "file a.incr.aof seq 2 type i\n", nil},
+		{"odd fields", "file a.incr.aof seq 2 type\n", "", errs.AOFManifestError},
+		{"bad seq", "file a.incr.aof seq two type i\n", "", errs.AOFManifestError},
+		{"long type", "file a.incr.aof seq 2 type incr\n", "", errs.AOFManifestError},
+		{"unknown type", "file a.history.aof seq 2 type h\n", "", errs.AOFManifestError},
+		{"missing file", "seq 2 type i\n", "", errs.AOFManifestError},
+		{"missing type", "file a.incr.aof seq 2\n", "", errs.AOFManifestError},
+		{"two bases", "file a.1.base.rdb seq 1 type b\nfile a.2.base.rdb seq 2 type b\n", "", errs.AOFManifestError},
+		{"bad line after good ones", "file a.base.rdb seq 1 type b\nfile\n", "", errs.AOFManifestError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := loadManifest(writeManifest(t, tt.content))
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err == nil && m.String() != tt.want {
+				t.Fatalf("manifest %q, want %q", m.String(), tt.want)
+			}
+		})
+	}
+}
+
+// 序号取base的序号与incr的最大序号，之后新建的文件在此基础上递增
+func TestLoadManifestSeq(t *testing.T) {
+	m, err := loadManifest(writeManifest(t, "file a.4.base.rdb seq 4 type b\nfile a.9.incr.aof seq 9 type i\nfile a.7.incr.aof seq 7 type i\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.baseSeq != 4 || m.incrSeq != 9 {
+		t.Fatalf("baseSeq %d incrSeq %d, want 4 9", m.baseSeq, m.incrSeq)
+	}
+	if _, err = loadManifest(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Fatalf("err = %v, want not exist", err)
+	}
+}
@@ -1,11 +1,14 @@
 package persistence
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
 	"os"
-	"syscall"
+	"strconv"
+	"strings"
 
 	"github.com/godis/conf"
 	"github.com/godis/data"
@@ -15,24 +18,100 @@ import (
 	"github.com/rs/zerolog"
 )
 
+const RDB_BGSAVE_RETRY_DELAY = 5 //后台保存失败后，自动保存的重试间隔，单位秒
+
+// 自动保存条件，Seconds秒内至少有Changes次修改时触发后台保存
+type SaveParam struct {
+	Seconds int64
+	Changes int64
+}
+
 type RDB struct {
-	Buffer         []byte //RDB文件缓冲区
 	Filename       string //RDB文件名
 	RDBCheckSum    bool
 	RDBCompression bool
+	Format         string //写入时使用的格式，RDB_FORMAT_GODIS|RDB_FORMAT_REDIS
 	log            zerolog.Logger
 	isRDBSave      bool
 	CheckSum       uint64
+
+	source        *db.GodisDB //后台保存的数据集，保存结束后释放其快照
+	toSocket      bool        //后台保存是否直接写入从节点连接
+	saveDone      chan error  //后台保存结果
+	saveStart     int64       //后台保存开始的毫秒时间
+	LastSave      int64       //最近一次成功保存的秒级时间
+	LastBgSaveErr error       //最近一次后台保存的错误
+	LastBgSaveMs  int64       //最近一次后台保存的耗时
+
+	SaveParams        []SaveParam
+	Dirty             int64 //上次保存后的修改次数
+	dirtyBeforeBgSave int64 //后台保存开始时的修改次数，保存成功后从Dirty中扣除
+	lastBgSaveTry     int64 //最近一次尝试后台保存的秒级时间
 }
 
 func InitRDB(config *conf.Config, logger *zerolog.Logger) *RDB {
-	return &RDB{
-		Buffer:         make([]byte, conf.RDB_BUF_BLOCK_SIZE),
+	rdb := &RDB{
 		Filename:       config.DBFilename,
 		RDBCheckSum:    config.RDBCheckSum,
 		RDBCompression: config.RDBCompression,
+		Format:         config.RDBFormat,
 		log:            logger.With().Logger(),
+		LastSave:       util.GetTime(),
+		LastBgSaveMs:   -1,
+	}
+	switch rdb.Format {
+	case conf.RDB_FORMAT_GODIS, conf.RDB_FORMAT_REDIS:
+	case "":
+		rdb.Format = conf.RDB_FORMAT_GODIS
+	default:
+		rdb.log.Error().Msgf("unknown rdb format %q, use %s instead", rdb.Format, conf.RDB_FORMAT_GODIS)
+		rdb.Format = conf.RDB_FORMAT_GODIS
+	}
+	params, err := parseSaveParams(config.Save)
+	if err != nil {
+		rdb.log.Error().Err(err).Msgf("invalid save config %q, automatic saving disabled", config.Save)
 	}
+	rdb.SaveParams = params
+	return rdb
+}
+
+func parseSaveParams(save string) ([]SaveParam, error) {
+	fields := strings.Fields(save)
+	if len(fields)%2 != 0 {
+		return nil, errs.ParamsCheckError
+	}
+	params := make([]SaveParam, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds <= 0 {
+			return nil, errs.ParamsCheckError
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes <= 0 {
+			return nil, errs.ParamsCheckError
+		}
+		params = append(params, SaveParam{Seconds: seconds, Changes: changes})
+	}
+	return params, nil
+}
+
+/*
+返回满足的自动保存条件，没有满足的条件时返回nil
+上次后台保存失败时，需间隔RDB_BGSAVE_RETRY_DELAY秒后再重试
+*/
+func (rdb *RDB) NeedSave() *SaveParam {
+	if rdb.isRDBSave {
+		return nil
+	}
+	now := util.GetTime()
+	for i := range rdb.SaveParams {
+		sp := &rdb.SaveParams[i]
+		if rdb.Dirty >= sp.Changes && now-rdb.LastSave > sp.Seconds &&
+			(now-rdb.lastBgSaveTry > RDB_BGSAVE_RETRY_DELAY || rdb.LastBgSaveErr == nil) {
+			return sp
+		}
+	}
+	return nil
 }
 
 func (rdb *RDB) IsRDBSave() bool {
@@ -51,35 +130,118 @@ func (rdb *RDB) Save(db *db.GodisDB) error {
 		rdb.log.Error().Err(err).Msg("rdb save failed")
 		return err
 	}
+	rdb.LastSave = util.GetTime()
+	rdb.Dirty = 0
 	return nil
 }
 
+/*
+后台保存，基于数据集的时间点快照在goroutine中编码写入文件，事件循环可以继续处理命令
+保存结果在ServerCron中通过DoneBgSave获取
+*/
 func (rdb *RDB) BgSave(db *db.GodisDB) error {
+	if err := rdb.startBgSave(db, rdb.save, false); err != nil {
+		return err
+	}
+	rdb.dirtyBeforeBgSave = rdb.Dirty
+	rdb.lastBgSaveTry = util.GetTime()
+	rdb.log.Info().Msg("background saving started")
+	return nil
+}
+
+/*
+无盘复制的后台保存，由save将快照直接编码写入从节点连接，不生成RDB文件
+结果同样通过DoneBgSave获取，但不影响上次保存时间、修改次数与保存状态
+*/
+func (rdb *RDB) BgSaveToSocket(db *db.GodisDB, save func(snapshot *db.GodisDB) error) error {
+	if err := rdb.startBgSave(db, save, true); err != nil {
+		return err
+	}
+	rdb.log.Info().Msg("background RDB transfer started")
+	return nil
+}
+
+func (rdb *RDB) startBgSave(db *db.GodisDB, save func(snapshot *db.GodisDB) error, toSocket bool) error {
 	if rdb.isRDBSave {
 		return errs.RDBIsSavingError
 	}
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
 	rdb.isRDBSave = true
-	defer func() {
-		rdb.isRDBSave = false
+	rdb.toSocket = toSocket
+	rdb.source = db
+	rdb.saveDone = make(chan error, 1)
+	rdb.saveStart = util.GetMsTime()
+
+	go func() {
+		rdb.saveDone <- save(snapshot)
 	}()
+	return nil
+}
+
+// 后台保存是否为无盘复制
+func (rdb *RDB) IsSavingToSocket() bool {
+	return rdb.isRDBSave && rdb.toSocket
+}
+
+// 检查后台保存是否完成，完成则释放快照并记录结果，返回是否完成及保存结果
+func (rdb *RDB) DoneBgSave() (bool, error) {
+	if rdb.saveDone == nil {
+		return false, nil
+	}
+	select {
+	case err := <-rdb.saveDone:
+		rdb.finishBgSave(err)
+		return true, err
+	default:
+		return false, nil
+	}
+}
 
-	id, _, _ := syscall.Syscall(syscall.SYS_CLONE, 0, 0, 0)
-	if id == 0 {
-		err := rdb.save(db)
+// 阻塞等待后台保存结束，用于关闭服务前的最终保存
+func (rdb *RDB) WaitBgSave() {
+	if rdb.saveDone == nil {
+		return
+	}
+	rdb.finishBgSave(<-rdb.saveDone)
+}
+
+func (rdb *RDB) finishBgSave(err error) {
+	rdb.source.ReleaseSnapshot()
+	rdb.source = nil
+	rdb.saveDone = nil
+	rdb.isRDBSave = false
+	if rdb.toSocket {
+		rdb.toSocket = false
 		if err != nil {
-			rdb.log.Error().Err(err).Msg("rdb bgsave failed")
-			return err
+			rdb.log.Error().Err(err).Msg("background RDB transfer failed")
+			return
 		}
-		os.Exit(0)
-	} else if id > 0 {
-		rdb.log.Info().Msg("start rdb bgsave")
-	} else {
-		rdb.log.Error().Msg("fork failed")
-		return errs.ForkError
+		rdb.log.Info().Int64("ms", util.GetMsTime()-rdb.saveStart).Msg("background RDB transfer terminated with success")
+		return
 	}
-	return nil
+	rdb.LastBgSaveErr = err
+	rdb.LastBgSaveMs = util.GetMsTime() - rdb.saveStart
+	if err != nil {
+		rdb.log.Error().Err(err).Msg("background saving failed")
+		return
+	}
+	rdb.LastSave = util.GetTime()
+	rdb.Dirty -= rdb.dirtyBeforeBgSave
+	rdb.log.Info().Int64("ms", rdb.LastBgSaveMs).Msg("background saving terminated with success")
 }
 
+// 后台保存已进行的毫秒数，未在保存时返回-1
+func (rdb *RDB) BgSaveElapsed() int64 {
+	if rdb.saveDone == nil {
+		return -1
+	}
+	return util.GetMsTime() - rdb.saveStart
+}
+
+// 先写入临时文件，fsync后再rename，保证RDB文件的原子替换
 func (rdb *RDB) save(db *db.GodisDB) error {
 	tempFilename := fmt.Sprintf("temp-%d.rdb", util.GetMsTime())
 	tempFile, err := os.Create(tempFilename)
@@ -87,168 +249,165 @@ func (rdb *RDB) save(db *db.GodisDB) error {
 		rdb.log.Error().Err(err).Msgf("create tempfile %s", tempFilename)
 		return err
 	}
-	defer func() {
-		tempFile.Close()
-		os.Rename(tempFilename, rdb.Filename)
-	}()
 
-	buffer := bytes.NewBuffer(make([]byte, 0, conf.RDB_BUF_BLOCK_SIZE))
-	buffer.Write([]byte(conf.RDB_APPNAME))
-	buffer.Write([]byte(conf.RDB_VERSION))
+	if err = rdb.Encode(tempFile, db); err == nil {
+		err = tempFile.Sync()
+	}
+	tempFile.Close()
+	if err != nil {
+		os.Remove(tempFilename)
+		return err
+	}
+	return os.Rename(tempFilename, rdb.Filename)
+}
+
+// 将数据集以RDB格式流式写入w，AOF重写的RDB前导部分也复用该编码
+func (rdb *RDB) Encode(w io.Writer, db *db.GodisDB) error {
+	if rdb.Format == conf.RDB_FORMAT_REDIS {
+		return rdb.encodeRedis(w, db)
+	}
+	writer := NewRDBWriter(w)
+	writer.WriteString(conf.RDB_APPNAME)
+	writer.WriteString(conf.RDB_VERSION)
 
 	Gobjs := db.Data.IterateDict()
 
 	for _, obj := range Gobjs {
 		key, val := obj[0], obj[1]
-		if err := rdb.Persist(db, buffer, key, val); err != nil {
+		if err := rdb.Persist(db, writer, key, val); err != nil {
 			rdb.log.Error().Err(err).Msgf("persist key:%s failed", key.StrVal())
 		}
 	}
 
-	buffer.WriteByte(byte(conf.RDB_OPCODE_EOF))
+	writer.WriteByte(byte(conf.RDB_OPCODE_EOF))
 	if rdb.RDBCheckSum {
-		checksumNum := util.CheckSumCreate(buffer.Bytes())
-		rdb.log.Info().Msgf("rdb checksum:%d", checksumNum)
-		checksum := make([]byte, 8)
-		binary.BigEndian.PutUint64(checksum, checksumNum)
-		buffer.Write(checksum)
+		writer.WriteCheckSum()
 	}
-	tempFile.Write(buffer.Bytes()[:buffer.Len()])
-	return nil
+	return writer.Flush()
 }
 
-func (rdb *RDB) Persist(db *db.GodisDB, buffer *bytes.Buffer, key, val *data.Gobj) error {
+func (rdb *RDB) Persist(db *db.GodisDB, writer *RDBWriter, key, val *data.Gobj) error {
+	typ, err := rdbValueType(val)
+	if err != nil {
+		return err
+	}
+	rdb.checkExpire(db, writer, key)
+	writer.WriteByte(typ)
+	rdb.WriteString(writer, key)
+	return rdb.writeValue(writer, val)
+}
+
+// value在RDB中的类型
+func rdbValueType(val *data.Gobj) (byte, error) {
 	switch val.Type_ {
 	case conf.GSTR:
-		return rdb.PersistString(db, buffer, key, val)
+		return conf.RDB_TYPE_STRING, nil
 	case conf.GLIST:
-		return rdb.PersistList(db, buffer, key, val)
+		return conf.RDB_TYPE_LIST, nil
 	case conf.GDICT:
-		return rdb.PersistDict(db, buffer, key, val)
+		return conf.RDB_TYPE_HASH, nil
 	case conf.GSET:
-		return rdb.PersistSet(db, buffer, key, val)
+		return conf.RDB_TYPE_SET, nil
 	case conf.GZSET:
-		return rdb.PersistZSet(db, buffer, key, val)
+		return conf.RDB_TYPE_ZSET, nil
 	case conf.GBIT:
-		return rdb.PersistBit(db, buffer, key, val)
+		return conf.RDB_TYPE_BIT, nil
 	default:
-		return errs.TypeCheckError
-	}
-}
-
-func (rdb *RDB) PersistString(db *db.GodisDB, buffer *bytes.Buffer, key, val *data.Gobj) error {
-	rdb.checkExpire(db, buffer, key)
-	buffer.WriteByte(conf.RDB_TYPE_STRING)
-	rdb.WriteString(buffer, key)
-	rdb.WriteString(buffer, val)
-	return nil
-}
-
-func (rdb *RDB) PersistList(db *db.GodisDB, buffer *bytes.Buffer, key, val *data.Gobj) error {
-	rdb.checkExpire(db, buffer, key)
-	buffer.WriteByte(conf.RDB_TYPE_LIST)
-	rdb.WriteString(buffer, key)
-	list := val.Val_.(*data.List)
-	rdb.WriteLen(buffer, list.Length())
-
-	// var node *data.Node
-	// for i := 0; i < list.Length(); i++ {
-	// 	node = list.ForwardIndex(i)
-	// 	rdb.log.Debugln(node.Val.StrVal(), list.Length())
-	// 	rdb.WriteString(buffer, node.Val)
-	// }
-	for i := 0; i < list.Length(); i++ {
-		rdb.WriteString(buffer, list.Index(i).Val)
-	}
-	return nil
-}
-
-func (rdb *RDB) PersistDict(db *db.GodisDB, buffer *bytes.Buffer, key, val *data.Gobj) error {
-	rdb.checkExpire(db, buffer, key)
-	buffer.WriteByte(conf.RDB_TYPE_HASH)
-	rdb.WriteString(buffer, key)
-	dict := val.Val_.(*data.Dict)
-	objs := dict.IterateDict()
-	rdb.WriteLen(buffer, len(objs))
-	for _, obj := range objs {
-		rdb.WriteString(buffer, obj[0])
-		rdb.WriteString(buffer, obj[1])
-	}
-
-	return nil
-}
-
-func (rdb *RDB) PersistSet(db *db.GodisDB, buffer *bytes.Buffer, key, val *data.Gobj) error {
-	rdb.checkExpire(db, buffer, key)
-	buffer.WriteByte(conf.RDB_TYPE_SET)
-	rdb.WriteString(buffer, key)
-	set := val.Val_.(*data.Set)
-	rdb.WriteLen(buffer, set.Length())
-	for _, member := range set.Dict.IterateDict() {
-		rdb.WriteString(buffer, member[0])
+		return 0, errs.TypeCheckError
 	}
-	return nil
 }
 
-func (rdb *RDB) PersistZSet(db *db.GodisDB, buffer *bytes.Buffer, key, val *data.Gobj) error {
-	rdb.checkExpire(db, buffer, key)
-	buffer.WriteByte(conf.RDB_TYPE_ZSET)
-	rdb.WriteString(buffer, key)
-	zset := val.Val_.(*data.ZSet)
-	rdb.WriteLen(buffer, int(zset.Zcard()))
-	for _, obj := range zset.Dict.IterateDict() {
-		member, score := obj[0], obj[1]
-		rdb.WriteString(buffer, member)
-		rdb.WriteString(buffer, score)
+// 写入value本身，不包括类型与key
+func (rdb *RDB) writeValue(writer *RDBWriter, val *data.Gobj) error {
+	switch val.Type_ {
+	case conf.GSTR:
+		rdb.WriteString(writer, val)
+	case conf.GLIST:
+		list := val.Val_.(*data.List)
+		rdb.WriteLen(writer, list.Length())
+		for node := list.First(); node != nil; node = node.Next() {
+			rdb.WriteString(writer, node.Val)
+		}
+	case conf.GDICT:
+		objs := val.Val_.(*data.Dict).IterateDict()
+		rdb.WriteLen(writer, len(objs))
+		for _, obj := range objs {
+			rdb.WriteString(writer, obj[0])
+			rdb.WriteString(writer, obj[1])
+		}
+	case conf.GSET:
+		set := val.Val_.(*data.Set)
+		rdb.WriteLen(writer, set.Length())
+		for _, member := range set.Dict.IterateDict() {
+			rdb.WriteString(writer, member[0])
+		}
+	case conf.GZSET:
+		zset := val.Val_.(*data.ZSet)
+		rdb.WriteLen(writer, int(zset.Zcard()))
+		for _, obj := range zset.Dict.IterateDict() {
+			member, score := obj[0], obj[1]
+			rdb.WriteString(writer, member)
+			rdb.WriteString(writer, score)
+		}
+	case conf.GBIT:
+		bitmap := val.Val_.(*data.Bitmap)
+		rdb.WriteLen(writer, bitmap.Len)
+		writer.Write(bitmap.Bytes[:bitmap.Len])
+	default:
+		return errs.TypeCheckError
 	}
 	return nil
 }
 
-func (rdb *RDB) PersistBit(db *db.GodisDB, buffer *bytes.Buffer, key, val *data.Gobj) error {
-	rdb.checkExpire(db, buffer, key)
-
-	buffer.WriteByte(conf.RDB_TYPE_BIT)
-	rdb.WriteString(buffer, key)
-	bitmap := val.Val_.(*data.Bitmap)
-	rdb.WriteLen(buffer, bitmap.Len)
-	for _, b := range bitmap.Bytes {
-		buffer.WriteByte(b)
-	}
-	return nil
-}
-func (rdb *RDB) checkExpire(db *db.GodisDB, buffer *bytes.Buffer, key *data.Gobj) {
+func (rdb *RDB) checkExpire(db *db.GodisDB, writer *RDBWriter, key *data.Gobj) {
 	if expireKey := db.Expire.Get(key); expireKey != nil {
-		buffer.WriteByte(byte(conf.RDB_OPCODE_EXPIRETIME))
-
-		expireTimeSlice := make([]byte, 8)
-		expireTime, err := expireKey.IntVal()
+		expireTime, err := expireKey.Int64Val()
 		if err != nil {
 			rdb.log.Error().Err(err).Msgf("get expire key %s failed", key.StrVal())
 			return
 		}
+		writer.WriteByte(byte(conf.RDB_OPCODE_EXPIRETIME_MS))
+		expireTimeSlice := make([]byte, 8)
 		binary.BigEndian.PutUint64(expireTimeSlice, uint64(expireTime))
-		buffer.Write(expireTimeSlice)
+		writer.Write(expireTimeSlice)
 	}
 }
-func (rdb *RDB) WriteString(buffer *bytes.Buffer, obj *data.Gobj) (bool, error) {
-	str := obj.StrVal()
-	rdb.WriteLen(buffer, len(str))
-	buffer.WriteString(str)
+func (rdb *RDB) WriteString(writer *RDBWriter, obj *data.Gobj) (bool, error) {
+	return rdb.writeRawString(writer, obj.StrVal())
+}
+
+func (rdb *RDB) writeRawString(writer *RDBWriter, str string) (bool, error) {
+	if rdb.RDBCompression && len(str) > conf.RDB_COMPRESS_MIN_LEN {
+		if compressed := util.LzfCompress([]byte(str)); compressed != nil {
+			rdb.writeLzfString(writer, compressed, len(str))
+			return true, nil
+		}
+	}
+	rdb.WriteLen(writer, len(str))
+	writer.WriteString(str)
 	return true, nil
 }
 
-func (rdb *RDB) WriteLen(buffer *bytes.Buffer, length int) (bool, error) {
+// 压缩字符串格式: 0xC3 压缩后长度 原始长度 压缩数据
+func (rdb *RDB) writeLzfString(writer *RDBWriter, compressed []byte, length int) {
+	writer.WriteByte(conf.RDB_ENCVAL<<6 | conf.RDB_ENC_LZF)
+	rdb.WriteLen(writer, len(compressed))
+	rdb.WriteLen(writer, length)
+	writer.Write(compressed)
+}
+
+func (rdb *RDB) WriteLen(writer *RDBWriter, length int) (bool, error) {
 	switch {
-	case length <= 2<<6-1:
-		buffer.WriteByte(byte(length))
-	case length <= 2<<14-1:
-		buffer.WriteByte(byte(length>>8) | 0x40)
-		buffer.WriteByte(byte(length))
-	case length <= 2<<32-1:
-		buffer.WriteByte(0x80)
+	case length <= 1<<6-1:
+		writer.WriteByte(byte(length))
+	case length <= 1<<14-1:
+		writer.WriteByte(byte(length>>8) | 0x40)
+		writer.WriteByte(byte(length))
+	case length <= 1<<32-1:
+		writer.WriteByte(0x80)
 		l := make([]byte, 4)
 		binary.BigEndian.PutUint32(l, uint32(length))
-		buffer.Write(l)
+		writer.Write(l)
 	default:
 		return false, errs.OutOfRangeError
 	}
@@ -275,302 +434,397 @@ func (rdb *RDB) load(db *db.GodisDB) error {
 		return err
 	}
 	defer file.Close()
+	_, err = rdb.Decode(bufio.NewReaderSize(file, conf.RDB_BUF_BLOCK_SIZE), db)
+	return err
+}
 
-	buffer := make([]byte, conf.RDB_BUF_BLOCK_SIZE)
-	n, err := file.Read(buffer)
-	if err != nil {
-		rdb.log.Error().Err(err).Msgf("read rdb file %s failed", rdb.Filename)
-		return err
-	}
-	// rdb.log.Debugln(buffer[9:n])
-	if rdb.RDBCheckSum {
-		getChecksum := binary.BigEndian.Uint64(buffer[n-8 : n])
-		expectChecksum := util.CheckSumCreate(buffer[:n-8])
-		if expectChecksum != getChecksum {
-			rdb.log.Error().Msgf("rdb file checksum not match,expect:%d,get:%d", expectChecksum, getChecksum)
-			return errs.RDBFileDamagedError
+/*
+从reader中流式解析RDB数据并写入db，读取到EOF标记与校验和为止，不会多读
+返回RDB数据占用的字节数，AOF的RDB前导部分之后的命令紧接着从同一个reader中读取
+根据魔数自动识别godis格式与Redis格式
+*/
+func (rdb *RDB) Decode(r *bufio.Reader, db *db.GodisDB) (int64, error) {
+	return rdb.DecodeEach(r, func(record *RDBRecord) error {
+		db.Data.Set(record.Key, record.Val)
+		if record.Expire != -1 {
+			db.Expire.Set(record.Key, data.CreateObjectFromInt(record.Expire))
 		}
-	}
+		return nil
+	})
+}
+
+// RDB中的一条键值记录
+type RDBRecord struct {
+	Key    *data.Gobj
+	Val    *data.Gobj
+	Expire int64 //毫秒级过期时间，-1表示不过期
+	Offset int64 //记录在RDB数据中的起始位置，包括之前的过期时间等操作码
+	Size   int64 //记录占用的字节数
+}
+
+// RDB数据损坏的位置，Record为出错记录的起始位置，Offset为发现损坏时已读取的字节数
+type RDBCorruptionError struct {
+	Err    error
+	Record int64
+	Offset int64
+}
+
+func (e *RDBCorruptionError) Error() string {
+	return fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+}
 
-	buffer, err = rdb.checkAppName(buffer)
+func (e *RDBCorruptionError) Unwrap() error {
+	return e.Err
+}
+
+/*
+逐条解析RDB记录并交给fn处理，fn返回错误时停止解析并原样返回该错误
+成功时返回RDB数据占用的字节数，失败时返回出错记录的起始位置，
+数据损坏时错误为*RDBCorruptionError，便于定位损坏的位置
+*/
+func (rdb *RDB) DecodeEach(r *bufio.Reader, fn func(record *RDBRecord) error) (int64, error) {
+	reader, decode := NewRDBReader(r), rdb.decodeGodis
+	if magic, err := r.Peek(len(conf.REDIS_RDB_MAGIC)); err == nil && string(magic) == conf.REDIS_RDB_MAGIC {
+		reader, decode = newRDBReader(r, util.RedisCheckSumHash()), rdb.decodeRedis
+	}
+	var fnErr error
+	n, err := decode(reader, func(record *RDBRecord) error {
+		fnErr = fn(record)
+		return fnErr
+	})
+	if err != nil && fnErr == nil {
+		err = &RDBCorruptionError{Err: err, Record: n, Offset: reader.Offset()}
+	}
+	return n, err
+}
+
+func (rdb *RDB) decodeGodis(reader *RDBReader, fn func(record *RDBRecord) error) (int64, error) {
+	err := rdb.checkAppName(reader)
 	if err != nil {
 		rdb.log.Error().Err(err).Msgf("check rdb file %s appname failed", rdb.Filename)
-		return err
+		return 0, err
 	}
-	buffer, err = rdb.checkVersion(buffer)
+	version, err := rdb.checkVersion(reader)
 	if err != nil {
 		rdb.log.Error().Err(err).Msgf("check rdb file %s version failed", rdb.Filename)
-		return err
+		return 0, err
 	}
+	reader.legacy = version == conf.RDB_VERSION_V1
 
 	var expireTime int64 = -1
+	start := reader.Offset()
 
 	for {
-		switch buffer[0] {
-		case conf.RDB_OPCODE_EXPIRETIME:
-			var ex int
-			buffer, ex, err = rdb.LoadNumber(buffer[1:])
-			expireTime = int64(ex)
+		opcode, err := reader.PeekByte()
+		if err != nil {
+			rdb.log.Error().Err(err).Msgf("rdb file %s unexpected end", rdb.Filename)
+			return start, errs.RDBFileDamagedError
+		}
+		switch opcode {
+		case conf.RDB_OPCODE_EXPIRETIME_MS, conf.RDB_OPCODE_EXPIRETIME:
+			reader.ReadByte()
+			buf, err := reader.ReadFull(8)
 			if err != nil {
-				rdb.log.Error().Err(err).Msgf("load rdb file %s expiretime failed", rdb.Filename)
-				return err
+				rdb.log.Error().Msgf("load rdb file %s expiretime failed", rdb.Filename)
+				return start, errs.RDBFileDamagedError
+			}
+			expireTime = int64(binary.BigEndian.Uint64(buf))
+			// 旧版本的RDB文件按秒存储过期时间
+			if opcode == conf.RDB_OPCODE_EXPIRETIME {
+				expireTime *= 1000
 			}
 		case conf.RDB_OPCODE_EOF:
-			return nil
+			reader.ReadByte()
+			if rdb.RDBCheckSum {
+				expectChecksum := reader.Sum()
+				buf, err := reader.ReadFull(8)
+				if err != nil {
+					rdb.log.Error().Msgf("rdb file %s checksum missing", rdb.Filename)
+					return start, errs.RDBFileDamagedError
+				}
+				getChecksum := binary.BigEndian.Uint64(buf)
+				if expectChecksum != getChecksum {
+					rdb.log.Error().Msgf("rdb file checksum not match,expect:%d,get:%d", expectChecksum, getChecksum)
+					return start, errs.RDBCheckSumError
+				}
+			}
+			return reader.Offset(), nil
 		default:
-			var key *data.Gobj
-			buffer, key, err = rdb.LoadCommand(buffer, db)
+			key, val, err := rdb.LoadCommand(reader)
 			if err != nil {
 				rdb.log.Error().Err(err).Msgf("load rdb file %s command failed", rdb.Filename)
-				return err
+				return start, err
 			}
-			if expireTime != -1 {
-				expObj := data.CreateObjectFromInt(expireTime)
-				db.Expire.Set(key, expObj)
-				expireTime = -1
+			record := &RDBRecord{Key: key, Val: val, Expire: expireTime, Offset: start, Size: reader.Offset() - start}
+			if err = fn(record); err != nil {
+				return start, err
 			}
+			expireTime = -1
+			start = reader.Offset()
 		}
 	}
 }
 
-func (rdb *RDB) checkAppName(buffer []byte) ([]byte, error) {
-	if string(buffer[:conf.RDB_APPNAME_LEN]) != conf.RDB_APPNAME {
-		rdb.log.Error().Msgf("rdb file %s is not godis rdb file", rdb.Filename)
-		return nil, errs.RDBAppNameError
+// reader是否以godis或Redis的RDB魔数开头
+func isRDBPreamble(r *bufio.Reader) bool {
+	magic, err := r.Peek(conf.RDB_APPNAME_LEN)
+	if err != nil {
+		return false
 	}
-	buffer = buffer[conf.RDB_APPNAME_LEN:]
-	return buffer, nil
+	return string(magic) == conf.RDB_APPNAME || string(magic) == conf.REDIS_RDB_MAGIC
 }
 
-func (rdb *RDB) checkVersion(buffer []byte) ([]byte, error) {
-	if string(buffer[:conf.RDB_VERSION_LEN]) != conf.RDB_VERSION {
-		rdb.log.Error().Msgf("rdb file %s version err", rdb.Filename)
-		return nil, errs.RDBVersionError
+func (rdb *RDB) checkAppName(reader *RDBReader) error {
+	buf, err := reader.ReadFull(conf.RDB_APPNAME_LEN)
+	if err != nil || string(buf) != conf.RDB_APPNAME {
+		rdb.log.Error().Msgf("rdb file %s is not godis rdb file", rdb.Filename)
+		return errs.RDBAppNameError
 	}
-	buffer = buffer[conf.RDB_VERSION_LEN:]
-	return buffer, nil
+	return nil
 }
 
-func (rdb *RDB) LoadNumber(buffer []byte) ([]byte, int, error) {
-	switch {
-	case buffer[0]>>6 == 0x00:
-		return buffer[1:], int(buffer[0]), nil
-	case buffer[0]>>6 == 0x01:
-		return buffer[2:], int(uint16(buffer[0]&0x3f)<<8 | uint16(buffer[1])), nil
-	case buffer[0]>>6 == 0x02:
-		return buffer[5:], int(uint32(buffer[1])<<24 | uint32(buffer[2])<<16 | uint32(buffer[3])<<8 | uint32(buffer[4])), nil
+// 兼容当前及更早版本的RDB文件，返回文件的版本
+func (rdb *RDB) checkVersion(reader *RDBReader) (string, error) {
+	buf, err := reader.ReadFull(conf.RDB_VERSION_LEN)
+	if err != nil || len(buf) != len(conf.RDB_VERSION) || string(buf) > conf.RDB_VERSION || string(buf) < conf.RDB_VERSION_V1 {
+		rdb.log.Error().Msgf("rdb file %s version err", rdb.Filename)
+		return "", errs.RDBVersionError
 	}
-	return nil, 0, errs.RDBLoadNumberError
+	return string(buf), nil
 }
 
-func (rdb *RDB) LoadCommand(buffer []byte, db *db.GodisDB) ([]byte, *data.Gobj, error) {
-	var key *data.Gobj
-	var err error
-	switch buffer[0] {
-	case conf.RDB_TYPE_STRING:
-		buffer, key, err = rdb.LoadString(buffer[1:], db)
+/*
+0001版本写入长度时，64~127的长度写为单字节，与双字节长度的首字节冲突，旧版本解析时首字节为01的长度一律按双字节处理，
+之后的版本修正了长度编码，增加了64位长度与特殊编码的字符串，0001版本的数据中出现时按损坏处理
+*/
+func (rdb *RDB) LoadNumber(reader *RDBReader) (int, error) {
+	c, err := reader.ReadByte()
+	if err != nil {
+		return 0, errs.RDBLoadNumberError
+	}
+	switch c >> 6 {
+	case 0x00:
+		return int(c), nil
+	case 0x01:
+		next, err := reader.ReadByte()
 		if err != nil {
-			rdb.log.Error().Err(err).Msg("load string value failed")
-			return nil, nil, errs.RDBLoadFailedError
+			return 0, errs.RDBLoadNumberError
 		}
-	case conf.RDB_TYPE_LIST:
-		buffer, key, err = rdb.LoadList(buffer[1:], db)
-		if err != nil {
-			rdb.log.Error().Err(err).Msg("load list value failed")
-			return nil, nil, errs.RDBLoadFailedError
+		return int(uint16(c&0x3f)<<8 | uint16(next)), nil
+	case 0x02:
+		// 0x80后跟32位长度，0x81后跟64位长度
+		if c == 0x81 && !reader.legacy {
+			buf, err := reader.ReadFull(8)
+			if err != nil {
+				return 0, errs.RDBLoadNumberError
+			}
+			length := binary.BigEndian.Uint64(buf)
+			if length > math.MaxInt {
+				return 0, errs.RDBLoadNumberError
+			}
+			return int(length), nil
 		}
-	case conf.RDB_TYPE_HASH:
-		buffer, key, err = rdb.LoadDict(buffer[1:], db)
-		if err != nil {
-			rdb.log.Error().Err(err).Msg("load hash value failed")
-			return nil, nil, errs.RDBLoadFailedError
+		if c != 0x80 {
+			return 0, errs.RDBLoadNumberError
 		}
-	case conf.RDB_TYPE_SET:
-		buffer, key, err = rdb.LoadSet(buffer[1:], db)
+		buf, err := reader.ReadFull(4)
 		if err != nil {
-			rdb.log.Error().Err(err).Msg("load set value failed")
-			return nil, nil, errs.RDBLoadFailedError
+			return 0, errs.RDBLoadNumberError
 		}
+		return int(binary.BigEndian.Uint32(buf)), nil
+	}
+	return 0, errs.RDBLoadNumberError
+}
+
+func (rdb *RDB) LoadCommand(reader *RDBReader) (key, val *data.Gobj, err error) {
+	typ, err := reader.ReadByte()
+	if err != nil {
+		return nil, nil, errs.RDBLoadFailedError
+	}
+	key, err = rdb.LoadSDS(reader)
+	if err != nil {
+		return nil, nil, errs.RDBLoadFailedError
+	}
+	val, err = rdb.loadValue(reader, typ)
+	if err != nil {
+		rdb.log.Error().Err(err).Msgf("load value of key %s failed, type %d", key.StrVal(), typ)
+		return nil, nil, errs.RDBLoadFailedError
+	}
+	return key, val, nil
+}
+
+// 按类型读取value本身
+func (rdb *RDB) loadValue(reader *RDBReader, typ byte) (*data.Gobj, error) {
+	switch typ {
+	case conf.RDB_TYPE_STRING:
+		return rdb.LoadSDS(reader)
+	case conf.RDB_TYPE_LIST:
+		return rdb.LoadList(reader)
+	case conf.RDB_TYPE_HASH:
+		return rdb.LoadDict(reader)
+	case conf.RDB_TYPE_SET:
+		return rdb.LoadSet(reader)
 	case conf.RDB_TYPE_ZSET:
-		buffer, key, err = rdb.LoadZset(buffer[1:], db)
-		if err != nil {
-			rdb.log.Error().Err(err).Msg("load zset value failed")
-			return nil, nil, errs.RDBLoadFailedError
-		}
+		return rdb.LoadZset(reader)
 	case conf.RDB_TYPE_BIT:
-		buffer, key, err = rdb.LoadBitmap(buffer[1:], db)
-		if err != nil {
-			rdb.log.Error().Err(err).Msg("load bitmap value failed")
-			return nil, nil, errs.RDBLoadFailedError
-		}
+		return rdb.LoadBitmap(reader)
 	default:
-		return nil, nil, errs.RDBLoadFailedError
+		return nil, errs.RDBUnsupportedTypeError
 	}
-
-	return buffer, key, nil
 }
 
-func (rdb *RDB) LoadSDS(buffer []byte) ([]byte, *data.Gobj, error) {
-	buffer, length, err := rdb.LoadNumber(buffer)
+func (rdb *RDB) LoadSDS(reader *RDBReader) (*data.Gobj, error) {
+	c, err := reader.PeekByte()
 	if err != nil {
-		return nil, nil, err
+		return nil, errs.RDBLoadFailedError
 	}
-	if len(buffer) < length {
-		return nil, nil, errs.RDBLoadFailedError
+	if c>>6 == conf.RDB_ENCVAL && !reader.legacy {
+		return rdb.loadEncodedString(reader)
+	}
+	length, err := rdb.LoadNumber(reader)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := reader.ReadFull(length)
+	if err != nil {
+		return nil, errs.RDBLoadFailedError
 	}
-	val := string(buffer[:length])
 	sds := &data.Gobj{
 		Type_: conf.GSTR,
-		Val_:  val,
+		Val_:  string(buf),
 	}
-
-	buffer = buffer[length:]
-	return buffer, sds, nil
+	return sds, nil
 }
 
-func (rdb *RDB) LoadString(buffer []byte, db *db.GodisDB) ([]byte, *data.Gobj, error) {
-	buffer, key, err := rdb.LoadSDS(buffer)
+func (rdb *RDB) loadEncodedString(reader *RDBReader) (*data.Gobj, error) {
+	c, err := reader.ReadByte()
 	if err != nil {
-		return nil, nil, errs.RDBLoadFailedError
+		return nil, errs.RDBLoadFailedError
+	}
+	switch c & 0x3f {
+	case conf.RDB_ENC_INT8, conf.RDB_ENC_INT16, conf.RDB_ENC_INT32:
+		buf, err := reader.ReadFull(1 << (c & 0x3f))
+		if err != nil {
+			return nil, errs.RDBLoadFailedError
+		}
+		return data.CreateObjectFromInt(littleEndianInt(buf)), nil
+	case conf.RDB_ENC_LZF:
+	default:
+		return nil, errs.RDBLoadFailedError
 	}
-	buffer, val, err := rdb.LoadSDS(buffer)
+	clen, err := rdb.LoadNumber(reader)
 	if err != nil {
-		return nil, nil, errs.RDBLoadFailedError
+		return nil, err
 	}
-	db.Data.Set(key, val)
-	return buffer, key, nil
-}
-
-func (rdb *RDB) LoadList(buffer []byte, db *db.GodisDB) ([]byte, *data.Gobj, error) {
-	buffer, key, err := rdb.LoadSDS(buffer)
+	length, err := rdb.LoadNumber(reader)
 	if err != nil {
-		return nil, nil, errs.RDBLoadFailedError
+		return nil, err
+	}
+	compressed, err := reader.ReadFull(clen)
+	if err != nil {
+		return nil, errs.RDBLoadFailedError
+	}
+	buf, err := util.LzfDecompress(compressed, length)
+	if err != nil {
+		return nil, err
 	}
+	return &data.Gobj{Type_: conf.GSTR, Val_: string(buf)}, nil
+}
 
-	buffer, length, err := rdb.LoadNumber(buffer)
+func (rdb *RDB) LoadList(reader *RDBReader) (*data.Gobj, error) {
+	length, err := rdb.LoadNumber(reader)
 	if err != nil {
-		return nil, nil, errs.RDBLoadFailedError
+		return nil, errs.RDBLoadFailedError
 	}
 
 	list := data.ListCreate(data.ListType{EqualFunc: data.GStrEqual})
 	var val *data.Gobj
 	for i := 0; i < length; i++ {
-		buffer, val, err = rdb.LoadSDS(buffer)
+		val, err = rdb.LoadSDS(reader)
 		if err != nil {
-			return nil, nil, errs.RDBLoadFailedError
+			return nil, errs.RDBLoadFailedError
 		}
 		list.Append(val)
 	}
-	listObj := data.CreateObject(conf.GLIST, list)
-
-	db.Data.Set(key, listObj)
-	return buffer, key, nil
+	return data.CreateObject(conf.GLIST, list), nil
 }
 
-func (rdb *RDB) LoadDict(buffer []byte, db *db.GodisDB) ([]byte, *data.Gobj, error) {
-	buffer, key, err := rdb.LoadSDS(buffer)
-	if err != nil {
-		return nil, nil, errs.RDBLoadFailedError
-	}
-
-	buffer, length, err := rdb.LoadNumber(buffer)
+func (rdb *RDB) LoadDict(reader *RDBReader) (*data.Gobj, error) {
+	length, err := rdb.LoadNumber(reader)
 	if err != nil {
-		return nil, nil, errs.RDBLoadFailedError
+		return nil, errs.RDBLoadFailedError
 	}
 
 	dict := data.DictCreate()
 	var k, v *data.Gobj
 	for i := 0; i < length; i++ {
-		buffer, k, err = rdb.LoadSDS(buffer)
+		k, err = rdb.LoadSDS(reader)
 		if err != nil {
-			return nil, nil, errs.RDBLoadFailedError
+			return nil, errs.RDBLoadFailedError
 		}
-		buffer, v, err = rdb.LoadSDS(buffer)
+		v, err = rdb.LoadSDS(reader)
 		if err != nil {
-			return nil, nil, errs.RDBLoadFailedError
+			return nil, errs.RDBLoadFailedError
 		}
 		dict.Set(k, v)
 	}
-	dictObj := data.CreateObject(conf.GDICT, dict)
-
-	db.Data.Set(key, dictObj)
-	return buffer, key, nil
+	return data.CreateObject(conf.GDICT, dict), nil
 }
 
-func (rdb *RDB) LoadSet(buffer []byte, db *db.GodisDB) ([]byte, *data.Gobj, error) {
-	buffer, key, err := rdb.LoadSDS(buffer)
-	if err != nil {
-		return nil, nil, errs.RDBLoadFailedError
-	}
-
-	buffer, length, err := rdb.LoadNumber(buffer)
+func (rdb *RDB) LoadSet(reader *RDBReader) (*data.Gobj, error) {
+	length, err := rdb.LoadNumber(reader)
 	if err != nil {
-		return nil, nil, errs.RDBLoadFailedError
+		return nil, errs.RDBLoadFailedError
 	}
 	set := data.SetCreate()
 	var k *data.Gobj
 	for i := 0; i < length; i++ {
-		buffer, k, err = rdb.LoadSDS(buffer)
+		k, err = rdb.LoadSDS(reader)
 		if err != nil {
-			return nil, nil, errs.RDBLoadFailedError
+			return nil, errs.RDBLoadFailedError
 		}
 		set.SAdd(k)
 	}
-	setObj := data.CreateObject(conf.GSET, set)
-
-	db.Data.Set(key, setObj)
-	return buffer, key, nil
+	return data.CreateObject(conf.GSET, set), nil
 }
 
-func (rdb *RDB) LoadZset(buffer []byte, db *db.GodisDB) ([]byte, *data.Gobj, error) {
-	buffer, key, err := rdb.LoadSDS(buffer)
+func (rdb *RDB) LoadZset(reader *RDBReader) (*data.Gobj, error) {
+	length, err := rdb.LoadNumber(reader)
 	if err != nil {
-		return nil, nil, errs.RDBLoadFailedError
-	}
-
-	buffer, length, err := rdb.LoadNumber(buffer)
-	if err != nil {
-		return nil, nil, errs.RDBLoadFailedError
+		return nil, errs.RDBLoadFailedError
 	}
 
 	zset := data.NewZset()
 
 	var k, score *data.Gobj
 	for i := 0; i < length; i++ {
-		buffer, k, err = rdb.LoadSDS(buffer)
+		k, err = rdb.LoadSDS(reader)
 		if err != nil {
-			return nil, nil, errs.RDBLoadFailedError
+			return nil, errs.RDBLoadFailedError
 		}
-		buffer, score, err = rdb.LoadSDS(buffer)
+		score, err = rdb.LoadSDS(reader)
 		if err != nil {
-			return nil, nil, errs.RDBLoadFailedError
+			return nil, errs.RDBLoadFailedError
+		}
+		if _, err = zset.Zadd([]*data.Gobj{score, k}); err != nil {
+			return nil, errs.RDBLoadFailedError
 		}
-		zset.Zadd([]*data.Gobj{k, score})
 	}
-	zsetObj := data.CreateObject(conf.GZSET, zset)
-
-	db.Data.Set(key, zsetObj)
-	return buffer, key, nil
+	return data.CreateObject(conf.GZSET, zset), nil
 }
 
-func (rdb *RDB) LoadBitmap(buffer []byte, db *db.GodisDB) ([]byte, *data.Gobj, error) {
-	buffer, key, err := rdb.LoadSDS(buffer)
+func (rdb *RDB) LoadBitmap(reader *RDBReader) (*data.Gobj, error) {
+	length, err := rdb.LoadNumber(reader)
 	if err != nil {
-		return nil, nil, errs.RDBLoadFailedError
+		return nil, errs.RDBLoadFailedError
 	}
 
-	buffer, length, err := rdb.LoadNumber(buffer)
+	buf, err := reader.ReadFull(length)
 	if err != nil {
-		return nil, nil, errs.RDBLoadFailedError
+		return nil, errs.RDBLoadFailedError
 	}
-
 	bitmap := data.BitmapCreate()
-	bitmap.Bytes = buffer[:length]
+	bitmap.Bytes = buf
 	bitmap.Len = length
-	buffer = buffer[length:]
-
-	bitmapObj := data.CreateObject(conf.GBIT, bitmap)
-
-	db.Data.Set(key, bitmapObj)
-	return buffer, key, nil
+	return data.CreateObject(conf.GBIT, bitmap), nil
 }
@@ -0,0 +1,141 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/godis/conf"
+	"github.com/godis/data"
+	"github.com/godis/db"
+	"github.com/godis/util"
+	"github.com/rs/zerolog"
+)
+
+func newTestRDB(config *conf.Config) *RDB {
+	logger := zerolog.Nop()
+	return InitRDB(config, &logger)
+}
+
+func newTestDB() *db.GodisDB {
+	return &db.GodisDB{Data: data.DictCreate(), Expire: data.DictCreate()}
+}
+
+func decodeAll(t *testing.T, rdb *RDB, buf []byte) map[string]*RDBRecord {
+	t.Helper()
+	records := make(map[string]*RDBRecord)
+	n, err := rdb.DecodeEach(bufio.NewReader(bytes.NewReader(buf)), func(record *RDBRecord) error {
+		records[record.Key.StrVal()] = record
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if n != int64(len(buf)) {
+		t.Fatalf("decoded %d bytes, want %d", n, len(buf))
+	}
+	return records
+}
+
+// 同一文件中LZF压缩的字符串与未压缩的字符串混合出现，列表元素也可以分别使用两种编码
+func TestDecodeMixedStringEncodings(t *testing.T) {
+	rdb := newTestRDB(&conf.Config{RDBCheckSum: true})
+	random := make([]byte, 200)
+	rand.New(rand.NewSource(1)).Read(random)
+	values := map[string]string{
+		"plain-short": "v",
+		"plain-long":  string(random),
+		"lzf":         strings.Repeat("compressible ", 50),
+	}
+	lzf := map[string]bool{"lzf": true}
+
+	var buf bytes.Buffer
+	writer := NewRDBWriter(&buf)
+	writer.WriteString(conf.RDB_APPNAME)
+	writer.WriteString(conf.RDB_VERSION)
+	writeString := func(s string, compress bool) {
+		if compress {
+			compressed := util.LzfCompress([]byte(s))
+			if compressed == nil {
+				t.Fatalf("%q is not compressible", s)
+			}
+			rdb.writeLzfString(writer, compressed, len(s))
+			return
+		}
+		rdb.WriteLen(writer, len(s))
+		writer.WriteString(s)
+	}
+	for key, val := range values {
+		writer.WriteByte(conf.RDB_TYPE_STRING)
+		writeString(key, false)
+		writeString(val, lzf[key])
+	}
+	items := []string{"a", strings.Repeat("x", 100), string(random), strings.Repeat("yz", 100)}
+	writer.WriteByte(conf.RDB_TYPE_LIST)
+	writeString("list", false)
+	rdb.WriteLen(writer, len(items))
+	for i, item := range items {
+		writeString(item, i%2 == 1)
+	}
+	writer.WriteByte(conf.RDB_OPCODE_EOF)
+	writer.WriteCheckSum()
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := decodeAll(t, rdb, buf.Bytes())
+	for key, val := range values {
+		record, ok := records[key]
+		if !ok {
+			t.Fatalf("key %s missing", key)
+		}
+		if got := record.Val.StrVal(); got != val {
+			t.Fatalf("key %s = %q, want %q", key, got, val)
+		}
+	}
+	list := records["list"].Val.Val_.(*data.List)
+	i := 0
+	for node := list.First(); node != nil; node = node.Next() {
+		if got := node.Val.StrVal(); got != items[i] {
+			t.Fatalf("list[%d] = %q, want %q", i, got, items[i])
+		}
+		i++
+	}
+	if i != len(items) {
+		t.Fatalf("list length %d, want %d", i, len(items))
+	}
+}
+
+// 开启压缩时由写入端决定每个字符串的编码，读取端不依赖配置
+func TestEncodeWithCompression(t *testing.T) {
+	random := make([]byte, 100)
+	rand.New(rand.NewSource(2)).Read(random)
+	source := newTestDB()
+	values := map[string]string{
+		"short":          "small",
+		"compressible":   strings.Repeat("abc", 100),
+		"incompressible": string(random),
+	}
+	for key, val := range values {
+		source.Data.Set(data.CreateObject(conf.GSTR, key), data.CreateObject(conf.GSTR, val))
+	}
+
+	var compressed, plain bytes.Buffer
+	if err := newTestRDB(&conf.Config{RDBCompression: true}).Encode(&compressed, source); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestRDB(&conf.Config{}).Encode(&plain, source); err != nil {
+		t.Fatal(err)
+	}
+	if compressed.Len() >= plain.Len() {
+		t.Fatalf("compressed rdb %d bytes, plain rdb %d bytes", compressed.Len(), plain.Len())
+	}
+	records := decodeAll(t, newTestRDB(&conf.Config{}), compressed.Bytes())
+	for key, val := range values {
+		if got := records[key].Val.StrVal(); got != val {
+			t.Fatalf("key %s = %q, want %q", key, got, val)
+		}
+	}
+}
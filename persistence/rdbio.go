@@ -0,0 +1,147 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"hash"
+	"io"
+
+	"github.com/godis/conf"
+	"github.com/godis/errs"
+	"github.com/godis/util"
+)
+
+/*
+RDB流式写入器，数据经缓冲区直接写入底层文件或连接，同时计算校验和
+写入过程中的第一个错误会被记录，之后的写入直接忽略，编码结束后统一检查
+*/
+type RDBWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash64
+	err error
+}
+
+func NewRDBWriter(w io.Writer) *RDBWriter {
+	return newRDBWriter(w, util.CheckSumHash())
+}
+
+// crc为校验和算法，Redis格式与godis格式使用的算法不同
+func newRDBWriter(w io.Writer, crc hash.Hash64) *RDBWriter {
+	return &RDBWriter{
+		w:   bufio.NewWriterSize(w, conf.RDB_BUF_BLOCK_SIZE),
+		crc: crc,
+	}
+}
+
+func (w *RDBWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.crc.Write(p)
+	n, err := w.w.Write(p)
+	w.err = err
+	return n, err
+}
+
+func (w *RDBWriter) WriteByte(c byte) error {
+	_, err := w.Write([]byte{c})
+	return err
+}
+
+func (w *RDBWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// 写入校验和，校验和本身不参与计算
+func (w *RDBWriter) WriteCheckSum() error {
+	if w.err != nil {
+		return w.err
+	}
+	_, w.err = w.w.Write(w.crc.Sum(nil))
+	return w.err
+}
+
+func (w *RDBWriter) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.w.Flush()
+	return w.err
+}
+
+// RDB流式读取器，记录已读取的字节数并计算校验和
+type RDBReader struct {
+	r      *bufio.Reader
+	crc    hash.Hash64
+	n      int64
+	legacy bool //0001版本的RDB数据，按旧规则解析长度
+}
+
+func NewRDBReader(r *bufio.Reader) *RDBReader {
+	return newRDBReader(r, util.CheckSumHash())
+}
+
+func newRDBReader(r *bufio.Reader, crc hash.Hash64) *RDBReader {
+	return &RDBReader{
+		r:   r,
+		crc: crc,
+	}
+}
+
+func (r *RDBReader) ReadByte() (byte, error) {
+	c, err := r.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	r.crc.Write([]byte{c})
+	r.n++
+	return c, nil
+}
+
+func (r *RDBReader) PeekByte() (byte, error) {
+	b, err := r.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+/*
+读取length个字节，length来自待解析的数据，可能已经损坏
+较长的数据按实际读取到的内容逐步扩容，避免按损坏的长度直接分配内存
+*/
+func (r *RDBReader) ReadFull(length int) ([]byte, error) {
+	if length < 0 {
+		return nil, errs.RDBFileDamagedError
+	}
+	if length <= conf.RDB_BUF_BLOCK_SIZE {
+		buf := make([]byte, length)
+		n, err := io.ReadFull(r.r, buf)
+		r.crc.Write(buf[:n])
+		r.n += int64(n)
+		if err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	var buf bytes.Buffer
+	n, err := io.CopyN(io.MultiWriter(&buf, r.crc), r.r, int64(length))
+	r.n += n
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 读取到目前为止的校验和
+func (r *RDBReader) Sum() uint64 {
+	return r.crc.Sum64()
+}
+
+// 已读取的字节数
+func (r *RDBReader) Offset() int64 {
+	return r.n
+}
@@ -0,0 +1,224 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"strconv"
+
+	"github.com/godis/errs"
+)
+
+// Redis紧凑编码(ziplist、listpack、intset、zipmap)的解析，结果中的整数元素转换为十进制字符串
+
+// 顺序读取字节切片，越界时记录错误并返回零值，解析结束后统一检查
+type blobReader struct {
+	buf []byte
+	pos int
+	bad bool
+}
+
+func (b *blobReader) next(n int) []byte {
+	if n < 0 || b.pos+n > len(b.buf) {
+		b.bad = true
+		b.pos = len(b.buf)
+		// 返回足够定长整数解析使用的零值
+		if n < 0 || n > 8 {
+			return nil
+		}
+		return make([]byte, n)
+	}
+	p := b.buf[b.pos : b.pos+n]
+	b.pos += n
+	return p
+}
+
+func (b *blobReader) byte() byte {
+	return b.next(1)[0]
+}
+
+// 小端序有符号整数，支持1、2、3、4、8字节
+func littleEndianInt(buf []byte) int64 {
+	var v uint64
+	for i := len(buf) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(buf[i])
+	}
+	shift := 64 - 8*len(buf)
+	return int64(v<<shift) >> shift
+}
+
+func intEntry(v int64) string {
+	return strconv.FormatInt(v, 10)
+}
+
+/*
+ziplist: <zlbytes:4> <zltail:4> <zllen:2> <entry>... <0xff>
+entry: <prevlen:1或0xfe+4> <encoding> <data>
+*/
+func ziplistEntries(zl []byte) ([]string, error) {
+	b := &blobReader{buf: zl}
+	b.next(10)
+	var entries []string
+	for !b.bad {
+		if b.pos < len(zl) && zl[b.pos] == 0xff {
+			return entries, nil
+		}
+		if b.byte() == 0xfe {
+			b.next(4)
+		}
+		enc := b.byte()
+		switch enc >> 6 {
+		case 0:
+			entries = append(entries, string(b.next(int(enc&0x3f))))
+			continue
+		case 1:
+			entries = append(entries, string(b.next(int(enc&0x3f)<<8|int(b.byte()))))
+			continue
+		case 2:
+			entries = append(entries, string(b.next(int(binary.BigEndian.Uint32(b.next(4))))))
+			continue
+		}
+		switch {
+		case enc == 0xc0:
+			entries = append(entries, intEntry(littleEndianInt(b.next(2))))
+		case enc == 0xd0:
+			entries = append(entries, intEntry(littleEndianInt(b.next(4))))
+		case enc == 0xe0:
+			entries = append(entries, intEntry(littleEndianInt(b.next(8))))
+		case enc == 0xf0:
+			entries = append(entries, intEntry(littleEndianInt(b.next(3))))
+		case enc == 0xfe:
+			entries = append(entries, intEntry(littleEndianInt(b.next(1))))
+		case enc >= 0xf1 && enc <= 0xfd:
+			// 4位立即数，取值0~12
+			entries = append(entries, intEntry(int64(enc&0x0f)-1))
+		default:
+			return nil, errs.RDBLoadFailedError
+		}
+	}
+	return nil, errs.RDBLoadFailedError
+}
+
+/*
+listpack: <total-bytes:4> <num-elements:2> <element>... <0xff>
+element: <encoding+data> <backlen>，backlen为encoding+data的长度，占1~5字节
+*/
+func listpackEntries(lp []byte) ([]string, error) {
+	b := &blobReader{buf: lp}
+	b.next(6)
+	var entries []string
+	for !b.bad {
+		enc := b.byte()
+		if b.bad {
+			break
+		}
+		if enc == 0xff {
+			return entries, nil
+		}
+		var size int
+		switch {
+		case enc&0x80 == 0:
+			entries = append(entries, intEntry(int64(enc&0x7f)))
+			size = 1
+		case enc&0xc0 == 0x80:
+			length := int(enc & 0x3f)
+			entries = append(entries, string(b.next(length)))
+			size = 1 + length
+		case enc&0xe0 == 0xc0:
+			// 13位有符号整数
+			v := int64(enc&0x1f)<<8 | int64(b.byte())
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			entries = append(entries, intEntry(v))
+			size = 2
+		case enc&0xf0 == 0xe0:
+			length := int(enc&0x0f)<<8 | int(b.byte())
+			entries = append(entries, string(b.next(length)))
+			size = 2 + length
+		case enc == 0xf0:
+			length := int(binary.LittleEndian.Uint32(b.next(4)))
+			entries = append(entries, string(b.next(length)))
+			size = 5 + length
+		case enc >= 0xf1 && enc <= 0xf4:
+			width := []int{2, 3, 4, 8}[enc-0xf1]
+			entries = append(entries, intEntry(littleEndianInt(b.next(width))))
+			size = 1 + width
+		default:
+			return nil, errs.RDBLoadFailedError
+		}
+		b.next(listpackBacklenSize(size))
+	}
+	return nil, errs.RDBLoadFailedError
+}
+
+func listpackBacklenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// intset: <encoding:4> <length:4> <contents>，encoding为每个整数的字节数
+func intsetEntries(is []byte) ([]string, error) {
+	b := &blobReader{buf: is}
+	width := int(binary.LittleEndian.Uint32(b.next(4)))
+	length := int(binary.LittleEndian.Uint32(b.next(4)))
+	if width != 2 && width != 4 && width != 8 {
+		return nil, errs.RDBLoadFailedError
+	}
+	if length > len(is)/width {
+		return nil, errs.RDBLoadFailedError
+	}
+	entries := make([]string, 0, length)
+	for i := 0; i < length && !b.bad; i++ {
+		entries = append(entries, intEntry(littleEndianInt(b.next(width))))
+	}
+	if b.bad {
+		return nil, errs.RDBLoadFailedError
+	}
+	return entries, nil
+}
+
+/*
+zipmap: <zmlen:1> <len>key<len><free>value<free个空闲字节>... <0xff>
+len为1字节，取值254时之后4字节为实际长度
+*/
+func zipmapEntries(zm []byte) ([]string, error) {
+	b := &blobReader{buf: zm}
+	b.byte()
+	var entries []string
+	readLen := func() (int, bool) {
+		c := b.byte()
+		switch c {
+		case 0xff:
+			return 0, false
+		case 0xfe:
+			return int(binary.LittleEndian.Uint32(b.next(4))), true
+		}
+		return int(c), true
+	}
+	for !b.bad {
+		length, ok := readLen()
+		if !ok {
+			if b.bad || len(entries)%2 != 0 {
+				break
+			}
+			return entries, nil
+		}
+		entries = append(entries, string(b.next(length)))
+		if length, ok = readLen(); !ok {
+			break
+		}
+		free := int(b.byte())
+		entries = append(entries, string(b.next(length)))
+		b.next(free)
+	}
+	return nil, errs.RDBLoadFailedError
+}
@@ -0,0 +1,170 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/godis/conf"
+	"github.com/godis/data"
+	"github.com/godis/util"
+)
+
+/*
+字节样例取自Redis源码注释(ziplist.c、zipmap.c)与redis.io上DUMP/RESTORE命令的示例，
+DUMP的输出带有Redis计算的CRC64，测试中先校验以确认样例未被改动，
+其余样例按intset.h与listpack规范中的格式逐字节构造
+*/
+
+type blobTest struct {
+	name string
+	blob string
+	want []string
+}
+
+func runBlobTests(t *testing.T, decode func([]byte) ([]string, error), tests []blobTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decode([]byte(tt.blob))
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("decoded %q from corrupt blob", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestZiplistEntries(t *testing.T) {
+	runBlobTests(t, ziplistEntries, []blobTest{
+		// ziplist.c中包含"2"、"5"两个元素的示例
+		{"header example", "\x0f\x00\x00\x00\x0c\x00\x00\x00\x02\x00\x00\xf3\x02\xf6\xff", []string{"2", "5"}},
+		// 在上例之后加入ziplist.c中"Hello World"的元素
+		{"string entry", "\x1c\x00\x00\x00\x0e\x00\x00\x00\x03\x00\x00\xf3\x02\xf6\x02\x0bHello World\xff", []string{"2", "5", "Hello World"}},
+		// 整数编码: int16、int32、int64、int24、int8
+		{"integers", "\x00\x00\x00\x00\x00\x00\x00\x00\x05\x00" +
+			"\x00\xc0\xfe\xff" +
+			"\x04\xd0\xa0\x86\x01\x00" +
+			"\x06\xe0\xff\xff\xff\xff\xff\xff\xff\xff" +
+			"\x0a\xf0\x00\x00\x80" +
+			"\x05\xfe\x80" +
+			"\xff", []string{"-2", "100000", "-1", "-8388608", "-128"}},
+		// 14位长度的字符串，其后元素的prevlen占5字节，最后为32位长度的字符串
+		{"long entries", "\x00\x00\x00\x00\x00\x00\x00\x00\x03\x00" +
+			"\x00\x41\x2c" + strings.Repeat("a", 300) +
+			"\xfe\x2f\x01\x00\x00\xf2" +
+			"\x06\x80\x00\x00\x00\x03abc" +
+			"\xff", []string{strings.Repeat("a", 300), "1", "abc"}},
+		{"missing end", "\x0f\x00\x00\x00\x0c\x00\x00\x00\x02\x00\x00\xf3\x02\xf6", nil},
+		{"truncated string", "\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x05ab", nil},
+		{"bad encoding", "\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\xc1\xff", nil},
+		{"truncated header", "\x0f\x00\x00", nil},
+	})
+}
+
+func TestListpackEntries(t *testing.T) {
+	runBlobTests(t, listpackEntries, []blobTest{
+		{"small", "\x10\x00\x00\x00\x02\x00" + "\x0a\x01" + "\x85hello\x06" + "\xff", []string{"10", "hello"}},
+		{"integers", "\x00\x00\x00\x00\x06\x00" +
+			"\xdf\xff\x02" + //13位整数-1
+			"\xcf\xa0\x02" + //13位整数4000
+			"\xf1\x30\x75\x03" +
+			"\xf2\x60\x79\xfe\x04" +
+			"\xf3\xff\xff\xff\x7f\x05" +
+			"\xf4\x00\x00\x00\x00\x00\x00\x00\x80\x09" +
+			"\xff", []string{"-1", "4000", "30000", "-100000", "2147483647", "-9223372036854775808"}},
+		// 12位长度的字符串backlen占2字节
+		{"strings", "\x00\x00\x00\x00\x02\x00" +
+			"\xe0\xc8" + strings.Repeat("b", 200) + "\x01\xca" +
+			"\xf0\x03\x00\x00\x00xyz\x08" +
+			"\xff", []string{strings.Repeat("b", 200), "xyz"}},
+		{"missing end", "\x10\x00\x00\x00\x02\x00\x0a\x01\x85hello\x06", nil},
+		{"truncated string", "\x00\x00\x00\x00\x01\x00\x85he", nil},
+		{"bad encoding", "\x00\x00\x00\x00\x01\x00\xf5\x01\xff", nil},
+	})
+}
+
+func TestIntsetEntries(t *testing.T) {
+	runBlobTests(t, intsetEntries, []blobTest{
+		{"int16", "\x02\x00\x00\x00\x03\x00\x00\x00\x01\x00\x02\x00\x03\x00", []string{"1", "2", "3"}},
+		{"int32", "\x04\x00\x00\x00\x02\x00\x00\x00\xff\xff\xff\xff\x00\x00\x01\x00", []string{"-1", "65536"}},
+		{"int64", "\x08\x00\x00\x00\x02\x00\x00\x00\xfb\xff\xff\xff\xff\xff\xff\xff\x00\x00\x00\x00\x00\x01\x00\x00", []string{"-5", "1099511627776"}},
+		{"empty", "\x02\x00\x00\x00\x00\x00\x00\x00", []string{}},
+		{"bad encoding", "\x03\x00\x00\x00\x01\x00\x00\x00\x01\x00\x00", nil},
+		{"length too large", "\x02\x00\x00\x00\xff\x00\x00\x00\x01\x00", nil},
+		{"truncated", "\x02\x00\x00\x00\x02\x00\x00\x00\x01\x00\x02", nil},
+	})
+}
+
+func TestZipmapEntries(t *testing.T) {
+	runBlobTests(t, zipmapEntries, []blobTest{
+		// zipmap.c中"foo" => "bar", "hello" => "world"的示例
+		{"header example", "\x02\x03foo\x03\x00bar\x05hello\x05\x00world\xff", []string{"foo", "bar", "hello", "world"}},
+		// 值之后有2个空闲字节
+		{"free bytes", "\x01\x01a\x01\x02b\x00\x00\xff", []string{"a", "b"}},
+		{"long value", "\x01\x01k\xfe\x2c\x01\x00\x00\x00" + strings.Repeat("v", 300) + "\xff", []string{"k", strings.Repeat("v", 300)}},
+		{"missing end", "\x01\x03foo\x03\x00bar", nil},
+		{"key without value", "\x01\x03foo\xff", nil},
+	})
+}
+
+// redis.io上DUMP与RESTORE命令示例的输出，放入Redis格式的RDB文件中解析
+func TestDecodeRedisDumpPayloads(t *testing.T) {
+	payloads := []struct {
+		key     string
+		payload string
+	}{
+		{"mykey", "\x00\xc0\n\n\x00n\x9fWE\x0e\xaec\xbb"},
+		{"list", "\n\x17\x17\x00\x00\x00\x12\x00\x00\x00\x03\x00\x00\xc0\x01\x00\x04\xc0\x02\x00\x04\xc0\x03\x00\xff\x04\x00u#<\xc0;.\xe9\xdd"},
+	}
+	rdb := newTestRDB(&conf.Config{RDBCheckSum: true})
+	var buf bytes.Buffer
+	buf.WriteString(conf.REDIS_RDB_MAGIC + "0009")
+	for _, p := range payloads {
+		// 类型 + 值 + 2字节RDB版本 + 8字节CRC64
+		body, sum := p.payload[:len(p.payload)-8], binary.LittleEndian.Uint64([]byte(p.payload[len(p.payload)-8:]))
+		h := util.RedisCheckSumHash()
+		h.Write([]byte(body))
+		if h.Sum64() != sum {
+			t.Fatalf("payload of %s checksum %#x, want %#x", p.key, h.Sum64(), sum)
+		}
+		buf.WriteByte(body[0])
+		buf.WriteByte(byte(len(p.key)))
+		buf.WriteString(p.key)
+		buf.WriteString(body[1 : len(body)-2])
+	}
+	// zipmap.c示例作为旧版本的哈希
+	buf.WriteString("\x09\x04hash\x18\x02\x03foo\x03\x00bar\x05hello\x05\x00world\xff")
+	buf.WriteByte(conf.REDIS_RDB_OPCODE_EOF)
+	h := util.RedisCheckSumHash()
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+
+	records := decodeAll(t, rdb, buf.Bytes())
+	if got := records["mykey"].Val.StrVal(); got != "10" {
+		t.Fatalf("mykey = %q, want 10", got)
+	}
+	var items []string
+	for node := records["list"].Val.Val_.(*data.List).First(); node != nil; node = node.Next() {
+		items = append(items, node.Val.StrVal())
+	}
+	if !reflect.DeepEqual(items, []string{"1", "2", "3"}) {
+		t.Fatalf("list = %q, want [1 2 3]", items)
+	}
+	hash := records["hash"].Val.Val_.(*data.Dict)
+	for field, val := range map[string]string{"foo": "bar", "hello": "world"} {
+		if got := hash.Get(data.CreateObject(conf.GSTR, field)); got == nil || got.StrVal() != val {
+			t.Fatalf("hash field %s = %v, want %s", field, got, val)
+		}
+	}
+}
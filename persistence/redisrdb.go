@@ -0,0 +1,489 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/godis/conf"
+	"github.com/godis/data"
+	"github.com/godis/db"
+	"github.com/godis/errs"
+	"github.com/godis/util"
+)
+
+/*
+Redis兼容的RDB格式，用于从Redis的dump.rdb导入数据，或导出Redis可以加载的快照
+导出时只使用各版本Redis都能加载的基础类型，位图以字符串形式导出
+导入时支持ziplist、listpack、intset、quicklist等紧凑编码，不支持stream、module与带字段过期时间的hash
+godis只有一个数据库，Redis中非0号数据库的键会被跳过
+*/
+func (rdb *RDB) encodeRedis(w io.Writer, db *db.GodisDB) error {
+	writer := newRDBWriter(w, util.RedisCheckSumHash())
+	writer.WriteString(conf.REDIS_RDB_MAGIC)
+	writer.WriteString(conf.REDIS_RDB_VERSION)
+	rdb.writeAux(writer, "redis-ver", conf.REDIS_RDB_COMPAT_VER)
+	rdb.writeAux(writer, "redis-bits", strconv.Itoa(strconv.IntSize))
+	rdb.writeAux(writer, "ctime", strconv.FormatInt(util.GetTime(), 10))
+
+	Gobjs := db.Data.IterateDict()
+	writer.WriteByte(conf.REDIS_RDB_OPCODE_SELECTDB)
+	rdb.WriteLen(writer, 0)
+	writer.WriteByte(conf.REDIS_RDB_OPCODE_RESIZEDB)
+	rdb.WriteLen(writer, len(Gobjs))
+	rdb.WriteLen(writer, len(db.Expire.IterateDict()))
+
+	for _, obj := range Gobjs {
+		key, val := obj[0], obj[1]
+		if err := rdb.persistRedis(db, writer, key, val); err != nil {
+			rdb.log.Error().Err(err).Msgf("persist key:%s failed", key.StrVal())
+		}
+	}
+
+	writer.WriteByte(conf.REDIS_RDB_OPCODE_EOF)
+	// 校验和为0表示未开启校验，Redis加载时会跳过检查
+	if rdb.RDBCheckSum {
+		writer.WriteCheckSum()
+	} else {
+		writer.Write(make([]byte, 8))
+	}
+	return writer.Flush()
+}
+
+func (rdb *RDB) writeAux(writer *RDBWriter, key, val string) {
+	writer.WriteByte(conf.REDIS_RDB_OPCODE_AUX)
+	rdb.writeRawString(writer, key)
+	rdb.writeRawString(writer, val)
+}
+
+func (rdb *RDB) persistRedis(db *db.GodisDB, writer *RDBWriter, key, val *data.Gobj) error {
+	var typ byte
+	switch val.Type_ {
+	case conf.GSTR, conf.GBIT:
+		typ = conf.REDIS_RDB_TYPE_STRING
+	case conf.GLIST:
+		typ = conf.REDIS_RDB_TYPE_LIST
+	case conf.GSET:
+		typ = conf.REDIS_RDB_TYPE_SET
+	case conf.GZSET:
+		typ = conf.REDIS_RDB_TYPE_ZSET_2
+	case conf.GDICT:
+		typ = conf.REDIS_RDB_TYPE_HASH
+	default:
+		return errs.TypeCheckError
+	}
+
+	if expireKey := db.Expire.Get(key); expireKey != nil {
+		expireTime, err := expireKey.Int64Val()
+		if err != nil {
+			rdb.log.Error().Err(err).Msgf("get expire key %s failed", key.StrVal())
+		} else {
+			writer.WriteByte(conf.REDIS_RDB_OPCODE_EXPIRETIME_MS)
+			writer.Write(binary.LittleEndian.AppendUint64(nil, uint64(expireTime)))
+		}
+	}
+	writer.WriteByte(typ)
+	rdb.WriteString(writer, key)
+
+	switch val.Type_ {
+	case conf.GSTR:
+		rdb.WriteString(writer, val)
+	case conf.GBIT:
+		bitmap := val.Val_.(*data.Bitmap)
+		rdb.writeRawString(writer, string(bitmap.Bytes[:bitmap.Len]))
+	case conf.GLIST:
+		list := val.Val_.(*data.List)
+		rdb.WriteLen(writer, list.Length())
+		for node := list.First(); node != nil; node = node.Next() {
+			rdb.WriteString(writer, node.Val)
+		}
+	case conf.GSET:
+		members := val.Val_.(*data.Set).Dict.IterateDict()
+		rdb.WriteLen(writer, len(members))
+		for _, member := range members {
+			rdb.WriteString(writer, member[0])
+		}
+	case conf.GZSET:
+		members := val.Val_.(*data.ZSet).Dict.IterateDict()
+		rdb.WriteLen(writer, len(members))
+		for _, obj := range members {
+			score, err := obj[1].ParseFloat()
+			if err != nil {
+				return err
+			}
+			rdb.WriteString(writer, obj[0])
+			writer.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(score)))
+		}
+	case conf.GDICT:
+		fields := val.Val_.(*data.Dict).IterateDict()
+		rdb.WriteLen(writer, len(fields))
+		for _, field := range fields {
+			rdb.WriteString(writer, field[0])
+			rdb.WriteString(writer, field[1])
+		}
+	}
+	return nil
+}
+
+func (rdb *RDB) decodeRedis(reader *RDBReader, fn func(record *RDBRecord) error) (int64, error) {
+	header, err := reader.ReadFull(len(conf.REDIS_RDB_MAGIC) + conf.RDB_VERSION_LEN)
+	if err != nil {
+		rdb.log.Error().Msgf("rdb file %s unexpected end", rdb.Filename)
+		return 0, errs.RDBFileDamagedError
+	}
+	version, err := strconv.Atoi(string(header[len(conf.REDIS_RDB_MAGIC):]))
+	if err != nil || version < conf.REDIS_RDB_MIN_VERSION || version > conf.REDIS_RDB_MAX_VERSION {
+		rdb.log.Error().Msgf("redis rdb file %s version %s not supported", rdb.Filename, header[len(conf.REDIS_RDB_MAGIC):])
+		return 0, errs.RDBVersionError
+	}
+
+	var expireMs int64 = -1
+	dbid, skipped := 0, 0
+	start := reader.Offset()
+	prefixed := false //已读取属于下一条记录的过期时间、LRU等操作码
+	for {
+		opcode, err := reader.ReadByte()
+		if err != nil {
+			rdb.log.Error().Err(err).Msgf("rdb file %s unexpected end", rdb.Filename)
+			return start, errs.RDBFileDamagedError
+		}
+		// 键值记录之前的过期时间、LRU等操作码属于该记录，其余操作码单独计算位置
+		if !prefixed {
+			start = reader.Offset() - 1
+		}
+		switch opcode {
+		case conf.REDIS_RDB_OPCODE_EXPIRETIME_MS, conf.REDIS_RDB_OPCODE_EXPIRETIME,
+			conf.REDIS_RDB_OPCODE_FREQ, conf.REDIS_RDB_OPCODE_IDLE:
+			prefixed = true
+		}
+		switch opcode {
+		case conf.REDIS_RDB_OPCODE_EXPIRETIME_MS:
+			buf, err := reader.ReadFull(8)
+			if err != nil {
+				return start, errs.RDBFileDamagedError
+			}
+			expireMs = int64(binary.LittleEndian.Uint64(buf))
+		case conf.REDIS_RDB_OPCODE_EXPIRETIME:
+			buf, err := reader.ReadFull(4)
+			if err != nil {
+				return start, errs.RDBFileDamagedError
+			}
+			expireMs = int64(binary.LittleEndian.Uint32(buf)) * 1000
+		case conf.REDIS_RDB_OPCODE_FREQ:
+			if _, err = reader.ReadByte(); err != nil {
+				return start, errs.RDBFileDamagedError
+			}
+		case conf.REDIS_RDB_OPCODE_IDLE:
+			if _, err = rdb.LoadNumber(reader); err != nil {
+				return start, err
+			}
+		case conf.REDIS_RDB_OPCODE_AUX:
+			key, err := rdb.LoadSDS(reader)
+			if err != nil {
+				return start, err
+			}
+			val, err := rdb.LoadSDS(reader)
+			if err != nil {
+				return start, err
+			}
+			rdb.log.Debug().Msgf("redis rdb aux field %s: %s", key.StrVal(), val.StrVal())
+		case conf.REDIS_RDB_OPCODE_RESIZEDB:
+			if _, err = rdb.LoadNumber(reader); err == nil {
+				_, err = rdb.LoadNumber(reader)
+			}
+			if err != nil {
+				return start, err
+			}
+		case conf.REDIS_RDB_OPCODE_SLOT_INFO:
+			for i := 0; i < 3 && err == nil; i++ {
+				_, err = rdb.LoadNumber(reader)
+			}
+			if err != nil {
+				return start, err
+			}
+		case conf.REDIS_RDB_OPCODE_SELECTDB:
+			if dbid, err = rdb.LoadNumber(reader); err != nil {
+				return start, err
+			}
+		case conf.REDIS_RDB_OPCODE_FUNCTION2:
+			if _, err = rdb.LoadSDS(reader); err != nil {
+				return start, err
+			}
+			rdb.log.Warn().Msg("redis functions are not supported, skipped")
+		case conf.REDIS_RDB_OPCODE_FUNCTION, conf.REDIS_RDB_OPCODE_MODULE_AUX:
+			rdb.log.Error().Msgf("redis rdb opcode %#x not supported", opcode)
+			return start, errs.RDBUnsupportedTypeError
+		case conf.REDIS_RDB_OPCODE_EOF:
+			// 版本5之前的RDB文件没有校验和
+			if version >= 5 {
+				expectChecksum := reader.Sum()
+				buf, err := reader.ReadFull(8)
+				if err != nil {
+					rdb.log.Error().Msgf("rdb file %s checksum missing", rdb.Filename)
+					return start, errs.RDBFileDamagedError
+				}
+				getChecksum := binary.LittleEndian.Uint64(buf)
+				if rdb.RDBCheckSum && getChecksum != 0 && expectChecksum != getChecksum {
+					rdb.log.Error().Msgf("rdb file checksum not match,expect:%d,get:%d", expectChecksum, getChecksum)
+					return start, errs.RDBCheckSumError
+				}
+			}
+			if skipped > 0 {
+				rdb.log.Warn().Int("keys", skipped).Msg("keys of redis databases other than 0 skipped")
+			}
+			return reader.Offset(), nil
+		default:
+			key, err := rdb.LoadSDS(reader)
+			if err != nil {
+				return start, err
+			}
+			val, err := rdb.loadRedisObject(reader, opcode)
+			if err != nil {
+				rdb.log.Error().Err(err).Msgf("load redis rdb key %s failed", key.StrVal())
+				return start, err
+			}
+			if dbid != 0 {
+				skipped++
+			} else if val != nil {
+				record := &RDBRecord{Key: key, Val: val, Expire: expireMs, Offset: start, Size: reader.Offset() - start}
+				if err = fn(record); err != nil {
+					return start, err
+				}
+			}
+			expireMs = -1
+			prefixed = false
+		}
+	}
+}
+
+// 按Redis的类型解析值，空集合返回nil
+func (rdb *RDB) loadRedisObject(reader *RDBReader, typ byte) (*data.Gobj, error) {
+	switch typ {
+	case conf.REDIS_RDB_TYPE_STRING:
+		return rdb.LoadSDS(reader)
+	case conf.REDIS_RDB_TYPE_LIST, conf.REDIS_RDB_TYPE_SET:
+		items, err := rdb.loadRedisStrings(reader, 1)
+		if err != nil {
+			return nil, err
+		}
+		if typ == conf.REDIS_RDB_TYPE_LIST {
+			return createListObject(items), nil
+		}
+		return createSetObject(items), nil
+	case conf.REDIS_RDB_TYPE_HASH:
+		items, err := rdb.loadRedisStrings(reader, 2)
+		if err != nil {
+			return nil, err
+		}
+		return createHashObject(items)
+	case conf.REDIS_RDB_TYPE_ZSET, conf.REDIS_RDB_TYPE_ZSET_2:
+		return rdb.loadRedisZset(reader, typ)
+	case conf.REDIS_RDB_TYPE_LIST_QUICKLIST, conf.REDIS_RDB_TYPE_LIST_QUICKLIST_2:
+		return rdb.loadRedisQuicklist(reader, typ)
+	}
+
+	// 其余类型的值都是单个字符串形式的紧凑编码
+	var decode func([]byte) ([]string, error)
+	switch typ {
+	case conf.REDIS_RDB_TYPE_HASH_ZIPMAP:
+		decode = zipmapEntries
+	case conf.REDIS_RDB_TYPE_LIST_ZIPLIST, conf.REDIS_RDB_TYPE_ZSET_ZIPLIST, conf.REDIS_RDB_TYPE_HASH_ZIPLIST:
+		decode = ziplistEntries
+	case conf.REDIS_RDB_TYPE_SET_INTSET:
+		decode = intsetEntries
+	case conf.REDIS_RDB_TYPE_HASH_LISTPACK, conf.REDIS_RDB_TYPE_ZSET_LISTPACK, conf.REDIS_RDB_TYPE_SET_LISTPACK:
+		decode = listpackEntries
+	default:
+		rdb.log.Error().Msgf("redis rdb type %d not supported", typ)
+		return nil, errs.RDBUnsupportedTypeError
+	}
+	blob, err := rdb.LoadSDS(reader)
+	if err != nil {
+		return nil, err
+	}
+	items, err := decode([]byte(blob.StrVal()))
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case conf.REDIS_RDB_TYPE_LIST_ZIPLIST:
+		return createListObject(items), nil
+	case conf.REDIS_RDB_TYPE_SET_INTSET, conf.REDIS_RDB_TYPE_SET_LISTPACK:
+		return createSetObject(items), nil
+	case conf.REDIS_RDB_TYPE_ZSET_ZIPLIST, conf.REDIS_RDB_TYPE_ZSET_LISTPACK:
+		return createZsetObject(items)
+	default:
+		return createHashObject(items)
+	}
+}
+
+// 读取长度n及之后的n*width个字符串
+func (rdb *RDB) loadRedisStrings(reader *RDBReader, width int) ([]string, error) {
+	length, err := rdb.LoadNumber(reader)
+	if err != nil {
+		return nil, err
+	}
+	// 长度可能已经损坏，不按长度预先分配
+	var items []string
+	for i := 0; i < length; i++ {
+		for j := 0; j < width; j++ {
+			item, err := rdb.LoadSDS(reader)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item.StrVal())
+		}
+	}
+	return items, nil
+}
+
+func (rdb *RDB) loadRedisZset(reader *RDBReader, typ byte) (*data.Gobj, error) {
+	length, err := rdb.LoadNumber(reader)
+	if err != nil {
+		return nil, err
+	}
+	var items []string
+	for i := 0; i < length; i++ {
+		member, err := rdb.LoadSDS(reader)
+		if err != nil {
+			return nil, err
+		}
+		var score float64
+		if typ == conf.REDIS_RDB_TYPE_ZSET_2 {
+			buf, err := reader.ReadFull(8)
+			if err != nil {
+				return nil, errs.RDBLoadFailedError
+			}
+			score = math.Float64frombits(binary.LittleEndian.Uint64(buf))
+		} else if score, err = rdb.loadRedisDoubleValue(reader); err != nil {
+			return nil, err
+		}
+		if math.IsNaN(score) {
+			return nil, errs.RDBLoadFailedError
+		}
+		items = append(items, member.StrVal(), formatScore(score))
+	}
+	return createZsetObject(items)
+}
+
+// 旧版zset的分数以字符串保存，首字节253、254、255分别表示NaN、+inf、-inf
+func (rdb *RDB) loadRedisDoubleValue(reader *RDBReader) (float64, error) {
+	length, err := reader.ReadByte()
+	if err != nil {
+		return 0, errs.RDBLoadFailedError
+	}
+	switch length {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf, err := reader.ReadFull(int(length))
+	if err != nil {
+		return 0, errs.RDBLoadFailedError
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+func (rdb *RDB) loadRedisQuicklist(reader *RDBReader, typ byte) (*data.Gobj, error) {
+	length, err := rdb.LoadNumber(reader)
+	if err != nil {
+		return nil, err
+	}
+	var items []string
+	for i := 0; i < length; i++ {
+		container := conf.REDIS_QUICKLIST_NODE_PACKED
+		if typ == conf.REDIS_RDB_TYPE_LIST_QUICKLIST_2 {
+			if container, err = rdb.LoadNumber(reader); err != nil {
+				return nil, err
+			}
+		}
+		blob, err := rdb.LoadSDS(reader)
+		if err != nil {
+			return nil, err
+		}
+		if container == conf.REDIS_QUICKLIST_NODE_PLAIN {
+			items = append(items, blob.StrVal())
+			continue
+		}
+		decode := ziplistEntries
+		if typ == conf.REDIS_RDB_TYPE_LIST_QUICKLIST_2 {
+			decode = listpackEntries
+		}
+		entries, err := decode([]byte(blob.StrVal()))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, entries...)
+	}
+	return createListObject(items), nil
+}
+
+func createListObject(items []string) *data.Gobj {
+	if len(items) == 0 {
+		return nil
+	}
+	list := data.ListCreate(data.ListType{EqualFunc: data.GStrEqual})
+	for _, item := range items {
+		list.Append(data.CreateObject(conf.GSTR, item))
+	}
+	return data.CreateObject(conf.GLIST, list)
+}
+
+func createSetObject(items []string) *data.Gobj {
+	if len(items) == 0 {
+		return nil
+	}
+	set := data.SetCreate()
+	for _, item := range items {
+		set.SAdd(data.CreateObject(conf.GSTR, item))
+	}
+	return data.CreateObject(conf.GSET, set)
+}
+
+// items为交替出现的field与value
+func createHashObject(items []string) (*data.Gobj, error) {
+	if len(items)%2 != 0 {
+		return nil, errs.RDBLoadFailedError
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	dict := data.DictCreate()
+	for i := 0; i < len(items); i += 2 {
+		dict.Set(data.CreateObject(conf.GSTR, items[i]), data.CreateObject(conf.GSTR, items[i+1]))
+	}
+	return data.CreateObject(conf.GDICT, dict), nil
+}
+
+// items为交替出现的member与score
+func createZsetObject(items []string) (*data.Gobj, error) {
+	if len(items)%2 != 0 {
+		return nil, errs.RDBLoadFailedError
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	zset := data.NewZset()
+	for i := 0; i < len(items); i += 2 {
+		member := data.CreateObject(conf.GSTR, items[i])
+		score := data.CreateObject(conf.GSTR, items[i+1])
+		if _, err := zset.Zadd([]*data.Gobj{score, member}); err != nil {
+			return nil, errs.RDBLoadFailedError
+		}
+	}
+	return data.CreateObject(conf.GZSET, zset), nil
+}
+
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
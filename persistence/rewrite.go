@@ -0,0 +1,307 @@
+package persistence
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/godis/conf"
+	"github.com/godis/data"
+	"github.com/godis/db"
+	"github.com/godis/errs"
+	"github.com/godis/util"
+)
+
+func (aof *AOF) IsRewriting() bool {
+	return aof.rewriting
+}
+
+// 判断AOF文件是否增长到需要自动重写
+func (aof *AOF) NeedRewrite() bool {
+	if !aof.AppendOnly || aof.rewriting || aof.RewritePercentage <= 0 {
+		return false
+	}
+	if aof.CurrentSize < aof.RewriteMinSize {
+		return false
+	}
+	base := aof.BaseSize
+	if base <= 0 {
+		base = 1
+	}
+	growth := (aof.CurrentSize - base) * 100 / base
+	return growth >= int64(aof.RewritePercentage)
+}
+
+/*
+后台重写流程:
+1. 主线程生成当前数据集的快照，并切换到新的incr文件，之后的命令都追加到新文件
+2. 后台goroutine将快照写成新的base文件
+3. 主线程在ServerCron中检测到重写完成后，更新清单文件，并删除旧的base与incr文件
+*/
+func (aof *AOF) BgRewrite(db *db.GodisDB) error {
+	if aof.rewriting {
+		return errs.AOFIsRewritingError
+	}
+	if !aof.AppendOnly || aof.manifest == nil {
+		return errs.AOFDisabledError
+	}
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	if err := aof.prepareRewrite(); err != nil {
+		db.ReleaseSnapshot()
+		return err
+	}
+
+	aof.rewriteSource = db
+	aof.rewriteDone = make(chan error, 1)
+	aof.rewriting = true
+	aof.logEntry.Info().Msg("background append only file rewriting started")
+
+	go func(filename string) {
+		aof.rewriteDone <- aof.rewrite(snapshot, filename)
+	}(aof.rewriteTemp)
+	return nil
+}
+
+// 在主线程中同步重写，用于启动时按时间点恢复后生成新的base文件
+func (aof *AOF) Rewrite(db *db.GodisDB) error {
+	if aof.rewriting {
+		return errs.AOFIsRewritingError
+	}
+	if !aof.AppendOnly || aof.manifest == nil {
+		return errs.AOFDisabledError
+	}
+	if err := aof.prepareRewrite(); err != nil {
+		return err
+	}
+	if err := aof.rewrite(db, aof.rewriteTemp); err != nil {
+		os.Remove(aof.rewriteTemp)
+		return err
+	}
+	return aof.installRewriteFile()
+}
+
+// 切换到新的incr文件，重写完成后之前的incr文件均可删除
+func (aof *AOF) prepareRewrite() error {
+	if err := aof.rotateIncrFile(); err != nil {
+		aof.logEntry.Error().Err(err).Msg("open new incr aof file failed")
+		return err
+	}
+	aof.rewriteIncrSeq = aof.manifest.incrSeq
+	aof.rewriteTemp = fmt.Sprintf("%s%srewriteaof-%d.aof", aof.Dirname, AOF_TEMP_PREFIX, util.GetMsTime())
+	return nil
+}
+
+// 检查后台重写是否完成，完成则启用新的base文件
+func (aof *AOF) DoneRewrite() {
+	if !aof.rewriting {
+		return
+	}
+	select {
+	case err := <-aof.rewriteDone:
+		aof.rewriting = false
+		aof.rewriteSource.ReleaseSnapshot()
+		aof.rewriteSource = nil
+		if err == nil {
+			err = aof.installRewriteFile()
+		}
+		aof.LastRewriteErr = err
+		if err != nil {
+			aof.logEntry.Error().Err(err).Msg("background append only file rewriting failed")
+			os.Remove(aof.rewriteTemp)
+		} else {
+			aof.logEntry.Info().Int64("size", aof.BaseSize).Msg("background append only file rewriting terminated with success")
+		}
+	default:
+	}
+}
+
+func (aof *AOF) installRewriteFile() error {
+	m := aof.manifest.dup()
+	m.baseSeq++
+	m.base = &aofInfo{name: aof.baseName(m.baseSeq), seq: m.baseSeq, typ: AOF_FILE_TYPE_BASE}
+
+	// 重写开始前的incr文件已包含在新的base中
+	history := make([]*aofInfo, 0, len(m.incrList)+1)
+	if aof.manifest.base != nil {
+		history = append(history, aof.manifest.base)
+	}
+	incrList := make([]*aofInfo, 0, len(m.incrList))
+	for _, info := range m.incrList {
+		if info.seq < aof.rewriteIncrSeq {
+			history = append(history, info)
+		} else {
+			incrList = append(incrList, info)
+		}
+	}
+	m.incrList = incrList
+
+	if err := os.Rename(aof.rewriteTemp, aof.Dirname+m.base.name); err != nil {
+		return err
+	}
+	if err := aof.persistManifest(m); err != nil {
+		os.Remove(aof.Dirname + m.base.name)
+		return err
+	}
+	aof.manifest = m
+
+	for _, info := range history {
+		if aof.historyDir != "" {
+			if err := os.Rename(aof.Dirname+info.name, aof.historyDir+info.name); err != nil {
+				aof.logEntry.Error().Err(err).Str("file", info.name).Msg("move history aof file to backup dir failed")
+			}
+			continue
+		}
+		if err := os.Remove(aof.Dirname + info.name); err != nil {
+			aof.logEntry.Error().Err(err).Str("file", info.name).Msg("remove history aof file failed")
+		}
+	}
+
+	aof.BaseSize = aof.fileSize(m.base.name)
+	aof.CurrentSize = aof.BaseSize
+	for _, info := range m.incrList {
+		aof.CurrentSize += aof.fileSize(info.name)
+	}
+	return nil
+}
+
+func (aof *AOF) rewrite(db *db.GodisDB, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		aof.logEntry.Error().Err(err).Msgf("create tempfile %s", filename)
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriterSize(file, conf.AOF_RW_BUF_BLOCK_SIZE)
+	if aof.UseRDBPreamble {
+		if err = aof.rdb.Encode(writer, db); err != nil {
+			return err
+		}
+		if err = writer.Flush(); err != nil {
+			return err
+		}
+		return file.Sync()
+	}
+
+	now := util.GetMsTime()
+	for _, obj := range db.Data.IterateDict() {
+		key, val := obj[0], obj[1]
+		var expireTime int64 = -1
+		if expireObj := db.Expire.Get(key); expireObj != nil {
+			expireTime, err = expireObj.Int64Val()
+			if err != nil {
+				aof.logEntry.Error().Err(err).Msgf("get expire key %s failed", key.StrVal())
+				expireTime = -1
+			} else if expireTime <= now {
+				// 已过期的key无需写入
+				continue
+			}
+		}
+		if err = rewriteObject(writer, key, val); err != nil {
+			aof.logEntry.Error().Err(err).Msgf("rewrite key:%s failed", key.StrVal())
+			return err
+		}
+		if expireTime != -1 {
+			writeCommand(writer, []string{"pexpireat", key.StrVal(), strconv.FormatInt(expireTime, 10)})
+		}
+	}
+
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func rewriteObject(writer *bufio.Writer, key, val *data.Gobj) error {
+	switch val.Type_ {
+	case conf.GSTR:
+		return writeCommand(writer, []string{"set", key.StrVal(), val.StrVal()})
+	case conf.GLIST:
+		list := val.Val_.(*data.List)
+		items := make([]string, 0, list.Length())
+		for node := list.First(); node != nil; node = node.Next() {
+			items = append(items, node.Val.StrVal())
+		}
+		return writeBatchCommand(writer, "rpush", key.StrVal(), items, 1)
+	case conf.GDICT:
+		dict := val.Val_.(*data.Dict)
+		objs := dict.IterateDict()
+		items := make([]string, 0, len(objs)*2)
+		for _, obj := range objs {
+			items = append(items, obj[0].StrVal(), obj[1].StrVal())
+		}
+		return writeBatchCommand(writer, "hset", key.StrVal(), items, 2)
+	case conf.GSET:
+		set := val.Val_.(*data.Set)
+		objs := set.Dict.IterateDict()
+		items := make([]string, 0, len(objs))
+		for _, obj := range objs {
+			items = append(items, obj[0].StrVal())
+		}
+		return writeBatchCommand(writer, "sadd", key.StrVal(), items, 1)
+	case conf.GZSET:
+		zset := val.Val_.(*data.ZSet)
+		objs := zset.Dict.IterateDict()
+		items := make([]string, 0, len(objs)*2)
+		for _, obj := range objs {
+			member, score := obj[0], obj[1]
+			items = append(items, score.StrVal(), member.StrVal())
+		}
+		return writeBatchCommand(writer, "zadd", key.StrVal(), items, 2)
+	case conf.GBIT:
+		bitmap := val.Val_.(*data.Bitmap)
+		written := false
+		for i, b := range bitmap.Bytes {
+			for j := data.MaxOffset; j >= 0; j-- {
+				if b>>j&1 == 1 {
+					offset := strconv.Itoa(i*8 + data.MaxOffset - j)
+					if err := writeCommand(writer, []string{"setbit", key.StrVal(), offset, "1"}); err != nil {
+						return err
+					}
+					written = true
+				}
+			}
+		}
+		// 全零的bitmap也需要保留key
+		if !written {
+			return writeCommand(writer, []string{"setbit", key.StrVal(), "0", "0"})
+		}
+		return nil
+	default:
+		return errs.TypeCheckError
+	}
+}
+
+// 集合类型按AOF_REWRITE_ITEMS_PER_CMD拆分为多条命令，step为每个元素占用的参数个数
+func writeBatchCommand(writer *bufio.Writer, cmd, key string, items []string, step int) error {
+	batch := conf.AOF_REWRITE_ITEMS_PER_CMD * step
+	for i := 0; i < len(items); i += batch {
+		end := i + batch
+		if end > len(items) {
+			end = len(items)
+		}
+		args := make([]string, 0, end-i+2)
+		args = append(args, cmd, key)
+		args = append(args, items[i:end]...)
+		if err := writeCommand(writer, args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCommand(writer *bufio.Writer, args []string) error {
+	writer.WriteString(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		writer.WriteString(fmt.Sprintf("$%d\r\n", len(arg)))
+		writer.WriteString(arg)
+		if _, err := writer.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/godis/conf"
+	"github.com/godis/net"
+	"github.com/godis/server"
+)
+
+// 与后端节点的连接，命令按发送顺序在waiting中等待回复
+type backend struct {
+	addr        string
+	fd          int //-1表示未连接
+	out         bytes.Buffer
+	in          []byte
+	readBuf     []byte //每次读取使用的缓冲区，在连接的整个生命周期中复用
+	waiting     []*subRequest
+	connecting  bool
+	lastAttempt int64
+}
+
+type backendEvent struct {
+	backend *backend
+	fd      int
+	err     error
+}
+
+var errReplyProtocol = errors.New("invalid reply from backend")
+
+// 连接后端并取出fd交给事件循环，在goroutine中执行，启动时直接调用
+func connectBackend(b *backend) *backendEvent {
+	conn, err := net.Connect(b.addr, time.Duration(conf.PROXY_CONNECT_TIMEOUT)*time.Millisecond)
+	if err != nil {
+		return &backendEvent{backend: b, fd: -1, err: err}
+	}
+	fd, err := net.DetachFd(conn)
+	return &backendEvent{backend: b, fd: fd, err: err}
+}
+
+func (p *Proxy) processBackendEvents() {
+	for {
+		select {
+		case e := <-p.events:
+			p.handleBackendEvent(e)
+		default:
+			return
+		}
+	}
+}
+
+func (p *Proxy) handleBackendEvent(e *backendEvent) {
+	b := e.backend
+	b.connecting = false
+	if e.err != nil {
+		p.logger.Warn().Err(e.err).Msgf("connect to backend %s failed", b.addr)
+		return
+	}
+	b.fd = e.fd
+	p.loop.AddReadEvent(b.fd, server.AE_READABLE, p.readFromBackend, b)
+	p.logger.Info().Msgf("connected to backend %s", b.addr)
+}
+
+// 发送子请求，后端未连接时直接以错误回复完成
+func (p *Proxy) sendToBackend(b *backend, sub *subRequest, cmd []byte) {
+	if b.fd == -1 {
+		p.completeSubRequest(sub, []byte(fmt.Sprintf("-ERR backend %s is unavailable\r\n", b.addr)))
+		return
+	}
+	if b.out.Len() == 0 {
+		p.loop.ModWriteEvent(b.fd, server.AE_WRITABLE, p.writeToBackend, b)
+	}
+	b.out.Write(cmd)
+	b.waiting = append(b.waiting, sub)
+}
+
+func (p *Proxy) writeToBackend(loop *server.AeLoop, fd int, extra any) {
+	b := extra.(*backend)
+	if b.fd != fd {
+		return
+	}
+	if b.out.Len() > 0 {
+		n, err := net.Write(fd, b.out.Bytes())
+		if err != nil {
+			p.closeBackend(b, err)
+			return
+		}
+		// 只写入了一部分时保留剩余的命令，可写事件保持注册，下一轮继续写入
+		b.out.Next(n)
+		if b.out.Len() > 0 {
+			return
+		}
+	}
+	loop.ModReadEvent(fd)
+}
+
+func (p *Proxy) readFromBackend(loop *server.AeLoop, fd int, extra any) {
+	b := extra.(*backend)
+	if b.fd != fd {
+		return
+	}
+	n, err := net.Read(fd, b.readBuf)
+	if err != nil || n == 0 {
+		if err == nil {
+			err = errors.New("connection closed by backend")
+		}
+		p.closeBackend(b, err)
+		return
+	}
+	b.in = append(b.in, b.readBuf[:n]...)
+	off := 0
+	for off < len(b.in) {
+		size, err := replyLen(b.in[off:])
+		if err == nil && size > 0 && len(b.waiting) == 0 {
+			err = errReplyProtocol
+		}
+		if err != nil {
+			p.closeBackend(b, err)
+			return
+		}
+		if size == 0 {
+			break
+		}
+		sub := b.waiting[0]
+		b.waiting[0] = nil
+		b.waiting = b.waiting[1:]
+		p.completeSubRequest(sub, append([]byte(nil), b.in[off:off+size]...))
+		off += size
+	}
+	b.in = append(b.in[:0], b.in[off:]...)
+}
+
+// 关闭与后端的连接，等待回复的命令以错误回复完成，之后由定时任务重连
+func (p *Proxy) closeBackend(b *backend, err error) {
+	p.logger.Warn().Err(err).Msgf("lost connection with backend %s", b.addr)
+	p.loop.RemoveFileEvent(b.fd)
+	net.Close(b.fd)
+	b.fd = -1
+	b.out.Reset()
+	b.in = nil
+	waiting := b.waiting
+	b.waiting = nil
+	reply := []byte(fmt.Sprintf("-ERR connection with backend %s lost\r\n", b.addr))
+	for _, sub := range waiting {
+		p.completeSubRequest(sub, reply)
+	}
+}
+
+/*
+buf开头一个完整回复的长度，回复不完整时返回0
+后端的回复原样返回给客户端，只有拆分执行的命令需要合并回复的内容
+*/
+func replyLen(buf []byte) (int, error) {
+	end := bytes.Index(buf, []byte("\r\n"))
+	if end < 0 {
+		return 0, nil
+	}
+	switch buf[0] {
+	case '+', '-', ':':
+		return end + 2, nil
+	case '$':
+		n, err := strconv.Atoi(string(buf[1:end]))
+		if err != nil {
+			return 0, errReplyProtocol
+		}
+		if n < 0 {
+			return end + 2, nil
+		}
+		if len(buf) < end+2+n+2 {
+			return 0, nil
+		}
+		return end + 2 + n + 2, nil
+	case '*':
+		n, err := strconv.Atoi(string(buf[1:end]))
+		if err != nil {
+			return 0, errReplyProtocol
+		}
+		off := end + 2
+		for i := 0; i < n; i++ {
+			size, err := replyLen(buf[off:])
+			if err != nil || size == 0 {
+				return 0, err
+			}
+			off += size
+		}
+		return off, nil
+	}
+	return 0, errReplyProtocol
+}
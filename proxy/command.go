@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/godis/conf"
+	"github.com/godis/data"
+	"github.com/godis/server"
+)
+
+// 一条客户端命令，key分布在多个后端的命令拆分为多个子请求，全部回复后合并
+type request struct {
+	client    *client
+	subs      []*subRequest
+	remaining int
+	merge     mergeFunc //为nil时只有一个子请求，回复原样返回
+	reply     []byte
+	done      bool
+}
+
+type subRequest struct {
+	req   *request
+	reply []byte
+}
+
+type mergeFunc func(replies [][]byte) []byte
+
+// 可以拆分到多个后端执行的多key命令，step为每个key及其参数占用的参数个数
+var splitCommands = map[string]struct {
+	step  int
+	merge mergeFunc
+}{
+	"del":    {1, mergeIntegers},
+	"exists": {1, mergeIntegers},
+	"mset":   {2, mergeStatus},
+}
+
+/*
+转发命令，PING、ECHO、QUIT由代理直接回复，其余命令必须带有key
+key都在同一个后端时原样转发，否则只有DEL、EXISTS、MSET按后端拆分，其他命令回复CROSSSLOT
+没有key的命令与后端的数据集无关或需要在所有后端执行，代理不支持
+*/
+func (p *Proxy) dispatch(c *client, args []*data.Gobj) {
+	name := strings.ToLower(args[0].StrVal())
+	switch name {
+	case "ping":
+		if len(args) > 2 {
+			p.addReply(c, "-ERR wrong number of arguments for 'ping' command\r\n")
+		} else if len(args) == 2 {
+			p.addReply(c, bulkString(args[1].StrVal()))
+		} else {
+			p.addReply(c, "+PONG\r\n")
+		}
+		return
+	case "echo":
+		if len(args) != 2 {
+			p.addReply(c, "-ERR wrong number of arguments for 'echo' command\r\n")
+		} else {
+			p.addReply(c, bulkString(args[1].StrVal()))
+		}
+		return
+	case "quit":
+		p.addReply(c, "+OK\r\n")
+		c.closing = true
+		return
+	}
+
+	cmd := server.LookupCommand(name)
+	if cmd == nil {
+		p.addReply(c, fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0].StrVal()))
+		return
+	}
+	if cmd.Arity() != server.MULTI_ARGS_COMMAND && cmd.Arity() != len(args) {
+		p.addReply(c, fmt.Sprintf("-ERR wrong number of arguments for '%s' command\r\n", cmd.Name()))
+		return
+	}
+	keys := cmd.GetKeys(args)
+	if len(keys) == 0 {
+		p.addReply(c, fmt.Sprintf("-ERR command '%s' is not supported in proxy mode\r\n", cmd.Name()))
+		return
+	}
+	target := p.backendOf(keys[0].StrVal())
+	single := true
+	for _, key := range keys[1:] {
+		if p.backendOf(key.StrVal()) != target {
+			single = false
+			break
+		}
+	}
+	if single {
+		req := &request{client: c, remaining: 1}
+		req.subs = []*subRequest{{req: req}}
+		c.pending = append(c.pending, req)
+		p.sendToBackend(p.backends[target], req.subs[0], encodeArgs(args))
+		return
+	}
+
+	split, ok := splitCommands[cmd.Name()]
+	if !ok || (len(args)-1)%split.step != 0 {
+		p.addReply(c, "-CROSSSLOT Keys in request don't hash to the same backend\r\n")
+		return
+	}
+	// 按后端分组，保持key在原命令中的先后顺序
+	groups := make([][]*data.Gobj, len(p.backends))
+	for i := 1; i < len(args); i += split.step {
+		b := p.backendOf(args[i].StrVal())
+		if groups[b] == nil {
+			groups[b] = []*data.Gobj{args[0]}
+		}
+		groups[b] = append(groups[b], args[i:i+split.step]...)
+	}
+	req := &request{client: c, merge: split.merge}
+	for _, group := range groups {
+		if group != nil {
+			req.subs = append(req.subs, &subRequest{req: req})
+		}
+	}
+	req.remaining = len(req.subs)
+	c.pending = append(c.pending, req)
+	i := 0
+	for b, group := range groups {
+		if group != nil {
+			p.sendToBackend(p.backends[b], req.subs[i], encodeArgs(group))
+			i++
+		}
+	}
+}
+
+// key所在的后端，哈希槽按后端数量平均分为连续的区间
+func (p *Proxy) backendOf(key string) int {
+	return server.KeyHashSlot(key) * len(p.backends) / conf.CLUSTER_SLOTS
+}
+
+func (p *Proxy) completeSubRequest(sub *subRequest, reply []byte) {
+	sub.reply = reply
+	req := sub.req
+	req.remaining--
+	if req.remaining > 0 {
+		return
+	}
+	if req.merge == nil {
+		req.reply = reply
+	} else {
+		replies := make([][]byte, len(req.subs))
+		for i, s := range req.subs {
+			replies[i] = s.reply
+		}
+		req.reply = req.merge(replies)
+	}
+	req.subs = nil
+	req.done = true
+	p.flushReplies(req.client)
+}
+
+// 整数回复求和，DEL与EXISTS的结果为各后端结果之和，任一后端出错时返回该错误
+func mergeIntegers(replies [][]byte) []byte {
+	var sum int64
+	for _, reply := range replies {
+		if reply[0] != ':' {
+			return reply
+		}
+		n, err := strconv.ParseInt(string(reply[1:len(reply)-2]), 10, 64)
+		if err != nil {
+			return []byte("-ERR invalid reply from backend\r\n")
+		}
+		sum += n
+	}
+	return []byte(fmt.Sprintf(":%d\r\n", sum))
+}
+
+// 状态回复，全部成功时回复OK，否则返回第一个错误
+func mergeStatus(replies [][]byte) []byte {
+	for _, reply := range replies {
+		if reply[0] != '+' {
+			return reply
+		}
+	}
+	return []byte("+OK\r\n")
+}
+
+func bulkString(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func encodeArgs(args []*data.Gobj) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		s := arg.StrVal()
+		buf.WriteString(fmt.Sprintf("$%d\r\n", len(s)))
+		buf.WriteString(s)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"bytes"
+
+	"github.com/godis/conf"
+	"github.com/godis/errs"
+	"github.com/godis/net"
+	"github.com/godis/server"
+	"github.com/godis/util"
+	"github.com/rs/zerolog"
+)
+
+/*
+代理，接受普通客户端的连接，按key的哈希槽将命令转发到后端节点，使不支持集群协议的客户端也能使用多个节点
+哈希槽按后端的顺序平均分为连续的区间，每个后端与代理之间只有一条连接，所有客户端的命令在这条连接上流水线发送，
+后端按发送顺序回复，代理按客户端的命令顺序返回回复
+代理与服务端共用事件循环与请求解析，所有状态只在事件循环中访问
+*/
+type Proxy struct {
+	port     int
+	fd       int
+	loop     *server.AeLoop
+	backends []*backend
+	clients  map[int]*client
+	events   chan *backendEvent //后台连接后端的结果
+	logger   *zerolog.Logger
+}
+
+// 客户端连接
+type client struct {
+	fd      int
+	parser  *server.QueryParser
+	reply   bytes.Buffer
+	pending []*request //按命令顺序等待回复的请求
+	closing bool       //QUIT之后发送完回复关闭连接
+	closed  bool
+}
+
+func New(config *conf.ProxyConfig, logger *zerolog.Logger) (*Proxy, error) {
+	if len(config.Backends) == 0 {
+		logger.Error().Msg("no backend configured")
+		return nil, errs.ProxyConfigError
+	}
+	p := &Proxy{
+		port:    config.Port,
+		clients: make(map[int]*client),
+		events:  make(chan *backendEvent, len(config.Backends)),
+		logger:  logger,
+	}
+	var err error
+	if p.loop, err = server.AeLoopCreate(logger); err != nil {
+		return nil, err
+	}
+	if p.fd, err = net.TcpServer(p.port, logger); err != nil || p.fd < 0 {
+		logger.Error().Msgf("listen on port %d failed", p.port)
+		return nil, errs.ProxyConfigError
+	}
+	for _, addr := range config.Backends {
+		b := &backend{addr: addr, fd: -1, readBuf: make([]byte, conf.GODIS_IO_BUF)}
+		p.backends = append(p.backends, b)
+		// 启动时同步连接，连接失败的后端由定时任务重连
+		b.connecting = true
+		b.lastAttempt = util.GetMsTime()
+		p.handleBackendEvent(connectBackend(b))
+	}
+	p.loop.AddReadEvent(p.fd, server.AE_READABLE, p.acceptHandler, nil)
+	p.loop.AddTimeEvent(server.AE_NORMAL, conf.PROXY_CRON_PERIOD, p.cron, nil)
+	p.loop.SetBeforeSleepProc(p.beforeSleep)
+	return p, nil
+}
+
+func (p *Proxy) Run() {
+	p.logger.Info().Msgf("godis proxy is listening on port %d with %d backends", p.port, len(p.backends))
+	p.loop.AeMain()
+}
+
+func (p *Proxy) acceptHandler(loop *server.AeLoop, fd int, extra any) {
+	cfd, err := net.Accept(fd)
+	if err != nil {
+		p.logger.Error().Err(err).Msg("accept err")
+		return
+	}
+	c := &client{fd: cfd, parser: server.NewQueryParser()}
+	p.clients[cfd] = c
+	loop.AddReadEvent(cfd, server.AE_READABLE, p.readFromClient, c)
+}
+
+func (p *Proxy) readFromClient(loop *server.AeLoop, fd int, extra any) {
+	c := extra.(*client)
+	n, err := c.parser.ReadFd(fd)
+	if err != nil || n == 0 {
+		p.freeClient(c)
+		return
+	}
+	for !c.closing {
+		ok, err := c.parser.Parse()
+		if err != nil {
+			p.logger.Debug().Err(err).Msgf("client %d protocol error", c.fd)
+			p.addReply(c, "-ERR Protocol error\r\n")
+			c.closing = true
+			break
+		}
+		if !ok {
+			break
+		}
+		if args := c.parser.Args(); len(args) > 0 {
+			p.dispatch(c, args)
+		}
+		c.parser.Reset()
+	}
+	p.flushReplies(c)
+}
+
+// 代理直接回复的命令与错误，排在之前的命令之后返回
+func (p *Proxy) addReply(c *client, reply string) {
+	c.pending = append(c.pending, &request{client: c, reply: []byte(reply), done: true})
+}
+
+// 按命令顺序取出已完成的请求的回复
+func (p *Proxy) flushReplies(c *client) {
+	if c.closed {
+		return
+	}
+	i := 0
+	for ; i < len(c.pending) && c.pending[i].done; i++ {
+		c.reply.Write(c.pending[i].reply)
+	}
+	if i > 0 {
+		c.pending = c.pending[i:]
+	}
+	if c.reply.Len() > 0 || (c.closing && len(c.pending) == 0) {
+		p.loop.ModWriteEvent(c.fd, server.AE_WRITABLE, p.replyToClient, c)
+	}
+}
+
+func (p *Proxy) replyToClient(loop *server.AeLoop, fd int, extra any) {
+	c := extra.(*client)
+	if c.closed {
+		return
+	}
+	if c.reply.Len() > 0 {
+		n, err := net.Write(fd, c.reply.Bytes())
+		if err != nil {
+			p.logger.Debug().Err(err).Msgf("client %d write", fd)
+			p.freeClient(c)
+			return
+		}
+		c.reply.Next(n)
+		if c.reply.Len() > 0 {
+			return
+		}
+	}
+	if c.closing && len(c.pending) == 0 {
+		p.freeClient(c)
+		return
+	}
+	loop.ModReadEvent(fd)
+}
+
+// 仍在后端等待回复的请求在回复到达后丢弃
+func (p *Proxy) freeClient(c *client) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.pending = nil
+	delete(p.clients, c.fd)
+	p.loop.RemoveFileEvent(c.fd)
+	net.Close(c.fd)
+}
+
+func (p *Proxy) cron(loop *server.AeLoop, id int, extra any) {
+	p.processBackendEvents()
+	now := util.GetMsTime()
+	for _, b := range p.backends {
+		if b.fd == -1 && !b.connecting && now-b.lastAttempt >= conf.PROXY_RECONNECT_PERIOD {
+			b.connecting = true
+			b.lastAttempt = now
+			go func(b *backend) {
+				p.events <- connectBackend(b)
+			}(b)
+		}
+	}
+}
+
+func (p *Proxy) beforeSleep(loop *server.AeLoop) {
+	p.processBackendEvents()
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/godis/conf"
+	"github.com/godis/data"
+	"github.com/godis/server"
+	"github.com/rs/zerolog"
+	"golang.org/x/sys/unix"
+)
+
+// 非阻塞的socketpair，返回代理一端与测试一端
+func socketpair(t *testing.T) (int, int) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fd := range fds {
+		if err = unix.SetNonblock(fd, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+	})
+	return fds[0], fds[1]
+}
+
+// 代理连接n个后端，返回各后端在测试一端的fd
+func newTestProxy(t *testing.T, n int) (*Proxy, []int) {
+	t.Helper()
+	logger := zerolog.Nop()
+	loop, err := server.AeLoopCreate(&logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{loop: loop, clients: make(map[int]*client), events: make(chan *backendEvent, n), logger: &logger}
+	var peers []int
+	for i := 0; i < n; i++ {
+		fd, peer := socketpair(t)
+		b := &backend{addr: fmt.Sprintf("backend%d", i), fd: -1, readBuf: make([]byte, conf.GODIS_IO_BUF)}
+		p.backends = append(p.backends, b)
+		p.handleBackendEvent(&backendEvent{backend: b, fd: fd})
+		peers = append(peers, peer)
+	}
+	return p, peers
+}
+
+func newTestClient(t *testing.T, p *Proxy) (*client, int) {
+	t.Helper()
+	fd, peer := socketpair(t)
+	c := &client{fd: fd, parser: server.NewQueryParser()}
+	p.clients[fd] = c
+	p.loop.AddReadEvent(fd, server.AE_READABLE, p.readFromClient, c)
+	return c, peer
+}
+
+// 执行事件循环直到条件成立
+func stepUntil(t *testing.T, p *Proxy, cond func() bool) {
+	t.Helper()
+	for i := 0; !cond(); i++ {
+		if i == 100 {
+			t.Fatal("condition not reached")
+		}
+		p.loop.AeProcess(p.loop.AeWait())
+	}
+}
+
+// 读取fd中当前可读的全部数据
+func readAvailable(t *testing.T, fd int) []byte {
+	t.Helper()
+	var out []byte
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := unix.Read(fd, buf)
+		if err == unix.EAGAIN {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			return out
+		}
+		out = append(out, buf[:n]...)
+	}
+}
+
+func writeAll(t *testing.T, fd int, s string) {
+	t.Helper()
+	if n, err := unix.Write(fd, []byte(s)); err != nil || n != len(s) {
+		t.Fatalf("write %d of %d bytes: %v", n, len(s), err)
+	}
+}
+
+func command(args ...string) string {
+	objs := make([]*data.Gobj, len(args))
+	for i, arg := range args {
+		objs[i] = data.CreateObject(conf.GSTR, arg)
+	}
+	return string(encodeArgs(objs))
+}
+
+// 哈希到指定后端的key
+func keyOn(p *Proxy, backend int) string {
+	for i := 0; ; i++ {
+		if key := fmt.Sprintf("key%d", i); p.backendOf(key) == backend {
+			return key
+		}
+	}
+}
+
+// 拆分到多个后端的命令与其他命令流水线发送，后端回复的先后不影响客户端收到回复的顺序
+func TestSplitCommandReplyOrder(t *testing.T) {
+	p, peers := newTestProxy(t, 2)
+	c, peer := newTestClient(t, p)
+	a, b := keyOn(p, 0), keyOn(p, 1)
+	writeAll(t, peer, command("DEL", a, b)+command("MSET", a, "1", b, "2")+command("SINTER", a, b)+
+		command("EXISTS", b, a)+command("GET", a)+command("PING"))
+	stepUntil(t, p, func() bool {
+		return len(p.backends[0].waiting) == 4 && len(p.backends[1].waiting) == 3 &&
+			p.backends[0].out.Len() == 0 && p.backends[1].out.Len() == 0
+	})
+	// 每个后端按原命令中key的顺序收到属于自己的部分，SINTER不能拆分，由代理直接回复CROSSSLOT
+	if got, want := string(readAvailable(t, peers[0])), command("DEL", a)+command("MSET", a, "1")+command("EXISTS", a)+command("GET", a); got != want {
+		t.Fatalf("backend0 got %q, want %q", got, want)
+	}
+	if got, want := string(readAvailable(t, peers[1])), command("DEL", b)+command("MSET", b, "2")+command("EXISTS", b); got != want {
+		t.Fatalf("backend1 got %q, want %q", got, want)
+	}
+
+	// 后一个后端先回复，第一条命令仍未完成，客户端收不到任何回复
+	writeAll(t, peers[1], ":1\r\n+OK\r\n:1\r\n")
+	stepUntil(t, p, func() bool { return len(p.backends[1].waiting) == 0 })
+	if c.reply.Len() != 0 || len(readAvailable(t, peer)) != 0 {
+		t.Fatal("replies sent before the first command completed")
+	}
+	// 回复分两次到达，第二个回复被截断
+	writeAll(t, peers[0], ":1\r\n+O")
+	stepUntil(t, p, func() bool { return len(p.backends[0].waiting) == 3 })
+	writeAll(t, peers[0], "K\r\n:0\r\n$1\r\n1\r\n")
+	stepUntil(t, p, func() bool { return len(p.backends[0].waiting) == 0 && len(c.pending) == 0 && c.reply.Len() == 0 })
+
+	want := ":2\r\n+OK\r\n-CROSSSLOT Keys in request don't hash to the same backend\r\n:1\r\n$1\r\n1\r\n+PONG\r\n"
+	if got := string(readAvailable(t, peer)); got != want {
+		t.Fatalf("client got %q, want %q", got, want)
+	}
+}
+
+// 命令与回复大于socket缓冲区时只写入一部分，剩余部分在之后的可写事件中继续写入
+func TestPartialWriteResume(t *testing.T) {
+	p, peers := newTestProxy(t, 1)
+	c, peer := newTestClient(t, p)
+	b := p.backends[0]
+	for _, fd := range []int{b.fd, c.fd} {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, 16*1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+	value := strings.Repeat("0123456789", 100*1024)
+
+	cmd := command("SET", "key", value)
+	p.dispatch(c, []*data.Gobj{
+		data.CreateObject(conf.GSTR, "SET"), data.CreateObject(conf.GSTR, "key"), data.CreateObject(conf.GSTR, value),
+	})
+	var got []byte
+	short := false
+	for b.out.Len() > 0 {
+		p.loop.AeProcess(p.loop.AeWait())
+		short = short || (b.out.Len() > 0 && b.out.Len() < len(cmd))
+		got = append(got, readAvailable(t, peers[0])...)
+	}
+	got = append(got, readAvailable(t, peers[0])...)
+	if string(got) != cmd {
+		t.Fatalf("backend got %d bytes, want %d bytes of the command", len(got), len(cmd))
+	}
+	if !short {
+		t.Fatal("command was written to backend at once")
+	}
+
+	// 后端分多次写入大的回复，代理分多次写给客户端
+	reply := bulkString(value)
+	got, short = nil, false
+	for off := 0; len(got) < len(reply); {
+		if off < len(reply) {
+			n, err := unix.Write(peers[0], []byte(reply[off:]))
+			if err != nil && err != unix.EAGAIN {
+				t.Fatal(err)
+			}
+			if n > 0 {
+				off += n
+			}
+		}
+		p.loop.AeProcess(p.loop.AeWait())
+		short = short || c.reply.Len() > 0
+		got = append(got, readAvailable(t, peer)...)
+		// 代理已经没有待发送的数据，回复仍不完整
+		if off == len(reply) && len(b.waiting) == 0 && c.reply.Len() == 0 && len(got) < len(reply) {
+			t.Fatalf("client got %d bytes, want %d bytes of the reply", len(got), len(reply))
+		}
+	}
+	if string(got) != reply {
+		t.Fatalf("client got %d bytes, want %d bytes of the reply", len(got), len(reply))
+	}
+	if !short {
+		t.Fatal("reply was written to client at once")
+	}
+	if len(b.in) != 0 {
+		t.Fatalf("%d bytes left in backend input", len(b.in))
+	}
+}
@@ -0,0 +1,283 @@
+package sentinel
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/godis/util"
+)
+
+// 执行客户端或其他哨兵发来的命令，第二个返回值表示是否关闭哨兵
+func (s *Sentinel) processCommand(args []string) (*reply, bool) {
+	out := &reply{}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.ToLower(args[0]) {
+	case "ping":
+		out.status("PONG")
+	case "info":
+		out.bulk(s.genInfoString())
+	case "sentinel":
+		if len(args) < 2 {
+			out.error("ERR wrong number of arguments for 'sentinel' command")
+		} else {
+			s.sentinelCommand(out, strings.ToLower(args[1]), args[2:])
+		}
+	case "shutdown":
+		out.status("OK")
+		return out, true
+	default:
+		out.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	return out, false
+}
+
+func (s *Sentinel) sentinelCommand(out *reply, sub string, args []string) {
+	// 除myid与masters外，子命令的参数个数
+	arity := map[string]int{
+		"master": 1, "replicas": 1, "slaves": 1, "sentinels": 1, "get-master-addr-by-name": 1,
+		"failover": 1, "is-master-down-by-addr": 4, "hello": 8,
+	}
+	if n, ok := arity[sub]; ok && len(args) != n {
+		out.error(fmt.Sprintf("ERR wrong number of arguments for 'sentinel %s' command", sub))
+		return
+	}
+	var m *master
+	switch sub {
+	case "master", "replicas", "slaves", "sentinels", "get-master-addr-by-name", "failover":
+		if m = s.masters[args[0]]; m == nil {
+			if sub == "get-master-addr-by-name" {
+				out.null()
+			} else {
+				out.error("ERR No such master with that name")
+			}
+			return
+		}
+	}
+
+	switch sub {
+	case "myid":
+		out.bulk(s.runid)
+	case "masters":
+		names := make([]string, 0, len(s.masters))
+		for name := range s.masters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		out.array(len(names))
+		for _, name := range names {
+			out.fields(s.masterFields(s.masters[name]))
+		}
+	case "master":
+		out.fields(s.masterFields(m))
+	case "replicas", "slaves":
+		replicas := m.sortedReplicas()
+		out.array(len(replicas))
+		for _, r := range replicas {
+			out.fields(s.replicaFields(r))
+		}
+	case "sentinels":
+		peers := m.sortedSentinels()
+		out.array(len(peers))
+		for _, p := range peers {
+			out.fields(s.sentinelFields(p))
+		}
+	case "get-master-addr-by-name":
+		addr := m.currentAddr()
+		out.array(2)
+		out.bulk(addr.ip)
+		out.bulk(strconv.Itoa(addr.port))
+	case "failover":
+		s.failoverCommand(out, m)
+	case "is-master-down-by-addr":
+		s.isMasterDownByAddrCommand(out, args)
+	case "hello":
+		s.helloCommand(out, args)
+	default:
+		out.error(fmt.Sprintf("ERR unknown sentinel subcommand '%s'", sub))
+	}
+}
+
+func instanceFlags(inst *instance) string {
+	flags := inst.kind
+	if inst.sdownSince != 0 {
+		flags += ",s_down"
+	}
+	return flags
+}
+
+func (s *Sentinel) masterFields(m *master) []string {
+	now := util.GetMsTime()
+	flags := instanceFlags(m.instance)
+	if m.odownSince != 0 {
+		flags += ",o_down"
+	}
+	if m.failoverState != FAILOVER_STATE_NONE {
+		flags += ",failover_in_progress"
+	}
+	return []string{
+		"name", m.name,
+		"ip", m.ip,
+		"port", strconv.Itoa(m.port),
+		"flags", flags,
+		"last-ok-ping-reply", strconv.FormatInt(now-m.lastPong, 10),
+		"down-after-milliseconds", strconv.FormatInt(m.downAfter, 10),
+		"role-reported", m.role,
+		"config-epoch", strconv.FormatInt(m.configEpoch, 10),
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(m.sentinels)),
+		"quorum", strconv.Itoa(m.quorum),
+		"failover-timeout", strconv.FormatInt(m.failoverTimeout, 10),
+		"parallel-syncs", strconv.Itoa(m.parallelSyncs),
+		"failover-state", failoverStateNames[m.failoverState],
+	}
+}
+
+func (s *Sentinel) replicaFields(r *instance) []string {
+	now := util.GetMsTime()
+	linkStatus := "down"
+	if r.linkUp {
+		linkStatus = "up"
+	}
+	return []string{
+		"name", r.addr,
+		"ip", r.ip,
+		"port", strconv.Itoa(r.port),
+		"flags", instanceFlags(r),
+		"last-ok-ping-reply", strconv.FormatInt(now-r.lastPong, 10),
+		"role-reported", r.role,
+		"master-host", r.masterHost,
+		"master-port", strconv.Itoa(r.masterPort),
+		"master-link-status", linkStatus,
+		"slave-repl-offset", strconv.FormatInt(r.replOffset, 10),
+	}
+}
+
+func (s *Sentinel) sentinelFields(p *peer) []string {
+	now := util.GetMsTime()
+	lastHello := int64(-1)
+	if p.lastHello != 0 {
+		lastHello = now - p.lastHello
+	}
+	return []string{
+		"name", p.addr,
+		"ip", p.ip,
+		"port", strconv.Itoa(p.port),
+		"runid", p.runid,
+		"flags", instanceFlags(p.instance),
+		"last-ok-ping-reply", strconv.FormatInt(now-p.lastPong, 10),
+		"last-hello-message", strconv.FormatInt(lastHello, 10),
+		"voted-leader", p.leader,
+		"voted-leader-epoch", strconv.FormatInt(p.leaderEpoch, 10),
+	}
+}
+
+// SENTINEL FAILOVER <name>，不等待客观下线与其他哨兵同意，直接发起故障转移
+func (s *Sentinel) failoverCommand(out *reply, m *master) {
+	now := util.GetMsTime()
+	if m.failoverState != FAILOVER_STATE_NONE {
+		out.error("INPROG Failover already in progress")
+		return
+	}
+	if s.selectReplica(m, now) == nil {
+		out.error("NOGOODSLAVE No suitable replica to promote")
+		return
+	}
+	m.forceFailover = true
+	s.startFailover(m, now)
+	m.leader = s.runid
+	m.leaderEpoch = m.failoverEpoch
+	out.status("OK")
+}
+
+/*
+SENTINEL is-master-down-by-addr <ip> <port> <current-epoch> <runid>
+回复[本哨兵是否认为该主节点主观下线, 领头哨兵, 领头哨兵的纪元]，runid为*时只询问状态，否则请求投票
+*/
+func (s *Sentinel) isMasterDownByAddrCommand(out *reply, args []string) {
+	port, err1 := strconv.Atoi(args[1])
+	epoch, err2 := strconv.ParseInt(args[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		out.error("ERR value is not an integer or out of range")
+		return
+	}
+	var m *master
+	for _, candidate := range s.masters {
+		if candidate.ip == args[0] && candidate.port == port {
+			m = candidate
+			break
+		}
+	}
+	down := int64(0)
+	leader, leaderEpoch := "*", int64(0)
+	if m != nil {
+		if m.sdownSince != 0 {
+			down = 1
+		}
+		if args[3] != "*" {
+			leader, leaderEpoch = s.voteLeader(m, epoch, args[3])
+		}
+	}
+	out.array(3)
+	out.integer(down)
+	out.bulk(leader)
+	out.integer(leaderEpoch)
+}
+
+/*
+SENTINEL hello <ip> <port> <runid> <current-epoch> <master-name> <master-ip> <master-port> <master-config-epoch>
+其他哨兵定期发送的自身与主节点信息，回复本哨兵的runid及除发送者外已知的其他哨兵
+*/
+func (s *Sentinel) helloCommand(out *reply, args []string) {
+	port, err1 := strconv.Atoi(args[1])
+	epoch, err2 := strconv.ParseInt(args[3], 10, 64)
+	masterPort, err3 := strconv.Atoi(args[6])
+	configEpoch, err4 := strconv.ParseInt(args[7], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		out.error("ERR value is not an integer or out of range")
+		return
+	}
+	known := []string{s.runid}
+	if m := s.masters[args[4]]; m != nil {
+		s.processHello(m, args[0], port, args[2], epoch, args[5], masterPort, configEpoch)
+		sender := net.JoinHostPort(args[0], args[1])
+		for _, p := range m.sortedSentinels() {
+			if p.addr != sender {
+				known = append(known, p.addr)
+			}
+		}
+	}
+	out.fields(known)
+}
+
+func (s *Sentinel) genInfoString() string {
+	var builder strings.Builder
+	builder.WriteString("# Server\r\n")
+	builder.WriteString("redis_mode:sentinel\r\n")
+	builder.WriteString(fmt.Sprintf("run_id:%s\r\n", s.runid))
+	builder.WriteString(fmt.Sprintf("tcp_port:%d\r\n", s.port))
+	builder.WriteString("\r\n# Sentinel\r\n")
+	builder.WriteString(fmt.Sprintf("sentinel_masters:%d\r\n", len(s.masters)))
+	builder.WriteString(fmt.Sprintf("sentinel_current_epoch:%d\r\n", s.currentEpoch))
+	names := make([]string, 0, len(s.masters))
+	for name := range s.masters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		m := s.masters[name]
+		status := "ok"
+		if m.odownSince != 0 {
+			status = "odown"
+		} else if m.sdownSince != 0 {
+			status = "sdown"
+		}
+		addr := m.currentAddr()
+		builder.WriteString(fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d\r\n",
+			i, m.name, status, addr.addr, len(m.replicas), len(m.sentinels)+1))
+	}
+	return builder.String()
+}
@@ -0,0 +1,291 @@
+package sentinel
+
+import (
+	"math/rand"
+	"strconv"
+
+	"github.com/godis/conf"
+	"github.com/godis/util"
+)
+
+// 故障转移的状态
+const (
+	FAILOVER_STATE_NONE                 = iota
+	FAILOVER_STATE_WAIT_START           //等待选举出领头哨兵
+	FAILOVER_STATE_SELECT_REPLICA       //选择晋升的从节点
+	FAILOVER_STATE_SEND_REPLICAOF_NOONE //向选中的从节点发送REPLICAOF NO ONE
+	FAILOVER_STATE_WAIT_PROMOTION       //等待选中的从节点以主节点身份运行
+	FAILOVER_STATE_RECONF_REPLICAS      //让其余从节点复制新主节点
+)
+
+var failoverStateNames = []string{"none", "wait_start", "select_slave", "send_slaveof_noone", "wait_promotion", "reconf_slaves"}
+
+func (s *Sentinel) setFailoverState(m *master, state int, now int64) {
+	m.failoverState = state
+	m.failoverStateChange = now
+	s.event(m, m.instance, "+failover-state-"+failoverStateNames[state], "")
+}
+
+func (s *Sentinel) failoverStateMachine(m *master, now int64) {
+	switch m.failoverState {
+	case FAILOVER_STATE_NONE:
+		s.startFailoverIfNeeded(m, now)
+	case FAILOVER_STATE_WAIT_START:
+		s.failoverWaitStart(m, now)
+	case FAILOVER_STATE_SELECT_REPLICA:
+		s.failoverSelectReplica(m, now)
+	case FAILOVER_STATE_SEND_REPLICAOF_NOONE:
+		s.failoverSendReplicaOfNoOne(m, now)
+	case FAILOVER_STATE_WAIT_PROMOTION:
+		// 晋升完成由INFO回复推进
+		if now-m.failoverStateChange > m.failoverTimeout {
+			s.abortFailover(m, "-failover-abort-slave-timeout")
+		}
+	case FAILOVER_STATE_RECONF_REPLICAS:
+		s.failoverReconfReplicas(m, now)
+	}
+}
+
+// 客观下线后开始故障转移，距上一次开始或投票给其他哨兵不足两倍failover-timeout时不重复发起
+func (s *Sentinel) startFailoverIfNeeded(m *master, now int64) {
+	if m.odownSince == 0 || now-m.failoverStart < m.failoverTimeout*2 {
+		return
+	}
+	s.startFailover(m, now)
+}
+
+func (s *Sentinel) startFailover(m *master, now int64) {
+	s.currentEpoch++
+	m.failoverEpoch = s.currentEpoch
+	m.failoverStart = now
+	s.event(m, nil, "+new-epoch", "%d", s.currentEpoch)
+	s.event(m, m.instance, "+try-failover", "")
+	for _, r := range m.replicas {
+		r.reconfSent = 0
+		r.reconfDone = false
+	}
+	s.setFailoverState(m, FAILOVER_STATE_WAIT_START, now)
+}
+
+func (s *Sentinel) abortFailover(m *master, reason string) {
+	s.event(m, m.instance, reason, "")
+	m.failoverState = FAILOVER_STATE_NONE
+	m.failoverStateChange = util.GetMsTime()
+	m.forceFailover = false
+	m.promoted = nil
+}
+
+func (s *Sentinel) failoverWaitStart(m *master, now int64) {
+	if !m.forceFailover && s.getLeader(m, m.failoverEpoch) != s.runid {
+		electionTimeout := m.failoverTimeout
+		if electionTimeout > conf.SENTINEL_ELECTION_TIMEOUT {
+			electionTimeout = conf.SENTINEL_ELECTION_TIMEOUT
+		}
+		if now-m.failoverStart > electionTimeout {
+			s.abortFailover(m, "-failover-abort-not-elected")
+		}
+		return
+	}
+	s.event(m, m.instance, "+elected-leader", "#epoch %d", m.failoverEpoch)
+	s.setFailoverState(m, FAILOVER_STATE_SELECT_REPLICA, now)
+}
+
+/*
+在纪元epoch中统计其他哨兵的投票，本哨兵投给得票最多的候选者，没有候选者时投给自己，
+得票数同时达到已知哨兵数的多数与quorum的候选者成为领头哨兵
+*/
+func (s *Sentinel) getLeader(m *master, epoch int64) string {
+	counters := make(map[string]int)
+	for _, p := range m.sentinels {
+		if p.leader != "" && p.leaderEpoch == epoch {
+			counters[p.leader]++
+		}
+	}
+	candidate, _ := mostVoted(counters)
+	if candidate == "" {
+		candidate = s.runid
+	}
+	if vote, voteEpoch := s.voteLeader(m, epoch, candidate); vote != "" && voteEpoch == epoch {
+		counters[vote]++
+	}
+	winner, votes := mostVoted(counters)
+	voters := len(m.sentinels) + 1
+	if winner == "" || votes < voters/2+1 || votes < m.quorum {
+		return ""
+	}
+	return winner
+}
+
+// 得票最多的候选者，票数相同时取runid较小的
+func mostVoted(counters map[string]int) (string, int) {
+	winner, max := "", 0
+	for runid, votes := range counters {
+		if votes > max || votes == max && runid < winner {
+			winner, max = runid, votes
+		}
+	}
+	return winner, max
+}
+
+/*
+每个纪元只投一票，投给第一个在该纪元请求投票的哨兵，返回本哨兵投票的领头哨兵及纪元
+投给其他哨兵后推迟自身的故障转移，给领头哨兵留出完成故障转移的时间
+*/
+func (s *Sentinel) voteLeader(m *master, reqEpoch int64, reqRunid string) (string, int64) {
+	if reqEpoch > s.currentEpoch {
+		s.currentEpoch = reqEpoch
+		s.event(m, nil, "+new-epoch", "%d", reqEpoch)
+	}
+	if m.leaderEpoch < reqEpoch && s.currentEpoch <= reqEpoch {
+		m.leader = reqRunid
+		m.leaderEpoch = s.currentEpoch
+		s.event(m, m.instance, "+vote-for-leader", "%s %d", m.leader, m.leaderEpoch)
+		if m.leader != s.runid {
+			m.failoverStart = util.GetMsTime() + rand.Int63n(conf.SENTINEL_MAX_DESYNC)
+		}
+	}
+	return m.leader, m.leaderEpoch
+}
+
+func (s *Sentinel) failoverSelectReplica(m *master, now int64) {
+	r := s.selectReplica(m, now)
+	if r == nil {
+		s.abortFailover(m, "-failover-abort-no-good-slave")
+		return
+	}
+	m.promoted = r
+	s.event(m, r, "+selected-slave", "")
+	s.setFailoverState(m, FAILOVER_STATE_SEND_REPLICAOF_NOONE, now)
+}
+
+/*
+选择晋升的从节点，排除主观下线、近期没有回复PING或INFO的从节点，
+其余的从节点中选择复制偏移量最大的，偏移量相同时选择地址较小的
+*/
+func (s *Sentinel) selectReplica(m *master, now int64) *instance {
+	infoValidity := conf.SENTINEL_INFO_PERIOD * 3
+	if m.sdownSince != 0 {
+		infoValidity = conf.SENTINEL_PING_PERIOD * 5
+	}
+	var best *instance
+	for _, r := range m.sortedReplicas() {
+		if r.sdownSince != 0 || r.role != "slave" ||
+			now-r.lastPong > conf.SENTINEL_PING_PERIOD*5 || now-r.lastInfo > infoValidity {
+			continue
+		}
+		if best == nil || r.replOffset > best.replOffset {
+			best = r
+		}
+	}
+	return best
+}
+
+func (s *Sentinel) failoverSendReplicaOfNoOne(m *master, now int64) {
+	r := m.promoted
+	if now-m.failoverStateChange > m.failoverTimeout {
+		s.abortFailover(m, "-failover-abort-slave-timeout")
+		return
+	}
+	s.request(r, &r.commanding, func(reply any, err error) {
+		if m.failoverState != FAILOVER_STATE_SEND_REPLICAOF_NOONE || m.promoted != r {
+			return
+		}
+		if e, ok := reply.(replyError); ok && err == nil {
+			err = e
+		}
+		if err != nil {
+			s.logger.Error().Err(err).Str("addr", r.addr).Msg("send replicaof no one failed")
+			return
+		}
+		s.setFailoverState(m, FAILOVER_STATE_WAIT_PROMOTION, util.GetMsTime())
+	}, "replicaof", "no", "one")
+}
+
+/*
+让其余从节点复制新主节点，同时切换的从节点不超过parallel-syncs个，
+主观下线的从节点跳过，恢复后再纠正，全部完成或超时后更新主节点配置
+*/
+func (s *Sentinel) failoverReconfReplicas(m *master, now int64) {
+	timeout := now-m.failoverStateChange > m.failoverTimeout
+	inProgress := 0
+	for _, r := range m.replicas {
+		if r == m.promoted || r.reconfSent == 0 || r.reconfDone {
+			continue
+		}
+		if now-r.reconfSent > conf.SENTINEL_REPLICA_RECONF_TIMEOUT {
+			r.reconfDone = true
+			s.event(m, r, "-slave-reconf-sent-timeout", "")
+			continue
+		}
+		inProgress++
+	}
+	for _, r := range m.sortedReplicas() {
+		if r == m.promoted || r.reconfSent != 0 || r.reconfDone || r.sdownSince != 0 || r.commanding {
+			continue
+		}
+		if inProgress >= m.parallelSyncs && !timeout {
+			break
+		}
+		r.reconfSent = now
+		inProgress++
+		s.event(m, r, "+slave-reconf-sent", "")
+		r := r
+		s.request(r, &r.commanding, func(reply any, err error) {
+			if e, ok := reply.(replyError); ok && err == nil {
+				err = e
+			}
+			if err != nil {
+				s.logger.Error().Err(err).Str("addr", r.addr).Msg("send replicaof to replica failed")
+				r.reconfSent = 0
+			}
+		}, "replicaof", m.promoted.ip, strconv.Itoa(m.promoted.port))
+	}
+
+	done := true
+	for _, r := range m.replicas {
+		if r != m.promoted && r.sdownSince == 0 && !r.reconfDone {
+			done = false
+		}
+	}
+	if !done && !timeout {
+		return
+	}
+	if done {
+		s.event(m, m.instance, "+failover-end", "")
+	} else {
+		s.event(m, m.instance, "+failover-end-for-timeout", "")
+	}
+	s.switchMaster(m, m.promoted.ip, m.promoted.port)
+}
+
+// 将主节点切换到新地址，旧主节点作为从节点继续监控，恢复后让其复制新主节点
+func (s *Sentinel) switchMaster(m *master, ip string, port int) {
+	old := m.instance
+	s.event(m, nil, "+switch-master", "%s %s %d %s %d", m.name, old.ip, old.port, ip, port)
+	m.instance = newInstance("master", ip, port)
+	go old.link.close()
+
+	replicas := make(map[string]*instance)
+	for addr, r := range m.replicas {
+		if addr == m.addr {
+			go r.link.close()
+			continue
+		}
+		r.reconfSent = 0
+		r.reconfDone = false
+		replicas[addr] = r
+	}
+	if old.addr != m.addr {
+		replicas[old.addr] = newInstance("slave", old.ip, old.port)
+	}
+	m.replicas = replicas
+
+	m.odownSince = 0
+	m.failoverState = FAILOVER_STATE_NONE
+	m.failoverStateChange = util.GetMsTime()
+	m.forceFailover = false
+	m.promoted = nil
+	for _, p := range m.sentinels {
+		p.masterDown = false
+	}
+}
@@ -0,0 +1,73 @@
+package sentinel
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/godis/conf"
+)
+
+// 哨兵到实例的连接，请求串行执行，出错时关闭连接，下一次请求时重新建立
+type link struct {
+	mu     sync.Mutex
+	addr   string
+	conn   net.Conn
+	reader *bufio.Reader
+	local  atomic.Value //最近一次建立连接时的本地IP，读取时不需要等待进行中的请求
+}
+
+func newLink(addr string) *link {
+	return &link{addr: addr}
+}
+
+// 发送命令并等待回复，错误回复不视为连接错误
+func (l *link) do(args ...string) (any, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	timeout := time.Duration(conf.SENTINEL_REQUEST_TIMEOUT) * time.Millisecond
+	if l.conn == nil {
+		conn, err := net.DialTimeout("tcp", l.addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		l.conn = conn
+		l.reader = bufio.NewReader(conn)
+		if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			l.local.Store(addr.IP.String())
+		}
+	}
+	l.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := l.conn.Write(encodeCommand(args...)); err != nil {
+		l.closeLocked()
+		return nil, err
+	}
+	reply, err := readReply(l.reader)
+	if err != nil {
+		l.closeLocked()
+		return nil, err
+	}
+	return reply, nil
+}
+
+// 连接的本地IP，从未连接成功时返回空
+func (l *link) localIP() string {
+	ip, _ := l.local.Load().(string)
+	return ip
+}
+
+func (l *link) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeLocked()
+}
+
+func (l *link) closeLocked() {
+	if l.conn != nil {
+		l.conn.Close()
+		l.conn = nil
+		l.reader = nil
+	}
+}
@@ -0,0 +1,172 @@
+package sentinel
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// 实例返回的错误回复
+type replyError string
+
+func (e replyError) Error() string {
+	return string(e)
+}
+
+// 将命令编码为RESP数组
+func encodeCommand(args ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg))
+	}
+	return buf.Bytes()
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+/*
+读取一个RESP回复，状态回复与批量回复返回string，整数回复返回int64，数组回复返回[]any，
+空批量回复与空数组返回nil，错误回复返回replyError
+*/
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty reply line")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return replyError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]any, n)
+		for i := range arr {
+			if arr[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", line)
+}
+
+// 读取客户端发送的一条命令，支持RESP数组与内联命令
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid multibulk length")
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		header, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(header) == 0 || header[0] != '$' {
+			return nil, fmt.Errorf("expected '$', got %q", header)
+		}
+		size, err := strconv.Atoi(header[1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid bulk length")
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// 构造发给客户端的回复
+type reply struct {
+	bytes.Buffer
+}
+
+func (r *reply) status(s string) {
+	r.WriteString("+" + s + "\r\n")
+}
+
+func (r *reply) error(s string) {
+	r.WriteString("-" + s + "\r\n")
+}
+
+func (r *reply) integer(n int64) {
+	r.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (r *reply) bulk(s string) {
+	r.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(s), s))
+}
+
+func (r *reply) null() {
+	r.WriteString("$-1\r\n")
+}
+
+func (r *reply) array(n int) {
+	r.WriteString(fmt.Sprintf("*%d\r\n", n))
+}
+
+// 以字段名、字段值交替的批量回复数组输出
+func (r *reply) fields(kv []string) {
+	r.array(len(kv))
+	for _, s := range kv {
+		r.bulk(s)
+	}
+}
+
+// 解析INFO回复中的"key:value"行
+func parseInfo(info string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\r\n") {
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			fields[k] = v
+		}
+	}
+	return fields
+}
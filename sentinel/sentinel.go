@@ -0,0 +1,656 @@
+package sentinel
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godis/conf"
+	"github.com/godis/errs"
+	"github.com/godis/util"
+	"github.com/rs/zerolog"
+)
+
+/*
+哨兵，监控若干主节点及其从节点，通过PING判断实例是否主观下线，
+主节点主观下线后询问其他哨兵，达到quorum个哨兵认为其下线时判定客观下线，
+之后在哨兵之间以纪元投票选出领头哨兵，由领头哨兵将最优的从节点晋升为主节点，并让其余从节点复制新主节点，
+其他哨兵通过hello消息中更大的配置纪元得知新主节点
+哨兵的状态由mu保护，对实例的请求在单独的goroutine中执行，回复加锁后处理
+*/
+type Sentinel struct {
+	mu           sync.Mutex
+	runid        string
+	port         int
+	announceIP   string
+	currentEpoch int64
+	masters      map[string]*master //key为主节点名
+	selfAddrs    map[string]bool    //已确认指向自身的哨兵地址
+	logger       *zerolog.Logger
+	listener     net.Listener
+	stop         chan struct{}
+	once         sync.Once
+}
+
+// 被监控的主从节点或其他哨兵
+type instance struct {
+	kind string //master|slave|sentinel
+	ip   string
+	port int
+	addr string
+	link *link
+
+	lastPong    int64 //最近一次收到有效PING回复的时间，毫秒
+	lastPing    int64 //最近一次发送PING的时间
+	lastInfo    int64 //最近一次收到INFO回复的时间
+	lastInfoReq int64 //最近一次发送INFO的时间
+	sdownSince  int64 //主观下线的开始时间，0表示未下线
+	pinging     bool
+	infoing     bool
+	commanding  bool //REPLICAOF是否在执行中
+
+	// INFO replication中的复制信息
+	role         string
+	roleReported int64 //角色或复制的主节点最近一次发生变化的时间
+	masterHost   string
+	masterPort   int
+	linkUp       bool
+	replOffset   int64
+
+	reconfSent int64 //故障转移时发送REPLICAOF新主节点的时间
+	reconfDone bool
+	lastFix    int64 //最近一次纠正从节点配置的时间
+}
+
+// 其他哨兵
+type peer struct {
+	*instance
+	runid       string
+	lastHello   int64 //最近一次收到该哨兵hello消息的时间
+	helloSent   int64
+	helloing    bool
+	lastAsk     int64
+	asking      bool
+	lastReply   int64 //最近一次收到is-master-down-by-addr回复的时间
+	masterDown  bool
+	leader      string //该哨兵在leaderEpoch中投票选出的领头哨兵
+	leaderEpoch int64
+}
+
+type master struct {
+	*instance
+	name            string
+	quorum          int
+	downAfter       int64
+	failoverTimeout int64
+	parallelSyncs   int
+	replicas        map[string]*instance //key为"ip:port"
+	sentinels       map[string]*peer     //key为"ip:port"
+
+	odownSince  int64
+	configEpoch int64  //主节点配置的纪元，故障转移成功后为故障转移的纪元
+	leader      string //本哨兵在leaderEpoch中投票选出的领头哨兵
+	leaderEpoch int64
+
+	failoverState       int
+	failoverEpoch       int64
+	failoverStart       int64
+	failoverStateChange int64
+	forceFailover       bool      //SENTINEL FAILOVER发起的故障转移，不需要客观下线与选举
+	promoted            *instance //被选中晋升的从节点
+}
+
+func newInstance(kind string, ip string, port int) *instance {
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	return &instance{
+		kind:     kind,
+		ip:       ip,
+		port:     port,
+		addr:     addr,
+		link:     newLink(addr),
+		lastPong: util.GetMsTime(),
+	}
+}
+
+func splitAddr(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in %q", addr)
+	}
+	return host, port, nil
+}
+
+func New(config *conf.SentinelConfig, logger *zerolog.Logger) (*Sentinel, error) {
+	id := make([]byte, conf.REPL_ID_LEN/2)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	s := &Sentinel{
+		runid:      hex.EncodeToString(id),
+		port:       config.Port,
+		announceIP: config.AnnounceIP,
+		masters:    make(map[string]*master),
+		selfAddrs:  make(map[string]bool),
+		logger:     logger,
+		stop:       make(chan struct{}),
+	}
+	if s.port == 0 {
+		s.port = conf.SENTINEL_DEFAULT_PORT
+	}
+	if len(config.Monitors) == 0 {
+		logger.Error().Msg("no master to monitor")
+		return nil, errs.SentinelConfigError
+	}
+	for _, mc := range config.Monitors {
+		if mc.Name == "" || mc.Host == "" || mc.Port <= 0 || mc.Quorum <= 0 {
+			logger.Error().Interface("monitor", mc).Msg("invalid monitor config")
+			return nil, errs.SentinelConfigError
+		}
+		if _, ok := s.masters[mc.Name]; ok {
+			logger.Error().Str("name", mc.Name).Msg("duplicated master name")
+			return nil, errs.SentinelConfigError
+		}
+		m := &master{
+			instance:        newInstance("master", mc.Host, mc.Port),
+			name:            mc.Name,
+			quorum:          mc.Quorum,
+			downAfter:       mc.DownAfter,
+			failoverTimeout: mc.FailoverTimeout,
+			parallelSyncs:   mc.ParallelSyncs,
+			replicas:        make(map[string]*instance),
+			sentinels:       make(map[string]*peer),
+		}
+		if m.downAfter <= 0 {
+			m.downAfter = conf.SENTINEL_DEFAULT_DOWN_AFTER
+		}
+		if m.failoverTimeout <= 0 {
+			m.failoverTimeout = conf.SENTINEL_DEFAULT_FAILOVER_TIMEOUT
+		}
+		if m.parallelSyncs <= 0 {
+			m.parallelSyncs = conf.SENTINEL_DEFAULT_PARALLEL_SYNCS
+		}
+		// 配置中可能包含自身，收到hello回复中的runid后移除
+		for _, addr := range config.Sentinels {
+			ip, port, err := splitAddr(addr)
+			if err != nil {
+				logger.Error().Err(err).Str("addr", addr).Msg("invalid sentinel address")
+				return nil, errs.SentinelConfigError
+			}
+			p := &peer{instance: newInstance("sentinel", ip, port)}
+			m.sentinels[p.addr] = p
+		}
+		s.masters[m.name] = m
+	}
+	return s, nil
+}
+
+// 监听客户端连接并开始监控，Close后返回
+func (s *Sentinel) Run() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.logger.Info().Str("runid", s.runid).Int("port", s.port).Msg("sentinel is running")
+	go s.cron()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serveClient(conn)
+	}
+}
+
+func (s *Sentinel) Close() {
+	s.once.Do(func() {
+		close(s.stop)
+		if s.listener != nil {
+			s.listener.Close()
+		}
+	})
+}
+
+func (s *Sentinel) serveClient(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		out, shutdown := s.processCommand(args)
+		if _, err := conn.Write(out.Bytes()); err != nil {
+			return
+		}
+		if shutdown {
+			s.Close()
+			return
+		}
+	}
+}
+
+func (s *Sentinel) cron() {
+	ticker := time.NewTicker(time.Duration(conf.SENTINEL_TICK_PERIOD) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.tick()
+		}
+	}
+}
+
+func (s *Sentinel) tick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := util.GetMsTime()
+	for _, m := range s.masters {
+		s.sendPeriodicCommands(m, now)
+		s.checkSubjectivelyDown(m, now)
+		s.checkObjectivelyDown(m, now)
+		s.askMasterStateToOtherSentinels(m, now)
+		s.failoverStateMachine(m, now)
+	}
+}
+
+// 记录哨兵事件，格式为"<事件> <实例类型> <实例名> <ip> <port> @ <主节点名> <ip> <port> [详情]"
+func (s *Sentinel) event(m *master, inst *instance, typ string, format string, args ...any) {
+	var b strings.Builder
+	b.WriteString(typ)
+	if inst == m.instance {
+		fmt.Fprintf(&b, " master %s %s %d", m.name, inst.ip, inst.port)
+	} else if inst != nil {
+		fmt.Fprintf(&b, " %s %s %s %d @ %s %s %d", inst.kind, inst.addr, inst.ip, inst.port, m.name, m.ip, m.port)
+	}
+	if format != "" {
+		b.WriteString(" ")
+		fmt.Fprintf(&b, format, args...)
+	}
+	s.logger.Warn().Msg(b.String())
+}
+
+// 在新的goroutine中向实例发送命令，加锁后以回复调用cb，pending为true时说明上一个同类请求还未完成，不再发送
+func (s *Sentinel) request(inst *instance, pending *bool, cb func(reply any, err error), args ...string) {
+	if *pending {
+		return
+	}
+	*pending = true
+	go func() {
+		reply, err := inst.link.do(args...)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		*pending = false
+		cb(reply, err)
+	}()
+}
+
+// 本哨兵告知其他哨兵的IP，未配置announce-ip时使用连接主节点的本地IP
+func (s *Sentinel) myIP(m *master) string {
+	if s.announceIP != "" {
+		return s.announceIP
+	}
+	return m.link.localIP()
+}
+
+func (s *Sentinel) isMyAddr(m *master, ip string, port int) bool {
+	return port == s.port && ip == s.myIP(m) || s.selfAddrs[net.JoinHostPort(ip, strconv.Itoa(port))]
+}
+
+// 故障转移进入重新配置从节点阶段后，新主节点的地址即为当前配置
+func (m *master) currentAddr() *instance {
+	if m.failoverState == FAILOVER_STATE_RECONF_REPLICAS {
+		return m.promoted
+	}
+	return m.instance
+}
+
+func (m *master) sortedReplicas() []*instance {
+	replicas := make([]*instance, 0, len(m.replicas))
+	for _, r := range m.replicas {
+		replicas = append(replicas, r)
+	}
+	sort.Slice(replicas, func(i, j int) bool {
+		return replicas[i].addr < replicas[j].addr
+	})
+	return replicas
+}
+
+func (m *master) sortedSentinels() []*peer {
+	peers := make([]*peer, 0, len(m.sentinels))
+	for _, p := range m.sentinels {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].addr < peers[j].addr
+	})
+	return peers
+}
+
+func (s *Sentinel) sendPeriodicCommands(m *master, now int64) {
+	infoPeriod := conf.SENTINEL_INFO_PERIOD
+	if m.sdownSince != 0 || m.failoverState != FAILOVER_STATE_NONE {
+		infoPeriod = conf.SENTINEL_PING_PERIOD
+	}
+	for _, inst := range append([]*instance{m.instance}, m.sortedReplicas()...) {
+		if now-inst.lastPing >= conf.SENTINEL_PING_PERIOD {
+			inst.lastPing = now
+			s.ping(inst)
+		}
+		if now-inst.lastInfoReq >= infoPeriod {
+			inst.lastInfoReq = now
+			inst := inst
+			s.request(inst, &inst.infoing, func(reply any, err error) {
+				s.refreshFromInfo(m, inst, reply, err)
+			}, "info", "replication")
+		}
+	}
+	for _, p := range m.sentinels {
+		if now-p.lastPing >= conf.SENTINEL_PING_PERIOD {
+			p.lastPing = now
+			s.ping(p.instance)
+		}
+		if now-p.helloSent >= conf.SENTINEL_HELLO_PERIOD {
+			p.helloSent = now
+			s.sendHello(m, p)
+		}
+	}
+}
+
+// PONG以及LOADING、MASTERDOWN错误都视为实例可用
+func (s *Sentinel) ping(inst *instance) {
+	s.request(inst, &inst.pinging, func(reply any, err error) {
+		if err != nil {
+			return
+		}
+		valid := false
+		switch v := reply.(type) {
+		case string:
+			valid = v == "PONG"
+		case replyError:
+			valid = strings.HasPrefix(string(v), "LOADING") || strings.HasPrefix(string(v), "MASTERDOWN")
+		}
+		if valid {
+			inst.lastPong = util.GetMsTime()
+		}
+	}, "ping")
+}
+
+// 根据INFO replication更新实例的复制信息，发现新的从节点，推进故障转移，纠正配置错误的从节点
+func (s *Sentinel) refreshFromInfo(m *master, inst *instance, reply any, err error) {
+	info, ok := reply.(string)
+	if err != nil || !ok {
+		return
+	}
+	now := util.GetMsTime()
+	fields := parseInfo(info)
+	role := fields["role"]
+	masterHost := fields["master_host"]
+	masterPort, _ := strconv.Atoi(fields["master_port"])
+	if role != inst.role || masterHost != inst.masterHost || masterPort != inst.masterPort {
+		inst.roleReported = now
+	}
+	inst.lastInfo = now
+	inst.role = role
+	inst.masterHost = masterHost
+	inst.masterPort = masterPort
+	inst.linkUp = fields["master_link_status"] == "up"
+	if role == "slave" {
+		inst.replOffset, _ = strconv.ParseInt(fields["slave_repl_offset"], 10, 64)
+	} else {
+		inst.replOffset, _ = strconv.ParseInt(fields["master_repl_offset"], 10, 64)
+	}
+
+	if inst == m.instance {
+		if role == "master" {
+			s.discoverReplicas(m, fields)
+		}
+		return
+	}
+	if _, ok := m.replicas[inst.addr]; !ok {
+		return
+	}
+
+	switch {
+	case m.failoverState == FAILOVER_STATE_WAIT_PROMOTION && inst == m.promoted:
+		if role == "master" {
+			m.configEpoch = m.failoverEpoch
+			s.event(m, inst, "+promoted-slave", "")
+			s.setFailoverState(m, FAILOVER_STATE_RECONF_REPLICAS, now)
+		}
+	case m.failoverState == FAILOVER_STATE_RECONF_REPLICAS && inst != m.promoted:
+		if inst.reconfSent != 0 && !inst.reconfDone && role == "slave" && inst.linkUp &&
+			masterHost == m.promoted.ip && masterPort == m.promoted.port {
+			inst.reconfDone = true
+			s.event(m, inst, "+slave-reconf-done", "")
+		}
+	case m.failoverState == FAILOVER_STATE_NONE:
+		s.fixReplicaConfig(m, inst, now)
+	}
+}
+
+// 主节点INFO中的slave<N>:ip=...,port=...
+func (s *Sentinel) discoverReplicas(m *master, fields map[string]string) {
+	for key, val := range fields {
+		if !strings.HasPrefix(key, "slave") {
+			continue
+		}
+		if _, err := strconv.Atoi(key[len("slave"):]); err != nil {
+			continue
+		}
+		var ip string
+		var port int
+		for _, kv := range strings.Split(val, ",") {
+			k, v, _ := strings.Cut(kv, "=")
+			if k == "ip" {
+				ip = v
+			} else if k == "port" {
+				port, _ = strconv.Atoi(v)
+			}
+		}
+		if ip == "" || port <= 0 {
+			continue
+		}
+		r := newInstance("slave", ip, port)
+		if _, ok := m.replicas[r.addr]; ok || r.addr == m.addr {
+			continue
+		}
+		m.replicas[r.addr] = r
+		s.event(m, r, "+slave", "")
+	}
+}
+
+/*
+以主节点身份运行或复制其他节点的从节点，例如恢复后的旧主节点，让其复制当前主节点
+角色变化后等待一段时间，使其他哨兵完成的故障转移先通过hello消息传播过来
+*/
+func (s *Sentinel) fixReplicaConfig(m *master, inst *instance, now int64) {
+	if m.sdownSince != 0 || m.role != "master" || inst.sdownSince != 0 {
+		return
+	}
+	if inst.role == "slave" && inst.masterHost == m.ip && inst.masterPort == m.port {
+		return
+	}
+	wait := conf.SENTINEL_HELLO_PERIOD * 4
+	if now-inst.roleReported < wait || now-inst.lastFix < wait {
+		return
+	}
+	inst.lastFix = now
+	if inst.role == "master" {
+		s.event(m, inst, "+convert-to-slave", "")
+	} else {
+		s.event(m, inst, "+fix-slave-config", "")
+	}
+	s.request(inst, &inst.commanding, func(reply any, err error) {
+		if e, ok := reply.(replyError); ok && err == nil {
+			err = e
+		}
+		if err != nil {
+			s.logger.Error().Err(err).Str("addr", inst.addr).Msg("reconfigure replica failed")
+		}
+	}, "replicaof", m.ip, strconv.Itoa(m.port))
+}
+
+func (s *Sentinel) checkSubjectivelyDown(m *master, now int64) {
+	instances := append([]*instance{m.instance}, m.sortedReplicas()...)
+	for _, p := range m.sortedSentinels() {
+		instances = append(instances, p.instance)
+	}
+	for _, inst := range instances {
+		down := now-inst.lastPong > m.downAfter
+		if down && inst.sdownSince == 0 {
+			inst.sdownSince = now
+			s.event(m, inst, "+sdown", "")
+		} else if !down && inst.sdownSince != 0 {
+			inst.sdownSince = 0
+			s.event(m, inst, "-sdown", "")
+		}
+	}
+}
+
+// 认为主节点下线的哨兵数(包括自己)达到quorum时判定客观下线，只统计最近的回复
+func (s *Sentinel) checkObjectivelyDown(m *master, now int64) {
+	odown := false
+	votes := 1
+	if m.sdownSince != 0 {
+		for _, p := range m.sentinels {
+			if p.masterDown && now-p.lastReply <= conf.SENTINEL_ASK_PERIOD*5 {
+				votes++
+			}
+		}
+		odown = votes >= m.quorum
+	}
+	if odown && m.odownSince == 0 {
+		m.odownSince = now
+		s.event(m, m.instance, "+odown", "#quorum %d/%d", votes, m.quorum)
+	} else if !odown && m.odownSince != 0 {
+		m.odownSince = 0
+		s.event(m, m.instance, "-odown", "")
+	}
+}
+
+// 主节点主观下线后询问其他哨兵的判断，发起故障转移后同时请求其他哨兵投票
+func (s *Sentinel) askMasterStateToOtherSentinels(m *master, now int64) {
+	if m.sdownSince == 0 {
+		return
+	}
+	runid := "*"
+	if m.failoverState != FAILOVER_STATE_NONE {
+		runid = s.runid
+	}
+	for _, p := range m.sentinels {
+		if now-p.lastAsk < conf.SENTINEL_ASK_PERIOD {
+			continue
+		}
+		p.lastAsk = now
+		p := p
+		s.request(p.instance, &p.asking, func(reply any, err error) {
+			arr, ok := reply.([]any)
+			if err != nil || !ok || len(arr) != 3 {
+				return
+			}
+			down, ok1 := arr[0].(int64)
+			leader, ok2 := arr[1].(string)
+			epoch, ok3 := arr[2].(int64)
+			if !ok1 || !ok2 || !ok3 {
+				return
+			}
+			p.lastReply = util.GetMsTime()
+			p.masterDown = down == 1
+			if leader != "*" {
+				p.leader = leader
+				p.leaderEpoch = epoch
+			}
+		}, "sentinel", "is-master-down-by-addr", m.ip, strconv.Itoa(m.port), strconv.FormatInt(s.currentEpoch, 10), runid)
+	}
+}
+
+/*
+向其他哨兵发送自身地址、当前纪元与主节点配置，回复为对方的runid与对方已知的其他哨兵，
+回复中的runid与自身相同时说明配置中的地址就是自己
+*/
+func (s *Sentinel) sendHello(m *master, p *peer) {
+	ip := s.myIP(m)
+	if ip == "" {
+		return
+	}
+	addr := m.currentAddr()
+	s.request(p.instance, &p.helloing, func(reply any, err error) {
+		arr, ok := reply.([]any)
+		if err != nil || !ok || len(arr) == 0 {
+			return
+		}
+		runid, _ := arr[0].(string)
+		if runid == s.runid {
+			s.selfAddrs[p.addr] = true
+			if m.sentinels[p.addr] == p {
+				delete(m.sentinels, p.addr)
+				go p.link.close()
+			}
+			return
+		}
+		p.runid = runid
+		for _, item := range arr[1:] {
+			addr, _ := item.(string)
+			s.addSentinel(m, addr)
+		}
+	}, "sentinel", "hello", ip, strconv.Itoa(s.port), s.runid, strconv.FormatInt(s.currentEpoch, 10),
+		m.name, addr.ip, strconv.Itoa(addr.port), strconv.FormatInt(m.configEpoch, 10))
+}
+
+func (s *Sentinel) addSentinel(m *master, addr string) *peer {
+	ip, port, err := splitAddr(addr)
+	if err != nil || s.isMyAddr(m, ip, port) {
+		return nil
+	}
+	if p, ok := m.sentinels[addr]; ok {
+		return p
+	}
+	p := &peer{instance: newInstance("sentinel", ip, port)}
+	m.sentinels[p.addr] = p
+	s.event(m, p.instance, "+sentinel", "")
+	return p
+}
+
+// 处理其他哨兵的hello消息，对方的主节点配置纪元更大时切换到对方的主节点
+func (s *Sentinel) processHello(m *master, ip string, port int, runid string, epoch int64,
+	masterIP string, masterPort int, configEpoch int64) {
+	if runid == s.runid {
+		return
+	}
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		s.event(m, nil, "+new-epoch", "%d", epoch)
+	}
+	if p := s.addSentinel(m, net.JoinHostPort(ip, strconv.Itoa(port))); p != nil {
+		p.runid = runid
+		p.lastHello = util.GetMsTime()
+	}
+	if configEpoch > m.configEpoch {
+		m.configEpoch = configEpoch
+		if masterIP != m.ip || masterPort != m.port {
+			s.event(m, m.instance, "+config-update-from", "sentinel %s:%d", ip, port)
+			s.switchMaster(m, masterIP, masterPort)
+		}
+	}
+}
@@ -1,16 +1,11 @@
 package server
 
 import (
-	"sync"
-
 	"github.com/godis/util"
-	"github.com/panjf2000/ants/v2"
 	"github.com/rs/zerolog"
 	"golang.org/x/sys/unix"
 )
 
-var wg sync.WaitGroup
-
 type FeType int
 
 const (
@@ -29,6 +24,13 @@ type FileProc func(loop *AeLoop, fd int, extra any)
 
 type TimeProc func(loop *AeLoop, id int, extra any)
 
+type BeforeSleepProc func(loop *AeLoop)
+
+// 执行文件事件回调前的读写，服务端在goroutine池中并行完成，回调中只处理读入的数据
+type IOProc func(loop *AeLoop, fes []*AeFileEvent)
+
+type StopProc func(loop *AeLoop)
+
 type AeFileEvent struct {
 	fd    int
 	mask  FeType
@@ -52,6 +54,9 @@ type AeLoop struct {
 	fileEventFd     int
 	timeEventNextId int
 	stop            bool
+	beforeSleep     BeforeSleepProc //每次进入epoll等待前执行
+	ioProc          IOProc          //为nil时由文件事件回调自行读写
+	stopProc        StopProc        //事件循环退出后执行
 	logger          zerolog.Logger
 }
 
@@ -145,6 +150,22 @@ func (loop *AeLoop) RemoveTimeEvent(id int) {
 	}
 }
 
+func (loop *AeLoop) SetBeforeSleepProc(proc BeforeSleepProc) {
+	loop.beforeSleep = proc
+}
+
+func (loop *AeLoop) SetIOProc(proc IOProc) {
+	loop.ioProc = proc
+}
+
+func (loop *AeLoop) SetStopProc(proc StopProc) {
+	loop.stopProc = proc
+}
+
+func (loop *AeLoop) Stop() {
+	loop.stop = true
+}
+
 func AeLoopCreate(logger *zerolog.Logger) (*AeLoop, error) {
 	epollFd, err := unix.EpollCreate1(0)
 	if err != nil {
@@ -224,25 +245,9 @@ func (loop *AeLoop) AeProcess(tes []*AeTimeEvent, fes []*AeFileEvent) {
 		}
 	}
 	if len(fes) > 0 {
-		for _, fe := range fes {
-			if fe.mask == AE_READABLE && fe.fd != server.fd {
-				wg.Add(1)
-				// go func(fd int) {
-				// 	ReadBuffer(fd)
-				// 	wg.Done()
-				// }(fe.fd)
-				server.ReadPool.Invoke(fe.fd)
-			} else if fe.mask == AE_WRITABLE {
-				wg.Add(1)
-				// go func(fd int) {
-				// 	SendReplyToClient(fd)
-				// 	wg.Done()
-				// }(fe.fd)
-				server.WritePool.Invoke(fe.fd)
-			}
+		if loop.ioProc != nil {
+			loop.ioProc(loop, fes)
 		}
-		wg.Wait()
-
 		for _, fe := range fes {
 			fe.proc(loop, fe.fd, fe.extra)
 		}
@@ -251,20 +256,15 @@ func (loop *AeLoop) AeProcess(tes []*AeTimeEvent, fes []*AeFileEvent) {
 
 func (loop *AeLoop) AeMain() {
 	for !loop.stop {
+		if loop.beforeSleep != nil {
+			loop.beforeSleep(loop)
+		}
 		tes, fes := loop.AeWait()
 		loop.AeProcess(tes, fes)
 	}
 
-	for _, client := range server.clients {
-		freeClient(client)
+	if loop.stopProc != nil {
+		loop.stopProc(loop)
 	}
-
-	server.AOF.Buffer.Flush()
-	server.AOF.File.Close()
-
-	server.ReadPool.Release()
-	server.WritePool.Release()
-
-	ants.Release()
 	loop.logger.Info().Msg("ae loop exit")
 }
@@ -0,0 +1,65 @@
+package server
+
+/*
+复制积压缓冲区，环形保存最近写入复制流的字节，从节点断线重连后从中补发缺失的部分
+复制流中第一个字节的偏移量为1，end为最后写入的字节的偏移量，与master_repl_offset一致
+*/
+type replBacklog struct {
+	buf     []byte
+	idx     int   //下一个字节的写入位置
+	histlen int64 //缓冲区中有效数据的长度
+	end     int64
+}
+
+// 创建积压缓冲区，之后写入的第一个字节的偏移量为offset+1
+func newReplBacklog(size int64, offset int64) *replBacklog {
+	return &replBacklog{
+		buf: make([]byte, size),
+		end: offset,
+	}
+}
+
+func (b *replBacklog) size() int64 {
+	return int64(len(b.buf))
+}
+
+// 缓冲区中第一个字节的偏移量
+func (b *replBacklog) first() int64 {
+	return b.end - b.histlen + 1
+}
+
+func (b *replBacklog) feed(p []byte) {
+	b.end += int64(len(p))
+	for len(p) > 0 {
+		n := copy(b.buf[b.idx:], p)
+		b.idx = (b.idx + n) % len(b.buf)
+		b.histlen += int64(n)
+		p = p[n:]
+	}
+	if b.histlen > b.size() {
+		b.histlen = b.size()
+	}
+}
+
+// 缓冲区是否包含从offset开始到最新的数据
+func (b *replBacklog) contains(offset int64) bool {
+	return offset >= b.first() && offset <= b.end+1
+}
+
+// 从offset开始到最新的数据
+func (b *replBacklog) readFrom(offset int64) []byte {
+	skip := offset - b.first()
+	length := b.histlen - skip
+	out := make([]byte, 0, length)
+	start := (int64(b.idx) - b.histlen + skip + b.size()) % b.size()
+	for length > 0 {
+		end := start + length
+		if end > b.size() {
+			end = b.size()
+		}
+		out = append(out, b.buf[start:end]...)
+		length -= end - start
+		start = end % b.size()
+	}
+	return out
+}
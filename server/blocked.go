@@ -0,0 +1,91 @@
+package server
+
+import (
+	"github.com/godis/data"
+	"github.com/godis/errs"
+	"github.com/godis/util"
+)
+
+// 客户端阻塞的原因
+const (
+	BLOCKED_NONE    = iota
+	BLOCKED_WAIT    //WAIT等待从节点确认
+	BLOCKED_WAITAOF //WAITAOF等待本地与从节点AOF落盘
+)
+
+/*
+阻塞中的客户端不回复、不执行后续命令，已读入的命令在解除阻塞后继续处理
+事件循环不会因此阻塞，每次休眠前检查阻塞条件是否满足或已超时
+*/
+type blockingState struct {
+	btype       int
+	timeout     int64 //超时的毫秒时间，0表示一直等待
+	numReplicas int   //需要确认的从节点数
+	numLocal    int   //WAITAOF是否需要本地AOF落盘
+	offset      int64 //需要确认的复制偏移量
+}
+
+// 解析毫秒超时时间，不能为负数
+func getTimeoutArg(c *GodisClient, arg *data.Gobj) (int64, error) {
+	timeout, err := arg.Int64Val()
+	if err != nil {
+		c.AddReplyStr("-ERR timeout is not an integer or out of range\r\n")
+		return 0, err
+	}
+	if timeout < 0 {
+		c.AddReplyStr("-ERR timeout is negative\r\n")
+		return 0, errs.ParamsCheckError
+	}
+	return timeout, nil
+}
+
+// 阻塞客户端，timeout为等待的毫秒数，0表示一直等待
+func blockClient(c *GodisClient, btype int, timeout int64) {
+	c.bstate.btype = btype
+	if timeout > 0 {
+		c.bstate.timeout = util.GetMsTime() + timeout
+	}
+	server.blockedClients = append(server.blockedClients, c)
+}
+
+func unblockClient(c *GodisClient) {
+	for i, blocked := range server.blockedClients {
+		if blocked == c {
+			server.blockedClients = append(server.blockedClients[:i], server.blockedClients[i+1:]...)
+			break
+		}
+	}
+	c.bstate = blockingState{}
+}
+
+// 在事件循环休眠前回复条件已满足或已超时的阻塞客户端，并继续处理其已读入的命令
+func handleBlockedClients() {
+	if len(server.blockedClients) == 0 {
+		return
+	}
+	now := util.GetMsTime()
+	for _, c := range append([]*GodisClient(nil), server.blockedClients...) {
+		// 处理前一个客户端的命令时可能已释放该客户端
+		if c.bstate.btype == BLOCKED_NONE {
+			continue
+		}
+		timedOut := c.bstate.timeout > 0 && now >= c.bstate.timeout
+		var replied bool
+		switch c.bstate.btype {
+		case BLOCKED_WAIT:
+			replied = replyToWait(c, timedOut)
+		case BLOCKED_WAITAOF:
+			replied = replyToWaitAOF(c, timedOut)
+		}
+		if !replied {
+			continue
+		}
+		unblockClient(c)
+		if c.queryLen > 0 {
+			if err := ProcessQueryBuf(c); err != nil {
+				c.logEntry.Error().Err(err).Msg("process query buf")
+				freeClient(c)
+			}
+		}
+	}
+}
@@ -3,6 +3,8 @@ package server
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,119 +21,240 @@ var wgArgs sync.WaitGroup
 
 const sub = 'a' - 'A'
 
-type GodisClient struct {
-	fd       int
+// RESP请求的解析状态，客户端连接与代理共用
+type QueryParser struct {
 	args     []*data.Gobj
-	reply    *bytes.Buffer
 	queryBuf []byte
 	queryLen int
 	cmdTy    conf.CmdType
 	bulkNum  int
-	bulkLen  int
+	bulkLen  int //当前bulk参数长度，-1表示尚未读取长度
+}
+
+type GodisClient struct {
+	*QueryParser
+	fd       int
+	reply    *bytes.Buffer
 	logEntry zerolog.Logger
 	closed   bool
+
+	readTotal       int64 //累计读入的字节数
+	processedOffset int64 //最后一条完整命令的结束位置
+
+	propArgs []*data.Gobj //写入AOF的命令参数，为nil时使用原始参数
+
+	woff   int64 //执行最后一条命令后的复制偏移量，WAIT与WAITAOF等待该偏移量被确认
+	bstate blockingState
+
+	isMaster          bool     //从节点与主节点的连接
+	lastInteraction   int64    //最近一次收到数据的毫秒时间，用于检测主节点超时
+	replState         int      //从节点连接在主节点上的复制状态，0表示普通客户端
+	replListeningPort int      //从节点的监听端口
+	replDBFile        *os.File //发送给从节点的RDB
+	replDBOff         int64    //RDB已发送的字节数
+	replDBSize        int64
+	replBulkHeader    []byte          //RDB之前待发送的$<长度>\r\n
+	replPsync         bool            //从节点通过PSYNC同步，开始生成RDB时需要回复+FULLRESYNC
+	replAckOff        int64           //从节点上报的复制偏移量
+	replAckTime       int64           //最近一次收到从节点REPLCONF ACK的毫秒时间
+	replAofAckOff     int64           //从节点上报的AOF已落盘的复制偏移量
+	replCapaEOF       bool            //从节点支持以结束标记接收无盘复制的RDB
+	replWaitSince     int64           //开始等待全量同步的毫秒时间
+	replTarget        *disklessTarget //进行中的无盘复制
+	replStartOnAck    bool            //无盘复制完成后，收到从节点的第一个REPLCONF ACK才开始发送命令流
+
+	replPending    []byte //主节点发送的尚未转发给下级从节点的命令流
+	replReadOff    int64  //已追加到replPending的字节数
+	replAppliedOff int64  //已转发给下级从节点的字节数
+
+	asking bool //执行过ASKING，下一条命令可以访问正在迁入本节点的哈希槽
+}
+
+func NewQueryParser() *QueryParser {
+	return &QueryParser{
+		queryBuf: make([]byte, conf.GODIS_IO_BUF),
+		bulkLen:  -1,
+	}
 }
 
 func InitGodisClientInstance() *GodisClient {
 	return &GodisClient{
-		// fd:       fd,
-		queryBuf: make([]byte, conf.GODIS_IO_BUF),
-		reply:    bytes.NewBuffer(make([]byte, 0, conf.GODIS_REPLY_BUF)),
-		// logEntry: server.logger.With().Int("client-fd", fd).Logger(),
-		closed: false,
+		QueryParser: NewQueryParser(),
+		reply:       bytes.NewBuffer(make([]byte, 0, conf.GODIS_REPLY_BUF)),
+		closed:      false,
 	}
 }
 
-func (client *GodisClient) findLineInQuery() (int, error) {
-	index := strings.Index(string(client.queryBuf[:client.queryLen]), "\r\n")
-	if index < 0 && client.queryLen > conf.GODIS_MAX_INLINE {
+// 从fd读入数据追加到查询缓冲区，读取较大的bulk参数时一次扩容到足够容纳整个参数，避免每次只读入GODIS_MAX_BULK字节
+func (p *QueryParser) ReadFd(fd int) (int, error) {
+	need := conf.GODIS_MAX_BULK
+	if p.bulkLen >= 0 && p.bulkLen+2-p.queryLen > need {
+		need = p.bulkLen + 2 - p.queryLen
+	}
+	if len(p.queryBuf)-p.queryLen < need {
+		p.queryBuf = append(p.queryBuf, make([]byte, need)...)
+	}
+	n, err := net.Read(fd, p.queryBuf[p.queryLen:])
+	if err != nil {
+		return 0, err
+	}
+	p.queryLen += n
+	return n, nil
+}
+
+/*
+解析查询缓冲区中的下一条命令，命令完整时返回true，参数通过Args取得，处理完后调用Reset
+数据不足时返回false，等待读入更多数据
+*/
+func (p *QueryParser) Parse() (bool, error) {
+	if p.queryLen == 0 {
+		return false, nil
+	}
+	if p.cmdTy == conf.COMMAND_UNKNOWN {
+		if p.queryBuf[0] == '*' {
+			p.cmdTy = conf.COMMAND_BULK
+		} else {
+			p.cmdTy = conf.COMMAND_INLINE
+		}
+	}
+	if p.cmdTy == conf.COMMAND_BULK {
+		return p.parseBulk()
+	}
+	return p.parseInline()
+}
+
+func (p *QueryParser) Args() []*data.Gobj {
+	return p.args
+}
+
+func (p *QueryParser) Reset() {
+	p.args = p.args[:0]
+	p.cmdTy = conf.COMMAND_UNKNOWN
+	p.bulkLen = -1
+	p.bulkNum = 0
+}
+
+func (p *QueryParser) findLineInQuery() (int, error) {
+	index := strings.Index(string(p.queryBuf[:p.queryLen]), "\r\n")
+	if index < 0 && p.queryLen > conf.GODIS_MAX_INLINE {
 		return index, errs.OutOfLimitError
 	}
 	return index, nil
 }
 
-func (client *GodisClient) getNumInQuery(s, e int) (int, error) {
-	num, err := strconv.Atoi(string(client.queryBuf[s:e]))
-	client.queryBuf = client.queryBuf[e+2:]
-	client.queryLen -= e + 2
+func (p *QueryParser) getNumInQuery(s, e int) (int, error) {
+	num, err := strconv.Atoi(string(p.queryBuf[s:e]))
+	p.queryBuf = p.queryBuf[e+2:]
+	p.queryLen -= e + 2
 	return num, err
 }
 
-func handleInlineBuf(client *GodisClient) (bool, error) {
+// 内联命令不完整时等待读入更多数据，超过GODIS_MAX_INLINE仍没有换行则报错
+func (p *QueryParser) parseInline() (bool, error) {
+	index, err := p.findLineInQuery()
+	if index < 0 {
+		return false, err
+	}
+	subs := strings.Split(string(p.queryBuf[:index]), " ")
+	p.queryBuf = p.queryBuf[index+2:]
+	p.queryLen -= index + 2
+	p.args = append(p.args, make([]*data.Gobj, len(subs)-len(p.args))...)
+
+	for i, v := range subs {
+		p.args[i] = data.CreateObject(conf.GSTR, v)
+	}
+	return true, nil
+}
+
+/*
+处理AOF中的注释行，目前只有时间戳注释#TS:<毫秒时间戳>
+指定了恢复时间点时，遇到晚于该时间点的注释即停止加载，processedOffset指向该注释的起始位置
+*/
+func handleAnnotation(client *GodisClient) (bool, error) {
 	index := strings.Index(string(client.queryBuf[:client.queryLen]), "\r\n")
 	if index < 0 {
-		if client.queryLen > conf.GODIS_MAX_INLINE {
-			return false, errs.OutOfLimitError
-		} else {
-			return false, errs.CustomError
+		return false, nil
+	}
+	line := string(client.queryBuf[:index])
+	if ts, ok := strings.CutPrefix(line, conf.AOF_ANNOTATION_TIMESTAMP); ok {
+		timestamp, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return false, errs.AOFFormatError
+		}
+		if server.AOF.RestoreUntil > 0 && timestamp > server.AOF.RestoreUntil {
+			client.processedOffset = client.readTotal - int64(client.queryLen)
+			return false, errs.AOFRestorePointError
 		}
 	}
-	subs := strings.Split(string(client.queryBuf[:index]), " ")
 	client.queryBuf = client.queryBuf[index+2:]
 	client.queryLen -= index + 2
-	client.args = append(client.args, make([]*data.Gobj, len(subs)-len(client.args))...)
-
-	for i, v := range subs {
-		client.args[i] = data.CreateObject(conf.GSTR, v)
-	}
 	return true, nil
 }
 
-func handleBulkBuf(client *GodisClient) (bool, error) {
-	if client.bulkNum == 0 {
-		index, err := client.findLineInQuery()
+func (p *QueryParser) parseBulk() (bool, error) {
+	if p.bulkNum == 0 {
+		index, err := p.findLineInQuery()
 		if index < 0 {
 			return false, err
 		}
-		bnum, err := client.getNumInQuery(1, index)
+		bnum, err := p.getNumInQuery(1, index)
 		if err != nil {
 			return false, err
 		}
 		if bnum == 0 {
 			return true, nil
 		}
-		client.bulkNum = bnum
-		client.args = append(client.args, make([]*data.Gobj, bnum-len(client.args))...)
+		if bnum < 0 {
+			return false, errs.WrongCmdError
+		}
+		p.bulkNum = bnum
+		p.args = append(p.args, make([]*data.Gobj, bnum-len(p.args))...)
 	}
-	for client.bulkNum > 0 {
-		if client.bulkLen == 0 {
-			index, err := client.findLineInQuery()
+	for p.bulkNum > 0 {
+		if p.bulkLen < 0 {
+			index, err := p.findLineInQuery()
 			if index < 0 {
 				return false, err
 			}
-			if client.queryBuf[0] != '$' {
+			if p.queryBuf[0] != '$' {
 				return false, errs.WrongCmdError
 			}
-			blen, err := client.getNumInQuery(1, index)
-			if err != nil || blen == 0 {
+			blen, err := p.getNumInQuery(1, index)
+			if err != nil {
 				return false, err
 			}
-			if blen > conf.GODIS_MAX_BULK {
+			if blen < 0 {
+				return false, errs.WrongCmdError
+			}
+			if blen > conf.GODIS_PROTO_MAX_BULK_LEN {
 				return false, errs.OutOfLimitError
 			}
-			client.bulkLen = blen
+			p.bulkLen = blen
 		}
-		if client.queryLen < client.bulkLen+2 {
+		if p.queryLen < p.bulkLen+2 {
 			return false, nil
 		}
-		index := client.bulkLen
-		if client.queryBuf[index] != '\r' || client.queryBuf[index+1] != '\n' {
+		index := p.bulkLen
+		if p.queryBuf[index] != '\r' || p.queryBuf[index+1] != '\n' {
 			return false, errs.WrongCmdError
 		}
-		client.args[len(client.args)-client.bulkNum] = data.CreateObject(conf.GSTR, util.BytesToString(client.queryBuf[:index]))
-		client.queryBuf = client.queryBuf[index+2:]
-		client.queryLen -= index + 2
-		client.bulkLen = 0
-		client.bulkNum--
+		p.args[len(p.args)-p.bulkNum] = data.CreateObject(conf.GSTR, util.BytesToString(p.queryBuf[:index]))
+		p.queryBuf = p.queryBuf[index+2:]
+		p.queryLen -= index + 2
+		p.bulkLen = -1
+		p.bulkNum--
 	}
 	return true, nil
 }
 
 func ProcessQueryBuf(client *GodisClient) error {
-	for client.queryLen > 0 {
+	// 阻塞中的客户端在解除阻塞后继续处理
+	for client.queryLen > 0 && client.bstate.btype == BLOCKED_NONE {
 		if client.cmdTy == conf.COMMAND_UNKNOWN {
 			if client.queryBuf[0] == '*' {
 				client.cmdTy = conf.COMMAND_BULK
+			} else if client.fd == -1 && client.queryBuf[0] == '#' {
+				client.cmdTy = conf.COMMAND_ANNOTATION
 			} else {
 				client.cmdTy = conf.COMMAND_INLINE
 			}
@@ -139,9 +262,11 @@ func ProcessQueryBuf(client *GodisClient) error {
 		var ok bool
 		var err error
 		if client.cmdTy == conf.COMMAND_INLINE {
-			ok, err = handleInlineBuf(client)
+			ok, err = client.parseInline()
 		} else if client.cmdTy == conf.COMMAND_BULK {
-			ok, err = handleBulkBuf(client)
+			ok, err = client.parseBulk()
+		} else if client.cmdTy == conf.COMMAND_ANNOTATION {
+			ok, err = handleAnnotation(client)
 		} else {
 			return errs.WrongCmdError
 		}
@@ -149,6 +274,7 @@ func ProcessQueryBuf(client *GodisClient) error {
 			return err
 		}
 		if ok {
+			client.processedOffset = client.readTotal - int64(client.queryLen)
 			if len(client.args) == 0 {
 				resetClient(client)
 			} else {
@@ -161,7 +287,7 @@ func ProcessQueryBuf(client *GodisClient) error {
 	return nil
 }
 
-func lookupCommand(cmdStr string) *GodisCommand {
+func LookupCommand(cmdStr string) *GodisCommand {
 	for _, c := range cmdTable {
 		if len(cmdStr) == len(c.name) {
 			for i := range cmdStr {
@@ -179,6 +305,10 @@ func lookupCommand(cmdStr string) *GodisCommand {
 
 func SendReplyToClient(fd int) {
 	client := server.clients[fd]
+	if client.replState == REPL_REPLICA_SEND_BULK {
+		writeBulkToReplica(client)
+		return
+	}
 	if client.reply.Len() > 0 {
 		n, err := net.Write(client.fd, client.reply.Bytes())
 
@@ -197,11 +327,20 @@ func ReplyClient(loop *AeLoop, fd int, extra any) {
 		freeClient(client)
 		return
 	}
+	// 同一轮事件中读事件处理的命令可能在发送之后追加了回复，此时保留可写事件在下一轮发送
+	if client.reply.Len() > 0 {
+		return
+	}
 	loop.ModReadEvent(fd)
 }
 
+// AOF客户端与主节点的连接不需要回复，从节点的回复缓冲区只用于复制流
+func (client *GodisClient) canReply() bool {
+	return client.fd != -1 && !client.isMaster && client.replState == 0
+}
+
 func (client *GodisClient) AddReplyStr(str string) {
-	if client.fd != -1 {
+	if client.canReply() {
 		client.reply.WriteString(str)
 		server.AeLoop.ModWriteEvent(client.fd, AE_WRITABLE, ReplyClient, client)
 
@@ -209,7 +348,7 @@ func (client *GodisClient) AddReplyStr(str string) {
 }
 
 func (client *GodisClient) AddReplyStrVal(str string) {
-	if client.fd != -1 {
+	if client.canReply() {
 
 		client.reply.WriteByte('$')
 		client.reply.WriteString(strconv.Itoa(len(str)))
@@ -223,7 +362,7 @@ func (client *GodisClient) AddReplyStrVal(str string) {
 }
 
 func (client *GodisClient) AddReplyIntVal(numVal string) {
-	if client.fd != -1 {
+	if client.canReply() {
 
 		client.reply.WriteByte(':')
 		client.reply.WriteString(numVal)
@@ -235,7 +374,7 @@ func (client *GodisClient) AddReplyIntVal(numVal string) {
 }
 
 func (client *GodisClient) AddReplyBytes(bytes []byte) {
-	if client.fd != -1 {
+	if client.canReply() {
 		client.reply.Write(bytes)
 		server.AeLoop.ModWriteEvent(client.fd, AE_WRITABLE, ReplyClient, client)
 	}
@@ -246,7 +385,10 @@ func ProcessCommand(c *GodisClient) {
 		freeClient(c)
 		return
 	}
-	cmd := lookupCommand(cmdStr)
+	// ASKING只对紧随其后的一条命令有效
+	asking := c.asking
+	c.asking = false
+	cmd := LookupCommand(cmdStr)
 	if cmd == nil {
 		c.AddReplyStr(fmt.Sprintf("-ERR unknown command '%s'\r\n", cmdStr))
 		resetClient(c)
@@ -257,9 +399,25 @@ func ProcessCommand(c *GodisClient) {
 		resetClient(c)
 		return
 	}
+	// 集群模式下key不由本节点负责时重定向，主节点同步与AOF加载的命令直接执行
+	if server.cluster != nil && c.fd != -1 && !c.isMaster && !clusterRedirectIfNeeded(c, cmd, asking) {
+		resetClient(c)
+		return
+	}
+	// 只读从节点只执行主节点同步的写命令
+	if cmd.isModify && server.masterHost != "" && server.replicaReadOnly && c.fd != -1 && !c.isMaster {
+		c.AddReplyStr("-READONLY You can't write against a read only replica.\r\n")
+		resetClient(c)
+		return
+	}
 
 	start := util.GetUsTime()
+	server.currentClient = c
 	ok, err := cmd.proc(c)
+	server.currentClient = nil
+	if server.cluster != nil {
+		server.cluster.updateSlotKeys(cmd.GetKeys(c.args))
+	}
 	if err != nil {
 		resetClient(c)
 		return
@@ -293,25 +451,55 @@ func ProcessCommand(c *GodisClient) {
 		}))
 	}
 
-	if c.fd == -1 || !server.AOF.AppendOnly {
+	// 加载AOF时重放的命令不计入修改次数
+	if cmd.isModify && ok && c.fd != -1 {
+		server.RDB.Dirty++
+	}
+
+	if c.fd == -1 {
 		resetClient(c)
 		return
 	}
 
 	if cmd.isModify && ok {
-		//针对expire命令，需要计算过期的绝对时间
-		if cmd.name == "expire" {
-			err := server.AOF.PersistExpireCommand(c.args)
-			if err != nil {
-				c.logEntry.Error().Err(err).Msgf("AOF persist failed. Command: %v Appendfsync: %d", server.AOF.Command, server.AOF.Appendfsync)
-			}
+		args := c.args
+		if c.propArgs != nil {
+			args = c.propArgs
+		}
+		// 主节点同步的命令流由replicationFeedStreamFromMaster原样转发给下级从节点
+		if c.isMaster {
+			feedAppendOnlyFile(args)
 		} else {
-			err := server.AOF.PersistCommand(c.args)
-			if err != nil {
-				c.logEntry.Error().Err(err).Msgf("AOF persist failed. Command: %v Appendfsync: %d", server.AOF.Command, server.AOF.Appendfsync)
-			}
+			propagate(args)
 		}
-		resetClient(c)
+	}
+	c.woff = server.masterReplOffset
+	resetClient(c)
+}
+
+// 将写命令写入AOF并发送给从节点
+func propagate(args []*data.Gobj) {
+	feedAppendOnlyFile(args)
+	replicationFeedReplicas(args)
+}
+
+func feedAppendOnlyFile(args []*data.Gobj) {
+	if !server.AOF.AppendOnly {
+		return
+	}
+	if err := server.AOF.PersistCommand(args); err != nil {
+		server.logger.Error().Err(err).Msgf("AOF persist failed. Command: %v Appendfsync: %d", server.AOF.Command, server.AOF.Appendfsync)
+	}
+}
+
+/*
+修改命令写入AOF时使用的参数
+用于将相对时间等重放时结果不确定的参数转换为确定的形式，例如expire改写为pexpireat
+*/
+func (client *GodisClient) rewriteCommand(args ...string) {
+	client.propArgs = make([]*data.Gobj, len(args))
+	for i, arg := range args {
+		client.propArgs[i] = data.CreateObject(conf.GSTR, arg)
 	}
 }
 
@@ -322,7 +510,16 @@ func ReadQueryFromClient(loop *AeLoop, fd int, extra any) {
 		freeClient(client)
 		return
 	}
+	if client.isMaster {
+		client.lastInteraction = util.GetMsTime()
+		unread := client.readTotal - client.replReadOff
+		client.replPending = append(client.replPending, client.queryBuf[int64(client.queryLen)-unread:client.queryLen]...)
+		client.replReadOff = client.readTotal
+	}
 	err := ProcessQueryBuf(client)
+	if client.isMaster && server.master == client {
+		replicationFeedStreamFromMaster(client)
+	}
 	if err != nil {
 		client.logEntry.Error().Err(err).Msg("process query buf")
 		freeClient(client)
@@ -330,27 +527,40 @@ func ReadQueryFromClient(loop *AeLoop, fd int, extra any) {
 	}
 }
 
-func (client *GodisClient) ReadQueryFromAOF() {
+/*
+从AOF中读取并重放命令，返回最后一条完整命令的结束位置
+命令格式错误返回AOFFormatError，文件末尾存在不完整的命令返回AOFTruncatedError
+*/
+func (client *GodisClient) ReadQueryFromAOF(reader io.Reader) (int64, error) {
 	for {
-		n, err := server.AOF.Buffer.Read(client.queryBuf[client.queryLen : client.queryLen+4096])
-		if err != nil {
+		n, err := reader.Read(client.queryBuf[client.queryLen : client.queryLen+4096])
+		if n > 0 {
+			// 更新client参数
+			client.queryLen += n
+			client.readTotal += int64(n)
+
+			if perr := ProcessQueryBuf(client); perr == errs.AOFRestorePointError {
+				return client.processedOffset, perr
+			} else if perr != nil {
+				client.logEntry.Error().Err(perr).Int64("offset", client.processedOffset).Msg("bad file format reading the append only file")
+				return client.processedOffset, errs.AOFFormatError
+			}
+		}
+		if err == io.EOF {
 			break
 		}
-		// 更新client参数
-		client.queryLen += n
-		// client.logEntry.Printf("read %v bytes from client:%v\n", n, client.fd)
-
-		err = ProcessQueryBuf(client)
 		if err != nil {
-			// client.logEntry.Printf("process query buf err: %v\n", err)
-			continue
+			return client.processedOffset, err
 		}
 
 		if len(client.queryBuf)-client.queryLen < conf.GODIS_MAX_BULK {
 			client.queryBuf = append(client.queryBuf, make([]byte, conf.GODIS_MAX_BULK)...)
 		}
-
 	}
+	if client.queryLen > 0 || client.cmdTy != conf.COMMAND_UNKNOWN {
+		return client.processedOffset, errs.AOFTruncatedError
+	}
+	return client.processedOffset, nil
 }
 
 func freeArg(client *GodisClient, i int) {
@@ -368,27 +578,59 @@ func freeArgs(client *GodisClient) {
 
 func resetClient(client *GodisClient) {
 	freeArgs(client)
-	client.cmdTy = conf.COMMAND_UNKNOWN
-	client.bulkLen = 0
-	client.bulkNum = 0
+	client.propArgs = nil
+	client.QueryParser.Reset()
 }
 func freeClient(client *GodisClient) {
 	resetClient(client)
+	if client.bstate.btype != BLOCKED_NONE {
+		unblockClient(client)
+	}
+	if client.replState != 0 {
+		replicationRemoveReplica(client)
+	}
+	if client.isMaster && server.master == client {
+		replicationHandleMasterDisconnection()
+	}
 	delete(server.clients, client.fd)
 	server.AeLoop.RemoveFileEvent(client.fd)
-	net.Close(client.fd)
+	if client.replTarget != nil {
+		// 无盘复制的goroutine可能仍在写入，fd在传输结束后关闭
+		client.replTarget.released.Store(true)
+		client.replTarget = nil
+	} else {
+		net.Close(client.fd)
+	}
 	client.reply.Reset()
 	client.queryBuf = client.queryBuf[:0]
 	client.queryLen = 0
+	client.readTotal = 0
+	client.processedOffset = 0
+	client.isMaster = false
+	client.replState = 0
+	client.replListeningPort = 0
+	client.replBulkHeader = nil
+	client.replPsync = false
+	client.replAckOff = 0
+	client.replAckTime = 0
+	client.replAofAckOff = 0
+	client.replCapaEOF = false
+	client.replWaitSince = 0
+	client.replStartOnAck = false
+	client.woff = 0
+	client.replPending = nil
+	client.replReadOff = 0
+	client.replAppliedOff = 0
+	client.asking = false
 
 	server.clientPool.Put(client)
 }
 
 func freeAOFClient(client *GodisClient) {
 	for i := range client.args {
-		if client.args == nil {
-			break
-
+		// 末尾命令不完整时，args中可能存在未填充的参数
+		if client.args[i] == nil {
+			continue
 		}
 		client.args[i].DecrRefCount()
 	}
@@ -398,11 +640,7 @@ func freeAOFClient(client *GodisClient) {
 
 func ReadBuffer(fd int) {
 	client := server.clients[fd]
-
-	if len(client.queryBuf)-client.queryLen < conf.GODIS_MAX_BULK {
-		client.queryBuf = append(client.queryBuf, make([]byte, conf.GODIS_MAX_BULK)...)
-	}
-	n, err := net.Read(client.fd, client.queryBuf[client.queryLen:])
+	n, err := client.ReadFd(client.fd)
 	if err != nil {
 		client.logEntry.Error().Err(err).Msgf("client %d read", client.fd)
 		client.closed = true
@@ -412,5 +650,5 @@ func ReadBuffer(fd int) {
 		client.closed = true
 		return
 	}
-	client.queryLen += n
+	client.readTotal += int64(n)
 }
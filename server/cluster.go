@@ -0,0 +1,1164 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	gonet "net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/godis/conf"
+	"github.com/godis/data"
+	"github.com/godis/errs"
+	"github.com/godis/util"
+)
+
+// 节点的状态标记
+const (
+	CLUSTER_NODE_MYSELF    = 1 << iota //本节点
+	CLUSTER_NODE_MASTER                //主节点
+	CLUSTER_NODE_SLAVE                 //从节点
+	CLUSTER_NODE_PFAIL                 //本节点认为其疑似下线
+	CLUSTER_NODE_FAIL                  //多数主节点认为其已下线
+	CLUSTER_NODE_HANDSHAKE             //握手中，尚不知道其真实ID
+	CLUSTER_NODE_NOADDR                //地址未知
+	CLUSTER_NODE_MEET                  //握手时发送MEET而不是PING，让对方无条件接纳本节点
+)
+
+var clusterNodeFlagNames = []string{"myself", "master", "slave", "fail?", "fail", "handshake", "noaddr", "meet"}
+
+const (
+	CLUSTER_OK = iota
+	CLUSTER_FAIL
+)
+
+// 集群节点
+type clusterNode struct {
+	id       string
+	ip       string
+	port     int
+	cport    int            //集群总线端口
+	flags    int            //CLUSTER_NODE_*
+	slots    []byte         //负责的哈希槽位图
+	master   *clusterNode   //从节点复制的主节点
+	replicas []*clusterNode //主节点的从节点
+
+	configEpoch  uint64                 //主节点声明哈希槽时使用的纪元，哈希槽冲突时纪元大的一方胜出
+	replOffset   int64                  //最近一次收到的复制偏移量，从节点据此确定选举的先后
+	ctime        int64                  //创建时间，握手超时后删除
+	pingSent     int64                  //等待PONG的PING的发送时间，0表示没有
+	pongReceived int64                  //最近一次收到PONG的时间
+	failTime     int64                  //被标记为FAIL的时间
+	votedTime    int64                  //最近一次为该主节点的从节点投票的时间
+	failReports  map[*clusterNode]int64 //报告该节点PFAIL或FAIL的主节点及报告时间
+	link         *clusterLink           //本节点向其建立的总线连接
+}
+
+/*
+集群状态，16384个哈希槽分布在各主节点上，key所在的哈希槽由CRC16(key)%16384计算，
+key中包含{tag}时只对tag计算，使相关的key落在同一个哈希槽
+节点间通过集群总线交换各自的哈希槽与纪元，状态变化后写回集群配置文件
+*/
+type clusterState struct {
+	myself        *clusterNode
+	currentEpoch  uint64 //集群的当前纪元
+	lastVoteEpoch uint64 //本节点最近一次投票的纪元，每个纪元只投一票
+	state         int    //CLUSTER_OK|CLUSTER_FAIL
+	nodes         map[string]*clusterNode
+	blacklist     map[string]int64 //FORGET的节点及其过期的秒级时间
+	slots         []*clusterNode   //每个哈希槽所属的主节点，未分配为nil
+
+	migratingTo   []*clusterNode        //正在从本节点迁出的哈希槽的目标节点
+	importingFrom []*clusterNode        //正在迁入本节点的哈希槽的源节点
+	slotKeys      []map[string]struct{} //每个哈希槽中的key，用于GETKEYSINSLOT与COUNTKEYSINSLOT
+
+	configFile     string
+	todoSaveConfig bool  //配置有变化，在事件循环休眠前写回
+	nodeTimeout    int64 //节点超时时间，毫秒
+
+	// 从节点发起的故障转移
+	failoverAuthTime  int64  //发起选举的时间
+	failoverAuthCount int    //获得的票数
+	failoverAuthSent  bool   //是否已请求投票
+	failoverAuthRank  int    //复制偏移量在同一主节点的从节点中的排名，排名靠后的从节点推迟发起选举
+	failoverAuthEpoch uint64 //选举的纪元
+
+	listener         gonet.Listener
+	events           chan *clusterBusEvent //总线连接的读写在goroutine中进行，结果交给事件循环处理
+	cronLoops        int64
+	statsMsgSent     []int64 //按消息类型统计的发送数量
+	statsMsgReceived []int64
+}
+
+func createClusterNode(id string, flags int) *clusterNode {
+	if id == "" {
+		id = genRandomHex(conf.CLUSTER_NAMELEN)
+	}
+	return &clusterNode{
+		id:          id,
+		flags:       flags,
+		slots:       make([]byte, conf.CLUSTER_SLOTS/8),
+		ctime:       util.GetMsTime(),
+		failReports: make(map[*clusterNode]int64),
+	}
+}
+
+func (n *clusterNode) isMaster() bool {
+	return n.flags&CLUSTER_NODE_MASTER != 0
+}
+
+func (n *clusterNode) inHandshake() bool {
+	return n.flags&CLUSTER_NODE_HANDSHAKE != 0
+}
+
+func (n *clusterNode) failed() bool {
+	return n.flags&CLUSTER_NODE_FAIL != 0
+}
+
+func (n *clusterNode) timedOut() bool {
+	return n.flags&CLUSTER_NODE_PFAIL != 0
+}
+
+func (n *clusterNode) hasSlot(slot int) bool {
+	return n.slots[slot/8]&(1<<(slot%8)) != 0
+}
+
+func (n *clusterNode) setSlot(slot int) {
+	n.slots[slot/8] |= 1 << (slot % 8)
+}
+
+func (n *clusterNode) clearSlot(slot int) {
+	n.slots[slot/8] &^= 1 << (slot % 8)
+}
+
+func (n *clusterNode) numSlots() int {
+	count := 0
+	for slot := 0; slot < conf.CLUSTER_SLOTS; slot++ {
+		if n.hasSlot(slot) {
+			count++
+		}
+	}
+	return count
+}
+
+// 节点负责的连续哈希槽区间，依次为起始、结束
+func (n *clusterNode) slotRanges() []int {
+	var ranges []int
+	start := -1
+	for slot := 0; slot <= conf.CLUSTER_SLOTS; slot++ {
+		if slot < conf.CLUSTER_SLOTS && n.hasSlot(slot) {
+			if start == -1 {
+				start = slot
+			}
+		} else if start != -1 {
+			ranges = append(ranges, start, slot-1)
+			start = -1
+		}
+	}
+	return ranges
+}
+
+func (n *clusterNode) flagsString() string {
+	var names []string
+	for i, name := range clusterNodeFlagNames {
+		if n.flags&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "noflags"
+	}
+	return strings.Join(names, ",")
+}
+
+// key所在的哈希槽
+func KeyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start != -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(util.Crc16(key)) & (conf.CLUSTER_SLOTS - 1)
+}
+
+// 解析"起始-结束"或单个哈希槽
+func parseSlotRange(s string) (int, int, error) {
+	startStr, endStr, found := strings.Cut(s, "-")
+	if !found {
+		endStr = startStr
+	}
+	start, err1 := strconv.Atoi(startStr)
+	end, err2 := strconv.Atoi(endStr)
+	if err1 != nil || err2 != nil || start < 0 || end >= conf.CLUSTER_SLOTS || start > end {
+		return 0, 0, fmt.Errorf("invalid slot range %q", s)
+	}
+	return start, end, nil
+}
+
+/*
+从集群配置文件加载集群状态，文件不存在时以新的ID作为不负责哈希槽的主节点启动，
+之后在集群总线端口监听其他节点的连接，本节点为从节点时开始复制其主节点
+*/
+func clusterInit(filename string, nodeTimeout int64) error {
+	if nodeTimeout <= 0 {
+		nodeTimeout = conf.CLUSTER_DEFAULT_NODE_TIMEOUT
+	}
+	cluster := &clusterState{
+		nodes:            make(map[string]*clusterNode),
+		blacklist:        make(map[string]int64),
+		slots:            make([]*clusterNode, conf.CLUSTER_SLOTS),
+		migratingTo:      make([]*clusterNode, conf.CLUSTER_SLOTS),
+		importingFrom:    make([]*clusterNode, conf.CLUSTER_SLOTS),
+		configFile:       filename,
+		nodeTimeout:      nodeTimeout,
+		state:            CLUSTER_FAIL,
+		events:           make(chan *clusterBusEvent, 1024),
+		statsMsgSent:     make([]int64, CLUSTER_MSG_TYPE_COUNT),
+		statsMsgReceived: make([]int64, CLUSTER_MSG_TYPE_COUNT),
+	}
+	content, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		cluster.myself = createClusterNode("", CLUSTER_NODE_MYSELF|CLUSTER_NODE_MASTER)
+		cluster.nodes[cluster.myself.id] = cluster.myself
+		server.logger.Info().Msgf("no cluster configuration found, I'm %s", cluster.myself.id)
+		cluster.todoSaveConfig = true
+	} else if err != nil {
+		server.logger.Error().Err(err).Msgf("read cluster config file %s failed", filename)
+		return errs.ClusterConfigError
+	} else if err := cluster.loadConfig(string(content)); err != nil {
+		server.logger.Error().Err(err).Msgf("parse cluster config file %s failed", filename)
+		return errs.ClusterConfigError
+	}
+	myself := cluster.myself
+	myself.port = server.port
+	myself.cport = server.port + conf.CLUSTER_PORT_INCR
+
+	cluster.listener, err = gonet.Listen("tcp", fmt.Sprintf(":%d", myself.cport))
+	if err != nil {
+		server.logger.Error().Err(err).Msgf("listen cluster bus port %d failed", myself.cport)
+		return errs.ClusterConfigError
+	}
+	go clusterAcceptLoop(cluster.listener, cluster.events)
+
+	server.cluster = cluster
+	cluster.rebuildSlotKeys()
+	cluster.updateState()
+	if myself.master != nil && myself.master.ip != "" {
+		replicationSetMaster(myself.master.ip, myself.master.port)
+	}
+	if cluster.todoSaveConfig {
+		cluster.saveConfigOrLog()
+	}
+	return nil
+}
+
+/*
+解析集群配置文件，每行一个节点，格式与CLUSTER NODES相同，
+最后一行为vars currentEpoch <纪元> lastVoteEpoch <纪元>
+*/
+func (cluster *clusterState) loadConfig(content string) error {
+	var replicaOf [][2]string
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				val, err := strconv.ParseUint(fields[i+1], 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid vars %q", line)
+				}
+				switch fields[i] {
+				case "currentEpoch":
+					cluster.currentEpoch = val
+				case "lastVoteEpoch":
+					cluster.lastVoteEpoch = val
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 || len(fields[0]) != conf.CLUSTER_NAMELEN {
+			return fmt.Errorf("invalid node line %q", line)
+		}
+		node := cluster.nodes[fields[0]]
+		if node == nil {
+			node = createClusterNode(fields[0], 0)
+			cluster.nodes[node.id] = node
+		}
+		hostPort, cport, _ := strings.Cut(fields[1], "@")
+		host, port, err := gonet.SplitHostPort(hostPort)
+		if err != nil {
+			return fmt.Errorf("invalid node address %q", fields[1])
+		}
+		node.ip = host
+		node.port, _ = strconv.Atoi(port)
+		node.cport, _ = strconv.Atoi(cport)
+		for _, flag := range strings.Split(fields[2], ",") {
+			for i, name := range clusterNodeFlagNames {
+				if flag == name {
+					node.flags |= 1 << i
+				}
+			}
+		}
+		// 疑似下线与握手状态在重启后重新判断
+		node.flags &^= CLUSTER_NODE_PFAIL | CLUSTER_NODE_HANDSHAKE
+		if node.flags&CLUSTER_NODE_MYSELF != 0 {
+			if cluster.myself != nil {
+				return fmt.Errorf("more than one myself node")
+			}
+			cluster.myself = node
+		}
+		if fields[3] != "-" {
+			replicaOf = append(replicaOf, [2]string{node.id, fields[3]})
+		}
+		if node.configEpoch, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+			return fmt.Errorf("invalid config epoch %q", fields[6])
+		}
+		for _, r := range fields[8:] {
+			// 迁移中的哈希槽，[slot->-目标节点]或[slot-<-源节点]
+			if strings.HasPrefix(r, "[") {
+				slotStr, target, migrating := strings.Cut(strings.Trim(r, "[]"), "->-")
+				if !migrating {
+					slotStr, target, _ = strings.Cut(strings.Trim(r, "[]"), "-<-")
+				}
+				slot, err := strconv.Atoi(slotStr)
+				if err != nil || slot < 0 || slot >= conf.CLUSTER_SLOTS {
+					return fmt.Errorf("invalid slot %q", r)
+				}
+				peer := cluster.nodes[target]
+				if peer == nil {
+					peer = createClusterNode(target, 0)
+					cluster.nodes[target] = peer
+				}
+				if migrating {
+					cluster.migratingTo[slot] = peer
+				} else {
+					cluster.importingFrom[slot] = peer
+				}
+				continue
+			}
+			start, end, err := parseSlotRange(r)
+			if err != nil {
+				return err
+			}
+			for slot := start; slot <= end; slot++ {
+				node.setSlot(slot)
+				cluster.slots[slot] = node
+			}
+		}
+	}
+	if cluster.myself == nil {
+		return fmt.Errorf("myself node not found")
+	}
+	for _, pair := range replicaOf {
+		node, master := cluster.nodes[pair[0]], cluster.nodes[pair[1]]
+		if master == nil {
+			master = createClusterNode(pair[1], CLUSTER_NODE_MASTER|CLUSTER_NODE_NOADDR)
+			cluster.nodes[master.id] = master
+		}
+		cluster.setNodeReplicaOf(node, master)
+	}
+	return nil
+}
+
+// 写回集群配置文件，先写入临时文件再重命名，避免写入中途退出损坏原文件
+func (cluster *clusterState) saveConfig() error {
+	content := cluster.genNodesDescription(true) +
+		fmt.Sprintf("vars currentEpoch %d lastVoteEpoch %d\n", cluster.currentEpoch, cluster.lastVoteEpoch)
+	tmp := fmt.Sprintf("%s.tmp-%d", cluster.configFile, os.Getpid())
+	if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cluster.configFile)
+}
+
+func (cluster *clusterState) saveConfigOrLog() {
+	cluster.todoSaveConfig = false
+	if err := cluster.saveConfig(); err != nil {
+		server.logger.Error().Err(err).Msgf("save cluster config file %s failed", cluster.configFile)
+	}
+}
+
+// 节点按ID排序，使CLUSTER命令的输出稳定
+func (cluster *clusterState) sortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(cluster.nodes))
+	for _, node := range cluster.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].id < nodes[j].id
+	})
+	return nodes
+}
+
+// 负责哈希槽的主节点数量，故障判定与选举需要其中的多数同意
+func (cluster *clusterState) size() int {
+	size := 0
+	for _, node := range cluster.nodes {
+		if node.isMaster() && node.numSlots() > 0 {
+			size++
+		}
+	}
+	return size
+}
+
+func (cluster *clusterState) setNodeAsMaster(n *clusterNode) {
+	if n.master != nil {
+		n.master.removeReplica(n)
+		n.master = nil
+	}
+	n.flags = n.flags&^CLUSTER_NODE_SLAVE | CLUSTER_NODE_MASTER
+}
+
+// 节点成为master的从节点，原来负责的哈希槽变为未分配
+func (cluster *clusterState) setNodeReplicaOf(n *clusterNode, master *clusterNode) {
+	if n.master == master && n.flags&CLUSTER_NODE_SLAVE != 0 {
+		return
+	}
+	if n.master != nil {
+		n.master.removeReplica(n)
+	}
+	for slot := 0; slot < conf.CLUSTER_SLOTS; slot++ {
+		if n.hasSlot(slot) {
+			n.clearSlot(slot)
+			cluster.slots[slot] = nil
+		}
+	}
+	n.flags = n.flags&^CLUSTER_NODE_MASTER | CLUSTER_NODE_SLAVE
+	n.master = master
+	master.replicas = append(master.replicas, n)
+}
+
+func (n *clusterNode) removeReplica(replica *clusterNode) {
+	for i, r := range n.replicas {
+		if r == replica {
+			n.replicas = append(n.replicas[:i], n.replicas[i+1:]...)
+			return
+		}
+	}
+}
+
+func (cluster *clusterState) renameNode(n *clusterNode, id string) {
+	delete(cluster.nodes, n.id)
+	n.id = id
+	cluster.nodes[id] = n
+}
+
+// 删除节点，其负责的哈希槽变为未分配，其发出的失效报告失效
+func (cluster *clusterState) delNode(n *clusterNode) {
+	for slot := 0; slot < conf.CLUSTER_SLOTS; slot++ {
+		if cluster.slots[slot] == n {
+			cluster.slots[slot] = nil
+		}
+		if cluster.migratingTo[slot] == n {
+			cluster.migratingTo[slot] = nil
+		}
+		if cluster.importingFrom[slot] == n {
+			cluster.importingFrom[slot] = nil
+		}
+	}
+	for _, node := range cluster.nodes {
+		delete(node.failReports, n)
+	}
+	if n.master != nil {
+		n.master.removeReplica(n)
+	}
+	for _, r := range n.replicas {
+		r.master = nil
+	}
+	if n.link != nil {
+		freeClusterLink(n.link)
+	}
+	delete(cluster.nodes, n.id)
+}
+
+// 与某个节点开始握手，节点以随机ID加入，收到其PONG后改为真实ID
+func (cluster *clusterState) startHandshake(ip string, port, cport int, meet bool) bool {
+	for _, node := range cluster.nodes {
+		if node.inHandshake() && node.ip == ip && node.port == port && node.cport == cport {
+			return false
+		}
+	}
+	flags := CLUSTER_NODE_HANDSHAKE
+	if meet {
+		flags |= CLUSTER_NODE_MEET
+	}
+	node := createClusterNode("", flags)
+	node.ip, node.port, node.cport = ip, port, cport
+	cluster.nodes[node.id] = node
+	return true
+}
+
+/*
+所有哈希槽都由未下线的主节点负责时集群状态为ok，
+本节点为主节点时还需要能连通多数负责哈希槽的主节点，处于少数派分区时拒绝服务
+*/
+func (cluster *clusterState) updateState() {
+	state := CLUSTER_OK
+	for _, node := range cluster.slots {
+		if node == nil || node.failed() {
+			state = CLUSTER_FAIL
+			break
+		}
+	}
+	size, reachable := 0, 0
+	for _, node := range cluster.nodes {
+		if node.isMaster() && node.numSlots() > 0 {
+			size++
+			if node.flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_PFAIL) == 0 {
+				reachable++
+			}
+		}
+	}
+	if cluster.myself.isMaster() && reachable < size/2+1 {
+		state = CLUSTER_FAIL
+	}
+	if state != cluster.state {
+		server.logger.Warn().Msgf("cluster state changed: %s", clusterStateName(state))
+		cluster.state = state
+	}
+}
+
+func clusterStateName(state int) string {
+	if state == CLUSTER_OK {
+		return "ok"
+	}
+	return "fail"
+}
+
+/*
+本节点成为迁入的哈希槽的负责节点时，在不经过选举的情况下增大配置纪元，
+使其他节点以本节点的声明为准，只在本节点的配置纪元不是最大或为0时增加
+*/
+func (cluster *clusterState) bumpConfigEpochWithoutConsensus() {
+	var maxEpoch uint64
+	for _, node := range cluster.nodes {
+		if node.configEpoch > maxEpoch {
+			maxEpoch = node.configEpoch
+		}
+	}
+	myself := cluster.myself
+	if myself.configEpoch == 0 || myself.configEpoch != maxEpoch {
+		cluster.currentEpoch++
+		myself.configEpoch = cluster.currentEpoch
+		cluster.todoSaveConfig = true
+		server.logger.Info().Msgf("new configEpoch set to %d", myself.configEpoch)
+	}
+}
+
+// 删除哈希槽中的key，本节点失去哈希槽后调用
+func (cluster *clusterState) delKeysInSlot(slot int) {
+	for key := range cluster.slotKeys[slot] {
+		keyObj := data.CreateObject(conf.GSTR, key)
+		if dbDelete(keyObj) {
+			propagate([]*data.Gobj{data.CreateObject(conf.GSTR, "del"), keyObj})
+		}
+	}
+}
+
+func (cluster *clusterState) addSlotKey(key string) {
+	slot := KeyHashSlot(key)
+	if cluster.slotKeys[slot] == nil {
+		cluster.slotKeys[slot] = make(map[string]struct{})
+	}
+	cluster.slotKeys[slot][key] = struct{}{}
+}
+
+func (cluster *clusterState) delSlotKey(key string) {
+	delete(cluster.slotKeys[KeyHashSlot(key)], key)
+}
+
+// 命令执行后按key是否仍存在更新哈希槽索引
+func (cluster *clusterState) updateSlotKeys(keys []*data.Gobj) {
+	for _, key := range keys {
+		if server.DB.Data.Find(key) != nil {
+			cluster.addSlotKey(key.StrVal())
+		} else {
+			cluster.delSlotKey(key.StrVal())
+		}
+	}
+}
+
+// 加载数据或全量同步替换数据集后重建哈希槽索引
+func (cluster *clusterState) rebuildSlotKeys() {
+	cluster.slotKeys = make([]map[string]struct{}, conf.CLUSTER_SLOTS)
+	for _, entry := range server.DB.Data.IterateDict() {
+		cluster.addSlotKey(entry[0].StrVal())
+	}
+}
+
+/*
+检查命令的key是否都由本节点负责，否则回复重定向并返回false
+key分布在不同的哈希槽时回复CROSSSLOT，集群状态不为ok时回复CLUSTERDOWN，哈希槽由其他节点负责时回复MOVED，从节点也将命令重定向到主节点
+哈希槽迁出期间本节点缺少的key回复ASK，让客户端带上ASKING到目标节点访问；
+迁入期间只执行带ASKING的命令，多key命令只有部分key存在时回复TRYAGAIN，等待迁移完成
+*/
+func clusterRedirectIfNeeded(c *GodisClient, cmd *GodisCommand, asking bool) bool {
+	keys := cmd.GetKeys(c.args)
+	if len(keys) == 0 {
+		return true
+	}
+	slot := KeyHashSlot(keys[0].StrVal())
+	for _, key := range keys[1:] {
+		if KeyHashSlot(key.StrVal()) != slot {
+			c.AddReplyStr("-CROSSSLOT Keys in request don't hash to the same slot\r\n")
+			return false
+		}
+	}
+	cluster := server.cluster
+	if cluster.state != CLUSTER_OK {
+		c.AddReplyStr("-CLUSTERDOWN The cluster is down\r\n")
+		return false
+	}
+	node := cluster.slots[slot]
+	if node == nil {
+		c.AddReplyStr(fmt.Sprintf("-CLUSTERDOWN Hash slot %d not served\r\n", slot))
+		return false
+	}
+	var migrating *clusterNode
+	if node == cluster.myself {
+		migrating = cluster.migratingTo[slot]
+	}
+	importing := cluster.importingFrom[slot]
+	if migrating == nil && importing == nil {
+		if node != cluster.myself {
+			c.AddReplyStr(fmt.Sprintf("-MOVED %d %s:%d\r\n", slot, node.ip, node.port))
+			return false
+		}
+		return true
+	}
+	// MIGRATE只迁移本节点已有的key
+	if cmd.name == "migrate" {
+		return true
+	}
+	missing := 0
+	for _, key := range keys {
+		if server.DB.Data.Find(key) == nil {
+			missing++
+		}
+	}
+	if migrating != nil && missing > 0 {
+		if missing < len(keys) {
+			c.AddReplyStr("-TRYAGAIN Multiple keys request during rehashing of slot\r\n")
+		} else {
+			c.AddReplyStr(fmt.Sprintf("-ASK %d %s:%d\r\n", slot, migrating.ip, migrating.port))
+		}
+		return false
+	}
+	if importing != nil && asking {
+		if len(keys) > 1 && missing > 0 {
+			c.AddReplyStr("-TRYAGAIN Multiple keys request during rehashing of slot\r\n")
+			return false
+		}
+		return true
+	}
+	if node != cluster.myself {
+		c.AddReplyStr(fmt.Sprintf("-MOVED %d %s:%d\r\n", slot, node.ip, node.port))
+		return false
+	}
+	return true
+}
+
+func clusterCommand(c *GodisClient) (bool, error) {
+	if server.cluster == nil {
+		c.AddReplyStr("-ERR This instance has cluster support disabled\r\n")
+		return false, errs.ClusterDisabledError
+	}
+	if len(c.args) < 2 {
+		c.AddReplyStr("-ERR wrong number of arguments for 'cluster' command\r\n")
+		return false, errs.ParamsCheckError
+	}
+	subcommand := strings.ToLower(c.args[1].StrVal())
+	arity := map[string]int{"keyslot": 3, "slots": 2, "shards": 2, "nodes": 2, "myid": 2, "info": 2,
+		"countkeysinslot": 3, "getkeysinslot": 4, "forget": 3, "replicate": 3, "saveconfig": 2,
+		"count-failure-reports": 3}
+	if n, ok := arity[subcommand]; ok && n != len(c.args) {
+		c.AddReplyStr(fmt.Sprintf("-ERR wrong number of arguments for 'cluster|%s' command\r\n", subcommand))
+		return false, errs.ParamsCheckError
+	}
+	cluster := server.cluster
+	switch subcommand {
+	case "keyslot":
+		c.AddReplyStr(fmt.Sprintf(":%d\r\n", KeyHashSlot(c.args[2].StrVal())))
+	case "myid":
+		c.AddReplyStrVal(cluster.myself.id)
+	case "slots":
+		c.AddReplyBytes(cluster.genSlotsReply())
+	case "shards":
+		c.AddReplyBytes(cluster.genShardsReply())
+	case "nodes":
+		c.AddReplyStrVal(cluster.genNodesDescription(false))
+	case "info":
+		c.AddReplyStrVal(cluster.genInfoString())
+	case "countkeysinslot":
+		slot, ok := getSlotOrReply(c, c.args[2])
+		if !ok {
+			return false, errs.ParamsCheckError
+		}
+		c.AddReplyStr(fmt.Sprintf(":%d\r\n", len(cluster.slotKeys[slot])))
+	case "getkeysinslot":
+		slot, ok := getSlotOrReply(c, c.args[2])
+		if !ok {
+			return false, errs.ParamsCheckError
+		}
+		count, err := c.args[3].Int64Val()
+		if err != nil || count < 0 {
+			c.AddReplyStr("-ERR Invalid number of keys\r\n")
+			return false, errs.ParamsCheckError
+		}
+		keys := make([]string, 0, len(cluster.slotKeys[slot]))
+		for key := range cluster.slotKeys[slot] {
+			if int64(len(keys)) >= count {
+				break
+			}
+			keys = append(keys, key)
+		}
+		var buf bytes.Buffer
+		buf.WriteString(fmt.Sprintf("*%d\r\n", len(keys)))
+		for _, key := range keys {
+			writeBulk(&buf, key)
+		}
+		c.AddReplyBytes(buf.Bytes())
+	case "setslot":
+		return clusterSetSlotCommand(c)
+	case "meet":
+		return clusterMeetCommand(c)
+	case "forget":
+		return clusterForgetCommand(c)
+	case "replicate":
+		return clusterReplicateCommand(c)
+	case "addslots", "addslotsrange", "delslots":
+		return clusterAddSlotsCommand(c, subcommand)
+	case "saveconfig":
+		if err := cluster.saveConfig(); err != nil {
+			c.AddReplyStr(fmt.Sprintf("-ERR error saving the cluster node config: %s\r\n", err))
+			return false, errs.ClusterConfigError
+		}
+		c.AddReplyStr("+OK\r\n")
+	case "count-failure-reports":
+		node := cluster.nodes[c.args[2].StrVal()]
+		if node == nil {
+			c.AddReplyStr(fmt.Sprintf("-ERR Unknown node %s\r\n", c.args[2].StrVal()))
+			return false, errs.ParamsCheckError
+		}
+		c.AddReplyStr(fmt.Sprintf(":%d\r\n", len(node.failReports)))
+	default:
+		c.AddReplyStr(fmt.Sprintf("-ERR unknown subcommand '%s'.\r\n", subcommand))
+		return false, errs.WrongCmdError
+	}
+	return true, nil
+}
+
+func getSlotOrReply(c *GodisClient, arg *data.Gobj) (int, bool) {
+	slot, err := arg.Int64Val()
+	if err != nil || slot < 0 || slot >= int64(conf.CLUSTER_SLOTS) {
+		c.AddReplyStr("-ERR Invalid or out of range slot\r\n")
+		return 0, false
+	}
+	return int(slot), true
+}
+
+/*
+CLUSTER SETSLOT <slot> MIGRATING|IMPORTING|NODE <node-id> | STABLE
+迁移哈希槽时先在目标节点设置IMPORTING、源节点设置MIGRATING，用MIGRATE迁移槽中所有key，
+最后向源节点与目标节点发送NODE指定新的归属，NODE会清除迁移状态，
+目标节点在不经过选举的情况下增大配置纪元，新的归属随后通过集群总线传播到其他节点
+*/
+func clusterSetSlotCommand(c *GodisClient) (bool, error) {
+	cluster := server.cluster
+	if len(c.args) < 4 {
+		c.AddReplyStr("-ERR wrong number of arguments for 'cluster|setslot' command\r\n")
+		return false, errs.ParamsCheckError
+	}
+	slot, ok := getSlotOrReply(c, c.args[2])
+	if !ok {
+		return false, errs.ParamsCheckError
+	}
+	action := strings.ToLower(c.args[3].StrVal())
+	if action == "stable" {
+		if len(c.args) != 4 {
+			c.AddReplyStr("-ERR syntax error\r\n")
+			return false, errs.ParamsCheckError
+		}
+		cluster.migratingTo[slot] = nil
+		cluster.importingFrom[slot] = nil
+		cluster.todoSaveConfig = true
+		c.AddReplyStr("+OK\r\n")
+		return true, nil
+	}
+	if len(c.args) != 5 || (action != "migrating" && action != "importing" && action != "node") {
+		c.AddReplyStr("-ERR syntax error\r\n")
+		return false, errs.ParamsCheckError
+	}
+	node := cluster.nodes[c.args[4].StrVal()]
+	if node == nil {
+		c.AddReplyStr(fmt.Sprintf("-ERR I don't know about node %s\r\n", c.args[4].StrVal()))
+		return false, errs.ParamsCheckError
+	}
+	if !node.isMaster() {
+		c.AddReplyStr("-ERR Target node is not a master\r\n")
+		return false, errs.ParamsCheckError
+	}
+	if action != "node" && !cluster.myself.isMaster() {
+		c.AddReplyStr("-ERR Please use SETSLOT only with masters.\r\n")
+		return false, errs.ParamsCheckError
+	}
+
+	switch action {
+	case "migrating":
+		if cluster.slots[slot] != cluster.myself {
+			c.AddReplyStr(fmt.Sprintf("-ERR I'm not the owner of hash slot %d\r\n", slot))
+			return false, errs.ParamsCheckError
+		}
+		if node == cluster.myself {
+			c.AddReplyStr("-ERR I can't migrate a slot to myself\r\n")
+			return false, errs.ParamsCheckError
+		}
+		cluster.migratingTo[slot] = node
+	case "importing":
+		if cluster.slots[slot] == cluster.myself {
+			c.AddReplyStr(fmt.Sprintf("-ERR I'm already the owner of hash slot %d\r\n", slot))
+			return false, errs.ParamsCheckError
+		}
+		if node == cluster.myself {
+			c.AddReplyStr("-ERR I can't import a slot from myself\r\n")
+			return false, errs.ParamsCheckError
+		}
+		cluster.importingFrom[slot] = node
+	case "node":
+		keys := len(cluster.slotKeys[slot])
+		if cluster.slots[slot] == cluster.myself && node != cluster.myself && keys > 0 {
+			c.AddReplyStr(fmt.Sprintf("-ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.\r\n", slot))
+			return false, errs.ParamsCheckError
+		}
+		if keys == 0 {
+			cluster.migratingTo[slot] = nil
+		}
+		if owner := cluster.slots[slot]; owner != nil {
+			owner.clearSlot(slot)
+		}
+		node.setSlot(slot)
+		cluster.slots[slot] = node
+		if node == cluster.myself && cluster.importingFrom[slot] != nil {
+			cluster.importingFrom[slot] = nil
+			cluster.bumpConfigEpochWithoutConsensus()
+		}
+	}
+	cluster.todoSaveConfig = true
+	c.AddReplyStr("+OK\r\n")
+	return true, nil
+}
+
+// CLUSTER MEET ip port [cport]，与节点握手，对方收到MEET后将本节点加入集群，之后通过gossip互相发现其他节点
+func clusterMeetCommand(c *GodisClient) (bool, error) {
+	if len(c.args) != 4 && len(c.args) != 5 {
+		c.AddReplyStr("-ERR wrong number of arguments for 'cluster|meet' command\r\n")
+		return false, errs.ParamsCheckError
+	}
+	ip := c.args[2].StrVal()
+	port, err := c.args[3].Int64Val()
+	cport := port + int64(conf.CLUSTER_PORT_INCR)
+	if err == nil && len(c.args) == 5 {
+		cport, err = c.args[4].Int64Val()
+	}
+	if err != nil || gonet.ParseIP(ip) == nil || port <= 0 || port > 65535 || cport <= 0 || cport > 65535 {
+		c.AddReplyStr(fmt.Sprintf("-ERR Invalid node address specified: %s:%s\r\n", ip, c.args[3].StrVal()))
+		return false, errs.ParamsCheckError
+	}
+	server.cluster.startHandshake(ip, int(port), int(cport), true)
+	c.AddReplyStr("+OK\r\n")
+	return true, nil
+}
+
+// CLUSTER FORGET node-id，删除节点并加入黑名单，避免其在所有节点删除之前通过gossip重新加入
+func clusterForgetCommand(c *GodisClient) (bool, error) {
+	cluster := server.cluster
+	node := cluster.nodes[c.args[2].StrVal()]
+	if node == nil {
+		c.AddReplyStr(fmt.Sprintf("-ERR Unknown node %s\r\n", c.args[2].StrVal()))
+		return false, errs.ParamsCheckError
+	}
+	if node == cluster.myself {
+		c.AddReplyStr("-ERR I tried hard but I can't forget myself...\r\n")
+		return false, errs.ParamsCheckError
+	}
+	if node == cluster.myself.master {
+		c.AddReplyStr("-ERR Can't forget my master!\r\n")
+		return false, errs.ParamsCheckError
+	}
+	cluster.blacklist[node.id] = util.GetMsTime()/1000 + conf.CLUSTER_BLACKLIST_TTL
+	cluster.delNode(node)
+	cluster.updateState()
+	cluster.todoSaveConfig = true
+	c.AddReplyStr("+OK\r\n")
+	return true, nil
+}
+
+// CLUSTER REPLICATE node-id，成为节点的从节点，本节点为主节点时必须不负责哈希槽且没有数据
+func clusterReplicateCommand(c *GodisClient) (bool, error) {
+	cluster := server.cluster
+	myself := cluster.myself
+	node := cluster.nodes[c.args[2].StrVal()]
+	if node == nil {
+		c.AddReplyStr(fmt.Sprintf("-ERR Unknown node %s\r\n", c.args[2].StrVal()))
+		return false, errs.ParamsCheckError
+	}
+	if node == myself {
+		c.AddReplyStr("-ERR Can't replicate myself\r\n")
+		return false, errs.ParamsCheckError
+	}
+	if !node.isMaster() {
+		c.AddReplyStr("-ERR I can only replicate a master, not a replica.\r\n")
+		return false, errs.ParamsCheckError
+	}
+	if myself.isMaster() && (myself.numSlots() != 0 || server.DB.Data.Length() != 0) {
+		c.AddReplyStr("-ERR To set a master the node must be empty and without assigned slots.\r\n")
+		return false, errs.ParamsCheckError
+	}
+	cluster.setNodeReplicaOf(myself, node)
+	cluster.syncReplication()
+	cluster.updateState()
+	cluster.todoSaveConfig = true
+	c.AddReplyStr("+OK\r\n")
+	return true, nil
+}
+
+/*
+CLUSTER ADDSLOTS slot [slot ...] | ADDSLOTSRANGE start end [start end ...] | DELSLOTS slot [slot ...]
+将未分配的哈希槽分配给本节点，或将哈希槽恢复为未分配，只修改本节点的配置，分配的结果通过集群总线传播
+*/
+func clusterAddSlotsCommand(c *GodisClient, subcommand string) (bool, error) {
+	cluster := server.cluster
+	isRange := subcommand == "addslotsrange"
+	if len(c.args) < 3 || (isRange && len(c.args)%2 != 0) {
+		c.AddReplyStr(fmt.Sprintf("-ERR wrong number of arguments for 'cluster|%s' command\r\n", subcommand))
+		return false, errs.ParamsCheckError
+	}
+	if subcommand != "delslots" && !cluster.myself.isMaster() {
+		c.AddReplyStr("-ERR Please use ADDSLOTS only with masters.\r\n")
+		return false, errs.ParamsCheckError
+	}
+	seen := make(map[int]bool)
+	var slots []int
+	for i := 2; i < len(c.args); i++ {
+		start, ok := getSlotOrReply(c, c.args[i])
+		if !ok {
+			return false, errs.ParamsCheckError
+		}
+		end := start
+		if isRange {
+			i++
+			if end, ok = getSlotOrReply(c, c.args[i]); !ok {
+				return false, errs.ParamsCheckError
+			}
+			if start > end {
+				c.AddReplyStr(fmt.Sprintf("-ERR start slot number %d is greater than end slot number %d\r\n", start, end))
+				return false, errs.ParamsCheckError
+			}
+		}
+		for slot := start; slot <= end; slot++ {
+			if seen[slot] {
+				c.AddReplyStr(fmt.Sprintf("-ERR Slot %d specified multiple times\r\n", slot))
+				return false, errs.ParamsCheckError
+			}
+			if subcommand == "delslots" && cluster.slots[slot] == nil {
+				c.AddReplyStr(fmt.Sprintf("-ERR Slot %d is already unassigned\r\n", slot))
+				return false, errs.ParamsCheckError
+			}
+			if subcommand != "delslots" && cluster.slots[slot] != nil {
+				c.AddReplyStr(fmt.Sprintf("-ERR Slot %d is already busy\r\n", slot))
+				return false, errs.ParamsCheckError
+			}
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+	}
+	for _, slot := range slots {
+		if subcommand == "delslots" {
+			cluster.slots[slot].clearSlot(slot)
+			cluster.slots[slot] = nil
+		} else {
+			cluster.importingFrom[slot] = nil
+			cluster.myself.setSlot(slot)
+			cluster.slots[slot] = cluster.myself
+		}
+	}
+	cluster.updateState()
+	cluster.todoSaveConfig = true
+	c.AddReplyStr("+OK\r\n")
+	return true, nil
+}
+
+// ASKING，下一条命令可以访问正在迁入本节点的哈希槽
+func askingCommand(c *GodisClient) (bool, error) {
+	if server.cluster == nil {
+		c.AddReplyStr("-ERR This instance has cluster support disabled\r\n")
+		return false, errs.ClusterDisabledError
+	}
+	c.asking = true
+	c.AddReplyStr("+OK\r\n")
+	return true, nil
+}
+
+func writeBulk(buf *bytes.Buffer, s string) {
+	buf.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(s), s))
+}
+
+// CLUSTER SLOTS，每个连续的哈希槽区间回复[起始, 结束, 主节点, 从节点...]，节点为[ip, port, id]
+func (cluster *clusterState) genSlotsReply() []byte {
+	var body bytes.Buffer
+	count := 0
+	for _, node := range cluster.sortedNodes() {
+		ranges := node.slotRanges()
+		for i := 0; i < len(ranges); i += 2 {
+			count++
+			body.WriteString(fmt.Sprintf("*%d\r\n:%d\r\n:%d\r\n", 3+len(node.replicas), ranges[i], ranges[i+1]))
+			for _, n := range append([]*clusterNode{node}, node.replicas...) {
+				body.WriteString("*3\r\n")
+				writeBulk(&body, n.ip)
+				body.WriteString(fmt.Sprintf(":%d\r\n", n.port))
+				writeBulk(&body, n.id)
+			}
+		}
+	}
+	return append([]byte(fmt.Sprintf("*%d\r\n", count)), body.Bytes()...)
+}
+
+// CLUSTER SHARDS，每个主节点及其从节点为一个分片，回复分片的哈希槽区间与节点信息
+func (cluster *clusterState) genShardsReply() []byte {
+	var body bytes.Buffer
+	count := 0
+	for _, node := range cluster.sortedNodes() {
+		if !node.isMaster() {
+			continue
+		}
+		count++
+		ranges := node.slotRanges()
+		body.WriteString("*4\r\n")
+		writeBulk(&body, "slots")
+		body.WriteString(fmt.Sprintf("*%d\r\n", len(ranges)))
+		for _, slot := range ranges {
+			body.WriteString(fmt.Sprintf(":%d\r\n", slot))
+		}
+		writeBulk(&body, "nodes")
+		body.WriteString(fmt.Sprintf("*%d\r\n", 1+len(node.replicas)))
+		for _, n := range append([]*clusterNode{node}, node.replicas...) {
+			role, offset := "master", int64(0)
+			if !n.isMaster() {
+				role = "replica"
+			}
+			if n == cluster.myself {
+				offset = server.masterReplOffset
+			}
+			body.WriteString("*14\r\n")
+			for _, field := range []string{"id", n.id, "port"} {
+				writeBulk(&body, field)
+			}
+			body.WriteString(fmt.Sprintf(":%d\r\n", n.port))
+			for _, field := range []string{"ip", n.ip, "endpoint", n.ip, "role", role, "replication-offset"} {
+				writeBulk(&body, field)
+			}
+			body.WriteString(fmt.Sprintf(":%d\r\n", offset))
+			writeBulk(&body, "health")
+			writeBulk(&body, "online")
+		}
+	}
+	return append([]byte(fmt.Sprintf("*%d\r\n", count)), body.Bytes()...)
+}
+
+/*
+CLUSTER NODES，每个节点一行：
+<id> <ip:port@cport> <flags> <master id|-> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> ...
+集群配置文件使用相同的格式，不包含握手中的节点
+*/
+func (cluster *clusterState) genNodesDescription(filterHandshake bool) string {
+	var builder strings.Builder
+	for _, node := range cluster.sortedNodes() {
+		if filterHandshake && node.inHandshake() {
+			continue
+		}
+		masterID := "-"
+		if node.master != nil {
+			masterID = node.master.id
+		}
+		linkState := "disconnected"
+		if node == cluster.myself || (node.link != nil && node.link.conn != nil) {
+			linkState = "connected"
+		}
+		builder.WriteString(fmt.Sprintf("%s %s:%d@%d %s %s %d %d %d %s",
+			node.id, node.ip, node.port, node.cport, node.flagsString(), masterID,
+			node.pingSent, node.pongReceived, node.configEpoch, linkState))
+		ranges := node.slotRanges()
+		for i := 0; i < len(ranges); i += 2 {
+			if ranges[i] == ranges[i+1] {
+				builder.WriteString(fmt.Sprintf(" %d", ranges[i]))
+			} else {
+				builder.WriteString(fmt.Sprintf(" %d-%d", ranges[i], ranges[i+1]))
+			}
+		}
+		// 本节点的行中列出迁移中的哈希槽，[slot->-目标节点]为迁出，[slot-<-源节点]为迁入
+		if node == cluster.myself {
+			for slot := 0; slot < conf.CLUSTER_SLOTS; slot++ {
+				if target := cluster.migratingTo[slot]; target != nil {
+					builder.WriteString(fmt.Sprintf(" [%d->-%s]", slot, target.id))
+				} else if source := cluster.importingFrom[slot]; source != nil {
+					builder.WriteString(fmt.Sprintf(" [%d-<-%s]", slot, source.id))
+				}
+			}
+		}
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+func (cluster *clusterState) genInfoString() string {
+	assigned, pfail, fail := 0, 0, 0
+	for _, node := range cluster.slots {
+		if node == nil {
+			continue
+		}
+		assigned++
+		if node.failed() {
+			fail++
+		} else if node.timedOut() {
+			pfail++
+		}
+	}
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("cluster_state:%s\r\n", clusterStateName(cluster.state)))
+	builder.WriteString(fmt.Sprintf("cluster_slots_assigned:%d\r\n", assigned))
+	builder.WriteString(fmt.Sprintf("cluster_slots_ok:%d\r\n", assigned-pfail-fail))
+	builder.WriteString(fmt.Sprintf("cluster_slots_pfail:%d\r\n", pfail))
+	builder.WriteString(fmt.Sprintf("cluster_slots_fail:%d\r\n", fail))
+	builder.WriteString(fmt.Sprintf("cluster_known_nodes:%d\r\n", len(cluster.nodes)))
+	builder.WriteString(fmt.Sprintf("cluster_size:%d\r\n", cluster.size()))
+	builder.WriteString(fmt.Sprintf("cluster_current_epoch:%d\r\n", cluster.currentEpoch))
+	builder.WriteString(fmt.Sprintf("cluster_my_epoch:%d\r\n", cluster.myself.configEpoch))
+	var sent, received int64
+	for typ, name := range clusterMsgTypeNames {
+		if cluster.statsMsgSent[typ] > 0 {
+			builder.WriteString(fmt.Sprintf("cluster_stats_messages_%s_sent:%d\r\n", name, cluster.statsMsgSent[typ]))
+		}
+		sent += cluster.statsMsgSent[typ]
+	}
+	builder.WriteString(fmt.Sprintf("cluster_stats_messages_sent:%d\r\n", sent))
+	for typ, name := range clusterMsgTypeNames {
+		if cluster.statsMsgReceived[typ] > 0 {
+			builder.WriteString(fmt.Sprintf("cluster_stats_messages_%s_received:%d\r\n", name, cluster.statsMsgReceived[typ]))
+		}
+		received += cluster.statsMsgReceived[typ]
+	}
+	builder.WriteString(fmt.Sprintf("cluster_stats_messages_received:%d\r\n", received))
+	return builder.String()
+}
+
+func genClusterInfo(builder *strings.Builder) {
+	enabled := 0
+	if server.cluster != nil {
+		enabled = 1
+	}
+	builder.WriteString(fmt.Sprintf("cluster_enabled:%d\r\n", enabled))
+}
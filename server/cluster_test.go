@@ -0,0 +1,40 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/godis/conf"
+	"github.com/godis/util"
+)
+
+func TestKeyHashSlot(t *testing.T) {
+	slot := func(s string) int { return int(util.Crc16(s)) & (conf.CLUSTER_SLOTS - 1) }
+	tests := []struct {
+		key  string
+		want int
+	}{
+		// CLUSTER KEYSLOT文档中的示例
+		{"somekey", 11058},
+		{"foo", 12182},
+		{"foo{hash_tag}", 2515},
+		{"user{123}", slot("123")},
+		// 以下为Redis集群规范中哈希标签的例子
+		{"{user1000}.following", slot("user1000")},
+		{"{user1000}.followers", slot("user1000")},
+		{"foo{}{bar}", slot("foo{}{bar}")},
+		{"foo{{bar}}zap", slot("{bar")},
+		{"foo{bar}{zap}", slot("bar")},
+		{"{}", slot("{}")},
+		{"{", slot("{")},
+		{"}{", slot("}{")},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := KeyHashSlot(tt.key); got != tt.want {
+			t.Fatalf("KeyHashSlot(%q) = %d, want %d", tt.key, got, tt.want)
+		}
+	}
+	if KeyHashSlot("{user1000}.following") != KeyHashSlot("{user1000}.followers") {
+		t.Fatal("keys with the same hash tag map to different slots")
+	}
+}
@@ -0,0 +1,920 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	gonet "net"
+	"strconv"
+	"time"
+
+	"github.com/godis/conf"
+	"github.com/godis/net"
+	"github.com/godis/util"
+)
+
+// 集群总线消息类型
+const (
+	CLUSTER_MSG_TYPE_PING                  = iota //心跳，携带发送方的哈希槽、纪元与部分节点的gossip
+	CLUSTER_MSG_TYPE_PONG                         //心跳的回复，格式与PING相同
+	CLUSTER_MSG_TYPE_MEET                         //要求对方将发送方加入集群
+	CLUSTER_MSG_TYPE_FAIL                         //通知所有节点某个节点已下线
+	CLUSTER_MSG_TYPE_UPDATE                       //通知配置过期的节点某个节点的哈希槽
+	CLUSTER_MSG_TYPE_FAILOVER_AUTH_REQUEST        //从节点请求主节点为其故障转移投票
+	CLUSTER_MSG_TYPE_FAILOVER_AUTH_ACK            //主节点的投票
+	CLUSTER_MSG_TYPE_COUNT
+)
+
+var clusterMsgTypeNames = []string{"ping", "pong", "meet", "fail", "update", "auth-req", "auth-ack"}
+
+var clusterMsgSig = [4]byte{'R', 'C', 'm', 'b'}
+
+// 消息头，所有消息都携带发送方的状态，字段均为定长，按大端序编码
+type clusterMsgHeader struct {
+	Sig          [4]byte
+	TotLen       uint32 //消息总长度，包括消息头
+	Type         uint16
+	Count        uint16 //gossip的数量
+	CurrentEpoch uint64
+	ConfigEpoch  uint64 //发送方为从节点时为其主节点的配置纪元
+	Offset       int64  //复制偏移量
+	Sender       [40]byte
+	Slots        [2048]byte //发送方为从节点时为其主节点的哈希槽
+	ReplicaOf    [40]byte   //发送方为从节点时为其主节点的ID
+	Port         uint16
+	CPort        uint16
+	Flags        uint16
+	State        uint8
+}
+
+// PING、PONG、MEET中携带的其他节点的信息
+type clusterMsgGossip struct {
+	Name         [40]byte
+	PingSent     uint32 //秒级时间
+	PongReceived uint32
+	IP           [46]byte
+	Port         uint16
+	CPort        uint16
+	Flags        uint16
+}
+
+type clusterMsgFail struct {
+	Name [40]byte
+}
+
+type clusterMsgUpdate struct {
+	ConfigEpoch uint64
+	Name        [40]byte
+	Slots       [2048]byte
+}
+
+type clusterMsg struct {
+	hdr    clusterMsgHeader
+	gossip []clusterMsgGossip
+	fail   *clusterMsgFail
+	update *clusterMsgUpdate
+}
+
+var clusterMsgHeaderLen = binary.Size(clusterMsgHeader{})
+
+var errClusterMsg = errors.New("invalid cluster bus message")
+
+// 与其他节点的总线连接，本节点主动建立的连接属于对应的节点，对方建立的连接node为nil
+type clusterLink struct {
+	node  *clusterNode
+	conn  gonet.Conn
+	out   chan []byte //待发送的消息，由写goroutine发送
+	ctime int64
+	freed bool
+}
+
+// 总线goroutine交给事件循环的事件：连接建立、收到消息或连接出错
+type clusterBusEvent struct {
+	link *clusterLink
+	conn gonet.Conn
+	msg  *clusterMsg
+	err  error
+}
+
+func createClusterLink(node *clusterNode) *clusterLink {
+	return &clusterLink{
+		node:  node,
+		out:   make(chan []byte, 1024),
+		ctime: util.GetMsTime(),
+	}
+}
+
+func freeClusterLink(link *clusterLink) {
+	if link.freed {
+		return
+	}
+	link.freed = true
+	close(link.out)
+	if link.conn != nil {
+		link.conn.Close()
+	}
+	if link.node != nil && link.node.link == link {
+		link.node.link = nil
+	}
+}
+
+func fixedString(b []byte) string {
+	return string(bytes.TrimRight(b, "\x00"))
+}
+
+func encodeClusterMsg(hdr *clusterMsgHeader, body any) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, hdr)
+	if body != nil {
+		binary.Write(&buf, binary.BigEndian, body)
+	}
+	msg := buf.Bytes()
+	binary.BigEndian.PutUint32(msg[4:8], uint32(len(msg)))
+	return msg
+}
+
+func decodeClusterMsg(buf []byte) (*clusterMsg, error) {
+	reader := bytes.NewReader(buf)
+	msg := &clusterMsg{}
+	if err := binary.Read(reader, binary.BigEndian, &msg.hdr); err != nil {
+		return nil, err
+	}
+	var err error
+	switch msg.hdr.Type {
+	case CLUSTER_MSG_TYPE_PING, CLUSTER_MSG_TYPE_PONG, CLUSTER_MSG_TYPE_MEET:
+		msg.gossip = make([]clusterMsgGossip, msg.hdr.Count)
+		err = binary.Read(reader, binary.BigEndian, msg.gossip)
+	case CLUSTER_MSG_TYPE_FAIL:
+		msg.fail = &clusterMsgFail{}
+		err = binary.Read(reader, binary.BigEndian, msg.fail)
+	case CLUSTER_MSG_TYPE_UPDATE:
+		msg.update = &clusterMsgUpdate{}
+		err = binary.Read(reader, binary.BigEndian, msg.update)
+	case CLUSTER_MSG_TYPE_FAILOVER_AUTH_REQUEST, CLUSTER_MSG_TYPE_FAILOVER_AUTH_ACK:
+	default:
+		return nil, errClusterMsg
+	}
+	if err != nil || reader.Len() != 0 {
+		return nil, errClusterMsg
+	}
+	return msg, nil
+}
+
+func readClusterMsg(reader *bufio.Reader) (*clusterMsg, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		return nil, err
+	}
+	totLen := int(binary.BigEndian.Uint32(head[4:]))
+	if !bytes.Equal(head[:4], clusterMsgSig[:]) || totLen < clusterMsgHeaderLen || totLen > conf.CLUSTER_MAX_MSG_LEN {
+		return nil, errClusterMsg
+	}
+	buf := make([]byte, totLen)
+	copy(buf, head)
+	if _, err := io.ReadFull(reader, buf[8:]); err != nil {
+		return nil, err
+	}
+	return decodeClusterMsg(buf)
+}
+
+func clusterAcceptLoop(listener gonet.Listener, events chan<- *clusterBusEvent) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		events <- &clusterBusEvent{link: createClusterLink(nil), conn: conn}
+	}
+}
+
+func clusterLinkReader(link *clusterLink, conn gonet.Conn, events chan<- *clusterBusEvent) {
+	reader := bufio.NewReader(conn)
+	for {
+		msg, err := readClusterMsg(reader)
+		if err != nil {
+			events <- &clusterBusEvent{link: link, err: err}
+			return
+		}
+		events <- &clusterBusEvent{link: link, msg: msg}
+	}
+}
+
+// 写出错时关闭连接，读goroutine随之出错并通知事件循环释放连接
+func clusterLinkWriter(conn gonet.Conn, out <-chan []byte, timeout time.Duration) {
+	for buf := range out {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		if _, err := conn.Write(buf); err != nil {
+			conn.Close()
+			break
+		}
+	}
+	for range out {
+	}
+}
+
+// 向节点建立总线连接，连接建立前的消息在发送队列中等待
+func (cluster *clusterState) connectNode(node *clusterNode) {
+	link := createClusterLink(node)
+	node.link = link
+	typ := CLUSTER_MSG_TYPE_PING
+	if node.flags&CLUSTER_NODE_MEET != 0 {
+		typ = CLUSTER_MSG_TYPE_MEET
+	}
+	cluster.sendPing(link, typ)
+
+	addr := gonet.JoinHostPort(node.ip, strconv.Itoa(node.cport))
+	timeout := time.Duration(cluster.nodeTimeout) * time.Millisecond
+	events := cluster.events
+	go func() {
+		conn, err := net.Connect(addr, timeout)
+		events <- &clusterBusEvent{link: link, conn: conn, err: err}
+	}()
+}
+
+// 处理总线goroutine的事件，在serverCron与每次事件循环休眠前调用
+func (cluster *clusterState) processEvents() {
+	for {
+		select {
+		case e := <-cluster.events:
+			cluster.handleEvent(e)
+		default:
+			return
+		}
+	}
+}
+
+func (cluster *clusterState) handleEvent(e *clusterBusEvent) {
+	link := e.link
+	switch {
+	case e.err != nil:
+		if !link.freed {
+			if link.node != nil {
+				server.logger.Debug().Err(e.err).Msgf("cluster bus link to %s lost", link.node.id)
+			}
+			freeClusterLink(link)
+		}
+	case e.conn != nil:
+		if link.freed {
+			e.conn.Close()
+			return
+		}
+		link.conn = e.conn
+		go clusterLinkWriter(e.conn, link.out, time.Duration(cluster.nodeTimeout)*time.Millisecond)
+		go clusterLinkReader(link, e.conn, cluster.events)
+	case e.msg != nil:
+		if !link.freed {
+			cluster.processPacket(link, e.msg)
+		}
+	}
+}
+
+func (cluster *clusterState) sendMsg(link *clusterLink, typ int, buf []byte) {
+	if link == nil || link.freed {
+		return
+	}
+	// 发送队列已满说明对方长时间没有读取，丢弃消息，超时后对方会被标记为PFAIL
+	select {
+	case link.out <- buf:
+		cluster.statsMsgSent[typ]++
+	default:
+	}
+}
+
+// 向所有已建立连接的节点发送消息
+func (cluster *clusterState) broadcast(typ int, buf []byte) {
+	for _, node := range cluster.nodes {
+		if node != cluster.myself && !node.inHandshake() {
+			cluster.sendMsg(node.link, typ, buf)
+		}
+	}
+}
+
+func (cluster *clusterState) buildHeader(typ int) clusterMsgHeader {
+	myself := cluster.myself
+	master := myself
+	if !myself.isMaster() && myself.master != nil {
+		master = myself.master
+	}
+	hdr := clusterMsgHeader{
+		Sig:          clusterMsgSig,
+		Type:         uint16(typ),
+		CurrentEpoch: cluster.currentEpoch,
+		ConfigEpoch:  master.configEpoch,
+		Offset:       server.masterReplOffset,
+		Port:         uint16(myself.port),
+		CPort:        uint16(myself.cport),
+		Flags:        uint16(myself.flags),
+		State:        uint8(cluster.state),
+	}
+	copy(hdr.Sender[:], myself.id)
+	copy(hdr.Slots[:], master.slots)
+	if !myself.isMaster() && myself.master != nil {
+		copy(hdr.ReplicaOf[:], myself.master.id)
+	}
+	return hdr
+}
+
+/*
+发送PING、PONG或MEET，携带约十分之一已知节点的gossip，至少3个，
+疑似下线的节点总是携带，使其失效报告尽快传播到多数主节点
+*/
+func (cluster *clusterState) sendPing(link *clusterLink, typ int) {
+	now := util.GetMsTime()
+	if link.node != nil && typ != CLUSTER_MSG_TYPE_PONG && link.node.pingSent == 0 {
+		link.node.pingSent = now
+	}
+	wanted := len(cluster.nodes) / 10
+	if wanted < 3 {
+		wanted = 3
+	}
+	var candidates, pfail []*clusterNode
+	for _, node := range cluster.nodes {
+		if node == cluster.myself || node == link.node || node.flags&(CLUSTER_NODE_HANDSHAKE|CLUSTER_NODE_NOADDR) != 0 {
+			continue
+		}
+		if node.timedOut() {
+			pfail = append(pfail, node)
+		} else {
+			candidates = append(candidates, node)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > wanted {
+		candidates = candidates[:wanted]
+	}
+	gossip := make([]clusterMsgGossip, 0, len(candidates)+len(pfail))
+	for _, node := range append(candidates, pfail...) {
+		g := clusterMsgGossip{
+			PingSent:     uint32(node.pingSent / 1000),
+			PongReceived: uint32(node.pongReceived / 1000),
+			Port:         uint16(node.port),
+			CPort:        uint16(node.cport),
+			Flags:        uint16(node.flags),
+		}
+		copy(g.Name[:], node.id)
+		copy(g.IP[:], node.ip)
+		gossip = append(gossip, g)
+	}
+	hdr := cluster.buildHeader(typ)
+	hdr.Count = uint16(len(gossip))
+	cluster.sendMsg(link, typ, encodeClusterMsg(&hdr, gossip))
+}
+
+func (cluster *clusterState) broadcastPong() {
+	for _, node := range cluster.nodes {
+		if node != cluster.myself && !node.inHandshake() && node.link != nil {
+			cluster.sendPing(node.link, CLUSTER_MSG_TYPE_PONG)
+		}
+	}
+}
+
+func (cluster *clusterState) broadcastFail(node *clusterNode) {
+	hdr := cluster.buildHeader(CLUSTER_MSG_TYPE_FAIL)
+	body := clusterMsgFail{}
+	copy(body.Name[:], node.id)
+	cluster.broadcast(CLUSTER_MSG_TYPE_FAIL, encodeClusterMsg(&hdr, &body))
+}
+
+// 通知link的对端node负责的哈希槽，对端声明了纪元更小的过期配置时发送
+func (cluster *clusterState) sendUpdate(link *clusterLink, node *clusterNode) {
+	hdr := cluster.buildHeader(CLUSTER_MSG_TYPE_UPDATE)
+	body := clusterMsgUpdate{ConfigEpoch: node.configEpoch}
+	copy(body.Name[:], node.id)
+	copy(body.Slots[:], node.slots)
+	cluster.sendMsg(link, CLUSTER_MSG_TYPE_UPDATE, encodeClusterMsg(&hdr, &body))
+}
+
+func (cluster *clusterState) processPacket(link *clusterLink, msg *clusterMsg) {
+	hdr := &msg.hdr
+	typ := int(hdr.Type)
+	cluster.statsMsgReceived[typ]++
+	myself := cluster.myself
+	senderID := fixedString(hdr.Sender[:])
+	sender := cluster.nodes[senderID]
+	if sender != nil && sender.inHandshake() {
+		sender = nil
+	}
+	if sender != nil {
+		if hdr.CurrentEpoch > cluster.currentEpoch {
+			cluster.currentEpoch = hdr.CurrentEpoch
+			cluster.todoSaveConfig = true
+		}
+		if hdr.ConfigEpoch > sender.configEpoch {
+			sender.configEpoch = hdr.ConfigEpoch
+			cluster.todoSaveConfig = true
+		}
+		sender.replOffset = hdr.Offset
+	}
+
+	switch typ {
+	case CLUSTER_MSG_TYPE_PING, CLUSTER_MSG_TYPE_PONG, CLUSTER_MSG_TYPE_MEET:
+		cluster.processPingPacket(link, msg, sender, senderID)
+	case CLUSTER_MSG_TYPE_FAIL:
+		if sender == nil {
+			return
+		}
+		failing := cluster.nodes[fixedString(msg.fail.Name[:])]
+		if failing != nil && failing != myself && !failing.failed() {
+			server.logger.Warn().Msgf("FAIL message received from %s about %s", sender.id, failing.id)
+			failing.flags = failing.flags&^CLUSTER_NODE_PFAIL | CLUSTER_NODE_FAIL
+			failing.failTime = util.GetMsTime()
+			cluster.todoSaveConfig = true
+		}
+	case CLUSTER_MSG_TYPE_UPDATE:
+		if sender == nil {
+			return
+		}
+		node := cluster.nodes[fixedString(msg.update.Name[:])]
+		if node == nil || node.configEpoch >= msg.update.ConfigEpoch {
+			return
+		}
+		if !node.isMaster() {
+			cluster.setNodeAsMaster(node)
+		}
+		node.configEpoch = msg.update.ConfigEpoch
+		cluster.updateSlotsConfigWith(node, node.configEpoch, msg.update.Slots[:])
+		cluster.todoSaveConfig = true
+	case CLUSTER_MSG_TYPE_FAILOVER_AUTH_REQUEST:
+		if sender != nil {
+			cluster.sendFailoverAuthIfNeeded(sender, hdr)
+		}
+	case CLUSTER_MSG_TYPE_FAILOVER_AUTH_ACK:
+		// 只统计负责哈希槽的主节点在本轮选举中的投票
+		if sender != nil && sender.isMaster() && sender.numSlots() > 0 && hdr.CurrentEpoch >= cluster.failoverAuthEpoch {
+			cluster.failoverAuthCount++
+			server.logger.Info().Msgf("failover auth granted to me by %s", sender.id)
+		}
+	}
+}
+
+func (cluster *clusterState) processPingPacket(link *clusterLink, msg *clusterMsg, sender *clusterNode, senderID string) {
+	hdr := &msg.hdr
+	typ := int(hdr.Type)
+	myself := cluster.myself
+	now := util.GetMsTime()
+
+	if typ != CLUSTER_MSG_TYPE_PONG {
+		// 通过对方建立的连接得知本节点的地址
+		if myself.ip == "" && link.conn != nil {
+			if ip, _, err := gonet.SplitHostPort(link.conn.LocalAddr().String()); err == nil {
+				myself.ip = ip
+				cluster.todoSaveConfig = true
+			}
+		}
+		// MEET要求无条件接纳发送方，PING只接受已知节点，未知节点之后通过gossip握手加入
+		if sender == nil && typ == CLUSTER_MSG_TYPE_MEET && len(senderID) == conf.CLUSTER_NAMELEN && link.conn != nil {
+			ip, _, _ := gonet.SplitHostPort(link.conn.RemoteAddr().String())
+			sender = createClusterNode(senderID, CLUSTER_NODE_MASTER)
+			sender.ip, sender.port, sender.cport = ip, int(hdr.Port), int(hdr.CPort)
+			cluster.nodes[sender.id] = sender
+			cluster.todoSaveConfig = true
+			server.logger.Info().Msgf("node %s (%s:%d) joined the cluster by MEET", sender.id, ip, sender.port)
+		}
+		cluster.sendPing(link, CLUSTER_MSG_TYPE_PONG)
+	}
+
+	if node := link.node; node != nil && typ == CLUSTER_MSG_TYPE_PONG {
+		if node.inHandshake() {
+			// 握手完成，已知该ID的节点时删除握手节点，否则以真实ID加入
+			if sender != nil {
+				cluster.delNode(node)
+				return
+			}
+			cluster.renameNode(node, senderID)
+			node.flags &^= CLUSTER_NODE_HANDSHAKE | CLUSTER_NODE_MEET
+			node.flags |= int(hdr.Flags) & (CLUSTER_NODE_MASTER | CLUSTER_NODE_SLAVE)
+			cluster.todoSaveConfig = true
+			server.logger.Info().Msgf("handshake with node %s completed", node.id)
+			sender = node
+		} else if node.id != senderID {
+			// 地址上已经是另一个节点，断开连接等待重新发现
+			server.logger.Warn().Msgf("PONG contains mismatching sender ID %s, expected %s", senderID, node.id)
+			node.flags |= CLUSTER_NODE_NOADDR
+			node.ip, node.port, node.cport = "", 0, 0
+			freeClusterLink(link)
+			cluster.todoSaveConfig = true
+			return
+		}
+		node.pongReceived = now
+		node.pingSent = 0
+		if node.timedOut() {
+			node.flags &^= CLUSTER_NODE_PFAIL
+		} else if node.failed() {
+			cluster.clearNodeFailureIfNeeded(node)
+		}
+	}
+	if sender == nil {
+		return
+	}
+
+	// 主从关系变化
+	if replicaOf := fixedString(hdr.ReplicaOf[:]); replicaOf == "" {
+		if !sender.isMaster() {
+			cluster.setNodeAsMaster(sender)
+			cluster.todoSaveConfig = true
+		}
+	} else if master := cluster.nodes[replicaOf]; master != nil && master != sender && (sender.master != master || sender.isMaster()) {
+		cluster.setNodeReplicaOf(sender, master)
+		cluster.todoSaveConfig = true
+	}
+
+	// 哈希槽变化，纪元更大的一方胜出；发送方声明的哈希槽已被纪元更大的节点接管时通知其更新
+	if sender.isMaster() {
+		if !bytes.Equal(sender.slots, hdr.Slots[:]) {
+			cluster.updateSlotsConfigWith(sender, hdr.ConfigEpoch, hdr.Slots[:])
+		}
+		for slot := 0; slot < conf.CLUSTER_SLOTS; slot++ {
+			if hdr.Slots[slot/8]&(1<<(slot%8)) == 0 {
+				continue
+			}
+			if owner := cluster.slots[slot]; owner != nil && owner != sender && owner.configEpoch > hdr.ConfigEpoch {
+				cluster.sendUpdate(link, owner)
+				break
+			}
+		}
+		if myself.isMaster() && hdr.ConfigEpoch == myself.configEpoch {
+			cluster.handleConfigEpochCollision(sender)
+		}
+	}
+	cluster.processGossip(sender, msg.gossip)
+}
+
+/*
+处理gossip，主节点报告的PFAIL或FAIL作为失效报告记录，达到多数后将节点标记为FAIL，
+未知的节点发起握手，FORGET的节点在黑名单过期前不会重新加入
+*/
+func (cluster *clusterState) processGossip(sender *clusterNode, entries []clusterMsgGossip) {
+	now := util.GetMsTime()
+	for _, g := range entries {
+		id := fixedString(g.Name[:])
+		flags := int(g.Flags)
+		ip := fixedString(g.IP[:])
+		node := cluster.nodes[id]
+		if node == nil {
+			if flags&CLUSTER_NODE_NOADDR == 0 && ip != "" && len(id) == conf.CLUSTER_NAMELEN && !cluster.blacklisted(id) {
+				cluster.startHandshake(ip, int(g.Port), int(g.CPort), false)
+			}
+			continue
+		}
+		if node == cluster.myself {
+			continue
+		}
+		if sender.isMaster() {
+			if flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_PFAIL) != 0 {
+				if _, ok := node.failReports[sender]; !ok {
+					server.logger.Info().Msgf("node %s reported node %s as not reachable", sender.id, node.id)
+				}
+				node.failReports[sender] = now
+				cluster.markNodeAsFailingIfNeeded(node)
+			} else {
+				delete(node.failReports, sender)
+			}
+		}
+		// 其他节点最近收到过该节点的PONG，本节点没有等待中的PING时沿用，减少PING的数量
+		if flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_PFAIL) == 0 && node.pingSent == 0 && len(node.failReports) == 0 {
+			if pong := int64(g.PongReceived) * 1000; pong <= now+500 && pong > node.pongReceived {
+				node.pongReceived = pong
+			}
+		}
+		// 本节点连不上而其他节点正常连接的节点可能更换了地址
+		if node.flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_PFAIL|CLUSTER_NODE_NOADDR) != 0 && flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_PFAIL|CLUSTER_NODE_NOADDR) == 0 &&
+			ip != "" && (node.ip != ip || node.port != int(g.Port) || node.cport != int(g.CPort)) {
+			if node.link != nil {
+				freeClusterLink(node.link)
+			}
+			node.ip, node.port, node.cport = ip, int(g.Port), int(g.CPort)
+			node.flags &^= CLUSTER_NODE_NOADDR
+			cluster.todoSaveConfig = true
+		}
+	}
+}
+
+func (cluster *clusterState) blacklisted(id string) bool {
+	_, ok := cluster.blacklist[id]
+	return ok
+}
+
+// 疑似下线的节点收到多数主节点的失效报告后标记为FAIL，并通知所有节点
+func (cluster *clusterState) markNodeAsFailingIfNeeded(node *clusterNode) {
+	if !node.timedOut() || node.failed() {
+		return
+	}
+	now := util.GetMsTime()
+	validity := cluster.nodeTimeout * conf.CLUSTER_FAIL_REPORT_VALIDITY_MULT
+	for reporter, t := range node.failReports {
+		if now-t > validity {
+			delete(node.failReports, reporter)
+		}
+	}
+	failures := len(node.failReports)
+	if cluster.myself.isMaster() {
+		failures++
+	}
+	if failures < cluster.size()/2+1 {
+		return
+	}
+	server.logger.Warn().Msgf("marking node %s as failing (quorum reached)", node.id)
+	node.flags = node.flags&^CLUSTER_NODE_PFAIL | CLUSTER_NODE_FAIL
+	node.failTime = now
+	cluster.broadcastFail(node)
+	cluster.todoSaveConfig = true
+}
+
+/*
+已下线的节点恢复连接后清除FAIL，从节点与不负责哈希槽的主节点立即清除，
+负责哈希槽的主节点等待一段时间仍未被故障转移时清除
+*/
+func (cluster *clusterState) clearNodeFailureIfNeeded(node *clusterNode) {
+	now := util.GetMsTime()
+	if !node.isMaster() || node.numSlots() == 0 ||
+		now-node.failTime > cluster.nodeTimeout*conf.CLUSTER_FAIL_UNDO_TIME_MULT {
+		server.logger.Info().Msgf("clear FAIL state for node %s: is reachable again", node.id)
+		node.flags &^= CLUSTER_NODE_FAIL
+		cluster.todoSaveConfig = true
+	}
+}
+
+// 两个主节点的配置纪元相同时，ID较小的一方增大纪元，使每个主节点的配置纪元唯一
+func (cluster *clusterState) handleConfigEpochCollision(sender *clusterNode) {
+	myself := cluster.myself
+	if sender.configEpoch != myself.configEpoch || sender.id <= myself.id {
+		return
+	}
+	cluster.currentEpoch++
+	myself.configEpoch = cluster.currentEpoch
+	cluster.todoSaveConfig = true
+	server.logger.Warn().Msgf("configEpoch collision with node %s, configEpoch set to %d", sender.id, myself.configEpoch)
+}
+
+/*
+以sender声明的哈希槽更新本节点的配置，未分配或当前负责节点纪元更小的哈希槽归sender所有
+本节点或其主节点失去了所有哈希槽时成为sender的从节点，否则删除失去的哈希槽中的key
+*/
+func (cluster *clusterState) updateSlotsConfigWith(sender *clusterNode, senderEpoch uint64, slots []byte) {
+	myself := cluster.myself
+	if sender == myself {
+		return
+	}
+	curMaster := myself
+	if !myself.isMaster() {
+		curMaster = myself.master
+	}
+	var newMaster *clusterNode
+	var dirty []int
+	for slot := 0; slot < conf.CLUSTER_SLOTS; slot++ {
+		if slots[slot/8]&(1<<(slot%8)) == 0 {
+			continue
+		}
+		owner := cluster.slots[slot]
+		// 迁入中的哈希槽由SETSLOT NODE决定归属
+		if owner == sender || cluster.importingFrom[slot] != nil {
+			continue
+		}
+		if owner != nil && owner.configEpoch >= senderEpoch {
+			continue
+		}
+		if owner == myself && len(cluster.slotKeys[slot]) > 0 {
+			dirty = append(dirty, slot)
+		}
+		if owner != nil {
+			if owner == curMaster {
+				newMaster = sender
+			}
+			owner.clearSlot(slot)
+		}
+		sender.setSlot(slot)
+		cluster.slots[slot] = sender
+		cluster.todoSaveConfig = true
+	}
+	if newMaster != nil && curMaster.numSlots() == 0 {
+		server.logger.Warn().Msgf("configuration change detected, reconfiguring myself as a replica of %s", sender.id)
+		cluster.setNodeReplicaOf(myself, sender)
+		cluster.syncReplication()
+		return
+	}
+	for _, slot := range dirty {
+		cluster.delKeysInSlot(slot)
+	}
+}
+
+// 主节点为请求投票的从节点投票，每个纪元只投一票，同一主节点的故障转移在两倍节点超时时间内只投一次
+func (cluster *clusterState) sendFailoverAuthIfNeeded(node *clusterNode, hdr *clusterMsgHeader) {
+	myself := cluster.myself
+	master := node.master
+	if !myself.isMaster() || myself.numSlots() == 0 {
+		return
+	}
+	if hdr.CurrentEpoch < cluster.currentEpoch || cluster.lastVoteEpoch == cluster.currentEpoch {
+		return
+	}
+	if node.isMaster() || master == nil || !master.failed() {
+		return
+	}
+	now := util.GetMsTime()
+	if now-master.votedTime < cluster.nodeTimeout*2 {
+		return
+	}
+	for slot := 0; slot < conf.CLUSTER_SLOTS; slot++ {
+		if hdr.Slots[slot/8]&(1<<(slot%8)) == 0 {
+			continue
+		}
+		if owner := cluster.slots[slot]; owner != nil && owner.configEpoch > hdr.ConfigEpoch {
+			return
+		}
+	}
+	cluster.lastVoteEpoch = cluster.currentEpoch
+	master.votedTime = now
+	cluster.saveConfigOrLog()
+	server.logger.Info().Msgf("failover auth granted to %s for epoch %d", node.id, cluster.currentEpoch)
+	ack := cluster.buildHeader(CLUSTER_MSG_TYPE_FAILOVER_AUTH_ACK)
+	cluster.sendMsg(node.link, CLUSTER_MSG_TYPE_FAILOVER_AUTH_ACK, encodeClusterMsg(&ack, nil))
+}
+
+// 复制偏移量大于本节点的同一主节点的从节点数量
+func (cluster *clusterState) replicaRank() int {
+	myself := cluster.myself
+	rank := 0
+	for _, replica := range myself.master.replicas {
+		if replica != myself && replica.replOffset > server.masterReplOffset {
+			rank++
+		}
+	}
+	return rank
+}
+
+/*
+主节点下线后从节点发起选举，随机延迟避免多个从节点同时发起，复制偏移量越小的从节点延迟越长
+获得多数负责哈希槽的主节点投票后接管主节点的哈希槽，并广播PONG让其他节点更新配置
+*/
+func (cluster *clusterState) handleReplicaFailover() {
+	myself := cluster.myself
+	master := myself.master
+	if myself.isMaster() || master == nil || !master.failed() || master.numSlots() == 0 {
+		return
+	}
+	now := util.GetMsTime()
+	timeout := cluster.nodeTimeout * 2
+	if timeout < 2000 {
+		timeout = 2000
+	}
+	authAge := now - cluster.failoverAuthTime
+	if authAge > timeout*2 {
+		cluster.failoverAuthCount = 0
+		cluster.failoverAuthSent = false
+		cluster.failoverAuthRank = cluster.replicaRank()
+		cluster.failoverAuthTime = now + 500 + rand.Int63n(500) + int64(cluster.failoverAuthRank)*1000
+		server.logger.Warn().Msgf("start of election delayed for %dms (rank #%d, offset %d)",
+			cluster.failoverAuthTime-now, cluster.failoverAuthRank, server.masterReplOffset)
+		return
+	}
+	if now < cluster.failoverAuthTime || authAge > timeout {
+		return
+	}
+	if !cluster.failoverAuthSent {
+		cluster.currentEpoch++
+		cluster.failoverAuthEpoch = cluster.currentEpoch
+		cluster.failoverAuthSent = true
+		cluster.todoSaveConfig = true
+		server.logger.Warn().Msgf("starting a failover election for epoch %d", cluster.currentEpoch)
+		hdr := cluster.buildHeader(CLUSTER_MSG_TYPE_FAILOVER_AUTH_REQUEST)
+		cluster.broadcast(CLUSTER_MSG_TYPE_FAILOVER_AUTH_REQUEST, encodeClusterMsg(&hdr, nil))
+		return
+	}
+	if cluster.failoverAuthCount < cluster.size()/2+1 {
+		return
+	}
+	server.logger.Warn().Msgf("failover election won, I'm the new master for epoch %d", cluster.failoverAuthEpoch)
+	if myself.configEpoch < cluster.failoverAuthEpoch {
+		myself.configEpoch = cluster.failoverAuthEpoch
+	}
+	cluster.setNodeAsMaster(myself)
+	replicationUnsetMaster()
+	for slot := 0; slot < conf.CLUSTER_SLOTS; slot++ {
+		if master.hasSlot(slot) {
+			master.clearSlot(slot)
+			myself.setSlot(slot)
+			cluster.slots[slot] = myself
+		}
+	}
+	cluster.updateState()
+	cluster.saveConfigOrLog()
+	cluster.broadcastPong()
+}
+
+// 复制连接与集群中的主从关系保持一致
+func (cluster *clusterState) syncReplication() {
+	myself := cluster.myself
+	if myself.isMaster() {
+		if server.masterHost != "" {
+			replicationUnsetMaster()
+		}
+		return
+	}
+	master := myself.master
+	if master != nil && master.ip != "" && (server.masterHost != master.ip || server.masterPort != master.port) {
+		replicationSetMaster(master.ip, master.port)
+	}
+}
+
+/*
+每100毫秒执行一次：建立缺失的总线连接，每秒向随机节点中最久没有收到PONG的节点发送PING，
+等待PONG超过节点超时时间的节点标记为PFAIL，从节点检查是否需要故障转移
+*/
+func clusterCron() {
+	cluster := server.cluster
+	if cluster == nil {
+		return
+	}
+	cluster.processEvents()
+	cluster.cronLoops++
+	myself := cluster.myself
+	now := util.GetMsTime()
+
+	handshakeTimeout := cluster.nodeTimeout
+	if handshakeTimeout < 1000 {
+		handshakeTimeout = 1000
+	}
+	for _, node := range cluster.nodes {
+		if node == myself || node.flags&CLUSTER_NODE_NOADDR != 0 {
+			continue
+		}
+		if node.inHandshake() && now-node.ctime > handshakeTimeout {
+			cluster.delNode(node)
+			continue
+		}
+		if node.link == nil {
+			cluster.connectNode(node)
+		}
+	}
+
+	if cluster.cronLoops%10 == 0 {
+		var target *clusterNode
+		i := 0
+		for _, node := range cluster.nodes {
+			if i == 5 {
+				break
+			}
+			if node == myself || node.link == nil || node.pingSent != 0 || node.inHandshake() {
+				continue
+			}
+			i++
+			if target == nil || node.pongReceived < target.pongReceived {
+				target = node
+			}
+		}
+		if target != nil {
+			cluster.sendPing(target.link, CLUSTER_MSG_TYPE_PING)
+		}
+	}
+
+	for _, node := range cluster.nodes {
+		if node == myself || node.flags&(CLUSTER_NODE_NOADDR|CLUSTER_NODE_HANDSHAKE) != 0 {
+			continue
+		}
+		// 连接已建立但PING长时间没有回复时重连，避免连接本身的问题导致误判
+		if link := node.link; link != nil && link.conn != nil && now-link.ctime > cluster.nodeTimeout &&
+			node.pingSent != 0 && now-node.pingSent > cluster.nodeTimeout/2 && now-node.pongReceived > cluster.nodeTimeout/2 {
+			freeClusterLink(link)
+		}
+		if node.link != nil && node.pingSent == 0 && now-node.pongReceived > cluster.nodeTimeout/2 {
+			cluster.sendPing(node.link, CLUSTER_MSG_TYPE_PING)
+			continue
+		}
+		if node.pingSent != 0 && now-node.pingSent > cluster.nodeTimeout && node.flags&(CLUSTER_NODE_PFAIL|CLUSTER_NODE_FAIL) == 0 {
+			server.logger.Warn().Msgf("*** NODE %s possibly failing", node.id)
+			node.flags |= CLUSTER_NODE_PFAIL
+			cluster.markNodeAsFailingIfNeeded(node)
+		}
+	}
+
+	if !myself.isMaster() {
+		cluster.syncReplication()
+		cluster.handleReplicaFailover()
+	}
+	for id, expire := range cluster.blacklist {
+		if expire < now/1000 {
+			delete(cluster.blacklist, id)
+		}
+	}
+	cluster.updateState()
+	if cluster.todoSaveConfig {
+		cluster.saveConfigOrLog()
+	}
+}
+
+// 事件循环休眠前处理总线消息，并写回变化的集群配置
+func clusterBeforeSleep() {
+	cluster := server.cluster
+	if cluster == nil {
+		return
+	}
+	cluster.processEvents()
+	if cluster.todoSaveConfig {
+		cluster.saveConfigOrLog()
+	}
+}
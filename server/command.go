@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 
@@ -14,6 +15,14 @@ import (
 
 const MULTI_ARGS_COMMAND int = -1
 
+// 过期命令的NX|XX|GT|LT选项
+const (
+	EXPIRE_NX = 1 << iota
+	EXPIRE_XX
+	EXPIRE_GT
+	EXPIRE_LT
+)
+
 type CommandProc func(c *GodisClient) (bool, error)
 
 type GodisCommand struct {
@@ -21,6 +30,12 @@ type GodisCommand struct {
 	proc     CommandProc
 	arity    int
 	isModify bool //是否为修改命令，若是查询命令则不需要持久化
+
+	// 参数中key的位置，firstKey为0表示没有key，lastKey为负数时从末尾倒数
+	firstKey int
+	lastKey  int
+	keyStep  int
+	keysProc func(args []*data.Gobj) []*data.Gobj //key的位置不固定时由命令自行解析
 }
 
 func NewGodisCommand(name string, proc CommandProc, arity int, isModify bool) *GodisCommand {
@@ -32,86 +47,205 @@ func NewGodisCommand(name string, proc CommandProc, arity int, isModify bool) *G
 	}
 }
 
+// 设置命令参数中key的位置，集群模式下据此计算命令访问的哈希槽
+func (cmd *GodisCommand) withKeys(first, last, step int) *GodisCommand {
+	cmd.firstKey = first
+	cmd.lastKey = last
+	cmd.keyStep = step
+	return cmd
+}
+
+func (cmd *GodisCommand) withKeysProc(proc func(args []*data.Gobj) []*data.Gobj) *GodisCommand {
+	cmd.keysProc = proc
+	return cmd
+}
+
+func (cmd *GodisCommand) Name() string {
+	return cmd.name
+}
+
+// 参数个数，MULTI_ARGS_COMMAND表示不固定
+func (cmd *GodisCommand) Arity() int {
+	return cmd.arity
+}
+
+// 命令参数中的key
+func (cmd *GodisCommand) GetKeys(args []*data.Gobj) []*data.Gobj {
+	if cmd.keysProc != nil {
+		return cmd.keysProc(args)
+	}
+	if cmd.firstKey == 0 || cmd.firstKey >= len(args) {
+		return nil
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	keys := make([]*data.Gobj, 0, (last-cmd.firstKey)/cmd.keyStep+1)
+	for i := cmd.firstKey; i <= last; i += cmd.keyStep {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
 var cmdTable = map[string]*GodisCommand{
 	// system
 	"ping":     NewGodisCommand("ping", pingCommand, 1, false),
-	"shutdown": NewGodisCommand("shutdown", shutdownCommand, 1, false),
+	"shutdown": NewGodisCommand("shutdown", shutdownCommand, MULTI_ARGS_COMMAND, false),
 	// string
-	"set":    NewGodisCommand("set", setCommand, 3, true),
-	"mset":   NewGodisCommand("mset", msetCommand, MULTI_ARGS_COMMAND, true),
-	"setnx":  NewGodisCommand("setnx", setnxCommand, 3, true),
-	"get":    NewGodisCommand("get", getCommand, 2, false),
-	"del":    NewGodisCommand("del", delCommand, MULTI_ARGS_COMMAND, true),
-	"exists": NewGodisCommand("exists", existsCommand, MULTI_ARGS_COMMAND, false),
-	"incr":   NewGodisCommand("incr", incrCommand, 2, true),
-	"expire": NewGodisCommand("expire", expireCommand, 3, true),
+	"set":    NewGodisCommand("set", setCommand, 3, true).withKeys(1, 1, 1),
+	"mset":   NewGodisCommand("mset", msetCommand, MULTI_ARGS_COMMAND, true).withKeys(1, -1, 2),
+	"setnx":  NewGodisCommand("setnx", setnxCommand, 3, true).withKeys(1, 1, 1),
+	"get":    NewGodisCommand("get", getCommand, 2, false).withKeys(1, 1, 1),
+	"del":    NewGodisCommand("del", delCommand, MULTI_ARGS_COMMAND, true).withKeys(1, -1, 1),
+	"exists": NewGodisCommand("exists", existsCommand, MULTI_ARGS_COMMAND, false).withKeys(1, -1, 1),
+	"incr":   NewGodisCommand("incr", incrCommand, 2, true).withKeys(1, 1, 1),
+	"expire": NewGodisCommand("expire", expireCommand, MULTI_ARGS_COMMAND, true).withKeys(1, 1, 1),
+	"ttl":    NewGodisCommand("ttl", ttlCommand, 2, false).withKeys(1, 1, 1),
+	"pttl":   NewGodisCommand("pttl", pttlCommand, 2, false).withKeys(1, 1, 1),
+
+	"pexpire":     NewGodisCommand("pexpire", pexpireCommand, MULTI_ARGS_COMMAND, true).withKeys(1, 1, 1),
+	"expireat":    NewGodisCommand("expireat", expireatCommand, MULTI_ARGS_COMMAND, true).withKeys(1, 1, 1),
+	"pexpireat":   NewGodisCommand("pexpireat", pexpireatCommand, MULTI_ARGS_COMMAND, true).withKeys(1, 1, 1),
+	"expiretime":  NewGodisCommand("expiretime", expiretimeCommand, 2, false).withKeys(1, 1, 1),
+	"pexpiretime": NewGodisCommand("pexpiretime", pexpiretimeCommand, 2, false).withKeys(1, 1, 1),
+	"persist":     NewGodisCommand("persist", persistCommand, 2, true).withKeys(1, 1, 1),
 	// list
-	"lpush":  NewGodisCommand("lpush", lpushCommand, MULTI_ARGS_COMMAND, true),
-	"lpop":   NewGodisCommand("lpop", lpopCommand, 2, true),
-	"rpush":  NewGodisCommand("rpush", rpushCommand, MULTI_ARGS_COMMAND, true),
-	"rpop":   NewGodisCommand("rpop", rpopCommand, 2, true),
-	"lset":   NewGodisCommand("lset", lsetCommand, 4, true),
-	"lrem":   NewGodisCommand("lrem", lremCommand, 3, true),
-	"llen":   NewGodisCommand("llen", llenCommand, 2, false),
-	"lindex": NewGodisCommand("lindex", lindexCommand, 3, false),
-	"lrange": NewGodisCommand("lrange", lrangeCommand, 4, false),
+	"lpush":  NewGodisCommand("lpush", lpushCommand, MULTI_ARGS_COMMAND, true).withKeys(1, 1, 1),
+	"lpop":   NewGodisCommand("lpop", lpopCommand, 2, true).withKeys(1, 1, 1),
+	"rpush":  NewGodisCommand("rpush", rpushCommand, MULTI_ARGS_COMMAND, true).withKeys(1, 1, 1),
+	"rpop":   NewGodisCommand("rpop", rpopCommand, 2, true).withKeys(1, 1, 1),
+	"lset":   NewGodisCommand("lset", lsetCommand, 4, true).withKeys(1, 1, 1),
+	"lrem":   NewGodisCommand("lrem", lremCommand, 3, true).withKeys(1, 1, 1),
+	"llen":   NewGodisCommand("llen", llenCommand, 2, false).withKeys(1, 1, 1),
+	"lindex": NewGodisCommand("lindex", lindexCommand, 3, false).withKeys(1, 1, 1),
+	"lrange": NewGodisCommand("lrange", lrangeCommand, 4, false).withKeys(1, 1, 1),
 	// hash
-	"hset":    NewGodisCommand("hset", hsetCommand, MULTI_ARGS_COMMAND, true),
-	"hget":    NewGodisCommand("hget", hgetCommand, 3, false),
-	"hdel":    NewGodisCommand("hdel", hdelCommand, MULTI_ARGS_COMMAND, true),
-	"hexists": NewGodisCommand("hexists", hexistsCommand, 3, false),
-	"hgetall": NewGodisCommand("hgetall", hgetallCommand, 2, false),
+	"hset":    NewGodisCommand("hset", hsetCommand, MULTI_ARGS_COMMAND, true).withKeys(1, 1, 1),
+	"hget":    NewGodisCommand("hget", hgetCommand, 3, false).withKeys(1, 1, 1),
+	"hdel":    NewGodisCommand("hdel", hdelCommand, MULTI_ARGS_COMMAND, true).withKeys(1, 1, 1),
+	"hexists": NewGodisCommand("hexists", hexistsCommand, 3, false).withKeys(1, 1, 1),
+	"hgetall": NewGodisCommand("hgetall", hgetallCommand, 2, false).withKeys(1, 1, 1),
 	// set
-	"sadd":        NewGodisCommand("sadd", saddCommand, MULTI_ARGS_COMMAND, true),
-	"scard":       NewGodisCommand("scard", scardCommand, 2, false),
-	"sismember":   NewGodisCommand("sismember", sismemberCommand, 3, false),
-	"smembers":    NewGodisCommand("smembers", smembersCommand, 2, false),
-	"srandmember": NewGodisCommand("srandmember", srandmemberCommand, 2, false),
-	"srem":        NewGodisCommand("srem", sremCommand, MULTI_ARGS_COMMAND, true),
-	"spop":        NewGodisCommand("spop", spopCommand, 2, true),
-	"sinter":      NewGodisCommand("sinter", sinterCommand, 3, false),
-	"sdiff":       NewGodisCommand("sdiff", sdiffCommand, 3, false),
-	"sunion":      NewGodisCommand("sunion", sunionCommand, 3, false),
+	"sadd":        NewGodisCommand("sadd", saddCommand, MULTI_ARGS_COMMAND, true).withKeys(1, 1, 1),
+	"scard":       NewGodisCommand("scard", scardCommand, 2, false).withKeys(1, 1, 1),
+	"sismember":   NewGodisCommand("sismember", sismemberCommand, 3, false).withKeys(1, 1, 1),
+	"smembers":    NewGodisCommand("smembers", smembersCommand, 2, false).withKeys(1, 1, 1),
+	"srandmember": NewGodisCommand("srandmember", srandmemberCommand, 2, false).withKeys(1, 1, 1),
+	"srem":        NewGodisCommand("srem", sremCommand, MULTI_ARGS_COMMAND, true).withKeys(1, 1, 1),
+	"spop":        NewGodisCommand("spop", spopCommand, 2, true).withKeys(1, 1, 1),
+	"sinter":      NewGodisCommand("sinter", sinterCommand, 3, false).withKeys(1, -1, 1),
+	"sdiff":       NewGodisCommand("sdiff", sdiffCommand, 3, false).withKeys(1, -1, 1),
+	"sunion":      NewGodisCommand("sunion", sunionCommand, 3, false).withKeys(1, -1, 1),
 	// zset
-	"zadd":    NewGodisCommand("zadd", zaddCommand, MULTI_ARGS_COMMAND, true),
-	"zcard":   NewGodisCommand("zcard", zcardCommand, 2, false),
-	"zscore":  NewGodisCommand("zscore", zscoreCommand, 3, false),
-	"zrange":  NewGodisCommand("zrange", zrangeCommand, 4, false),
-	"zrank":   NewGodisCommand("zrank", zrankCommand, 3, false),
-	"zrem":    NewGodisCommand("zrem", zremCommand, MULTI_ARGS_COMMAND, true),
-	"zcount":  NewGodisCommand("zcount", zcountCommand, 4, false),
-	"zpopmin": NewGodisCommand("zpopmin", zpopminCommand, 2, true),
+	"zadd":    NewGodisCommand("zadd", zaddCommand, MULTI_ARGS_COMMAND, true).withKeys(1, 1, 1),
+	"zcard":   NewGodisCommand("zcard", zcardCommand, 2, false).withKeys(1, 1, 1),
+	"zscore":  NewGodisCommand("zscore", zscoreCommand, 3, false).withKeys(1, 1, 1),
+	"zrange":  NewGodisCommand("zrange", zrangeCommand, 4, false).withKeys(1, 1, 1),
+	"zrank":   NewGodisCommand("zrank", zrankCommand, 3, false).withKeys(1, 1, 1),
+	"zrem":    NewGodisCommand("zrem", zremCommand, MULTI_ARGS_COMMAND, true).withKeys(1, 1, 1),
+	"zcount":  NewGodisCommand("zcount", zcountCommand, 4, false).withKeys(1, 1, 1),
+	"zpopmin": NewGodisCommand("zpopmin", zpopminCommand, 2, true).withKeys(1, 1, 1),
 	// bitmap
-	"setbit":   NewGodisCommand("setbit", setbitCommand, 4, true),
-	"getbit":   NewGodisCommand("getbit", getbitCommand, 3, false),
-	"bitcount": NewGodisCommand("bitcount", bitcountCommand, 2, false),
-	"bitop":    NewGodisCommand("bitop", bitopCommand, 4, false),
-	"bitpos":   NewGodisCommand("bitpos", bitposCommand, 3, false),
-
-	"slowlog": NewGodisCommand("slowlog", slowlogCommand, 2, false),
-	"save":    NewGodisCommand("save", saveCommand, 1, false),
-	"bgsave":  NewGodisCommand("bgsave", bgsaveCommand, 1, false),
+	"setbit":   NewGodisCommand("setbit", setbitCommand, 4, true).withKeys(1, 1, 1),
+	"getbit":   NewGodisCommand("getbit", getbitCommand, 3, false).withKeys(1, 1, 1),
+	"bitcount": NewGodisCommand("bitcount", bitcountCommand, 2, false).withKeys(1, 1, 1),
+	"bitop":    NewGodisCommand("bitop", bitopCommand, 4, false).withKeys(2, -1, 1),
+	"bitpos":   NewGodisCommand("bitpos", bitposCommand, 3, false).withKeys(1, 1, 1),
+
+	"slowlog":  NewGodisCommand("slowlog", slowlogCommand, 2, false),
+	"save":     NewGodisCommand("save", saveCommand, 1, false),
+	"bgsave":   NewGodisCommand("bgsave", bgsaveCommand, 1, false),
+	"lastsave": NewGodisCommand("lastsave", lastsaveCommand, 1, false),
+
+	"bgrewriteaof": NewGodisCommand("bgrewriteaof", bgrewriteaofCommand, 1, false),
+	"info":         NewGodisCommand("info", infoCommand, MULTI_ARGS_COMMAND, false),
+	// replication
+	"replicaof": NewGodisCommand("replicaof", replicaofCommand, 3, false),
+	"slaveof":   NewGodisCommand("slaveof", replicaofCommand, 3, false),
+	"replconf":  NewGodisCommand("replconf", replconfCommand, MULTI_ARGS_COMMAND, false),
+	"sync":      NewGodisCommand("sync", syncCommand, 1, false),
+	"psync":     NewGodisCommand("psync", psyncCommand, 3, false),
+	"wait":      NewGodisCommand("wait", waitCommand, 3, false),
+	"waitaof":   NewGodisCommand("waitaof", waitaofCommand, 4, false),
+	// cluster
+	"cluster": NewGodisCommand("cluster", clusterCommand, MULTI_ARGS_COMMAND, false),
+	"asking":  NewGodisCommand("asking", askingCommand, 1, false),
+	"dump":    NewGodisCommand("dump", dumpCommand, 2, false).withKeys(1, 1, 1),
+	"restore": NewGodisCommand("restore", restoreCommand, MULTI_ARGS_COMMAND, true).withKeys(1, 1, 1),
+	"migrate": NewGodisCommand("migrate", migrateCommand, MULTI_ARGS_COMMAND, true).withKeysProc(migrateGetKeys),
 }
 
-func expireIfNeeded(key *data.Gobj) {
+/*
+惰性删除，访问key时若已过期则删除，返回key是否已过期，加载数据期间不删除
+从节点不删除过期key，只对普通客户端返回已过期，由主节点同步的del删除，执行主节点同步的命令时key视为未过期
+*/
+func expireIfNeeded(key *data.Gobj) bool {
+	if server.loading {
+		return false
+	}
 	entry := server.DB.Expire.Find(key)
 	if entry == nil {
-		return
+		return false
 	}
 	when, err := entry.Val.Int64Val()
 	if err != nil {
-		return
+		return false
 	}
-	if when > util.GetTime() {
-		return
+	if when > util.GetMsTime() {
+		return false
 	}
-	server.DB.Expire.Delete(key)
-	server.DB.Data.Delete(key)
+	if server.masterHost != "" {
+		return server.currentClient == nil || !server.currentClient.isMaster
+	}
+	deleteExpiredKey(key)
+	return true
+}
+
+/*
+设置的过期时间已经过去时，是否直接删除key，与Redis的checkAlreadyExpired一致
+加载数据或执行主节点同步的命令时按原样设置过期时间，交给惰性删除与定期删除处理，
+避免之后对同一key的写命令重新创建出没有过期时间的key，从节点时钟较快时也不会先于主节点删除
+*/
+func checkAlreadyExpired(c *GodisClient, when int64) bool {
+	return when <= util.GetMsTime() && !server.loading && !c.isMaster
 }
 
 func findKeyRead(key *data.Gobj) *data.Gobj {
-	expireIfNeeded(key)
-	return server.DB.Data.Get(key)
+	if expireIfNeeded(key) {
+		return nil
+	}
+	return server.DB.LookupKeyRead(key)
+}
+
+// 写命令同样先删除已过期的key，避免修改过期的value或让新value沿用旧的过期时间
+func findKeyWrite(key *data.Gobj) *data.Gobj {
+	if expireIfNeeded(key) {
+		return nil
+	}
+	return server.DB.LookupKeyWrite(key)
+}
+
+// 删除key及其过期时间，key不存在返回false
+func dbDelete(key *data.Gobj) bool {
+	if err := server.DB.Data.Delete(key); err != nil {
+		return false
+	}
+	server.DB.Expire.Delete(key)
+	if server.cluster != nil {
+		server.cluster.delSlotKey(key.StrVal())
+	}
+	return true
+}
+
+// 集合类型的元素被删空后删除key，与Redis一致，之后新建的同名key不会继承原来的过期时间
+func deleteKeyIfEmpty(key *data.Gobj, length int) {
+	if length == 0 {
+		dbDelete(key)
+	}
 }
 
 func pingCommand(c *GodisClient) (bool, error) {
@@ -119,8 +253,32 @@ func pingCommand(c *GodisClient) (bool, error) {
 	return true, nil
 }
 
+// SHUTDOWN [NOSAVE|SAVE]，配置了自动保存条件时默认在退出前执行一次同步保存
 func shutdownCommand(c *GodisClient) (bool, error) {
-	server.AeLoop.stop = true
+	if len(c.args) > 2 {
+		c.AddReplyStr("-ERR syntax error\r\n")
+		return false, errs.ParamsCheckError
+	}
+	save := len(server.RDB.SaveParams) > 0
+	if len(c.args) == 2 {
+		switch strings.ToLower(c.args[1].StrVal()) {
+		case "nosave":
+			save = false
+		case "save":
+			save = true
+		default:
+			c.AddReplyStr("-ERR syntax error\r\n")
+			return false, errs.ParamsCheckError
+		}
+	}
+	if save {
+		server.RDB.WaitBgSave()
+		if err := server.RDB.Save(server.DB); err != nil {
+			c.AddReplyStr("-ERR Errors trying to SHUTDOWN. Check logs.\r\n")
+			return false, err
+		}
+	}
+	server.AeLoop.Stop()
 	return true, nil
 }
 func setCommand(c *GodisClient) (bool, error) {
@@ -178,10 +336,10 @@ func delCommand(c *GodisClient) (bool, error) {
 	}
 	var key *data.Gobj
 	count := 0
-	for i := range c.args {
+	for i := 1; i < len(c.args); i++ {
 		key = c.args[i]
-		err := server.DB.Data.Delete(key)
-		if err != nil {
+		expireIfNeeded(key)
+		if !dbDelete(key) {
 			continue
 		}
 		count++
@@ -193,7 +351,7 @@ func delCommand(c *GodisClient) (bool, error) {
 
 func incrCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	rawVal := server.DB.Data.Get(key)
+	rawVal := findKeyWrite(key)
 	if rawVal != nil {
 		if rawVal.Type_ != conf.GSTR {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -221,6 +379,7 @@ func incrCommand(c *GodisClient) (bool, error) {
 func setnxCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
 	val := c.args[2]
+	expireIfNeeded(key)
 	err := server.DB.Data.SetNx(key, val)
 	if err != nil {
 		c.AddReplyStr(":0\r\n")
@@ -247,15 +406,185 @@ func existsCommand(c *GodisClient) (bool, error) {
 	return true, nil
 }
 func expireCommand(c *GodisClient) (bool, error) {
-	key := c.args[1]
-	val := c.args[2]
-	seconds, err := val.Int64Val()
+	return relativeExpireCommand(c, 1000)
+}
+
+func pexpireCommand(c *GodisClient) (bool, error) {
+	return relativeExpireCommand(c, 1)
+}
+
+func expireatCommand(c *GodisClient) (bool, error) {
+	return absoluteExpireCommand(c, 1000)
+}
+
+func pexpireatCommand(c *GodisClient) (bool, error) {
+	return absoluteExpireCommand(c, 1)
+}
+
+// 相对时间的过期命令，unit为参数单位对应的毫秒数
+func relativeExpireCommand(c *GodisClient, unit int64) (bool, error) {
+	ttl, flags, ok := parseExpireArgs(c)
+	if !ok {
+		return false, errs.ParamsCheckError
+	}
+	now := util.GetMsTime()
+	if ttl > (math.MaxInt64-now)/unit || ttl < (math.MinInt64+now)/unit {
+		c.AddReplyStr(fmt.Sprintf("-ERR invalid expire time in '%s' command\r\n", c.args[0].StrVal()))
+		return false, errs.OutOfRangeError
+	}
+	return expireGenericCommand(c, c.args[1], now+ttl*unit, flags)
+}
+
+// 绝对时间的过期命令，unit为参数单位对应的毫秒数
+func absoluteExpireCommand(c *GodisClient, unit int64) (bool, error) {
+	when, flags, ok := parseExpireArgs(c)
+	if !ok {
+		return false, errs.ParamsCheckError
+	}
+	if when > math.MaxInt64/unit || when < math.MinInt64/unit {
+		c.AddReplyStr(fmt.Sprintf("-ERR invalid expire time in '%s' command\r\n", c.args[0].StrVal()))
+		return false, errs.OutOfRangeError
+	}
+	return expireGenericCommand(c, c.args[1], when*unit, flags)
+}
+
+// 解析过期命令的时间参数与NX|XX|GT|LT选项，出错时已回复客户端
+func parseExpireArgs(c *GodisClient) (int64, int, bool) {
+	if len(c.args) < 3 {
+		c.AddReplyStr(fmt.Sprintf("-ERR wrong number of arguments for '%s' command\r\n", c.args[0].StrVal()))
+		return 0, 0, false
+	}
+	val, err := c.args[2].Int64Val()
 	if err != nil {
-		return false, err
+		c.AddReplyStr("-ERR value is not an integer or out of range\r\n")
+		return 0, 0, false
+	}
+	flags := 0
+	for _, arg := range c.args[3:] {
+		switch strings.ToUpper(arg.StrVal()) {
+		case "NX":
+			flags |= EXPIRE_NX
+		case "XX":
+			flags |= EXPIRE_XX
+		case "GT":
+			flags |= EXPIRE_GT
+		case "LT":
+			flags |= EXPIRE_LT
+		default:
+			c.AddReplyStr(fmt.Sprintf("-ERR Unsupported option %s\r\n", arg.StrVal()))
+			return 0, 0, false
+		}
+	}
+	if flags&EXPIRE_NX != 0 && flags&(EXPIRE_XX|EXPIRE_GT|EXPIRE_LT) != 0 {
+		c.AddReplyStr("-ERR NX and XX, GT or LT options at the same time are not compatible\r\n")
+		return 0, 0, false
+	}
+	if flags&EXPIRE_GT != 0 && flags&EXPIRE_LT != 0 {
+		c.AddReplyStr("-ERR GT and LT options at the same time are not compatible\r\n")
+		return 0, 0, false
+	}
+	return val, flags, true
+}
+
+// 剩余的秒数，四舍五入，key不存在返回-2，未设置过期时间返回-1
+func ttlCommand(c *GodisClient) (bool, error) {
+	ttl := remainingTTL(c.args[1])
+	if ttl >= 0 {
+		ttl = (ttl + 500) / 1000
+	}
+	c.AddReplyStr(fmt.Sprintf(":%d\r\n", ttl))
+	return true, nil
+}
+
+// 剩余的毫秒数，key不存在返回-2，未设置过期时间返回-1
+func pttlCommand(c *GodisClient) (bool, error) {
+	c.AddReplyStr(fmt.Sprintf(":%d\r\n", remainingTTL(c.args[1])))
+	return true, nil
+}
+
+func remainingTTL(key *data.Gobj) int64 {
+	when := expireTimeOf(key)
+	if when >= 0 {
+		if when -= util.GetMsTime(); when < 0 {
+			when = 0
+		}
+	}
+	return when
+}
+
+// 秒级的过期时间戳，key不存在返回-2，未设置过期时间返回-1
+func expiretimeCommand(c *GodisClient) (bool, error) {
+	when := expireTimeOf(c.args[1])
+	if when >= 0 {
+		when = (when + 500) / 1000
+	}
+	c.AddReplyStr(fmt.Sprintf(":%d\r\n", when))
+	return true, nil
+}
+
+// 毫秒级的过期时间戳，key不存在返回-2，未设置过期时间返回-1
+func pexpiretimeCommand(c *GodisClient) (bool, error) {
+	c.AddReplyStr(fmt.Sprintf(":%d\r\n", expireTimeOf(c.args[1])))
+	return true, nil
+}
+
+func expireTimeOf(key *data.Gobj) int64 {
+	if findKeyRead(key) == nil {
+		return -2
+	}
+	expireObj := server.DB.Expire.Get(key)
+	if expireObj == nil {
+		return -1
+	}
+	when, err := expireObj.Int64Val()
+	if err != nil {
+		return -1
+	}
+	return when
+}
+
+// 移除key的过期时间，key不存在或未设置过期时间时返回0且不记录AOF，移除成功时写入AOF并传播给从节点
+func persistCommand(c *GodisClient) (bool, error) {
+	key := c.args[1]
+	if findKeyWrite(key) == nil {
+		c.AddReplyStr(":0\r\n")
+		return false, errs.KeyNotExistError
+	}
+	if err := server.DB.Expire.Delete(key); err != nil {
+		c.AddReplyStr(":0\r\n")
+		return false, nil
 	}
-	expire := util.GetTime() + seconds
-	expObj := data.CreateObjectFromInt(expire)
-	server.DB.Expire.Set(key, expObj)
+	c.AddReplyStr(":1\r\n")
+	return true, nil
+}
+
+/*
+设置key的过期时间，when为毫秒级的绝对时间，flags为NX|XX|GT|LT选项，未设置过期时间的key视为永不过期
+AOF中统一记录为pexpireat，重放时不受重启时间与选项影响；普通客户端设置的时间已过期时直接删除key并记录为del
+*/
+func expireGenericCommand(c *GodisClient, key *data.Gobj, when int64, flags int) (bool, error) {
+	if findKeyWrite(key) == nil {
+		c.AddReplyStr(":0\r\n")
+		return false, errs.KeyNotExistError
+	}
+	if flags != 0 {
+		current := expireTimeOf(key)
+		if (flags&EXPIRE_NX != 0 && current != -1) ||
+			(flags&EXPIRE_XX != 0 && current == -1) ||
+			(flags&EXPIRE_GT != 0 && (current == -1 || when <= current)) ||
+			(flags&EXPIRE_LT != 0 && current != -1 && when >= current) {
+			c.AddReplyStr(":0\r\n")
+			return false, nil
+		}
+	}
+	if checkAlreadyExpired(c, when) {
+		dbDelete(key)
+		c.rewriteCommand("del", key.StrVal())
+		c.AddReplyStr(":1\r\n")
+		return true, nil
+	}
+	server.DB.Expire.Set(key, data.CreateObjectFromInt(when))
+	c.rewriteCommand("pexpireat", key.StrVal(), strconv.FormatInt(when, 10))
 	c.AddReplyStr(":1\r\n")
 	return true, nil
 }
@@ -267,7 +596,7 @@ func lpushCommand(c *GodisClient) (bool, error) {
 	}
 
 	key := c.args[1]
-	listObj := server.DB.Data.Get(key)
+	listObj := findKeyWrite(key)
 	if listObj != nil {
 		if listObj.Type_ != conf.GLIST {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -288,7 +617,7 @@ func lpushCommand(c *GodisClient) (bool, error) {
 }
 func lpopCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	listObj := server.DB.Data.Get(key)
+	listObj := findKeyWrite(key)
 	if listObj != nil {
 		if listObj.Type_ != conf.GLIST {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -304,6 +633,7 @@ func lpopCommand(c *GodisClient) (bool, error) {
 		c.AddReplyStr("$-1\r\n")
 		return false, nil
 	}
+	deleteKeyIfEmpty(key, list.Length())
 	c.AddReplyStrVal(nodeVal.StrVal())
 	return true, nil
 }
@@ -314,7 +644,7 @@ func rpushCommand(c *GodisClient) (bool, error) {
 	}
 
 	key := c.args[1]
-	listObj := server.DB.Data.Get(key)
+	listObj := findKeyWrite(key)
 	if listObj != nil {
 		if listObj.Type_ != conf.GLIST {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -335,7 +665,7 @@ func rpushCommand(c *GodisClient) (bool, error) {
 
 func rpopCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	listObj := server.DB.Data.Get(key)
+	listObj := findKeyWrite(key)
 	if listObj != nil {
 		if listObj.Type_ != conf.GLIST {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -351,13 +681,14 @@ func rpopCommand(c *GodisClient) (bool, error) {
 		c.AddReplyStr("$-1\r\n")
 		return false, nil
 	}
+	deleteKeyIfEmpty(key, list.Length())
 	c.AddReplyStrVal(nodeVal.StrVal())
 	return true, nil
 }
 
 func llenCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	listObj := server.DB.Data.Get(key)
+	listObj := findKeyRead(key)
 	if listObj != nil {
 		if listObj.Type_ != conf.GLIST {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -374,7 +705,7 @@ func llenCommand(c *GodisClient) (bool, error) {
 
 func lindexCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	listObj := server.DB.Data.Get(key)
+	listObj := findKeyRead(key)
 	if listObj != nil {
 		if listObj.Type_ != conf.GLIST {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -401,7 +732,7 @@ func lindexCommand(c *GodisClient) (bool, error) {
 
 func lsetCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	listObj := server.DB.Data.Get(key)
+	listObj := findKeyWrite(key)
 	if listObj != nil {
 		if listObj.Type_ != conf.GLIST {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -430,7 +761,7 @@ func lsetCommand(c *GodisClient) (bool, error) {
 
 func lremCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	listObj := server.DB.Data.Get(key)
+	listObj := findKeyWrite(key)
 	if listObj != nil {
 		if listObj.Type_ != conf.GLIST {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -446,12 +777,13 @@ func lremCommand(c *GodisClient) (bool, error) {
 		c.AddReplyStr(":0\r\n")
 		return false, nil
 	}
+	deleteKeyIfEmpty(key, list.Length())
 	c.AddReplyStr(":1\r\n")
 	return true, nil
 }
 func lrangeCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	listObj := server.DB.Data.Get(key)
+	listObj := findKeyRead(key)
 	if listObj != nil {
 		if listObj.Type_ != conf.GLIST {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -489,7 +821,7 @@ func hsetCommand(c *GodisClient) (bool, error) {
 
 	var count int
 	key := c.args[1]
-	htObj := server.DB.Data.Get(key)
+	htObj := findKeyWrite(key)
 	if htObj != nil {
 		if htObj.Type_ != conf.GDICT {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -591,7 +923,7 @@ func hdelCommand(c *GodisClient) (bool, error) {
 	var count int
 
 	key := c.args[1]
-	htObj := server.DB.Data.Get(key)
+	htObj := findKeyWrite(key)
 	if htObj != nil {
 		if htObj.Type_ != conf.GDICT {
 			c.AddReplyStr("-ERR WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -610,6 +942,7 @@ func hdelCommand(c *GodisClient) (bool, error) {
 		}
 		count++
 	}
+	deleteKeyIfEmpty(key, ht.Length())
 
 	c.AddReplyStr(fmt.Sprintf(":%d\r\n", count))
 	return true, nil
@@ -622,7 +955,7 @@ func saddCommand(c *GodisClient) (bool, error) {
 	}
 
 	key := c.args[1]
-	setObj := server.DB.Data.Get(key)
+	setObj := findKeyWrite(key)
 	if setObj != nil {
 		if setObj.Type_ != conf.GSET {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -705,7 +1038,7 @@ func sismemberCommand(c *GodisClient) (bool, error) {
 }
 func srandmemberCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	setObj := server.DB.Data.Get(key)
+	setObj := findKeyRead(key)
 	if setObj != nil {
 		if setObj.Type_ != conf.GSET {
 			c.AddReplyStr("-ERR WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -734,7 +1067,7 @@ func sremCommand(c *GodisClient) (bool, error) {
 	var count int
 
 	key := c.args[1]
-	setObj := server.DB.Data.Get(key)
+	setObj := findKeyWrite(key)
 	if setObj != nil {
 		if setObj.Type_ != conf.GSET {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -754,6 +1087,7 @@ func sremCommand(c *GodisClient) (bool, error) {
 		}
 		count++
 	}
+	deleteKeyIfEmpty(key, set.Length())
 
 	c.AddReplyStr(fmt.Sprintf(":%d\r\n", count))
 
@@ -762,7 +1096,7 @@ func sremCommand(c *GodisClient) (bool, error) {
 
 func spopCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	setObj := server.DB.Data.Get(key)
+	setObj := findKeyWrite(key)
 	if setObj != nil {
 		if setObj.Type_ != conf.GSET {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -778,6 +1112,7 @@ func spopCommand(c *GodisClient) (bool, error) {
 		c.AddReplyStr("$-1\r\n")
 		return false, nil
 	}
+	deleteKeyIfEmpty(key, set.Length())
 	c.AddReplyStrVal(setVal)
 	return true, nil
 }
@@ -906,7 +1241,7 @@ func zaddCommand(c *GodisClient) (bool, error) {
 		return false, errs.ParamsCheckError
 	}
 	key := c.args[1]
-	zsObj := server.DB.Data.Get(key)
+	zsObj := findKeyWrite(key)
 	if zsObj != nil {
 		if zsObj.Type_ != conf.GZSET {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -930,7 +1265,7 @@ func zaddCommand(c *GodisClient) (bool, error) {
 
 func zcardCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	zsObj := server.DB.Data.Get(key)
+	zsObj := findKeyRead(key)
 	if zsObj != nil {
 		if zsObj.Type_ != conf.GZSET {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -948,7 +1283,7 @@ func zcardCommand(c *GodisClient) (bool, error) {
 
 func zscoreCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	zsObj := server.DB.Data.Get(key)
+	zsObj := findKeyRead(key)
 	if zsObj != nil {
 		if zsObj.Type_ != conf.GZSET {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -971,7 +1306,7 @@ func zscoreCommand(c *GodisClient) (bool, error) {
 // 返回指定范围内的元素
 func zrangeCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	zsObj := server.DB.Data.Get(key)
+	zsObj := findKeyRead(key)
 	if zsObj != nil {
 		if zsObj.Type_ != conf.GZSET {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -1008,7 +1343,7 @@ func zremCommand(c *GodisClient) (bool, error) {
 	}
 	var count int
 	key := c.args[1]
-	zsObj := server.DB.Data.Get(key)
+	zsObj := findKeyWrite(key)
 	if zsObj != nil {
 		if zsObj.Type_ != conf.GZSET {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -1027,6 +1362,7 @@ func zremCommand(c *GodisClient) (bool, error) {
 			count += n
 		}
 	}
+	deleteKeyIfEmpty(key, zs.Zlen())
 
 	c.AddReplyStr(fmt.Sprintf(":%d\r\n", count))
 
@@ -1035,7 +1371,7 @@ func zremCommand(c *GodisClient) (bool, error) {
 
 func zrankCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	zsObj := server.DB.Data.Get(key)
+	zsObj := findKeyRead(key)
 	if zsObj != nil {
 		if zsObj.Type_ != conf.GZSET {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -1057,7 +1393,7 @@ func zrankCommand(c *GodisClient) (bool, error) {
 
 func zcountCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	zsObj := server.DB.Data.Get(key)
+	zsObj := findKeyRead(key)
 	if zsObj != nil {
 		if zsObj.Type_ != conf.GZSET {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -1080,7 +1416,7 @@ func zcountCommand(c *GodisClient) (bool, error) {
 
 func zpopminCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	zsObj := server.DB.Data.Get(key)
+	zsObj := findKeyWrite(key)
 	if zsObj != nil {
 		if zsObj.Type_ != conf.GZSET {
 			c.AddReplyStr("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -1102,6 +1438,7 @@ func zpopminCommand(c *GodisClient) (bool, error) {
 		c.AddReplyStr("*0\r\n")
 		return false, err
 	}
+	deleteKeyIfEmpty(key, zs.Zlen())
 	s := strconv.FormatFloat(score, 'f', -1, 64)
 
 	c.AddReplyStrVal(member)
@@ -1111,7 +1448,7 @@ func zpopminCommand(c *GodisClient) (bool, error) {
 
 func setbitCommand(c *GodisClient) (bool, error) {
 	key := c.args[1]
-	bitObj := server.DB.Data.Get(key)
+	bitObj := findKeyWrite(key)
 	if bitObj != nil {
 		if bitObj.Type_ != conf.GBIT {
 			c.AddReplyStr("-ERR WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
@@ -1282,6 +1619,12 @@ func bgsaveCommand(c *GodisClient) (bool, error) {
 		c.AddReplyStr("-ERR Background save already in progress\r\n")
 		return false, errs.RDBIsSavingError
 	}
+	// 同一时间只能存在一个快照，等待重写结束后执行
+	if server.AOF.IsRewriting() {
+		server.rdbBgsaveScheduled = true
+		c.AddReplyStr("+Background saving scheduled\r\n")
+		return true, nil
+	}
 	if err := server.RDB.BgSave(server.DB); err != nil {
 		c.AddReplyStr("-ERR Failed to save rdb file\r\n")
 		return false, err
@@ -1290,3 +1633,39 @@ func bgsaveCommand(c *GodisClient) (bool, error) {
 	}
 	return true, nil
 }
+
+func lastsaveCommand(c *GodisClient) (bool, error) {
+	c.AddReplyStr(fmt.Sprintf(":%d\r\n", server.RDB.LastSave))
+	return true, nil
+}
+
+func bgrewriteaofCommand(c *GodisClient) (bool, error) {
+	if server.AOF.IsRewriting() {
+		c.AddReplyStr("-ERR Background append only file rewriting already in progress\r\n")
+		return false, errs.AOFIsRewritingError
+	}
+	if server.RDB.IsRDBSave() {
+		server.aofRewriteScheduled = true
+		c.AddReplyStr("+Background append only file rewriting scheduled\r\n")
+		return true, nil
+	}
+	if err := server.AOF.BgRewrite(server.DB); err != nil {
+		c.AddReplyStr("-ERR Can't execute an AOF background rewriting\r\n")
+		return false, err
+	}
+	c.AddReplyStr("+Background append only file rewriting started\r\n")
+	return true, nil
+}
+
+func infoCommand(c *GodisClient) (bool, error) {
+	if len(c.args) > 2 {
+		c.AddReplyStr("-ERR syntax error\r\n")
+		return false, errs.ParamsCheckError
+	}
+	section := "default"
+	if len(c.args) == 2 {
+		section = strings.ToLower(c.args[1].StrVal())
+	}
+	c.AddReplyStrVal(genInfoString(section))
+	return true, nil
+}
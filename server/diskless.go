@@ -0,0 +1,58 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/godis/db"
+	"github.com/godis/errs"
+	"github.com/godis/net"
+)
+
+// 无盘复制中接收RDB的一个从节点连接
+type disklessTarget struct {
+	fd       int
+	err      error       //写入失败的错误，之后不再写入
+	released atomic.Bool //从节点已被释放，之后不再写入，fd在传输结束后关闭，避免被新连接复用
+}
+
+/*
+无盘复制: 在后台goroutine中将快照编码后同时写入多个从节点连接，不生成RDB文件
+RDB之前发送$EOF:<结束标记>\r\n，之后发送结束标记，从节点读取到结束标记即接收完成
+某个从节点写入失败不影响其他从节点，全部失败时停止编码
+*/
+type disklessTransfer struct {
+	targets []*disklessTarget
+	eofMark []byte
+}
+
+func (t *disklessTransfer) Write(p []byte) (int, error) {
+	alive := false
+	for _, target := range t.targets {
+		if target.err != nil || target.released.Load() {
+			continue
+		}
+		for written := 0; written < len(p); {
+			n, err := net.Write(target.fd, p[written:])
+			if err != nil {
+				target.err = err
+				break
+			}
+			written += n
+		}
+		if target.err == nil {
+			alive = true
+		}
+	}
+	if !alive {
+		return 0, errs.ReplTransferError
+	}
+	return len(p), nil
+}
+
+func (t *disklessTransfer) save(snapshot *db.GodisDB) error {
+	if err := server.RDB.Encode(t, snapshot); err != nil {
+		return err
+	}
+	_, err := t.Write(t.eofMark)
+	return err
+}
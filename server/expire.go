@@ -0,0 +1,108 @@
+package server
+
+import (
+	"github.com/godis/conf"
+	"github.com/godis/data"
+	"github.com/godis/util"
+)
+
+// 定期删除的统计信息，通过INFO stats查看
+type expireStats struct {
+	expiredKeys         int64   //惰性删除与定期删除的过期key总数
+	expiredStalePerc    float64 //抽样中过期key占比的估计值，百分比
+	timeCapReachedCount int64   //定期删除因超出时间上限而提前结束的次数
+	cycleTimeUs         int64   //定期删除累计耗时，微秒
+
+	lastTimeLimitExit bool  //上一次定期删除是否因超出时间上限而结束
+	lastFastCycle     int64 //上一次快速定期删除的开始时间，微秒
+}
+
+// 删除过期的key，并以del写入AOF和复制流，使重放结果不依赖重放时的时间
+func deleteExpiredKey(key *data.Gobj) {
+	keyStr := key.StrVal()
+	server.DB.Data.Delete(key)
+	server.DB.Expire.Delete(key)
+	if server.cluster != nil {
+		server.cluster.delSlotKey(keyStr)
+	}
+	server.expireStats.expiredKeys++
+	server.RDB.Dirty++
+	propagate([]*data.Gobj{data.CreateObject(conf.GSTR, "del"), data.CreateObject(conf.GSTR, keyStr)})
+}
+
+/*
+定期删除过期key，每轮从Expire中随机抽样ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP个key删除其中已过期的，
+抽样中过期key的占比超过ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE时说明过期key较多，继续下一轮，直到超出时间上限
+慢速模式在ServerCron中执行，时间上限为ServerCron周期的ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC
+快速模式在事件循环休眠前执行，时间上限为ACTIVE_EXPIRE_CYCLE_FAST_DURATION，
+只在上一次定期删除超时或过期key占比较高时执行，且两次执行至少间隔两倍的时间上限
+*/
+func activeExpireCycle(fast bool) {
+	// 从节点由主节点同步del删除过期key
+	if server.masterHost != "" {
+		return
+	}
+	stats := &server.expireStats
+	start := util.GetUsTime()
+	timeLimit := conf.SERVER_CRON_PERIOD * 1000 * conf.ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC / 100
+	if fast {
+		if !stats.lastTimeLimitExit && stats.expiredStalePerc < float64(conf.ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE) {
+			return
+		}
+		if start < stats.lastFastCycle+conf.ACTIVE_EXPIRE_CYCLE_FAST_DURATION*2 {
+			return
+		}
+		stats.lastFastCycle = start
+		timeLimit = conf.ACTIVE_EXPIRE_CYCLE_FAST_DURATION
+	}
+
+	var totalSampled, totalExpired int
+	stats.lastTimeLimitExit = false
+	for {
+		num := server.DB.Expire.Length()
+		if num == 0 {
+			break
+		}
+		if num > conf.ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP {
+			num = conf.ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP
+		}
+
+		now := util.GetMsTime()
+		sampled, expired := 0, 0
+		for i := 0; i < num; i++ {
+			entry := server.DB.Expire.RandomGet()
+			if entry == nil {
+				break
+			}
+			sampled++
+			when, err := entry.Val.Int64Val()
+			if err != nil {
+				server.logger.Error().Err(err).Msgf("expire time is not int64, key: %v", entry.Key.StrVal())
+				continue
+			}
+			if when <= now {
+				deleteExpiredKey(entry.Key)
+				expired++
+			}
+		}
+		totalSampled += sampled
+		totalExpired += expired
+
+		if util.GetUsTime()-start > timeLimit {
+			stats.lastTimeLimitExit = true
+			stats.timeCapReachedCount++
+			break
+		}
+		if sampled == 0 || expired*100 <= sampled*conf.ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE {
+			break
+		}
+	}
+
+	stats.cycleTimeUs += util.GetUsTime() - start
+	// 按抽样结果平滑更新过期key占比的估计值
+	currentPerc := 0.0
+	if totalSampled > 0 {
+		currentPerc = float64(totalExpired) * 100 / float64(totalSampled)
+	}
+	stats.expiredStalePerc = currentPerc*0.05 + stats.expiredStalePerc*0.95
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/godis/net"
+	"github.com/godis/util"
+)
+
+// INFO命令的各个分区，按顺序输出
+var infoSections = []struct {
+	name string
+	gen  func(builder *strings.Builder)
+}{
+	{"clients", genClientsInfo},
+	{"persistence", genPersistenceInfo},
+	{"stats", genStatsInfo},
+	{"replication", genReplicationInfo},
+	{"cluster", genClusterInfo},
+}
+
+func genInfoString(section string) string {
+	var builder strings.Builder
+	for _, s := range infoSections {
+		if section != "all" && section != "default" && section != s.name {
+			continue
+		}
+		if builder.Len() > 0 {
+			builder.WriteString("\r\n")
+		}
+		builder.WriteString(fmt.Sprintf("# %s\r\n", strings.ToUpper(s.name[:1])+s.name[1:]))
+		s.gen(&builder)
+	}
+	return builder.String()
+}
+
+func genClientsInfo(builder *strings.Builder) {
+	builder.WriteString(fmt.Sprintf("connected_clients:%d\r\n", len(server.clients)))
+	builder.WriteString(fmt.Sprintf("blocked_clients:%d\r\n", len(server.blockedClients)))
+}
+
+func genPersistenceInfo(builder *strings.Builder) {
+	aof, rdb := server.AOF, server.RDB
+	builder.WriteString(fmt.Sprintf("rdb_changes_since_last_save:%d\r\n", rdb.Dirty))
+	builder.WriteString(fmt.Sprintf("rdb_bgsave_in_progress:%d\r\n", btoi(rdb.IsRDBSave())))
+	builder.WriteString(fmt.Sprintf("rdb_last_save_time:%d\r\n", rdb.LastSave))
+	builder.WriteString(fmt.Sprintf("rdb_last_bgsave_status:%s\r\n", statusStr(rdb.LastBgSaveErr == nil)))
+	builder.WriteString(fmt.Sprintf("rdb_last_bgsave_time_sec:%d\r\n", msToSec(rdb.LastBgSaveMs)))
+	builder.WriteString(fmt.Sprintf("rdb_current_bgsave_time_sec:%d\r\n", msToSec(rdb.BgSaveElapsed())))
+	builder.WriteString(fmt.Sprintf("aof_enabled:%d\r\n", btoi(aof.AppendOnly)))
+	builder.WriteString(fmt.Sprintf("aof_rewrite_in_progress:%d\r\n", btoi(aof.IsRewriting())))
+	builder.WriteString(fmt.Sprintf("aof_rewrite_scheduled:%d\r\n", btoi(server.aofRewriteScheduled)))
+	builder.WriteString(fmt.Sprintf("aof_last_bgrewrite_status:%s\r\n", statusStr(aof.LastRewriteErr == nil)))
+	builder.WriteString(fmt.Sprintf("aof_last_write_status:%s\r\n", statusStr(aof.LastWriteErr == nil)))
+	builder.WriteString(fmt.Sprintf("aof_last_bgfsync_status:%s\r\n", statusStr(aof.FsyncOK())))
+	if aof.AppendOnly {
+		builder.WriteString(fmt.Sprintf("aof_current_size:%d\r\n", aof.CurrentSize))
+		builder.WriteString(fmt.Sprintf("aof_base_size:%d\r\n", aof.BaseSize))
+		builder.WriteString(fmt.Sprintf("aof_buffer_length:%d\r\n", aof.BufferLength()))
+		builder.WriteString(fmt.Sprintf("aof_pending_bio_fsync:%d\r\n", aof.PendingFsync()))
+		builder.WriteString(fmt.Sprintf("aof_delayed_fsync:%d\r\n", aof.DelayedFsync))
+		builder.WriteString(fmt.Sprintf("aof_fsync_lag_ms:%d\r\n", aof.FsyncLag()))
+	}
+}
+
+func genStatsInfo(builder *strings.Builder) {
+	stats := server.expireStats
+	builder.WriteString(fmt.Sprintf("expired_keys:%d\r\n", stats.expiredKeys))
+	builder.WriteString(fmt.Sprintf("expired_stale_perc:%.2f\r\n", stats.expiredStalePerc))
+	builder.WriteString(fmt.Sprintf("expired_time_cap_reached_count:%d\r\n", stats.timeCapReachedCount))
+	builder.WriteString(fmt.Sprintf("expire_cycle_cpu_milliseconds:%d\r\n", stats.cycleTimeUs/1000))
+}
+
+func genReplicationInfo(builder *strings.Builder) {
+	if server.masterHost == "" {
+		builder.WriteString("role:master\r\n")
+	} else {
+		builder.WriteString("role:slave\r\n")
+		builder.WriteString(fmt.Sprintf("master_host:%s\r\n", server.masterHost))
+		builder.WriteString(fmt.Sprintf("master_port:%d\r\n", server.masterPort))
+		linkStatus := "down"
+		if server.replState == REPL_STATE_CONNECTED {
+			linkStatus = "up"
+		}
+		builder.WriteString(fmt.Sprintf("master_link_status:%s\r\n", linkStatus))
+		builder.WriteString(fmt.Sprintf("master_sync_in_progress:%d\r\n", btoi(server.replState == REPL_STATE_SYNCING)))
+		if server.master != nil {
+			builder.WriteString(fmt.Sprintf("master_last_io_seconds_ago:%d\r\n", (util.GetMsTime()-server.master.lastInteraction)/1000))
+		} else {
+			builder.WriteString(fmt.Sprintf("master_link_down_since_seconds:%d\r\n", (util.GetMsTime()-server.masterLinkDownSince)/1000))
+		}
+		builder.WriteString(fmt.Sprintf("slave_repl_offset:%d\r\n", server.masterReplOffset))
+		builder.WriteString(fmt.Sprintf("replica_read_only:%d\r\n", btoi(server.replicaReadOnly)))
+	}
+	builder.WriteString(fmt.Sprintf("connected_slaves:%d\r\n", len(server.replicas)))
+	now := util.GetMsTime()
+	for i, replica := range server.replicas {
+		ip, _ := net.PeerAddr(replica.fd)
+		lag := int64(-1)
+		if replica.replAckTime > 0 {
+			lag = (now - replica.replAckTime) / 1000
+		}
+		builder.WriteString(fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\r\n",
+			i, ip, replica.replListeningPort, replicaStateNames[replica.replState], replica.replAckOff, lag))
+	}
+	builder.WriteString(fmt.Sprintf("master_replid:%s\r\n", server.replid))
+	builder.WriteString(fmt.Sprintf("master_replid2:%s\r\n", server.replid2))
+	builder.WriteString(fmt.Sprintf("master_repl_offset:%d\r\n", server.masterReplOffset))
+	builder.WriteString(fmt.Sprintf("second_repl_offset:%d\r\n", server.secondReplOffset))
+	builder.WriteString(fmt.Sprintf("repl_backlog_active:%d\r\n", btoi(server.backlog != nil)))
+	builder.WriteString(fmt.Sprintf("repl_backlog_size:%d\r\n", server.backlogSize))
+	if server.backlog != nil {
+		builder.WriteString(fmt.Sprintf("repl_backlog_first_byte_offset:%d\r\n", server.backlog.first()))
+		builder.WriteString(fmt.Sprintf("repl_backlog_histlen:%d\r\n", server.backlog.histlen))
+	}
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// 毫秒转换为秒，-1表示不存在
+func msToSec(ms int64) int64 {
+	if ms < 0 {
+		return -1
+	}
+	return ms / 1000
+}
+
+func statusStr(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "err"
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/godis/data"
+	"github.com/godis/errs"
+	"github.com/godis/net"
+	"github.com/godis/util"
+)
+
+const MIGRATE_DEFAULT_TIMEOUT = 1000 //MIGRATE未指定超时时间时的默认值，单位毫秒
+
+// DUMP key，回复value的序列化结果，格式见persistence.DumpValue
+func dumpCommand(c *GodisClient) (bool, error) {
+	val := findKeyRead(c.args[1])
+	if val == nil {
+		c.AddReplyStr("$-1\r\n")
+		return false, errs.KeyNotExistError
+	}
+	payload, err := server.RDB.DumpValue(val)
+	if err != nil {
+		c.AddReplyStr("-ERR DUMP failed\r\n")
+		return false, err
+	}
+	c.AddReplyStrVal(string(payload))
+	return true, nil
+}
+
+/*
+RESTORE key ttl serialized-value [REPLACE] [ABSTTL]
+ttl为0表示不过期，ABSTTL表示ttl为毫秒级时间戳，否则为剩余毫秒数
+写入AOF与复制流时改写为时间戳，使重放结果不依赖重放时的时间
+*/
+func restoreCommand(c *GodisClient) (bool, error) {
+	if len(c.args) < 4 {
+		c.AddReplyStr("-ERR wrong number of arguments for 'restore' command\r\n")
+		return false, errs.ParamsCheckError
+	}
+	replace, absTTL := false, false
+	for _, arg := range c.args[4:] {
+		switch strings.ToUpper(arg.StrVal()) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		default:
+			c.AddReplyStr("-ERR syntax error\r\n")
+			return false, errs.ParamsCheckError
+		}
+	}
+	key := c.args[1]
+	ttl, err := c.args[2].Int64Val()
+	if err != nil || ttl < 0 {
+		c.AddReplyStr("-ERR Invalid TTL value, must be >= 0\r\n")
+		return false, errs.ParamsCheckError
+	}
+	exists := findKeyWrite(key) != nil
+	if exists && !replace {
+		c.AddReplyStr("-BUSYKEY Target key name already exists.\r\n")
+		return false, errs.BusyKeyError
+	}
+	val, err := server.RDB.RestoreValue([]byte(c.args[3].StrVal()))
+	if err != nil {
+		c.AddReplyStr("-ERR DUMP payload version or checksum are wrong\r\n")
+		return false, err
+	}
+
+	when := int64(-1)
+	if ttl > 0 {
+		when = ttl
+		if !absTTL {
+			when += util.GetMsTime()
+		}
+	}
+	// 普通客户端恢复已过期的key时不写入，REPLACE时删除原有的key；加载数据或执行主节点同步的命令时按原样写入
+	if when != -1 && checkAlreadyExpired(c, when) {
+		c.AddReplyStr("+OK\r\n")
+		if exists {
+			dbDelete(key)
+			c.rewriteCommand("del", key.StrVal())
+			return true, nil
+		}
+		return false, nil
+	}
+	if exists {
+		dbDelete(key)
+	}
+	server.DB.Data.Set(key, val)
+	if when != -1 {
+		server.DB.Expire.Set(key, data.CreateObjectFromInt(when))
+		c.rewriteCommand("restore", key.StrVal(), strconv.FormatInt(when, 10), c.args[3].StrVal(), "REPLACE", "ABSTTL")
+	}
+	c.AddReplyStr("+OK\r\n")
+	return true, nil
+}
+
+// MIGRATE的key为第3个参数，为空字符串时为KEYS之后的参数
+func migrateGetKeys(args []*data.Gobj) []*data.Gobj {
+	if len(args) < 6 {
+		return nil
+	}
+	if args[3].StrVal() != "" {
+		return args[3:4]
+	}
+	for i := 6; i < len(args); i++ {
+		if strings.ToUpper(args[i].StrVal()) == "KEYS" {
+			return args[i+1:]
+		}
+	}
+	return nil
+}
+
+/*
+MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [KEYS key ...]
+将key及其过期时间迁移到目标节点，目标节点确认后删除本地的key，指定COPY时保留
+迁移在事件循环中同步进行，期间不执行其他命令，客户端只会在迁移前后的一侧看到key
+每个key以ASKING与RESTORE发送，使目标节点在哈希槽迁入期间也能写入
+*/
+func migrateCommand(c *GodisClient) (bool, error) {
+	if len(c.args) < 6 {
+		c.AddReplyStr("-ERR wrong number of arguments for 'migrate' command\r\n")
+		return false, errs.ParamsCheckError
+	}
+	copyKeys, replace := false, false
+	for i := 6; i < len(c.args); i++ {
+		switch strings.ToUpper(c.args[i].StrVal()) {
+		case "COPY":
+			copyKeys = true
+		case "REPLACE":
+			replace = true
+		case "KEYS":
+			if c.args[3].StrVal() != "" {
+				c.AddReplyStr("-ERR When using MIGRATE KEYS option, the key argument must be set to the empty string\r\n")
+				return false, errs.ParamsCheckError
+			}
+			i = len(c.args)
+		default:
+			c.AddReplyStr("-ERR syntax error\r\n")
+			return false, errs.ParamsCheckError
+		}
+	}
+	port, err1 := c.args[2].Int64Val()
+	dbid, err2 := c.args[4].Int64Val()
+	timeout, err3 := c.args[5].Int64Val()
+	if err1 != nil || err2 != nil || err3 != nil {
+		c.AddReplyStr("-ERR value is not an integer or out of range\r\n")
+		return false, errs.ParamsCheckError
+	}
+	if dbid != 0 {
+		c.AddReplyStr("-ERR DB index is out of range\r\n")
+		return false, errs.ParamsCheckError
+	}
+	if timeout <= 0 {
+		timeout = MIGRATE_DEFAULT_TIMEOUT
+	}
+
+	var keys []*data.Gobj
+	var cmds strings.Builder
+	for _, key := range migrateGetKeys(c.args) {
+		val := findKeyRead(key)
+		if val == nil {
+			continue
+		}
+		payload, err := server.RDB.DumpValue(val)
+		if err != nil {
+			c.AddReplyStr("-ERR DUMP failed\r\n")
+			return false, err
+		}
+		ttl := remainingTTL(key)
+		if ttl == 0 {
+			continue
+		}
+		if ttl < 0 {
+			ttl = 0
+		}
+		args := []string{"RESTORE", key.StrVal(), strconv.FormatInt(ttl, 10), string(payload)}
+		if replace {
+			args = append(args, "REPLACE")
+		}
+		cmds.WriteString(encodeStrings("ASKING"))
+		cmds.WriteString(encodeStrings(args...))
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		c.AddReplyStr("+NOKEY\r\n")
+		return false, nil
+	}
+
+	addr := fmt.Sprintf("%s:%d", c.args[1].StrVal(), port)
+	failed, err := migrateSend(addr, time.Duration(timeout)*time.Millisecond, cmds.String(), len(keys))
+	if err != nil {
+		c.logEntry.Error().Err(err).Msgf("migrate keys to %s failed", addr)
+		c.AddReplyStr(fmt.Sprintf("-IOERR error or timeout writing to or reading from target instance %s\r\n", addr))
+		return false, errs.MigrateError
+	}
+
+	// 目标节点写入失败的key保留在本节点
+	deleted := []string{"del"}
+	if !copyKeys {
+		for i, key := range keys {
+			if failed[i] == "" && dbDelete(key) {
+				deleted = append(deleted, key.StrVal())
+			}
+		}
+	}
+	reply := "+OK\r\n"
+	for _, e := range failed {
+		if e != "" {
+			reply = fmt.Sprintf("-ERR Target instance replied with error: %s\r\n", e[1:])
+			break
+		}
+	}
+	c.AddReplyStr(reply)
+	if len(deleted) == 1 {
+		return false, nil
+	}
+	c.rewriteCommand(deleted...)
+	return true, nil
+}
+
+// 发送迁移命令并读取回复，返回每个key的RESTORE错误，成功的key为空字符串
+func migrateSend(addr string, timeout time.Duration, cmds string, count int) ([]string, error) {
+	conn, err := net.Connect(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte(cmds)); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	failed := make([]string, count)
+	for i := 0; i < count*2; i++ {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "-") && failed[i/2] == "" {
+			failed[i/2] = line
+		}
+	}
+	return failed, nil
+}
@@ -0,0 +1,1087 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	gonet "net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/godis/conf"
+	"github.com/godis/data"
+	"github.com/godis/db"
+	"github.com/godis/errs"
+	"github.com/godis/net"
+	"github.com/godis/persistence"
+	"github.com/godis/util"
+)
+
+// 从节点的连接在主节点上的状态，0表示普通客户端
+const (
+	REPL_REPLICA_WAIT_BGSAVE_START = iota + 1 //等待开始生成RDB
+	REPL_REPLICA_WAIT_BGSAVE_END              //RDB生成中，期间的写命令缓存在回复缓冲区
+	REPL_REPLICA_SEND_BULK                    //发送RDB中
+	REPL_REPLICA_ONLINE                       //RDB发送完成，持续接收命令流
+)
+
+// 从节点自身的复制状态
+const (
+	REPL_STATE_NONE      = iota //主节点
+	REPL_STATE_CONNECT          //等待连接主节点
+	REPL_STATE_SYNCING          //握手并接收RDB中
+	REPL_STATE_CONNECTED        //已完成全量同步，接收命令流
+)
+
+var replicaStateNames = map[int]string{
+	REPL_REPLICA_WAIT_BGSAVE_START: "wait_bgsave",
+	REPL_REPLICA_WAIT_BGSAVE_END:   "wait_bgsave",
+	REPL_REPLICA_SEND_BULK:         "send_bulk",
+	REPL_REPLICA_ONLINE:            "online",
+}
+
+// 后台全量同步的结果，由握手goroutine交给事件循环
+type syncResult struct {
+	gen      int         //发起同步时的replGen，与当前不一致说明主节点已切换，结果作废
+	fd       int         //与主节点的连接，-1表示连接失败
+	fullSync bool        //是否为全量同步，否则为增量同步
+	replid   string      //主节点的复制ID
+	offset   int64       //全量同步时RDB对应的复制偏移量
+	db       *db.GodisDB //全量同步时从RDB加载的数据集
+	leftover []byte      //握手时多读入的命令流
+	err      error
+}
+
+func genReplicationID() string {
+	return genRandomHex(conf.REPL_ID_LEN)
+}
+
+func genRandomHex(n int) string {
+	buf := make([]byte, (n+1)/2)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)[:n]
+}
+
+// 数据集与之前的复制历史不再一致时更换复制ID
+func changeReplicationID() {
+	server.replid = genReplicationID()
+}
+
+func clearReplicationID2() {
+	server.replid2 = strings.Repeat("0", conf.REPL_ID_LEN)
+	server.secondReplOffset = -1
+}
+
+/*
+从节点提升为主节点或主节点的复制ID变化时，保留原复制ID及切换时的偏移量
+原来同步自同一主节点的从节点可以用原复制ID增量同步到切换时的位置
+*/
+func shiftReplicationID(newID string) {
+	server.replid2 = server.replid
+	server.secondReplOffset = server.masterReplOffset + 1
+	server.replid = newID
+}
+
+func syncCommand(c *GodisClient) (bool, error) {
+	return replicationAddReplica(c, false)
+}
+
+/*
+PSYNC replid offset，replid为从节点已同步的复制ID，offset为从节点需要的下一个字节的偏移量
+复制ID一致且积压缓冲区包含offset之后的数据时只补发缺失的部分，否则回复+FULLRESYNC进行全量同步
+*/
+func psyncCommand(c *GodisClient) (bool, error) {
+	return replicationAddReplica(c, true)
+}
+
+/*
+主节点收到SYNC或PSYNC后将客户端标记为从节点，全量同步时等待后台保存生成RDB
+生成期间的写命令按RESP格式追加到从节点的回复缓冲区，RDB发送完成后再发送，保证从节点按快照之后的顺序重放
+*/
+func replicationAddReplica(c *GodisClient, psync bool) (bool, error) {
+	if c.replState != 0 {
+		return false, nil
+	}
+	if server.masterHost != "" && server.replState != REPL_STATE_CONNECTED {
+		c.AddReplyStr("-NOMASTERLINK Can't SYNC while not connected with my master\r\n")
+		return false, errs.MasterLinkDownError
+	}
+	// 之前的回复立即发送，之后回复缓冲区只用于缓存复制流
+	if err := flushReplyNow(c); err != nil {
+		c.closed = true
+		return false, err
+	}
+	if psync && replicationTryPartialResync(c) {
+		return true, nil
+	}
+	c.replPsync = psync
+	c.replState = REPL_REPLICA_WAIT_BGSAVE_START
+	c.replWaitSince = util.GetMsTime()
+	server.replicas = append(server.replicas, c)
+	// 首个从节点连接时创建积压缓冲区，没有积压缓冲区期间的修改无法补发，因此更换复制ID
+	if server.backlog == nil {
+		changeReplicationID()
+		clearReplicationID2()
+		server.backlog = newReplBacklog(server.backlogSize, server.masterReplOffset)
+	}
+	ip, _ := net.PeerAddr(c.fd)
+	c.logEntry.Info().Msgf("replica %s:%d asks for full synchronization", ip, c.replListeningPort)
+	startBgSaveForReplication()
+	return true, nil
+}
+
+func replicationTryPartialResync(c *GodisClient) bool {
+	replid := c.args[1].StrVal()
+	offset, err := c.args[2].Int64Val()
+	if err != nil {
+		return false
+	}
+	if replid != server.replid && (replid != server.replid2 || offset > server.secondReplOffset) {
+		if replid != "?" {
+			c.logEntry.Info().Msgf("partial resynchronization not accepted: replication ID mismatch, replica asked for %s", replid)
+		}
+		return false
+	}
+	if server.backlog == nil || !server.backlog.contains(offset) {
+		c.logEntry.Info().Msgf("partial resynchronization not accepted: offset %d out of backlog range", offset)
+		return false
+	}
+	if _, err = net.Write(c.fd, []byte(fmt.Sprintf("+CONTINUE %s\r\n", server.replid))); err != nil {
+		c.closed = true
+		return true
+	}
+	c.replState = REPL_REPLICA_ONLINE
+	c.replAckTime = util.GetMsTime()
+	server.replicas = append(server.replicas, c)
+	missed := server.backlog.readFrom(offset)
+	c.reply.Write(missed)
+	if c.reply.Len() > 0 {
+		server.AeLoop.ModWriteEvent(c.fd, AE_WRITABLE, ReplyClient, c)
+	}
+	c.logEntry.Info().Msgf("partial resynchronization accepted, sending %d bytes of backlog starting from offset %d", len(missed), offset)
+	return true
+}
+
+func replconfCommand(c *GodisClient) (bool, error) {
+	if len(c.args)%2 == 0 {
+		c.AddReplyStr("-ERR syntax error\r\n")
+		return false, errs.ParamsCheckError
+	}
+	noReply := false
+	for i := 1; i < len(c.args); i += 2 {
+		switch strings.ToLower(c.args[i].StrVal()) {
+		case "listening-port":
+			port, err := c.args[i+1].IntVal()
+			if err != nil {
+				c.AddReplyStr("-ERR value is not an integer or out of range\r\n")
+				return false, err
+			}
+			c.replListeningPort = port
+		case "ack":
+			// 从节点每秒上报已处理的复制偏移量，不需要回复
+			offset, err := c.args[i+1].Int64Val()
+			if err == nil && offset > c.replAckOff {
+				c.replAckOff = offset
+			}
+			c.replAckTime = util.GetMsTime()
+			if c.replStartOnAck {
+				c.replStartOnAck = false
+				if c.reply.Len() > 0 {
+					server.AeLoop.ModWriteEvent(c.fd, AE_WRITABLE, ReplyClient, c)
+				}
+			}
+			noReply = true
+		case "fack":
+			// 从节点AOF已落盘的复制偏移量
+			offset, err := c.args[i+1].Int64Val()
+			if err == nil && offset > c.replAofAckOff {
+				c.replAofAckOff = offset
+			}
+			noReply = true
+		case "getack":
+			// 主节点要求立即上报，上报的偏移量包含这条命令本身
+			if c.isMaster && server.master == c {
+				replicationFeedStreamFromMaster(c)
+				replicationSendAck()
+			}
+			noReply = true
+		case "capa":
+			if strings.EqualFold(c.args[i+1].StrVal(), "eof") {
+				c.replCapaEOF = true
+			}
+		case "ip-address":
+		default:
+			c.AddReplyStr(fmt.Sprintf("-ERR Unrecognized REPLCONF option: %s\r\n", c.args[i].StrVal()))
+			return false, errs.ParamsCheckError
+		}
+	}
+	if noReply {
+		return true, nil
+	}
+	c.AddReplyStr("+OK\r\n")
+	return true, nil
+}
+
+// REPLICAOF host port切换为从节点，REPLICAOF NO ONE恢复为主节点
+func replicaofCommand(c *GodisClient) (bool, error) {
+	if server.cluster != nil {
+		c.AddReplyStr("-ERR REPLICAOF not allowed in cluster mode.\r\n")
+		return false, errs.WrongCmdError
+	}
+	host, portStr := c.args[1].StrVal(), c.args[2].StrVal()
+	if strings.EqualFold(host, "no") && strings.EqualFold(portStr, "one") {
+		if server.masterHost != "" {
+			replicationUnsetMaster()
+			server.logger.Info().Msg("MASTER MODE enabled")
+		}
+		c.AddReplyStr("+OK\r\n")
+		return true, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		c.AddReplyStr("-ERR Invalid master port\r\n")
+		return false, errs.ParamsCheckError
+	}
+	if server.masterHost == host && server.masterPort == port {
+		c.AddReplyStr("+OK Already connected to specified master\r\n")
+		return false, nil
+	}
+	replicationSetMaster(host, port)
+	c.AddReplyStr("+OK\r\n")
+	return true, nil
+}
+
+/*
+成为host:port的从节点，断开原有的主节点连接与下级从节点
+连接新主节点时以当前的复制ID与偏移量尝试增量同步，下级从节点重连后同样尝试增量同步
+*/
+func replicationSetMaster(host string, port int) {
+	replicationCancelMaster()
+	server.masterHost, server.masterPort = host, port
+	server.replState = REPL_STATE_CONNECT
+	server.replLastAttempt = 0
+	server.masterLinkDownSince = util.GetMsTime()
+	for _, replica := range append([]*GodisClient(nil), server.replicas...) {
+		freeClient(replica)
+	}
+	server.logger.Info().Msgf("Connecting to MASTER %s:%d", host, port)
+}
+
+// 恢复为主节点，更换复制ID并断开下级从节点，下级从节点重连后用原复制ID增量同步并获知新的复制ID
+func replicationUnsetMaster() {
+	replicationCancelMaster()
+	server.masterHost, server.masterPort = "", 0
+	server.replState = REPL_STATE_NONE
+	shiftReplicationID(genReplicationID())
+	for _, replica := range append([]*GodisClient(nil), server.replicas...) {
+		freeClient(replica)
+	}
+}
+
+// 断开与主节点的连接，进行中的握手结果在返回时丢弃
+func replicationCancelMaster() {
+	server.replGen++
+	if server.master != nil {
+		master := server.master
+		server.master = nil
+		freeClient(master)
+	}
+}
+
+// 主节点连接断开后等待重连
+func replicationHandleMasterDisconnection() {
+	server.master = nil
+	server.masterLinkDownSince = util.GetMsTime()
+	if server.masterHost != "" {
+		server.replState = REPL_STATE_CONNECT
+		server.logger.Info().Msgf("Connection with master lost, reconnecting to %s:%d", server.masterHost, server.masterPort)
+	}
+}
+
+func replicationRemoveReplica(replica *GodisClient) {
+	for i, r := range server.replicas {
+		if r == replica {
+			server.replicas = append(server.replicas[:i], server.replicas[i+1:]...)
+			break
+		}
+	}
+	if replica.replDBFile != nil {
+		replica.replDBFile.Close()
+		replica.replDBFile = nil
+	}
+}
+
+// 向主节点上报已处理的复制偏移量，开启AOF时同时上报已落盘的复制偏移量
+func replicationSendAck() {
+	args := []string{"REPLCONF", "ACK", strconv.FormatInt(server.masterReplOffset, 10)}
+	if server.AOF.AppendOnly {
+		server.replLastFack = server.AOF.FsyncedOffset()
+		args = append(args, "FACK", strconv.FormatInt(server.replLastFack, 10))
+	}
+	server.replLastAck = util.GetMsTime()
+	if _, err := net.Write(server.master.fd, []byte(encodeStrings(args...))); err != nil {
+		server.master.closed = true
+	}
+}
+
+// 已确认复制偏移量不小于offset的从节点数，aof为true时按AOF已落盘的偏移量统计
+func replicationCountAcksByOffset(offset int64, aof bool) int {
+	count := 0
+	for _, replica := range server.replicas {
+		if replica.replState != REPL_REPLICA_ONLINE {
+			continue
+		}
+		if (!aof && replica.replAckOff >= offset) || (aof && replica.replAofAckOff >= offset) {
+			count++
+		}
+	}
+	return count
+}
+
+/*
+WAIT numreplicas timeout，阻塞客户端直到至少numreplicas个从节点确认了该客户端最后一次写入，或超时
+回复已确认的从节点数，timeout为毫秒，0表示一直等待
+*/
+func waitCommand(c *GodisClient) (bool, error) {
+	if server.masterHost != "" {
+		c.AddReplyStr("-ERR WAIT cannot be used with replica instances\r\n")
+		return false, errs.ReadOnlyReplicaError
+	}
+	numReplicas, err := c.args[1].IntVal()
+	if err != nil {
+		c.AddReplyStr("-ERR value is not an integer or out of range\r\n")
+		return false, err
+	}
+	timeout, err := getTimeoutArg(c, c.args[2])
+	if err != nil {
+		return false, err
+	}
+	c.bstate.numReplicas = numReplicas
+	c.bstate.offset = c.woff
+	if replyToWait(c, false) {
+		return true, nil
+	}
+	blockClient(c, BLOCKED_WAIT, timeout)
+	server.getAckPending = true
+	return true, nil
+}
+
+/*
+WAITAOF numlocal numreplicas timeout，阻塞客户端直到该客户端最后一次写入已在本地AOF落盘(numlocal为1时)，
+且至少numreplicas个从节点的AOF已落盘，或超时，回复[本地是否落盘, 已落盘的从节点数]
+*/
+func waitaofCommand(c *GodisClient) (bool, error) {
+	if server.masterHost != "" {
+		c.AddReplyStr("-ERR WAITAOF cannot be used with replica instances\r\n")
+		return false, errs.ReadOnlyReplicaError
+	}
+	numLocal, err := c.args[1].IntVal()
+	if err != nil {
+		c.AddReplyStr("-ERR value is not an integer or out of range\r\n")
+		return false, err
+	}
+	numReplicas, err := c.args[2].IntVal()
+	if err != nil {
+		c.AddReplyStr("-ERR value is not an integer or out of range\r\n")
+		return false, err
+	}
+	timeout, err := getTimeoutArg(c, c.args[3])
+	if err != nil {
+		return false, err
+	}
+	if numLocal > 0 && !server.AOF.AppendOnly {
+		c.AddReplyStr("-ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.\r\n")
+		return false, errs.ParamsCheckError
+	}
+	c.bstate.numLocal = numLocal
+	c.bstate.numReplicas = numReplicas
+	c.bstate.offset = c.woff
+	if replyToWaitAOF(c, false) {
+		return true, nil
+	}
+	blockClient(c, BLOCKED_WAITAOF, timeout)
+	server.getAckPending = true
+	return true, nil
+}
+
+// WAIT条件满足或超时时回复，返回是否已回复
+func replyToWait(c *GodisClient, timedOut bool) bool {
+	acked := replicationCountAcksByOffset(c.bstate.offset, false)
+	if !timedOut && acked < c.bstate.numReplicas {
+		return false
+	}
+	c.AddReplyIntVal(strconv.Itoa(acked))
+	return true
+}
+
+// WAITAOF条件满足或超时时回复，返回是否已回复
+func replyToWaitAOF(c *GodisClient, timedOut bool) bool {
+	local := 0
+	if server.AOF.AppendOnly && server.AOF.FsyncedOffset() >= c.bstate.offset {
+		local = 1
+	}
+	acked := replicationCountAcksByOffset(c.bstate.offset, true)
+	if !timedOut && (local < c.bstate.numLocal || acked < c.bstate.numReplicas) {
+		return false
+	}
+	c.AddReplyStr(fmt.Sprintf("*2\r\n:%d\r\n:%d\r\n", local, acked))
+	return true
+}
+
+// 将写命令以RESP格式写入复制流
+func replicationFeedReplicas(args []*data.Gobj) {
+	if server.backlog == nil && len(server.replicas) == 0 {
+		return
+	}
+	feedReplicationStream(encodeCommand(args))
+}
+
+// 从节点将主节点同步并已执行的命令按原始字节转发，保证各级从节点的复制偏移量与主节点一致
+func replicationFeedStreamFromMaster(master *GodisClient) {
+	applied := master.processedOffset - master.replAppliedOff
+	if applied <= 0 {
+		return
+	}
+	feedReplicationStream(master.replPending[:applied])
+	master.replPending = master.replPending[applied:]
+	master.replAppliedOff = master.processedOffset
+}
+
+/*
+写入复制流，更新复制偏移量与积压缓冲区，并追加到从节点的回复缓冲区
+等待开始生成RDB的从节点会在快照中包含这些修改，无需发送
+*/
+func feedReplicationStream(buf []byte) {
+	server.masterReplOffset += int64(len(buf))
+	if server.backlog != nil {
+		server.backlog.feed(buf)
+	}
+	for _, replica := range server.replicas {
+		if replica.replState == REPL_REPLICA_WAIT_BGSAVE_START {
+			continue
+		}
+		replica.reply.Write(buf)
+		if replica.replState == REPL_REPLICA_ONLINE && !replica.replStartOnAck {
+			server.AeLoop.ModWriteEvent(replica.fd, AE_WRITABLE, ReplyClient, replica)
+		}
+	}
+}
+
+func encodeCommand(args []*data.Gobj) []byte {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		param := fmt.Sprintf("%v", arg.Val_)
+		builder.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(param), param))
+	}
+	return []byte(builder.String())
+}
+
+// 立即发送回复缓冲区中的内容并取消可写事件，在事件循环中调用，此时没有其他goroutine写该连接
+func flushReplyNow(c *GodisClient) error {
+	if c.reply.Len() > 0 {
+		if _, err := net.Write(c.fd, c.reply.Bytes()); err != nil {
+			return err
+		}
+		c.reply.Reset()
+	}
+	server.AeLoop.ModReadEvent(c.fd)
+	return nil
+}
+
+// 有从节点等待全量同步且没有进行中的后台保存时，开始生成RDB
+func startBgSaveForReplication() {
+	var waiting []*GodisClient
+	capaEOF := true
+	var maxIdle int64
+	now := util.GetMsTime()
+	for _, replica := range server.replicas {
+		if replica.replState == REPL_REPLICA_WAIT_BGSAVE_START {
+			waiting = append(waiting, replica)
+			capaEOF = capaEOF && replica.replCapaEOF
+			if now-replica.replWaitSince > maxIdle {
+				maxIdle = now - replica.replWaitSince
+			}
+		}
+	}
+	if len(waiting) == 0 || server.RDB.IsRDBSave() || server.AOF.IsRewriting() {
+		return
+	}
+	// 无盘复制需要所有从节点都支持结束标记，等待repl-diskless-sync-delay让同时发起同步的从节点共用一次传输
+	if server.replDisklessSync && capaEOF {
+		if maxIdle >= server.replDisklessSyncDelay*1000 {
+			startBgSaveToSockets(waiting)
+		}
+		return
+	}
+	if err := server.RDB.BgSave(server.DB); err != nil {
+		server.logger.Error().Err(err).Msg("start background saving for replication failed")
+		return
+	}
+	// RDB对应快照时的复制偏移量，从节点加载RDB后从下一个字节开始接收命令流
+	fullResync := fmt.Sprintf("+FULLRESYNC %s %d\r\n", server.replid, server.masterReplOffset)
+	for _, replica := range append([]*GodisClient(nil), server.replicas...) {
+		if replica.replState != REPL_REPLICA_WAIT_BGSAVE_START {
+			continue
+		}
+		replica.replState = REPL_REPLICA_WAIT_BGSAVE_END
+		if replica.replPsync {
+			if _, err := net.Write(replica.fd, []byte(fullResync)); err != nil {
+				freeClient(replica)
+			}
+		}
+	}
+}
+
+// 开始无盘复制，先在事件循环中发送+FULLRESYNC与$EOF:<结束标记>，之后由后台goroutine写入RDB
+func startBgSaveToSockets(waiting []*GodisClient) {
+	transfer := &disklessTransfer{eofMark: []byte(genRandomHex(conf.REPL_EOF_MARK_LEN))}
+	fullResync := fmt.Sprintf("+FULLRESYNC %s %d\r\n", server.replid, server.masterReplOffset)
+	header := fmt.Sprintf("$EOF:%s\r\n", transfer.eofMark)
+	var replicas []*GodisClient
+	for _, replica := range waiting {
+		msg := header
+		if replica.replPsync {
+			msg = fullResync + header
+		}
+		if _, err := net.Write(replica.fd, []byte(msg)); err != nil {
+			freeClient(replica)
+			continue
+		}
+		net.SetWriteTimeout(replica.fd, time.Duration(server.replTimeout)*time.Second)
+		replica.replState = REPL_REPLICA_WAIT_BGSAVE_END
+		replica.replTarget = &disklessTarget{fd: replica.fd}
+		transfer.targets = append(transfer.targets, replica.replTarget)
+		replicas = append(replicas, replica)
+	}
+	if len(replicas) == 0 {
+		return
+	}
+	if err := server.RDB.BgSaveToSocket(server.DB, transfer.save); err != nil {
+		server.logger.Error().Err(err).Msg("start diskless replication failed")
+		for _, replica := range replicas {
+			replica.replTarget = nil
+			freeClient(replica)
+		}
+		return
+	}
+	server.disklessTransfer = transfer
+	server.logger.Info().Msgf("starting diskless replication to %d replicas", len(replicas))
+}
+
+/*
+无盘复制结束，关闭传输期间被释放的从节点连接
+传输成功的从节点进入在线状态，等待其第一次REPLCONF ACK后再发送积压的命令流，避免与结束标记混在一起
+*/
+func finishBgSaveToSockets(saveErr error) {
+	transfer := server.disklessTransfer
+	server.disklessTransfer = nil
+	for _, target := range transfer.targets {
+		if target.released.Load() {
+			net.Close(target.fd)
+		}
+	}
+	now := util.GetMsTime()
+	for _, replica := range append([]*GodisClient(nil), server.replicas...) {
+		target := replica.replTarget
+		if target == nil {
+			continue
+		}
+		replica.replTarget = nil
+		net.SetWriteTimeout(replica.fd, 0)
+		if err := target.err; saveErr != nil || err != nil {
+			if err == nil {
+				err = saveErr
+			}
+			replica.logEntry.Error().Err(err).Msg("diskless replication to replica failed")
+			freeClient(replica)
+			continue
+		}
+		replica.replState = REPL_REPLICA_ONLINE
+		replica.replStartOnAck = true
+		replica.replAckTime = now
+		replica.logEntry.Info().Msg("streamed RDB transfer with replica succeeded, waiting for REPLCONF ACK")
+	}
+	startBgSaveForReplication()
+}
+
+// 后台保存结束后开始向等待中的从节点发送RDB，保存失败则断开从节点，由其重新发起同步
+func updateReplicasWaitingBgSave(saveErr error) {
+	if server.disklessTransfer != nil {
+		finishBgSaveToSockets(saveErr)
+		return
+	}
+	for _, replica := range append([]*GodisClient(nil), server.replicas...) {
+		if replica.replState != REPL_REPLICA_WAIT_BGSAVE_END {
+			continue
+		}
+		if saveErr != nil {
+			replica.logEntry.Error().Err(saveErr).Msg("background saving failed, disconnect replica")
+			freeClient(replica)
+			continue
+		}
+		file, err := os.Open(server.RDB.Filename)
+		if err != nil {
+			replica.logEntry.Error().Err(err).Msg("open rdb for replication failed")
+			freeClient(replica)
+			continue
+		}
+		info, err := file.Stat()
+		if err != nil {
+			replica.logEntry.Error().Err(err).Msg("stat rdb for replication failed")
+			file.Close()
+			freeClient(replica)
+			continue
+		}
+		replica.replDBFile = file
+		replica.replDBOff = 0
+		replica.replDBSize = info.Size()
+		replica.replBulkHeader = []byte(fmt.Sprintf("$%d\r\n", info.Size()))
+		replica.replState = REPL_REPLICA_SEND_BULK
+		server.AeLoop.ModWriteEvent(replica.fd, AE_WRITABLE, sendBulkToReplica, replica)
+	}
+	startBgSaveForReplication()
+}
+
+// 在写goroutine中执行，每次可写事件发送RDB的一部分
+func writeBulkToReplica(replica *GodisClient) {
+	if len(replica.replBulkHeader) > 0 {
+		n, err := net.Write(replica.fd, replica.replBulkHeader)
+		if err != nil {
+			replica.logEntry.Error().Err(err).Msg("send rdb to replica failed")
+			replica.closed = true
+			return
+		}
+		replica.replBulkHeader = replica.replBulkHeader[n:]
+		return
+	}
+	buf := make([]byte, conf.REPL_BULK_CHUNK_SIZE)
+	n, err := replica.replDBFile.ReadAt(buf, replica.replDBOff)
+	if n == 0 {
+		replica.logEntry.Error().Err(err).Msg("read rdb for replication failed")
+		replica.closed = true
+		return
+	}
+	written, err := net.Write(replica.fd, buf[:n])
+	if err != nil {
+		replica.logEntry.Error().Err(err).Msg("send rdb to replica failed")
+		replica.closed = true
+		return
+	}
+	replica.replDBOff += int64(written)
+}
+
+// RDB发送完成后从节点上线，开始发送缓存的命令流
+func sendBulkToReplica(loop *AeLoop, fd int, extra any) {
+	replica := extra.(*GodisClient)
+	if replica.closed {
+		freeClient(replica)
+		return
+	}
+	if len(replica.replBulkHeader) > 0 || replica.replDBOff < replica.replDBSize {
+		return
+	}
+	replica.replDBFile.Close()
+	replica.replDBFile = nil
+	replica.replState = REPL_REPLICA_ONLINE
+	replica.replAckTime = util.GetMsTime()
+	replica.logEntry.Info().Msg("synchronization with replica succeeded")
+	if replica.reply.Len() > 0 {
+		loop.ModWriteEvent(fd, AE_WRITABLE, ReplyClient, replica)
+	} else {
+		loop.ModReadEvent(fd)
+	}
+}
+
+/*
+复制相关的定时任务，在ServerCron中执行
+从节点: 处理握手结果，需要时发起连接，主节点超时未发送数据则断开重连，每秒向主节点上报复制偏移量
+主节点: 定期向从节点发送PING，断开超时未上报偏移量的从节点，向等待RDB的从节点发送换行保持连接，为等待中的从节点开始后台保存
+*/
+func replicationCron() {
+	for {
+		select {
+		case result := <-server.syncDone:
+			finishSyncWithMaster(result)
+			continue
+		default:
+		}
+		break
+	}
+
+	now := util.GetMsTime()
+	if server.replState == REPL_STATE_CONNECT && now-server.replLastAttempt >= conf.REPL_RETRY_PERIOD {
+		server.replLastAttempt = now
+		server.replState = REPL_STATE_SYNCING
+		addr := fmt.Sprintf("%s:%d", server.masterHost, server.masterPort)
+		disklessLoad := server.replDisklessLoad == conf.REPL_DISKLESS_LOAD_SWAPDB
+		go syncWithMaster(server.replGen, addr, server.port, server.replid, server.masterReplOffset+1, server.replTimeout, disklessLoad, server.RDB, server.syncDone)
+	}
+	if server.master != nil && now-server.master.lastInteraction > server.replTimeout*1000 {
+		server.logger.Warn().Msg("MASTER timeout: no data nor PING received")
+		freeClient(server.master)
+	}
+	if server.master != nil && now-server.replLastAck >= conf.REPL_ACK_PERIOD {
+		replicationSendAck()
+	}
+
+	if len(server.replicas) == 0 {
+		return
+	}
+	// 从节点转发主节点的PING，不单独发送，否则复制偏移量会与主节点不一致
+	if server.masterHost == "" && now-server.lastPingReplicas >= conf.REPL_PING_REPLICA_PERIOD*1000 {
+		server.lastPingReplicas = now
+		replicationFeedReplicas([]*data.Gobj{data.CreateObject(conf.GSTR, "ping")})
+	}
+	for _, replica := range append([]*GodisClient(nil), server.replicas...) {
+		if replica.replState == REPL_REPLICA_ONLINE && now-replica.replAckTime > server.replTimeout*1000 {
+			replica.logEntry.Warn().Msg("disconnecting timedout replica")
+			freeClient(replica)
+			continue
+		}
+		// 无盘复制中的连接由后台goroutine写入RDB，不能插入换行
+		if replica.replState == REPL_REPLICA_WAIT_BGSAVE_START ||
+			(replica.replState == REPL_REPLICA_WAIT_BGSAVE_END && replica.replTarget == nil) {
+			if _, err := net.Write(replica.fd, []byte("\n")); err != nil {
+				freeClient(replica)
+			}
+		}
+	}
+	startBgSaveForReplication()
+}
+
+/*
+在goroutine中与主节点握手，结果通过done交给事件循环
+握手: PING -> REPLCONF listening-port -> REPLCONF capa psync2 -> PSYNC <replid> <offset>
+主节点回复+CONTINUE时增量同步，之后直接接收缺失的命令流
+回复+FULLRESYNC <replid> <offset>时全量同步，之后发送$<长度>\r\n与RDB，无盘复制时发送$EOF:<结束标记>\r\n、RDB与结束标记
+disklessLoad为false时RDB写入本地dbfilename后加载到新的数据集，否则直接从连接加载
+*/
+func syncWithMaster(gen int, addr string, port int, replid string, offset int64, timeout int64, disklessLoad bool, rdb *persistence.RDB, done chan<- *syncResult) {
+	result := &syncResult{gen: gen, fd: -1}
+	defer func() {
+		done <- result
+	}()
+	deadline := time.Duration(timeout) * time.Second
+	conn, err := net.Connect(addr, deadline)
+	if err != nil {
+		result.err = err
+		return
+	}
+	conn.SetDeadline(time.Now().Add(deadline))
+	reader := bufio.NewReaderSize(conn, conf.RDB_BUF_BLOCK_SIZE)
+	handshake := [][]string{
+		{"PING"},
+		{"REPLCONF", "listening-port", strconv.Itoa(port)},
+		{"REPLCONF", "capa", "eof", "capa", "psync2"},
+	}
+	for _, args := range handshake {
+		if err = sendHandshakeCommand(conn, reader, args...); err != nil {
+			conn.Close()
+			result.err = err
+			return
+		}
+	}
+	if _, err = conn.Write([]byte(encodeStrings("PSYNC", replid, strconv.FormatInt(offset, 10)))); err != nil {
+		conn.Close()
+		result.err = err
+		return
+	}
+	line, err := readReplyLine(reader)
+	if err != nil {
+		conn.Close()
+		result.err = err
+		return
+	}
+	if continued, ok := strings.CutPrefix(line, "+CONTINUE"); ok {
+		result.replid = replid
+		if id := strings.TrimSpace(continued); id != "" {
+			result.replid = id
+		}
+		finishHandshake(conn, reader, result)
+		return
+	}
+	if _, err = fmt.Sscanf(line, "+FULLRESYNC %s %d", &result.replid, &result.offset); err != nil {
+		conn.Close()
+		result.err = fmt.Errorf("%w: bad PSYNC reply %s", errs.ReplHandshakeError, line)
+		return
+	}
+	result.fullSync = true
+
+	size, eofMark, err := readBulkHeader(reader)
+	if err != nil {
+		conn.Close()
+		result.err = err
+		return
+	}
+	src := &deadlineReader{conn: conn, r: reader, timeout: deadline}
+	result.db = &db.GodisDB{
+		Data:   data.DictCreate(),
+		Expire: data.DictCreate(),
+	}
+	if disklessLoad {
+		err = loadRDBFromSocket(src, rdb, result.db, size, eofMark)
+	} else {
+		err = receiveAndLoadRDB(src, rdb, result.db, size, eofMark)
+	}
+	if err != nil {
+		conn.Close()
+		result.err = err
+		return
+	}
+	finishHandshake(conn, reader, result)
+}
+
+// 每次读取前刷新连接的超时时间，传输大的RDB时只要持续有数据就不会超时
+type deadlineReader struct {
+	conn    gonet.Conn
+	r       io.Reader
+	timeout time.Duration
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetDeadline(time.Now().Add(d.timeout))
+	return d.r.Read(p)
+}
+
+// 接收RDB写入临时文件，替换本地dbfilename后再加载
+func receiveAndLoadRDB(src io.Reader, rdb *persistence.RDB, db *db.GodisDB, size int64, eofMark []byte) error {
+	tmpfile := filepath.Join(filepath.Dir(rdb.Filename), fmt.Sprintf("temp-%d.%d.rdb", util.GetTime(), os.Getpid()))
+	if err := receiveRDB(src, tmpfile, size, eofMark); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	if err := os.Rename(tmpfile, rdb.Filename); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	return loadReceivedRDB(rdb, db)
+}
+
+/*
+直接从连接解析RDB到新的数据集，不写入磁盘
+解析在goroutine中进行，期间事件循环继续使用原数据集处理请求，完成后再替换
+*/
+func loadRDBFromSocket(src io.Reader, rdb *persistence.RDB, db *db.GodisDB, size int64, eofMark []byte) error {
+	if eofMark == nil {
+		src = io.LimitReader(src, size)
+	}
+	reader := bufio.NewReaderSize(src, conf.RDB_BUF_BLOCK_SIZE)
+	if _, err := rdb.Decode(reader, db); err != nil {
+		return err
+	}
+	if eofMark == nil {
+		_, err := io.Copy(io.Discard, reader)
+		return err
+	}
+	mark := make([]byte, len(eofMark))
+	if _, err := io.ReadFull(reader, mark); err != nil {
+		return err
+	}
+	if !bytes.Equal(mark, eofMark) {
+		return errs.ReplEOFMarkError
+	}
+	return nil
+}
+
+// 保存已读入缓冲区的命令流，将连接转为阻塞的fd交给事件循环
+func finishHandshake(conn gonet.Conn, reader *bufio.Reader, result *syncResult) {
+	if n := reader.Buffered(); n > 0 {
+		buf, _ := reader.Peek(n)
+		result.leftover = append([]byte(nil), buf...)
+	}
+	conn.SetDeadline(time.Time{})
+	result.fd, result.err = net.DetachFd(conn)
+}
+
+func encodeStrings(args ...string) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		builder.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg))
+	}
+	return builder.String()
+}
+
+// 发送握手命令，主节点回复错误时握手失败
+func sendHandshakeCommand(w io.Writer, reader *bufio.Reader, args ...string) error {
+	if _, err := w.Write([]byte(encodeStrings(args...))); err != nil {
+		return err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(line, "-") {
+		return fmt.Errorf("%w: %s reply %s", errs.ReplHandshakeError, args[0], strings.TrimSpace(line))
+	}
+	return nil
+}
+
+// 读取一行回复，跳过主节点生成RDB期间发送的换行
+func readReplyLine(reader *bufio.Reader) (string, error) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line[0] == '-' {
+			return "", fmt.Errorf("%w: PSYNC reply %s", errs.ReplHandshakeError, line)
+		}
+		return line, nil
+	}
+}
+
+// 读取RDB的长度，无盘复制时为$EOF:<结束标记>，返回结束标记
+func readBulkHeader(reader *bufio.Reader) (int64, []byte, error) {
+	line, err := readReplyLine(reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	if line[0] != '$' {
+		return 0, nil, fmt.Errorf("%w: bad SYNC reply %s", errs.ReplHandshakeError, line)
+	}
+	if mark, ok := strings.CutPrefix(line, "$EOF:"); ok {
+		if len(mark) != conf.REPL_EOF_MARK_LEN {
+			return 0, nil, fmt.Errorf("%w: bad EOF mark %s", errs.ReplHandshakeError, mark)
+		}
+		return -1, []byte(mark), nil
+	}
+	size, err := strconv.ParseInt(line[1:], 10, 64)
+	return size, nil, err
+}
+
+/*
+接收RDB写入临时文件，eofMark为nil时接收size字节
+否则接收到结束标记为止，主节点在收到REPLCONF ACK前不会发送后续数据，因此结束标记一定位于末尾
+*/
+func receiveRDB(src io.Reader, filename string, size int64, eofMark []byte) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if eofMark == nil {
+		if _, err = io.CopyN(file, src, size); err != nil {
+			return err
+		}
+		return file.Sync()
+	}
+	buf := make([]byte, conf.RDB_BUF_BLOCK_SIZE)
+	var tail []byte //最近收到的可能属于结束标记的字节
+	for {
+		n, err := src.Read(buf)
+		tail = append(tail, buf[:n]...)
+		if len(tail) > len(eofMark) {
+			if _, werr := file.Write(tail[:len(tail)-len(eofMark)]); werr != nil {
+				return werr
+			}
+			tail = append(tail[:0], tail[len(tail)-len(eofMark):]...)
+		}
+		if bytes.Equal(tail, eofMark) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+func loadReceivedRDB(rdb *persistence.RDB, db *db.GodisDB) error {
+	file, err := os.Open(rdb.Filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = rdb.Decode(bufio.NewReaderSize(file, conf.RDB_BUF_BLOCK_SIZE), db)
+	return err
+}
+
+/*
+在事件循环中处理同步的结果，将与主节点的连接作为客户端加入事件循环
+全量同步时替换数据集，复制ID与偏移量改为主节点的值，并以新的偏移量重建积压缓冲区
+增量同步时保留数据集，主节点的复制ID变化时记录原复制ID
+*/
+func finishSyncWithMaster(result *syncResult) {
+	if result.gen != server.replGen {
+		if result.fd != -1 {
+			net.Close(result.fd)
+		}
+		return
+	}
+	if result.err != nil {
+		server.logger.Error().Err(result.err).Msgf("sync with master %s:%d failed", server.masterHost, server.masterPort)
+		server.replState = REPL_STATE_CONNECT
+		return
+	}
+
+	if result.fullSync {
+		server.DB = result.db
+		if server.cluster != nil {
+			server.cluster.rebuildSlotKeys()
+		}
+		server.replid = result.replid
+		clearReplicationID2()
+		server.masterReplOffset = result.offset
+		server.backlog = newReplBacklog(server.backlogSize, result.offset)
+		server.AOF.ResetOffset(result.offset)
+		// 下级从节点需要基于新的数据集重新同步，AOF需要重写为新的数据集
+		for _, replica := range append([]*GodisClient(nil), server.replicas...) {
+			freeClient(replica)
+		}
+		if server.AOF.AppendOnly {
+			server.aofRewriteScheduled = true
+		}
+	} else {
+		if server.backlog == nil {
+			server.backlog = newReplBacklog(server.backlogSize, server.masterReplOffset)
+		}
+		// 下级从节点重连后用原复制ID增量同步并获知新的复制ID
+		if result.replid != server.replid {
+			shiftReplicationID(result.replid)
+			for _, replica := range append([]*GodisClient(nil), server.replicas...) {
+				freeClient(replica)
+			}
+		}
+	}
+
+	master := server.clientPool.Get().(*GodisClient)
+	master.fd = result.fd
+	master.logEntry = server.logger.With().Int("client-fd", master.fd).Str("role", "master").Logger()
+	master.closed = false
+	master.isMaster = true
+	master.lastInteraction = util.GetMsTime()
+	if len(master.queryBuf) < len(result.leftover)+conf.GODIS_IO_BUF {
+		master.queryBuf = make([]byte, len(result.leftover)+conf.GODIS_IO_BUF)
+	}
+	master.queryLen = copy(master.queryBuf, result.leftover)
+	master.readTotal = int64(master.queryLen)
+
+	server.clients[master.fd] = master
+	server.AeLoop.AddReadEvent(master.fd, AE_READABLE, ReadQueryFromClient, master)
+	server.master = master
+	server.replState = REPL_STATE_CONNECTED
+	server.masterLinkDownSince = 0
+	if result.fullSync {
+		server.logger.Info().Msgf("MASTER <-> REPLICA sync: full resync finished with success, replid %s offset %d", server.replid, server.masterReplOffset)
+	} else {
+		server.logger.Info().Msgf("MASTER <-> REPLICA sync: partial resync accepted, replid %s offset %d", server.replid, server.masterReplOffset)
+	}
+	// 无盘复制的主节点收到第一次ACK后才开始发送命令流
+	replicationSendAck()
+
+	if master.queryLen > 0 {
+		ReadQueryFromClient(server.AeLoop, master.fd, master)
+	}
+}
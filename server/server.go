@@ -1,10 +1,11 @@
 package server
 
 import (
+	"fmt"
+	"io"
 	"os"
 	"runtime"
 	"sync"
-	"time"
 
 	"github.com/godis/conf"
 	"github.com/godis/data"
@@ -28,6 +29,46 @@ type GodisServer struct {
 	AOF        *persistence.AOF
 	RDB        *persistence.RDB
 
+	aofRewriteScheduled bool //RDB持久化期间收到的重写请求，待持久化结束后执行
+	rdbBgsaveScheduled  bool //AOF重写期间收到的BGSAVE请求，待重写结束后执行
+	loading             bool //正在加载AOF或RDB
+
+	expireStats expireStats
+
+	currentClient *GodisClient //正在执行命令的客户端
+
+	masterHost       string
+	masterPort       int
+	replState        int              //作为从节点的复制状态，REPL_STATE_*
+	master           *GodisClient     //与主节点的连接
+	replGen          int              //每次切换主节点时递增，用于丢弃过期的握手结果
+	replLastAttempt  int64            //最近一次连接主节点的毫秒时间
+	syncDone         chan *syncResult //后台全量同步的结果
+	replicaReadOnly  bool
+	replTimeout      int64          //复制连接的超时时间，秒
+	replicas         []*GodisClient //已连接的从节点
+	lastPingReplicas int64          //最近一次向从节点发送PING的毫秒时间
+
+	replid              string       //当前复制历史的ID
+	replid2             string       //切换前的复制ID
+	secondReplOffset    int64        //replid2有效的最大偏移量，-1表示无效
+	masterReplOffset    int64        //复制流的偏移量
+	backlog             *replBacklog //复制积压缓冲区，第一个从节点连接或与主节点同步后创建
+	backlogSize         int64
+	replLastAck         int64 //最近一次向主节点发送REPLCONF ACK的毫秒时间
+	masterLinkDownSince int64 //与主节点断开连接的毫秒时间
+	replLastFack        int64 //最近一次向主节点上报的AOF已落盘偏移量
+	getAckPending       bool  //有客户端阻塞在WAIT或WAITAOF，休眠前向从节点发送REPLCONF GETACK
+
+	replDisklessSync      bool
+	replDisklessSyncDelay int64             //无盘复制开始前等待更多从节点的时间，秒
+	replDisklessLoad      string            //从节点加载RDB的方式，REPL_DISKLESS_LOAD_*
+	disklessTransfer      *disklessTransfer //进行中的无盘复制
+
+	blockedClients []*GodisClient
+
+	cluster *clusterState //集群状态，未开启集群模式时为nil
+
 	Slowlog           *data.List
 	SlowLogSlowerThan int64
 	SlowLogMaxLen     int
@@ -64,25 +105,102 @@ func AcceptHandler(loop *AeLoop, fd int, extra any) {
 }
 
 func ServerCron(loop *AeLoop, id int, extra any) {
-	for i := 0; i < conf.EXPIRE_CHECK_COUNT; i++ {
-		entry := server.DB.Expire.RandomGet()
-		if entry == nil {
-			break
+	activeExpireCycle(false)
+	replicationCron()
+	clusterCron()
+
+	// 没有新命令时也需要按appendfsync策略刷盘，并处理被推迟的写入
+	if server.AOF.AppendOnly {
+		server.AOF.Offset = server.masterReplOffset
+		server.AOF.Flush(false)
+	}
+
+	// 后台RDB保存与AOF重写
+	if done, err := server.RDB.DoneBgSave(); done {
+		updateReplicasWaitingBgSave(err)
+	}
+	server.AOF.DoneRewrite()
+	if !server.AOF.IsRewriting() && !server.RDB.IsRDBSave() {
+		if server.rdbBgsaveScheduled {
+			server.rdbBgsaveScheduled = false
+			if err := server.RDB.BgSave(server.DB); err != nil {
+				server.logger.Error().Err(err).Msg("start scheduled background saving failed")
+			}
+		} else if sp := server.RDB.NeedSave(); sp != nil {
+			server.logger.Info().Msgf("%d changes in %d seconds. Saving...", sp.Changes, sp.Seconds)
+			if err := server.RDB.BgSave(server.DB); err != nil {
+				server.logger.Error().Err(err).Msg("start background saving failed")
+			}
 		}
-		expireTime, err := entry.Val.Int64Val()
-		if err != nil {
-			server.logger.Error().Err(err).Msgf("expire time is not int64, key: %v", entry.Key.StrVal())
-			continue
+	}
+	if !server.AOF.IsRewriting() && !server.RDB.IsRDBSave() {
+		if server.aofRewriteScheduled || server.AOF.NeedRewrite() {
+			server.aofRewriteScheduled = false
+			if err := server.AOF.BgRewrite(server.DB); err != nil {
+				server.logger.Error().Err(err).Msg("start aof rewrite failed")
+			}
 		}
+	}
+}
+
+/*
+事件循环休眠前执行快速定期删除，并将本轮命令写入AOF，保证回复客户端前命令已持久化
+之后处理阻塞的客户端，需要时请求从节点确认复制偏移量，从节点AOF落盘的偏移量变化时立即上报
+*/
+func beforeSleep(loop *AeLoop) {
+	activeExpireCycle(true)
+	clusterBeforeSleep()
+	if server.AOF.AppendOnly {
+		server.AOF.Offset = server.masterReplOffset
+		server.AOF.Flush(false)
+	}
+	handleBlockedClients()
+	if server.getAckPending {
+		server.getAckPending = false
+		if len(server.replicas) > 0 {
+			replicationFeedReplicas([]*data.Gobj{
+				data.CreateObject(conf.GSTR, "REPLCONF"),
+				data.CreateObject(conf.GSTR, "GETACK"),
+				data.CreateObject(conf.GSTR, "*"),
+			})
+		}
+	}
+	if server.master != nil && server.AOF.AppendOnly && server.AOF.FsyncedOffset() != server.replLastFack {
+		replicationSendAck()
+	}
+}
+
+var wg sync.WaitGroup
 
-		if expireTime < time.Now().Unix() {
-			server.DB.Data.Delete(entry.Key)
-			server.DB.Expire.Delete(entry.Key)
+// 客户端连接的读写交给goroutine池并行完成，监听fd的可读事件由AcceptHandler处理
+func parallelIO(loop *AeLoop, fes []*AeFileEvent) {
+	for _, fe := range fes {
+		if fe.mask == AE_READABLE && fe.fd != server.fd {
+			wg.Add(1)
+			server.ReadPool.Invoke(fe.fd)
+		} else if fe.mask == AE_WRITABLE {
+			wg.Add(1)
+			server.WritePool.Invoke(fe.fd)
 		}
 	}
+	wg.Wait()
+}
+
+func serverStop(loop *AeLoop) {
+	for _, client := range server.clients {
+		freeClient(client)
+	}
+
+	server.AOF.Close()
+
+	server.ReadPool.Release()
+	server.WritePool.Release()
+
+	ants.Release()
 }
 
 func InitGodisServerInstance(config *conf.Config, logger *zerolog.Logger) (*GodisServer, error) {
+	rdb := persistence.InitRDB(config, logger)
 	server = &GodisServer{
 		port:     config.Port,
 		workerID: config.WorkerID,
@@ -92,21 +210,53 @@ func InitGodisServerInstance(config *conf.Config, logger *zerolog.Logger) (*Godi
 			Expire: data.DictCreate(),
 		},
 		logger:            logger,
-		AOF:               persistence.InitAOF(config, logger),
-		RDB:               persistence.InitRDB(config, logger),
+		AOF:               persistence.InitAOF(config, rdb, logger),
+		RDB:               rdb,
 		Slowlog:           data.ListCreate(data.ListType{EqualFunc: data.GStrEqual}),
 		SlowLogSlowerThan: config.SlowLogSlowerThan,
 		SlowLogMaxLen:     config.SlowLogMaxLen,
 		MaxClients:        config.MaxClients,
+		syncDone:          make(chan *syncResult, 1),
+		replicaReadOnly:   config.ReplicaReadOnly,
+		replTimeout:       config.ReplTimeout,
+		replid:            genReplicationID(),
+		backlogSize:       config.ReplBacklogSize,
+
+		replDisklessSync:      config.ReplDisklessSync,
+		replDisklessSyncDelay: config.ReplDisklessSyncDelay,
+		replDisklessLoad:      config.ReplDisklessLoad,
+	}
+	if server.replTimeout <= 0 {
+		server.replTimeout = conf.REPL_DEFAULT_TIMEOUT
+	}
+	if server.backlogSize <= 0 {
+		server.backlogSize = conf.REPL_DEFAULT_BACKLOG
+	}
+	if server.replDisklessSyncDelay < 0 {
+		server.replDisklessSyncDelay = conf.REPL_DISKLESS_SYNC_DELAY
 	}
+	switch server.replDisklessLoad {
+	case conf.REPL_DISKLESS_LOAD_DISABLED, conf.REPL_DISKLESS_LOAD_SWAPDB:
+	default:
+		logger.Error().Msgf("unknown repl-diskless-load %q, use %s instead", server.replDisklessLoad, conf.REPL_DISKLESS_LOAD_DISABLED)
+		server.replDisklessLoad = conf.REPL_DISKLESS_LOAD_DISABLED
+	}
+	clearReplicationID2()
 
+	server.loading = true
 	if server.AOF.AppendOnly {
-		AOFClient := InitGodisClientInstance()
-		AOFClient.fd = -1
-		AOFClient.logEntry = server.logger.With().Int("client-fd", -1).Logger()
+		err := server.AOF.Load(server.DB, func(reader io.Reader) (int64, error) {
+			AOFClient := InitGodisClientInstance()
+			AOFClient.fd = -1
+			AOFClient.logEntry = server.logger.With().Int("client-fd", -1).Logger()
 
-		AOFClient.ReadQueryFromAOF()
-		freeAOFClient(AOFClient)
+			defer freeAOFClient(AOFClient)
+			return AOFClient.ReadQueryFromAOF(reader)
+		})
+		if err != nil {
+			server.logger.Error().Err(err).Msg("")
+			os.Exit(0)
+		}
 	} else {
 		err := server.RDB.Load(server.DB)
 		if err != nil && err != errs.RDBFileNotExistError {
@@ -114,6 +264,25 @@ func InitGodisServerInstance(config *conf.Config, logger *zerolog.Logger) (*Godi
 			os.Exit(0)
 		}
 	}
+	server.loading = false
+	// 开启AOF时需要复制偏移量记录AOF的落盘进度，因此启动时即创建积压缓冲区
+	if server.AOF.AppendOnly {
+		server.backlog = newReplBacklog(server.backlogSize, server.masterReplOffset)
+	}
+
+	if config.ClusterEnabled {
+		if err := clusterInit(config.ClusterConfigFile, config.ClusterNodeTimeout); err != nil {
+			return nil, err
+		}
+	} else if config.ReplicaOf != "" {
+		var host string
+		var port int
+		if _, err := fmt.Sscanf(config.ReplicaOf, "%s %d", &host, &port); err != nil {
+			server.logger.Error().Err(err).Msgf("invalid replicaof config %q", config.ReplicaOf)
+		} else {
+			replicationSetMaster(host, port)
+		}
+	}
 
 	var err error
 	if server.AeLoop, err = AeLoopCreate(logger); err != nil {
@@ -146,7 +315,10 @@ func InitGodisServerInstance(config *conf.Config, logger *zerolog.Logger) (*Godi
 	}
 
 	server.AeLoop.AddReadEvent(server.fd, AE_READABLE, AcceptHandler, nil)
-	server.AeLoop.AddTimeEvent(AE_NORMAL, 100, ServerCron, nil)
+	server.AeLoop.AddTimeEvent(AE_NORMAL, conf.SERVER_CRON_PERIOD, ServerCron, nil)
+	server.AeLoop.SetBeforeSleepProc(beforeSleep)
+	server.AeLoop.SetIOProc(parallelIO)
+	server.AeLoop.SetStopProc(serverStop)
 	server.logger.Info().Msg("[msg:godis server is up]")
 	return server, nil
 }
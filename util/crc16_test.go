@@ -0,0 +1,19 @@
+package util
+
+import "testing"
+
+func TestCrc16(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint16
+	}{
+		{"", 0},
+		// Redis集群规范中给出的校验值
+		{"123456789", 0x31c3},
+	}
+	for _, tt := range tests {
+		if got := Crc16(tt.in); got != tt.want {
+			t.Fatalf("Crc16(%q) = %#x, want %#x", tt.in, got, tt.want)
+		}
+	}
+}
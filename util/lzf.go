@@ -0,0 +1,225 @@
+package util
+
+import (
+	"math/bits"
+
+	"github.com/godis/errs"
+)
+
+/*
+LZF压缩算法，与liblzf(Redis RDB使用的版本)的编码格式兼容
+压缩数据由若干段组成，每段以控制字节开头:
+000LLLLL                      之后为L+1个字面量字节
+LLLooooo oooooooo             引用之前输出的L+2个字节，偏移为o+1，L为1~6
+111ooooo LLLLLLLL oooooooo    引用之前输出的L+9个字节
+*/
+const (
+	lzfMaxHLog = 16
+	lzfMinHLog = 8
+	lzfMaxLit  = 1 << 5
+	lzfMaxOff  = 1 << 13
+	lzfMaxRef  = (1 << 8) + (1 << 3)
+)
+
+// 压缩in，压缩后长度不小于len(in)-4时返回nil，表示不值得压缩
+func LzfCompress(in []byte) []byte {
+	if len(in) <= 4 {
+		return nil
+	}
+	out := make([]byte, len(in)-4)
+	n := lzfCompress(in, out)
+	if n == 0 {
+		return nil
+	}
+	return out[:n]
+}
+
+// 按输入长度选择哈希表大小，避免小字符串也分配64K的哈希表
+func lzfHashLog(length int) uint {
+	hlog := uint(bits.Len(uint(length)))
+	if hlog < lzfMinHLog {
+		return lzfMinHLog
+	}
+	if hlog > lzfMaxHLog {
+		return lzfMaxHLog
+	}
+	return hlog
+}
+
+// 压缩结果写入out，out空间不足时返回0
+func lzfCompress(in, out []byte) int {
+	inEnd, outEnd := len(in), len(out)
+	if inEnd < 2 || outEnd == 0 {
+		return 0
+	}
+	hlog := lzfHashLog(inEnd)
+	hmask := uint32(1)<<hlog - 1
+	htab := make([]int, 1<<hlog)
+	idx := func(h uint32) uint32 {
+		return ((h >> (3*8 - hlog)) - h*5) & hmask
+	}
+
+	ip, op := 0, 0
+	lit := 0
+	op++ // 预留字面量段的控制字节
+	hval := uint32(in[0])<<8 | uint32(in[1])
+
+	for ip < inEnd-2 {
+		hval = hval<<8 | uint32(in[ip+2])
+		slot := idx(hval)
+		ref := htab[slot]
+		htab[slot] = ip
+		off := ip - ref - 1
+
+		if ref < ip && ref > 0 && off < lzfMaxOff &&
+			in[ref] == in[ip] && in[ref+1] == in[ip+1] && in[ref+2] == in[ip+2] {
+			length := 2
+			maxLen := inEnd - ip - length
+			if maxLen > lzfMaxRef {
+				maxLen = lzfMaxRef
+			}
+			emptyRun := 0
+			if lit == 0 {
+				emptyRun = 1
+			}
+			if op-emptyRun+3+1 >= outEnd {
+				return 0
+			}
+
+			out[op-lit-1] = byte(lit - 1) // 结束当前字面量段
+			op -= emptyRun                // 字面量段为空时回收控制字节
+
+			for {
+				length++
+				if length >= maxLen || in[ref+length] != in[ip+length] {
+					break
+				}
+			}
+
+			length -= 2
+			ip++
+
+			if length < 7 {
+				out[op] = byte(off>>8 + length<<5)
+				op++
+			} else {
+				out[op] = byte(off>>8 + 7<<5)
+				out[op+1] = byte(length - 7)
+				op += 2
+			}
+			out[op] = byte(off)
+			op++
+
+			lit = 0
+			op++ // 开始新的字面量段
+
+			ip += length + 1
+			if ip >= inEnd-2 {
+				break
+			}
+
+			// 匹配部分的位置也加入哈希表
+			ip -= length + 1
+			for i := 0; i <= length; i++ {
+				hval = hval<<8 | uint32(in[ip+2])
+				htab[idx(hval)] = ip
+				ip++
+			}
+		} else {
+			if op >= outEnd {
+				return 0
+			}
+			lit++
+			out[op] = in[ip]
+			op++
+			ip++
+
+			if lit == lzfMaxLit {
+				out[op-lit-1] = byte(lit - 1)
+				lit = 0
+				op++
+			}
+		}
+	}
+
+	if op+3 > outEnd {
+		return 0
+	}
+
+	for ip < inEnd {
+		if op >= outEnd {
+			return 0
+		}
+		lit++
+		out[op] = in[ip]
+		op++
+		ip++
+
+		if lit == lzfMaxLit {
+			out[op-lit-1] = byte(lit - 1)
+			lit = 0
+			op++
+		}
+	}
+
+	out[op-lit-1] = byte(lit - 1)
+	if lit == 0 {
+		op--
+	}
+	return op
+}
+
+// 解压in，outLen为压缩前的长度
+func LzfDecompress(in []byte, outLen int) ([]byte, error) {
+	// 每3个字节的反向引用最多展开为264个字节，超过该比例的长度一定是损坏的
+	if outLen < 0 || outLen > len(in)*88 {
+		return nil, errs.LzfDecompressError
+	}
+	out := make([]byte, outLen)
+	ip, op := 0, 0
+	for ip < len(in) {
+		ctrl := int(in[ip])
+		ip++
+
+		if ctrl < 1<<5 {
+			ctrl++
+			if op+ctrl > outLen || ip+ctrl > len(in) {
+				return nil, errs.LzfDecompressError
+			}
+			copy(out[op:], in[ip:ip+ctrl])
+			op += ctrl
+			ip += ctrl
+			continue
+		}
+
+		length := ctrl >> 5
+		ref := op - (ctrl&0x1f)<<8 - 1
+		if ip >= len(in) {
+			return nil, errs.LzfDecompressError
+		}
+		if length == 7 {
+			length += int(in[ip])
+			ip++
+			if ip >= len(in) {
+				return nil, errs.LzfDecompressError
+			}
+		}
+		ref -= int(in[ip])
+		ip++
+
+		length += 2
+		if op+length > outLen || ref < 0 {
+			return nil, errs.LzfDecompressError
+		}
+		// 引用区间可能与输出区间重叠，需要逐字节复制
+		for i := 0; i < length; i++ {
+			out[op] = out[ref]
+			op++
+			ref++
+		}
+	}
+	if op != outLen {
+		return nil, errs.LzfDecompressError
+	}
+	return out, nil
+}
@@ -0,0 +1,87 @@
+package util
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/godis/errs"
+)
+
+func TestLzfRoundTrip(t *testing.T) {
+	random := make([]byte, 2*lzfMaxOff)
+	rand.New(rand.NewSource(1)).Read(random)
+	// 相同内容相隔接近最大偏移，覆盖长偏移的引用
+	far := append(append(append([]byte{}, random[:300]...), random[300:300+lzfMaxOff-400]...), random[:300]...)
+
+	tests := []struct {
+		name       string
+		in         []byte
+		compressed bool //是否应当压缩成功
+	}{
+		{"empty", nil, false},
+		{"short", []byte("abcd"), false},
+		{"incompressible", random, false},
+		{"repeated byte", bytes.Repeat([]byte{'a'}, 100000), true},
+		{"repeated text", bytes.Repeat([]byte("godis lzf "), 1000), true},
+		{"long back reference", bytes.Repeat(random[:1000], 8), true},
+		{"far back reference", far, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed := LzfCompress(tt.in)
+			if (compressed != nil) != tt.compressed {
+				t.Fatalf("compressed = %v, want %v", compressed != nil, tt.compressed)
+			}
+			if compressed == nil {
+				return
+			}
+			if len(compressed) >= len(tt.in) {
+				t.Fatalf("compressed length %d not less than input length %d", len(compressed), len(tt.in))
+			}
+			out, err := LzfDecompress(compressed, len(tt.in))
+			if err != nil {
+				t.Fatalf("decompress: %v", err)
+			}
+			if !bytes.Equal(out, tt.in) {
+				t.Fatal("decompressed data differs from input")
+			}
+		})
+	}
+}
+
+func TestLzfDecompress(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     []byte
+		outLen int
+		want   []byte
+		err    error
+	}{
+		{"empty", nil, 0, []byte{}, nil},
+		{"literal", []byte{0x02, 'a', 'b', 'c'}, 3, []byte("abc"), nil},
+		// 字面量abc之后引用偏移3处的6个字节，引用区间与输出区间重叠
+		{"overlapping reference", []byte{0x02, 'a', 'b', 'c', 0x80, 0x02}, 9, []byte("abcabcabc"), nil},
+		// 长引用: 2+7+1个字节
+		{"long reference", []byte{0x00, 'a', 0xe0, 0x01, 0x00}, 11, bytes.Repeat([]byte{'a'}, 11), nil},
+		{"truncated literal", []byte{0x05, 'a', 'b'}, 6, nil, errs.LzfDecompressError},
+		{"truncated reference", []byte{0x00, 'a', 0x20}, 4, nil, errs.LzfDecompressError},
+		{"truncated long reference", []byte{0x00, 'a', 0xe0, 0x01}, 11, nil, errs.LzfDecompressError},
+		{"reference before start", []byte{0x00, 'a', 0x20, 0x05}, 4, nil, errs.LzfDecompressError},
+		{"output overflow", []byte{0x02, 'a', 'b', 'c', 0x80, 0x02}, 5, nil, errs.LzfDecompressError},
+		{"output shorter than length", []byte{0x02, 'a', 'b', 'c'}, 4, nil, errs.LzfDecompressError},
+		{"negative length", []byte{0x00, 'a'}, -1, nil, errs.LzfDecompressError},
+		{"impossible length", []byte{0x00, 'a'}, 1 << 40, nil, errs.LzfDecompressError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := LzfDecompress(tt.in, tt.outLen)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err == nil && !bytes.Equal(out, tt.want) {
+				t.Fatalf("out = %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package util
 
 import (
+	"encoding/binary"
+	"hash"
 	"hash/crc64"
 	"time"
 )
 
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
 func GetMsTime() int64 {
 	return time.Now().UnixNano() / 1e6
 }
@@ -31,5 +35,39 @@ func Abs(x int) int {
 	return -1 * x
 }
 func CheckSumCreate(bytes []byte) uint64 {
-	return crc64.Checksum(bytes, crc64.MakeTable(crc64.ECMA))
+	return crc64.Checksum(bytes, crc64Table)
+}
+
+// 增量计算校验和，与CheckSumCreate结果一致
+func CheckSumHash() hash.Hash64 {
+	return crc64.New(crc64Table)
 }
+
+/*
+Redis RDB使用的CRC64(Jones多项式，反射输入输出，初始值与结果均不取反)
+Sum按小端序输出，与Redis写入文件的字节序一致
+*/
+var redisCrc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+type redisCrc64 struct {
+	crc uint64
+}
+
+func RedisCheckSumHash() hash.Hash64 {
+	return &redisCrc64{}
+}
+
+func (h *redisCrc64) Write(p []byte) (int, error) {
+	// crc64.Update会在计算前后各取反一次，这里提前抵消
+	h.crc = ^crc64.Update(^h.crc, redisCrc64Table, p)
+	return len(p), nil
+}
+
+func (h *redisCrc64) Sum(b []byte) []byte {
+	return binary.LittleEndian.AppendUint64(b, h.crc)
+}
+
+func (h *redisCrc64) Reset()         { h.crc = 0 }
+func (h *redisCrc64) Size() int      { return 8 }
+func (h *redisCrc64) BlockSize() int { return 1 }
+func (h *redisCrc64) Sum64() uint64  { return h.crc }
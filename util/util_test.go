@@ -0,0 +1,32 @@
+package util
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// Redis crc64.c中的校验值，以及redis.io上DUMP命令示例末尾的校验和
+func TestRedisCheckSumHash(t *testing.T) {
+	h := RedisCheckSumHash()
+	h.Write([]byte("123456789"))
+	if got := h.Sum64(); got != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("crc64(123456789) = %#x, want 0xe9c6d914c4b8d9ca", got)
+	}
+
+	// DUMP mykey，mykey的值为10
+	payload := []byte("\x00\xc0\n\n\x00n\x9fWE\x0e\xaec\xbb")
+	body, sum := payload[:len(payload)-8], binary.LittleEndian.Uint64(payload[len(payload)-8:])
+	// 分多次写入与一次写入结果相同
+	h = RedisCheckSumHash()
+	for _, c := range body {
+		h.Write([]byte{c})
+	}
+	if got := h.Sum64(); got != sum {
+		t.Fatalf("dump checksum = %#x, want %#x", got, sum)
+	}
+	h.Reset()
+	h.Write(body)
+	if got := h.Sum64(); got != sum {
+		t.Fatalf("dump checksum after reset = %#x, want %#x", got, sum)
+	}
+}